@@ -9,17 +9,268 @@ CREATE TABLE IF NOT EXISTS company (
     created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
 );
 GRANT SELECT, INSERT, UPDATE, DELETE ON company TO PUBLIC;
+-- When the company's invoices from before order statuses moved out of the DocNumber got order rows
+ALTER TABLE company ADD COLUMN IF NOT EXISTS orders_backfilled_at TIMESTAMP NULL;
 
+-- The logins of franchisee locations, a location (QB customer) can have many
 CREATE TABLE IF NOT EXISTS customer (
     qb_customer_id VARCHAR(50) NOT NULL,
     qb_company_id VARCHAR(50) REFERENCES company(qb_company_id),
     firebase_id VARCHAR(50) NOT NULL,
     created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
-    PRIMARY KEY (qb_customer_id, qb_company_id)
+    email VARCHAR(255) NOT NULL DEFAULT '',
+    name VARCHAR(255) NOT NULL DEFAULT '',
+    role VARCHAR(20) NOT NULL DEFAULT 'location_admin' CHECK (role IN ('location_admin', 'orderer', 'viewer')),
+    invited_by VARCHAR(50),
+    PRIMARY KEY (firebase_id)
 );
+-- Locations used to have a single login, keyed by the location. That login is its admin.
+ALTER TABLE customer ADD COLUMN IF NOT EXISTS email VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE customer ADD COLUMN IF NOT EXISTS name VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE customer ADD COLUMN IF NOT EXISTS role VARCHAR(20) NOT NULL DEFAULT 'location_admin'
+    CHECK (role IN ('location_admin', 'orderer', 'viewer'));
+ALTER TABLE customer ADD COLUMN IF NOT EXISTS invited_by VARCHAR(50);
+ALTER TABLE customer DROP CONSTRAINT IF EXISTS customer_pkey;
+ALTER TABLE customer ADD CONSTRAINT customer_pkey PRIMARY KEY (firebase_id);
+CREATE INDEX IF NOT EXISTS customer_location_idx ON customer(qb_company_id, qb_customer_id);
 
 GRANT SELECT, INSERT, UPDATE, DELETE ON customer TO PUBLIC;
 
+-- Order lifecycle lives here instead of in the QuickBooks DocNumber. QuickBooks
+-- stays the source of truth for the money, this table owns the status.
+CREATE TABLE IF NOT EXISTS orders (
+    qb_company_id VARCHAR(50) NOT NULL REFERENCES company(qb_company_id),
+    qb_invoice_id VARCHAR(50) NOT NULL,
+    qb_customer_id VARCHAR(50) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'draft'
+        CHECK (status IN ('draft', 'pending', 'approved', 'revision', 'void', 'complete')),
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (qb_company_id, qb_invoice_id)
+);
+CREATE INDEX IF NOT EXISTS orders_company_status_idx ON orders (qb_company_id, status);
+-- the invoice's TxnDate, so listings can be sorted and paged by it
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS txn_date DATE NULL;
+CREATE INDEX IF NOT EXISTS orders_company_customer_idx ON orders (qb_company_id, qb_customer_id);
+
+GRANT SELECT, INSERT, UPDATE, DELETE ON orders TO PUBLIC;
+
+-- Append only log of every status change, used to answer "who voided my order and why"
+CREATE TABLE IF NOT EXISTS order_events (
+    id BIGSERIAL PRIMARY KEY,
+    qb_company_id VARCHAR(50) NOT NULL,
+    qb_invoice_id VARCHAR(50) NOT NULL,
+    actor_firebase_id VARCHAR(128) NOT NULL,
+    actor_role VARCHAR(20) NOT NULL,
+    from_status VARCHAR(20) NULL,
+    to_status VARCHAR(20) NOT NULL,
+    trace_id VARCHAR(64) NOT NULL DEFAULT '',
+    reason TEXT NOT NULL DEFAULT '',
+    -- review is set when a franchiser sends the order back for revision: the lines they reviewed and their comments
+    review JSONB NULL,
+    -- changes is set when a franchisee resubmits a revision: what changed since the review
+    changes JSONB NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (qb_company_id, qb_invoice_id) REFERENCES orders(qb_company_id, qb_invoice_id)
+);
+CREATE INDEX IF NOT EXISTS order_events_order_idx ON order_events (qb_company_id, qb_invoice_id, created_at);
+ALTER TABLE order_events ADD COLUMN IF NOT EXISTS review JSONB NULL;
+ALTER TABLE order_events ADD COLUMN IF NOT EXISTS changes JSONB NULL;
+
+GRANT SELECT, INSERT ON order_events TO PUBLIC;
+GRANT USAGE, SELECT ON SEQUENCE order_events_id_seq TO PUBLIC;
+
+-- Outbox of notifications to send. Rows are written in the same transaction as the change they're about
+-- and delivered by a background worker, so a notification is never lost or sent for a change that rolled back
+CREATE TABLE IF NOT EXISTS notification_outbox (
+    id BIGSERIAL PRIMARY KEY,
+    -- e.g. order_event:<order_events.id>:<event_type>, so the same thing is never queued twice
+    idempotency_key VARCHAR(200) NOT NULL UNIQUE,
+    qb_company_id VARCHAR(50) NOT NULL,
+    event_type VARCHAR(50) NOT NULL,
+    payload JSONB NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'sending', 'sent', 'dead')),
+    attempts INT NOT NULL DEFAULT 0,
+    -- <firebase id>:<channel> of each user the notification already went out to, retries skip them
+    delivered JSONB NOT NULL DEFAULT '[]',
+    last_error TEXT NOT NULL DEFAULT '',
+    trace_id VARCHAR(64) NOT NULL DEFAULT '',
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    -- a worker holds a 'sending' row until then, after that it's picked up again
+    locked_until TIMESTAMP NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    sent_at TIMESTAMP NULL
+);
+CREATE INDEX IF NOT EXISTS notification_outbox_due_idx ON notification_outbox (status, next_attempt_at);
+CREATE INDEX IF NOT EXISTS notification_outbox_company_idx ON notification_outbox (qb_company_id, status, created_at);
+
+GRANT SELECT, INSERT, UPDATE ON notification_outbox TO PUBLIC;
+GRANT USAGE, SELECT ON SEQUENCE notification_outbox_id_seq TO PUBLIC;
+
+-- How each firebase user wants to be notified, users without a row get everything
+CREATE TABLE IF NOT EXISTS notification_preferences (
+    firebase_id VARCHAR(128) PRIMARY KEY,
+    -- {"sms": false} turns a channel off
+    channels JSONB NOT NULL DEFAULT '{}',
+    -- {"order_approved": {"email": false}} turns a channel off for one event
+    events JSONB NOT NULL DEFAULT '{}',
+    -- {"start": "22:00", "end": "07:00", "time_zone": "America/Toronto"}, SMS waits until they're over
+    quiet_hours JSONB NULL,
+    phone VARCHAR(20) NOT NULL DEFAULT '',
+    email VARCHAR(320) NOT NULL DEFAULT '',
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+GRANT SELECT, INSERT, UPDATE ON notification_preferences TO PUBLIC;
+
+-- Prices and catalogs per customer or QuickBooks customer type, items without an entry use the QuickBooks price
+CREATE TABLE IF NOT EXISTS price_lists (
+    id BIGSERIAL PRIMARY KEY,
+    qb_company_id VARCHAR(50) NOT NULL REFERENCES company(qb_company_id) ON DELETE CASCADE,
+    name VARCHAR(200) NOT NULL,
+    qb_customer_id VARCHAR(50) NULL,
+    qb_customer_type_id VARCHAR(50) NULL,
+    -- restricted lists only let customers order the items on them
+    restricted BOOLEAN NOT NULL DEFAULT FALSE,
+    effective_from TIMESTAMP NULL,
+    effective_to TIMESTAMP NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CHECK ((qb_customer_id IS NULL) <> (qb_customer_type_id IS NULL)),
+    CHECK (effective_from IS NULL OR effective_to IS NULL OR effective_from < effective_to)
+);
+CREATE INDEX IF NOT EXISTS price_lists_company_idx ON price_lists (qb_company_id);
+
+CREATE TABLE IF NOT EXISTS price_list_items (
+    price_list_id BIGINT NOT NULL REFERENCES price_lists(id) ON DELETE CASCADE,
+    qb_item_id VARCHAR(50) NOT NULL,
+    -- NULL keeps the QuickBooks UnitPrice
+    unit_price NUMERIC(14, 4) NULL CHECK (unit_price >= 0),
+    hidden BOOLEAN NOT NULL DEFAULT FALSE,
+    PRIMARY KEY (price_list_id, qb_item_id)
+);
+
+GRANT SELECT, INSERT, UPDATE, DELETE ON price_lists TO PUBLIC;
+GRANT SELECT, INSERT, UPDATE, DELETE ON price_list_items TO PUBLIC;
+GRANT USAGE, SELECT ON SEQUENCE price_lists_id_seq TO PUBLIC;
+
+-- How many of an item can be ordered, per item and optionally per customer. Items without a rule can be
+-- ordered in any positive whole quantity.
+CREATE TABLE IF NOT EXISTS quantity_rules (
+    id BIGSERIAL PRIMARY KEY,
+    qb_company_id VARCHAR(50) NOT NULL REFERENCES company(qb_company_id) ON DELETE CASCADE,
+    qb_item_id VARCHAR(50) NOT NULL,
+    -- '' for the rule every customer gets, a customer's own rule replaces it
+    qb_customer_id VARCHAR(50) NOT NULL DEFAULT '',
+    min_qty NUMERIC(14, 4) NULL CHECK (min_qty > 0),
+    pack_multiple NUMERIC(14, 4) NULL CHECK (pack_multiple > 0),
+    max_qty NUMERIC(14, 4) NULL CHECK (max_qty > 0),
+    allow_decimal BOOLEAN NOT NULL DEFAULT FALSE,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (qb_company_id, qb_item_id, qb_customer_id),
+    CHECK (min_qty IS NULL OR max_qty IS NULL OR min_qty <= max_qty)
+);
+
+GRANT SELECT, INSERT, UPDATE, DELETE ON quantity_rules TO PUBLIC;
+GRANT USAGE, SELECT ON SEQUENCE quantity_rules_id_seq TO PUBLIC;
+
+-- When franchisees can pick up or get deliveries and when orders for each slot close. Windows are
+-- weekly, see domain.OrderWindow.
+CREATE TABLE IF NOT EXISTS order_schedules (
+    qb_company_id VARCHAR(50) PRIMARY KEY REFERENCES company(qb_company_id) ON DELETE CASCADE,
+    time_zone VARCHAR(64) NOT NULL,
+    after_cutoff VARCHAR(20) NOT NULL DEFAULT 'block' CHECK (after_cutoff IN ('block', 'next_slot')),
+    windows JSONB NOT NULL DEFAULT '[]',
+    -- YYYY-MM-DD dates without any windows, e.g. holidays
+    blackout_dates JSONB NOT NULL DEFAULT '[]',
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+GRANT SELECT, INSERT, UPDATE, DELETE ON order_schedules TO PUBLIC;
+
+-- Orders franchisees place on a schedule, see domain.StandingOrder
+CREATE TABLE IF NOT EXISTS standing_orders (
+    id BIGSERIAL PRIMARY KEY,
+    qb_company_id VARCHAR(50) NOT NULL REFERENCES company(qb_company_id) ON DELETE CASCADE,
+    qb_customer_id VARCHAR(50) NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    -- [{"item_id": "1", "quantity": "2"}]
+    lines JSONB NOT NULL,
+    rrule VARCHAR(255) NOT NULL,
+    time_zone VARCHAR(64) NOT NULL,
+    starts_at TIMESTAMPTZ NOT NULL,
+    auto_publish BOOLEAN NOT NULL DEFAULT FALSE,
+    paused BOOLEAN NOT NULL DEFAULT FALSE,
+    next_run_at TIMESTAMPTZ NULL,
+    created_by VARCHAR(128) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS standing_orders_due_idx ON standing_orders (next_run_at) WHERE NOT paused;
+CREATE INDEX IF NOT EXISTS standing_orders_customer_idx ON standing_orders (qb_company_id, qb_customer_id);
+
+-- One row per occurrence that was skipped or placed. Skips are written ahead of time, the unique key
+-- stops an occurrence from being placed twice.
+CREATE TABLE IF NOT EXISTS standing_order_runs (
+    id BIGSERIAL PRIMARY KEY,
+    standing_order_id BIGINT NOT NULL REFERENCES standing_orders(id) ON DELETE CASCADE,
+    occurrence TIMESTAMPTZ NOT NULL,
+    status VARCHAR(20) NOT NULL CHECK (status IN ('skipped', 'pending', 'created', 'published', 'failed', 'missed')),
+    qb_invoice_id VARCHAR(50) NULL,
+    error TEXT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (standing_order_id, occurrence)
+);
+
+GRANT SELECT, INSERT, UPDATE, DELETE ON standing_orders, standing_order_runs TO PUBLIC;
+GRANT USAGE, SELECT ON SEQUENCE standing_orders_id_seq, standing_order_runs_id_seq TO PUBLIC;
+
+-- Named lists of items franchisees order from, see domain.OrderTemplate
+CREATE TABLE IF NOT EXISTS order_templates (
+    id BIGSERIAL PRIMARY KEY,
+    qb_company_id VARCHAR(50) NOT NULL REFERENCES company(qb_company_id) ON DELETE CASCADE,
+    qb_customer_id VARCHAR(50) NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    -- [{"item_id": "1", "quantity": "2"}]
+    lines JSONB NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (qb_company_id, qb_customer_id, name)
+);
+
+CREATE TABLE IF NOT EXISTS favorite_items (
+    qb_company_id VARCHAR(50) NOT NULL REFERENCES company(qb_company_id) ON DELETE CASCADE,
+    qb_customer_id VARCHAR(50) NOT NULL,
+    qb_item_id VARCHAR(50) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (qb_company_id, qb_customer_id, qb_item_id)
+);
+
+GRANT SELECT, INSERT, UPDATE, DELETE ON order_templates, favorite_items TO PUBLIC;
+GRANT USAGE, SELECT ON SEQUENCE order_templates_id_seq TO PUBLIC;
+
+-- Staff users of a franchiser company. The QuickBooks user in company.firebase_id is always an owner.
+CREATE TABLE IF NOT EXISTS company_users (
+    firebase_id VARCHAR(50) PRIMARY KEY,
+    qb_company_id VARCHAR(50) NOT NULL REFERENCES company(qb_company_id) ON DELETE CASCADE,
+    email VARCHAR(255) NOT NULL DEFAULT '',
+    name VARCHAR(255) NOT NULL DEFAULT '',
+    role VARCHAR(20) NOT NULL CHECK (role IN ('owner', 'approver', 'fulfillment', 'viewer')),
+    invited_by VARCHAR(50),
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS company_users_company_idx ON company_users(qb_company_id);
+
+INSERT INTO company_users(firebase_id, qb_company_id, role)
+    SELECT firebase_id, qb_company_id, 'owner' FROM company WHERE firebase_id IS NOT NULL
+    ON CONFLICT (firebase_id) DO NOTHING;
+
+GRANT SELECT, INSERT, UPDATE, DELETE ON company_users TO PUBLIC;
+
 -- This is for if we just to make the table public so we don't have to give permissions to users or groups
 -- In prod we want to use iam groups but right now we can't create because I have to do stupid gcp checklist for iam (billing and prod ready requirements)
 -- for now we just set to pubilc
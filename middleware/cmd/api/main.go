@@ -5,17 +5,25 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
+	// The alpine image has no zoneinfo, quiet hours need it
+	_ "time/tzdata"
 
 	firebase "firebase.google.com/go"
 
 	"github.com/twilio/twilio-go"
+	"golang.org/x/oauth2/google"
 
 	fb "github.com/Vertisphere/backend-service/external/firebase"
 	qb "github.com/Vertisphere/backend-service/external/quickbooks"
 	"github.com/Vertisphere/backend-service/internal/config"
 	mynet "github.com/Vertisphere/backend-service/internal/net"
+	"github.com/Vertisphere/backend-service/internal/notify"
+	"github.com/Vertisphere/backend-service/internal/qbtoken"
+	"github.com/Vertisphere/backend-service/internal/standing"
 	"github.com/Vertisphere/backend-service/internal/storage"
 
 	"github.com/rs/zerolog"
@@ -23,7 +31,9 @@ import (
 )
 
 func main() {
-	ctx := context.Background()
+	// Cloud Run sends SIGTERM before stopping the instance
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 	err := config.LoadEnv()
 	if err != nil {
 		log.Fatal().Err(err).Msg("error loading env")
@@ -63,15 +73,42 @@ func main() {
 	if err != nil {
 		log.Fatal().Msg("error initializing firebase client")
 	}
+	firebaseClient.SetTimeout(c.Firebase.Timeout)
 
 	// quickbooksClient
 	quickbooksClient, err := qb.NewClient(c.Quickbooks.ClientID, c.Quickbooks.ClientSecret, c.Quickbooks.RedirectURI, c.Quickbooks.IsProduction, c.Quickbooks.MinorVersion)
 	if err != nil {
 		log.Fatal().Msg("error initializing quickbooks client")
 	}
+	quickbooksClient.SetTimeout(c.Quickbooks.Timeout)
+
+	// Looking up the phone numbers users enrolled for MFA needs admin credentials, the API key isn't enough
+	adminClient, err := google.DefaultClient(ctx, "https://www.googleapis.com/auth/cloud-platform")
+	if err != nil {
+		log.Warn().Err(err).Msg("no google credentials, notifications won't use MFA phone numbers")
+	} else {
+		firebaseClient.SetAdminClient(c.GCP.ProjectID, adminClient)
+	}
 
 	// I guess twilio doesn't implement client initialization error handling? I guess you're just supposed to find out during runtime if you fucked up the initialization..
 	twilioClient := twilio.NewRestClient()
+	if c.Notify.TwilioFrom == "" {
+		log.Warn().Msg("TWILIO_FROM_NUMBER is not set, SMS notifications won't be sent")
+	}
+	if c.Notify.TwilioAuthToken == "" {
+		log.Warn().Msg("TWILIO_AUTH_TOKEN is not set, SMS commands will be rejected")
+	}
+	templates, err := notify.DefaultTemplates()
+	if err != nil {
+		log.Fatal().Err(err).Msg("error loading notification templates")
+	}
+	notifier := notify.NewService(
+		templates,
+		notify.NewResolver(auth, firebaseClient, store),
+		c.Notify.AppURL,
+		notify.NewTwilio(twilioClient, c.Notify.TwilioFrom),
+		notify.NewSendGrid(c.Notify.SendGridAPIKey, c.Notify.EmailFrom),
+	)
 
 	// zero log for cloud run
 	zerolog.LevelFieldName = "severity"
@@ -96,15 +133,36 @@ func main() {
 		}
 	}
 
+	tokens := qbtoken.NewManager(&store, quickbooksClient)
+	quickbooksClient.OnAuthExpired(func(companyID string, accessToken string) {
+		if err := tokens.Expire(companyID, accessToken); err != nil {
+			log.Error().Err(err).Str("companyID", companyID).Msg("Could not expire rejected QuickBooks token")
+		}
+	})
+
 	srv := mynet.NewServer(
 		ctx,
 		auth,
 		&store,
 		firebaseClient,
 		quickbooksClient,
-		twilioClient,
+		tokens,
+		notifier,
+		mynet.NewTwilioWebhook(c.Notify.TwilioAuthToken, c.Notify.TwilioWebhookURL),
 	)
 
+	// Delivers the notifications queued in the outbox
+	outbox := notify.NewWorker(&store, notifier, func(ctx context.Context, companyID string) (notify.QuickBooks, error) {
+		token, err := tokens.Token(ctx, companyID)
+		if err != nil {
+			return nil, err
+		}
+		return quickbooksClient.ForToken(token), nil
+	})
+
+	// Places standing orders when they're due
+	standingOrders := standing.NewScheduler(&store, mynet.PlaceStandingOrder(quickbooksClient, tokens, &store))
+
 	httpServer := &http.Server{
 		Addr:    ":" + c.Port,
 		Handler: srv,
@@ -118,6 +176,16 @@ func main() {
 	}()
 	var wg sync.WaitGroup
 	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		outbox.Run(ctx)
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		standingOrders.Run(ctx)
+	}()
+	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		<-ctx.Done()
@@ -126,6 +194,8 @@ func main() {
 		defer cancel()
 		if err := httpServer.Shutdown(shutdownCtx); err != nil {
 			fmt.Fprintf(os.Stderr, "error shutting down http server: %s\n", err)
+			// Closing the connections cancels the requests still running, and their calls to QB and Firebase
+			httpServer.Close()
 		}
 	}()
 	wg.Wait()
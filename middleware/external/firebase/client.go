@@ -2,27 +2,70 @@ package firebase
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/google/martian/v3/log"
 )
 
+// ErrNoAdminClient is returned by admin calls when SetAdminClient wasn't called
+var ErrNoAdminClient = errors.New("firebase admin client is not configured")
+
 // Client is your handle to the Firebase API.
 type Client struct {
-	apiKey string
+	apiKey     string
+	httpClient *http.Client
+	// adminClient carries Google credentials for the calls the API key isn't enough for
+	adminClient *http.Client
+	projectID   string
+	// timeout bounds each call to Firebase on top of the caller's context, 0 means no limit
+	timeout time.Duration
 }
 
 // NewClient creates a new Firebase client.
 func NewClient(apiKey string) (*Client, error) {
 	return &Client{
-		apiKey: apiKey,
+		apiKey:     apiKey,
+		httpClient: http.DefaultClient,
 	}, nil
 }
 
+// SetTimeout sets how long a single call to Firebase may take. Set it before serving requests.
+func (c *Client) SetTimeout(timeout time.Duration) {
+	c.timeout = timeout
+}
+
+// SetAdminClient sets the client used for admin calls such as MFAPhoneNumber. It has to carry Google
+// credentials with the identitytoolkit scope, e.g. from google.DefaultClient. Set it before serving requests.
+func (c *Client) SetAdminClient(projectID string, httpClient *http.Client) {
+	c.projectID = projectID
+	c.adminClient = httpClient
+}
+
+// withTimeout applies the per call timeout to ctx
+func (c *Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.timeout)
+}
+
+// post sends body as JSON
+func (c *Client) post(ctx context.Context, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return c.httpClient.Do(req)
+}
+
 // CreateUser creates a new user in Firebase.
-func (c *Client) SignUp(email string, password string, phone string) (CreateUserResponse, error) {
+func (c *Client) SignUp(ctx context.Context, email string, password string, phone string) (CreateUserResponse, error) {
 	url := "https://identitytoolkit.googleapis.com/v1/accounts:signUp?key=" + c.apiKey
 	// TODO: phoneNumber doesn't work right now
 	params := map[string]string{
@@ -38,7 +81,9 @@ func (c *Client) SignUp(email string, password string, phone string) (CreateUser
 		return CreateUserResponse{}, err
 	}
 
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(body))
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	resp, err := c.post(ctx, url, body)
 	if err != nil {
 		log.Errorf("firebase request failed: %v", err)
 		return CreateUserResponse{}, err
@@ -74,7 +119,7 @@ func (c *Client) SignUp(email string, password string, phone string) (CreateUser
 	return resData, nil
 }
 
-func (c *Client) SignInWithCustomToken(customTokenInternal string) (SignInWithCustomTokenResponse, error) {
+func (c *Client) SignInWithCustomToken(ctx context.Context, customTokenInternal string) (SignInWithCustomTokenResponse, error) {
 	url := "https://identitytoolkit.googleapis.com/v1/accounts:signInWithCustomToken?key=" + c.apiKey
 	params := map[string]string{
 		"token":             customTokenInternal,
@@ -87,7 +132,9 @@ func (c *Client) SignInWithCustomToken(customTokenInternal string) (SignInWithCu
 		return SignInWithCustomTokenResponse{}, err
 	}
 
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(body))
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	resp, err := c.post(ctx, url, body)
 	if err != nil {
 		log.Errorf("firebase request failed: %v", err)
 		return SignInWithCustomTokenResponse{}, err
@@ -107,7 +154,7 @@ func (c *Client) SignInWithCustomToken(customTokenInternal string) (SignInWithCu
 }
 
 // CreateUser creates a new user in Firebase.
-func (c *Client) SignInWithPassword(email string, password string) (SignInWithPasswordResponse, error) {
+func (c *Client) SignInWithPassword(ctx context.Context, email string, password string) (SignInWithPasswordResponse, error) {
 	url := "https://identitytoolkit.googleapis.com/v1/accounts:signInWithPassword?key=" + c.apiKey
 	params := map[string]string{
 		"email":             email,
@@ -121,7 +168,9 @@ func (c *Client) SignInWithPassword(email string, password string) (SignInWithPa
 		return SignInWithPasswordResponse{}, err
 	}
 
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(body))
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	resp, err := c.post(ctx, url, body)
 	if err != nil {
 		log.Errorf("firebase request failed: %v", err)
 		return SignInWithPasswordResponse{}, err
@@ -139,3 +188,45 @@ func (c *Client) SignInWithPassword(email string, password string) (SignInWithPa
 	}
 	return resData, nil
 }
+
+// MFAPhoneNumber returns the phone number the user enrolled as an SMS second factor, or "" if there isn't one
+func (c *Client) MFAPhoneNumber(ctx context.Context, uid string) (string, error) {
+	if c.adminClient == nil {
+		return "", ErrNoAdminClient
+	}
+	url := "https://identitytoolkit.googleapis.com/v1/projects/" + c.projectID + "/accounts:lookup"
+	body, err := json.Marshal(map[string][]string{"localId": {uid}})
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.adminClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("non 200 response code from Firebase %s", resp.Status)
+	}
+
+	var resData LookupResponse
+	if err := json.NewDecoder(resp.Body).Decode(&resData); err != nil {
+		return "", err
+	}
+	for _, user := range resData.Users {
+		for _, mfa := range user.MfaInfo {
+			if mfa.PhoneInfo != "" {
+				return mfa.PhoneInfo, nil
+			}
+		}
+	}
+	return "", nil
+}
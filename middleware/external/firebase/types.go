@@ -27,3 +27,22 @@ type SignInWithPasswordResponse struct {
 	RefreshToken string `json:"refreshToken,omitempty"`
 	ExpiresIn    string `json:"expiresIn,omitempty"`
 }
+
+type LookupResponse struct {
+	Kind  string       `json:"kind,omitempty"`
+	Users []LookupUser `json:"users"`
+}
+
+type LookupUser struct {
+	LocalID     string    `json:"localId"`
+	Email       string    `json:"email,omitempty"`
+	PhoneNumber string    `json:"phoneNumber,omitempty"`
+	MfaInfo     []MfaInfo `json:"mfaInfo,omitempty"`
+}
+
+// MfaInfo is a second factor the user enrolled. PhoneInfo is only set for SMS factors.
+type MfaInfo struct {
+	MfaEnrollmentID string `json:"mfaEnrollmentId"`
+	DisplayName     string `json:"displayName,omitempty"`
+	PhoneInfo       string `json:"phoneInfo,omitempty"`
+}
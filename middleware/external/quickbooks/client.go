@@ -6,60 +6,105 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
+	"sync"
 	"time"
 
 	"golang.org/x/oauth2"
 )
 
-// Client is your handle to the QuickBooks API.
+// Client holds the app's QuickBooks configuration. It's shared by every request and only talks to
+// the OAuth endpoints itself; use ForToken to get a client for a company's API.
 type Client struct {
-	// Get this from oauth2.NewClient().
-	Client       *http.Client
+	// httpClient is used for the OAuth endpoints and as the transport for realm clients
+	httpClient   *http.Client
 	clientID     string
 	clientSecret string
 	redirectURI  string
 	isProduction bool
 	discoveryAPI *DiscoveryAPI
 	endpoint     EndpointUrl
-	throttled    bool
 	minorVersion string
+	// timeout bounds each call to QuickBooks on top of the caller's context, 0 means no limit
+	timeout time.Duration
+	// onAuthExpired is called when QuickBooks rejects a realm client's access token
+	onAuthExpired func(realmID string, accessToken string)
+
+	// limiters are per realm since QuickBooks rate limits each company separately
+	limitersMu sync.Mutex
+	limiters   map[string]*realmLimiter
+}
+
+// RealmClient calls the QuickBooks API with a single company's access token. Create one per request
+// with Client.ForToken, it's cheap.
+type RealmClient struct {
+	client      *Client
+	httpClient  *http.Client
+	accessToken string
 }
 
 // NewClient initializes a new QuickBooks client for interacting with their Online API
 func NewClient(clientID, clientSecret, redirectURI string, isProduction bool, minorVersion string) (*Client, error) {
-	client := Client{
-		Client:       nil,
+	discoveryEndpoint, endpoint := DiscoverySandboxEndpoint, SandboxEndpoint
+	if isProduction {
+		discoveryEndpoint, endpoint = DiscoveryProductionEndpoint, ProductionEndpoint
+	}
+	discoveryAPI, err := CallDiscoveryAPI(discoveryEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	client := NewClientForEndpoint(clientID, clientSecret, redirectURI, endpoint, discoveryAPI, minorVersion)
+	client.isProduction = isProduction
+	return client, nil
+}
+
+// NewClientForEndpoint creates a client without calling the discovery API, e.g. to point it at a stub in tests
+func NewClientForEndpoint(clientID, clientSecret, redirectURI string, endpoint EndpointUrl, discoveryAPI *DiscoveryAPI, minorVersion string) *Client {
+	return &Client{
+		httpClient:   http.DefaultClient,
 		clientID:     clientID,
 		clientSecret: clientSecret,
 		redirectURI:  redirectURI,
-		isProduction: isProduction,
-		throttled:    false,
+		discoveryAPI: discoveryAPI,
+		endpoint:     endpoint,
 		minorVersion: minorVersion,
+		limiters:     map[string]*realmLimiter{},
 	}
-	var err error
-	if isProduction {
-		client.discoveryAPI, err = CallDiscoveryAPI(DiscoveryProductionEndpoint)
+}
 
-		client.endpoint = ProductionEndpoint
-	} else {
-		client.discoveryAPI, err = CallDiscoveryAPI(DiscoverySandboxEndpoint)
-		client.endpoint = SandboxEndpoint
+// ForToken returns a client that authenticates with the given access token
+func (c *Client) ForToken(accessToken string) *RealmClient {
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, c.httpClient)
+	token := oauth2.Token{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
 	}
-	if err != nil {
-		return nil, err
+	return &RealmClient{
+		client:      c,
+		httpClient:  oauth2.NewClient(ctx, oauth2.StaticTokenSource(&token)),
+		accessToken: accessToken,
 	}
-	return &client, nil
 }
 
-func (c *Client) SetClient(bearerToken BearerToken) {
-	ctx := context.Background()
-	token := oauth2.Token{
-		AccessToken: bearerToken.AccessToken,
-		TokenType:   "Bearer",
+// SetTimeout sets how long a single call to QuickBooks may take. Set it before serving requests.
+func (c *Client) SetTimeout(timeout time.Duration) {
+	c.timeout = timeout
+}
+
+// OnAuthExpired sets what to do when QuickBooks rejects an access token, e.g. because the connection
+// was revoked in QuickBooks, so the token isn't used again. Set it before serving requests.
+func (c *Client) OnAuthExpired(f func(realmID string, accessToken string)) {
+	c.onAuthExpired = f
+}
+
+// withTimeout applies the per call timeout to ctx
+func (c *Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.timeout <= 0 {
+		return context.WithCancel(ctx)
 	}
-	c.Client = oauth2.NewClient(ctx, oauth2.StaticTokenSource(&token))
+	return context.WithTimeout(ctx, c.timeout)
 }
 
 // FindAuthorizationUrl compiles the authorization url from the discovery api's auth endpoint.
@@ -86,13 +131,9 @@ func (c *Client) FindAuthorizationUrl(scope string, state string, redirectUri st
 	return authorizationUrl.String(), nil
 }
 
-func (c *Client) req(realmID string, method string, endpoint string, payloadData interface{}, responseObject interface{}, queryParameters map[string]string) error {
-	// TODO: possibly just wait until c.throttled is false, and continue the request?
-	if c.throttled {
-		return errors.New("waiting for rate limit")
-	}
+func (c *RealmClient) req(ctx context.Context, realmID string, method string, endpoint string, payloadData interface{}, responseObject interface{}, queryParameters map[string]string) error {
 	var err error
-	companyEndpoint, err := url.Parse(string(c.endpoint) + "/v3/company/" + realmID + "/")
+	companyEndpoint, err := url.Parse(string(c.client.endpoint) + "/v3/company/" + realmID + "/")
 	if err != nil {
 		return errors.New("failed to parse API endpoint")
 	}
@@ -106,7 +147,7 @@ func (c *Client) req(realmID string, method string, endpoint string, payloadData
 		}
 	}
 
-	urlValues.Set("minorversion", c.minorVersion)
+	urlValues.Set("minorversion", c.client.minorVersion)
 	urlValues.Encode()
 	endpointUrl.RawQuery = urlValues.Encode()
 
@@ -119,32 +160,21 @@ func (c *Client) req(realmID string, method string, endpoint string, payloadData
 		}
 	}
 
-	req, err := http.NewRequest(method, endpointUrl.String(), bytes.NewBuffer(marshalledJson))
-	if err != nil {
-		return fmt.Errorf("failed to create request: %v", err)
-	}
-
-	req.Header.Add("Accept", "application/json")
-	req.Header.Add("Content-Type", "application/json")
+	ctx, cancel := c.client.withTimeout(ctx)
+	defer cancel()
+	header := http.Header{}
+	header.Add("Accept", "application/json")
+	header.Add("Content-Type", "application/json")
 
-	resp, err := c.Client.Do(req)
+	resp, err := c.do(ctx, realmID, method, endpointUrl.String(), marshalledJson, header)
 	if err != nil {
 		return fmt.Errorf("failed to make request: %v", err)
 	}
 
 	defer resp.Body.Close()
 
-	switch resp.StatusCode {
-	case http.StatusOK:
-		break
-	case http.StatusTooManyRequests:
-		c.throttled = true
-		go func(c *Client) {
-			time.Sleep(1 * time.Minute)
-			c.throttled = false
-		}(c)
-	default:
-		return parseFailure(resp)
+	if resp.StatusCode != http.StatusOK {
+		return c.failure(realmID, resp)
 	}
 
 	if responseObject != nil {
@@ -156,18 +186,96 @@ func (c *Client) req(realmID string, method string, endpoint string, payloadData
 	return nil
 }
 
-func (c *Client) get(realmID string, endpoint string, responseObject interface{}, queryParameters map[string]string) error {
-	return c.req(realmID, "GET", endpoint, nil, responseObject, queryParameters)
+// failure parses a failed response, reporting a rejected access token to OnAuthExpired
+func (c *RealmClient) failure(realmID string, resp *http.Response) error {
+	err := parseFailure(resp)
+	if errors.Is(err, ErrAuthExpired) && c.client.onAuthExpired != nil {
+		c.client.onAuthExpired(realmID, c.accessToken)
+	}
+	return err
 }
 
-func (c *Client) post(realmID string, endpoint string, payloadData interface{}, responseObject interface{}, queryParameters map[string]string) error {
-	return c.req(realmID, "POST", endpoint, payloadData, responseObject, queryParameters)
+// do sends a request once the realm's rate limiter lets it through. Throttled requests are retried
+// once QuickBooks' Retry-After has passed, GETs are also retried with backoff on network errors and
+// server errors. The caller has to close the response body.
+func (c *RealmClient) do(ctx context.Context, realmID string, method string, url string, body []byte, header http.Header) (*http.Response, error) {
+	limiter := c.client.limiter(realmID)
+	idempotent := method == http.MethodGet
+	for retry := 0; ; retry++ {
+		if retry > 0 {
+			limiter.retries.Add(1)
+		}
+		if err := limiter.acquire(ctx); err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+		if err != nil {
+			limiter.release()
+			return nil, fmt.Errorf("failed to create request: %v", err)
+		}
+		req.Header = header.Clone()
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			limiter.release()
+			if !idempotent || retry == maxRetries || ctx.Err() != nil {
+				return nil, err
+			}
+			if err := sleep(ctx, backoff(retry+1)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		// Keep the slot until the body has been read
+		resp.Body = &releasingBody{ReadCloser: resp.Body, release: limiter.release}
+
+		switch {
+		case resp.StatusCode == http.StatusTooManyRequests:
+			limiter.throttled.Add(1)
+			delay, ok := retryAfter(resp)
+			if !ok {
+				delay = backoff(retry + 1)
+			}
+			// Everyone else queued for the realm waits too
+			limiter.pause(delay)
+			// QuickBooks didn't process the request, so it's safe to retry whatever the method
+			if retry == maxRetries {
+				return resp, nil
+			}
+			resp.Body.Close()
+		case resp.StatusCode >= http.StatusInternalServerError && idempotent && retry < maxRetries:
+			resp.Body.Close()
+			if err := sleep(ctx, backoff(retry+1)); err != nil {
+				return nil, err
+			}
+		default:
+			return resp, nil
+		}
+	}
 }
 
-// query makes the specified QBO `query` and unmarshals the result into `responseObject`
-func (c *Client) query(realmID string, query string, responseObject interface{}) error {
-	return c.get(realmID, "query", responseObject, map[string]string{"query": query})
+// releasingBody gives the request's rate limiter slot back once closed
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
 }
 
-// TODO add errors for 401 when qb access token expires
-// 401 {"warnings":null,"intuitObject":null,"fault":{"error":[{"message":"message=AuthenticationFailed; errorCode=003200; statusCode=401","detail":"Token expired: AB01730024136mqEofYN9fldzIcxH6lsAcqOYIbafE5z6ZdjPc","code":"3200","element":null}],"type":"AUTHENTICATION"},"report":null,"queryResponse":null,"batchItemResponse":[],"attachableResponse":[],"syncErrorResponse":null,"requestId":null,"time":1730024394085,"status":null,"cdcresponse":[]}
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+func (c *RealmClient) get(ctx context.Context, realmID string, endpoint string, responseObject interface{}, queryParameters map[string]string) error {
+	return c.req(ctx, realmID, "GET", endpoint, nil, responseObject, queryParameters)
+}
+
+func (c *RealmClient) post(ctx context.Context, realmID string, endpoint string, payloadData interface{}, responseObject interface{}, queryParameters map[string]string) error {
+	return c.req(ctx, realmID, "POST", endpoint, payloadData, responseObject, queryParameters)
+}
+
+// query makes the specified QBO `query` and unmarshals the result into `responseObject`
+func (c *RealmClient) query(ctx context.Context, realmID string, query string, responseObject interface{}) error {
+	return c.get(ctx, realmID, "query", responseObject, map[string]string{"query": query})
+}
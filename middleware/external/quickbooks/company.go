@@ -3,6 +3,8 @@
 
 package quickbooks
 
+import "context"
+
 // CompanyInfo describes a company account.
 type CompanyInfo struct {
 	CompanyName string `json:",omitempty"`
@@ -27,13 +29,13 @@ type CompanyInfo struct {
 
 // FindCompanyInfo returns the QuickBooks CompanyInfo object. This is a good
 // test to check whether you're connected.
-func (c *Client) FindCompanyInfo(realmID string) (*CompanyInfo, error) {
+func (c *RealmClient) FindCompanyInfo(ctx context.Context, realmID string) (*CompanyInfo, error) {
 	var resp struct {
 		CompanyInfo CompanyInfo
 		Time        Date
 	}
 
-	if err := c.get(realmID, "companyinfo/"+realmID, &resp, nil); err != nil {
+	if err := c.get(ctx, realmID, "companyinfo/"+realmID, &resp, nil); err != nil {
 		return nil, err
 	}
 
@@ -41,8 +43,8 @@ func (c *Client) FindCompanyInfo(realmID string) (*CompanyInfo, error) {
 }
 
 // UpdateCompanyInfo updates the company info
-func (c *Client) UpdateCompanyInfo(realmID string, companyInfo *CompanyInfo) (*CompanyInfo, error) {
-	existingCompanyInfo, err := c.FindCompanyInfo(realmID)
+func (c *RealmClient) UpdateCompanyInfo(ctx context.Context, realmID string, companyInfo *CompanyInfo) (*CompanyInfo, error) {
+	existingCompanyInfo, err := c.FindCompanyInfo(ctx, realmID)
 	if err != nil {
 		return nil, err
 	}
@@ -63,7 +65,7 @@ func (c *Client) UpdateCompanyInfo(realmID string, companyInfo *CompanyInfo) (*C
 		Time        Date
 	}
 
-	if err = c.post(realmID, "companyInfo", payload, &companyInfoData, nil); err != nil {
+	if err = c.post(ctx, realmID, "companyInfo", payload, &companyInfoData, nil); err != nil {
 		return nil, err
 	}
 
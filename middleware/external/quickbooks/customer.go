@@ -4,6 +4,7 @@
 package quickbooks
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -52,20 +53,20 @@ type Customer struct {
 }
 
 // FindCustomerById returns a customer with a given Id.
-func (c *Client) GetCustomerById(realmID string, id string) (*Customer, error) {
+func (c *RealmClient) GetCustomerById(ctx context.Context, realmID string, id string) (*Customer, error) {
 	var r struct {
 		Customer Customer
 		Time     Date
 	}
 
-	if err := c.get(realmID, "customer/"+id, &r, nil); err != nil {
+	if err := c.get(ctx, realmID, "customer/"+id, &r, nil); err != nil {
 		return nil, err
 	}
 
 	return &r.Customer, nil
 }
 
-func (c *Client) GetCustomerIdsByName(realmID string, name string) ([]string, error) {
+func (c *RealmClient) GetCustomerIdsByName(ctx context.Context, realmID string, name string) ([]string, error) {
 	var r struct {
 		QueryResponse struct {
 			Customers []Customer `json:"Customer"`
@@ -73,7 +74,7 @@ func (c *Client) GetCustomerIdsByName(realmID string, name string) ([]string, er
 	}
 
 	query := fmt.Sprintf("SELECT id FROM Customer WHERE DisplayName LIKE '%%%s%%'", name)
-	if err := c.query(realmID, query, &r); err != nil {
+	if err := c.query(ctx, realmID, query, &r); err != nil {
 		return nil, err
 	}
 
@@ -84,14 +85,14 @@ func (c *Client) GetCustomerIdsByName(realmID string, name string) ([]string, er
 	return ids, nil
 }
 
-func (c *Client) QueryCustomersCount(realmID string, searchQuery string) (int, error) {
+func (c *RealmClient) QueryCustomersCount(ctx context.Context, realmID string, searchQuery string) (int, error) {
 	var resp struct {
 		QueryResponse struct {
 			TotalCount int `json:"totalCount"`
 		}
 	}
 	query := fmt.Sprintf("SELECT COUNT(*) FROM Customer WHERE %s", searchQuery)
-	if err := c.query(realmID, query, &resp); err != nil {
+	if err := c.query(ctx, realmID, query, &resp); err != nil {
 		return 0, err
 	}
 
@@ -103,7 +104,7 @@ func (c *Client) QueryCustomersCount(realmID string, searchQuery string) (int, e
 }
 
 // QueryCustomers accepts an SQL query and returns all customers found using it
-func (c *Client) QueryCustomers(realmID string, orderBy string, pageSize string, pageToken string, searchQuery string) ([]Customer, error) {
+func (c *RealmClient) QueryCustomers(ctx context.Context, realmID string, orderBy string, pageSize string, pageToken string, searchQuery string) ([]Customer, error) {
 	var resp struct {
 		QueryResponse struct {
 			Customers     []Customer `json:"Customer"`
@@ -112,7 +113,7 @@ func (c *Client) QueryCustomers(realmID string, orderBy string, pageSize string,
 		}
 	}
 	query := fmt.Sprintf("SELECT * FROM Customer WHERE %s orderBy %s MAXRESULTS %s STARTPOSITION %s", searchQuery, orderBy, pageSize, pageToken)
-	if err := c.query(realmID, query, &resp); err != nil {
+	if err := c.query(ctx, realmID, query, &resp); err != nil {
 		return nil, err
 	}
 
@@ -126,7 +127,7 @@ func (c *Client) QueryCustomers(realmID string, orderBy string, pageSize string,
 // UpdateCustomer updates the given Customer on the QuickBooks server,
 // returning the resulting Customer object. It's a sparse update, as not all QB
 // fields are present in our Customer object.
-func (c *Client) UpdateCustomer(realmID string, customer *Customer) (*Customer, error) {
+func (c *RealmClient) UpdateCustomer(ctx context.Context, realmID string, customer *Customer) (*Customer, error) {
 	if customer.Id == "" {
 		return nil, errors.New("missing customer id")
 	}
@@ -148,7 +149,7 @@ func (c *Client) UpdateCustomer(realmID string, customer *Customer) (*Customer,
 	}
 
 	var err error
-	if err = c.post(realmID, "customer", payload, &customerData, nil); err != nil {
+	if err = c.post(ctx, realmID, "customer", payload, &customerData, nil); err != nil {
 		return nil, err
 	}
 
@@ -10,6 +10,21 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
+)
+
+// Errors a Failure can match with errors.Is
+var (
+	// ErrStaleObject means the SyncToken sent was out of date, someone else changed the object first
+	ErrStaleObject = errors.New("quickbooks: stale object")
+	// ErrAuthExpired means the access token expired or was revoked
+	ErrAuthExpired = errors.New("quickbooks: authentication expired")
+	// ErrValidation means QuickBooks rejected the request body or query
+	ErrValidation = errors.New("quickbooks: validation failed")
+	// ErrNotFound means the object doesn't exist, or was deleted
+	ErrNotFound = errors.New("quickbooks: object not found")
+	// ErrThrottled means the realm went over its rate limit
+	ErrThrottled = errors.New("quickbooks: throttled")
 )
 
 // Failure is the outermost struct that holds an error response.
@@ -24,6 +39,57 @@ type Failure struct {
 		Type string `json:"type"`
 	}
 	Time Date `json:"time"`
+	// StatusCode is the HTTP status of the response
+	StatusCode int `json:"-"`
+}
+
+// Code returns the code of the first error in the fault, without leading zeros
+func (f Failure) Code() string {
+	if len(f.Fault.Error) == 0 {
+		return ""
+	}
+	return strings.TrimLeft(f.Fault.Error[0].Code, "0")
+}
+
+// Detail returns the detail of the first error in the fault, falling back to its message
+func (f Failure) Detail() string {
+	if len(f.Fault.Error) == 0 {
+		return ""
+	}
+	if f.Fault.Error[0].Detail != "" {
+		return f.Fault.Error[0].Detail
+	}
+	return f.Fault.Error[0].Message
+}
+
+// Element returns the field the first error in the fault is about, if any
+func (f Failure) Element() string {
+	if len(f.Fault.Error) == 0 {
+		return ""
+	}
+	return f.Fault.Error[0].Element
+}
+
+// Is lets errors.Is match a Failure against ErrStaleObject, ErrAuthExpired, ErrValidation,
+// ErrNotFound and ErrThrottled.
+// See https://developer.intuit.com/app/developer/qbo/docs/develop/troubleshooting/error-codes
+func (f Failure) Is(target error) bool {
+	code := f.Code()
+	faultType := strings.ToLower(f.Fault.Type)
+	switch target {
+	case ErrStaleObject:
+		return code == "5010"
+	case ErrAuthExpired:
+		return code == "3200" || f.StatusCode == http.StatusUnauthorized || strings.HasPrefix(faultType, "authentication")
+	case ErrNotFound:
+		return code == "610" || f.StatusCode == http.StatusNotFound
+	case ErrThrottled:
+		return code == "3001" || f.StatusCode == http.StatusTooManyRequests
+	case ErrValidation:
+		// Stale objects and missing objects are reported as validation faults too
+		return faultType == "validationfault" && code != "5010" && code != "610"
+	}
+	return false
 }
 
 // Error implements the error interface.
@@ -45,9 +111,17 @@ func parseFailure(resp *http.Response) error {
 
 	var errStruct Failure
 
-	if err = json.Unmarshal(msg, &errStruct); err != nil {
-		return errors.New(strconv.Itoa(resp.StatusCode) + " " + string(msg))
+	// Some faults come with a time in milliseconds that Date can't parse, keep whatever was decoded
+	if err = json.Unmarshal(msg, &errStruct); err != nil && len(errStruct.Fault.Error) == 0 {
+		// Still return a Failure so the status code can be matched
+		errStruct.Fault.Error = append(errStruct.Fault.Error, struct {
+			Message string
+			Detail  string
+			Code    string `json:"code"`
+			Element string `json:"element"`
+		}{Message: strconv.Itoa(resp.StatusCode) + " " + string(msg)})
 	}
+	errStruct.StatusCode = resp.StatusCode
 
 	return errStruct
 }
@@ -0,0 +1,92 @@
+package quickbooks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseFailure(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		want    error
+		element string
+	}{
+		{
+			name:   "stale object",
+			status: http.StatusBadRequest,
+			body:   `{"Fault":{"Error":[{"Message":"Stale Object Error","Detail":"Stale Object Error : You and root were working on this at the same time.","code":"5010","element":""}],"type":"ValidationFault"},"time":"2024-10-27T03:19:54.085-07:00"}`,
+			want:   ErrStaleObject,
+		},
+		{
+			name:   "token expired",
+			status: http.StatusUnauthorized,
+			body:   `{"warnings":null,"fault":{"error":[{"message":"message=AuthenticationFailed; errorCode=003200; statusCode=401","detail":"Token expired","code":"3200","element":null}],"type":"AUTHENTICATION"},"time":1730024394085}`,
+			want:   ErrAuthExpired,
+		},
+		{
+			name:    "validation",
+			status:  http.StatusBadRequest,
+			body:    `{"Fault":{"Error":[{"Message":"Required param missing","Detail":"Required parameter Line.SalesItemLineDetail.ItemRef is missing","code":"2020","element":"Line.SalesItemLineDetail.ItemRef"}],"type":"ValidationFault"}}`,
+			want:    ErrValidation,
+			element: "Line.SalesItemLineDetail.ItemRef",
+		},
+		{
+			name:   "not found",
+			status: http.StatusBadRequest,
+			body:   `{"Fault":{"Error":[{"Message":"Object Not Found","Detail":"Object Not Found : Something you're trying to use has been made inactive.","code":"610","element":""}],"type":"ValidationFault"}}`,
+			want:   ErrNotFound,
+		},
+		{
+			name:   "throttled",
+			status: http.StatusTooManyRequests,
+			body:   `<html>Too Many Requests</html>`,
+			want:   ErrThrottled,
+		},
+	}
+	all := []error{ErrStaleObject, ErrAuthExpired, ErrValidation, ErrNotFound, ErrThrottled}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := parseFailure(&http.Response{StatusCode: tt.status, Body: io.NopCloser(strings.NewReader(tt.body))})
+			for _, target := range all {
+				if got := errors.Is(err, target); got != (target == tt.want) {
+					t.Errorf("errors.Is(%v) = %v", target, got)
+				}
+			}
+			var failure Failure
+			if !errors.As(err, &failure) {
+				t.Fatalf("got %T, want Failure", err)
+			}
+			if failure.Element() != tt.element {
+				t.Errorf("element = %q, want %q", failure.Element(), tt.element)
+			}
+		})
+	}
+}
+
+func TestAuthExpiredIsReported(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"fault":{"error":[{"message":"message=AuthenticationFailed; errorCode=003200; statusCode=401","detail":"Token revoked","code":"3200"}],"type":"AUTHENTICATION"}}`))
+	}))
+	defer srv.Close()
+
+	qbc := NewClientForEndpoint("id", "secret", "", EndpointUrl(srv.URL), &DiscoveryAPI{}, "75")
+	var rejected []string
+	qbc.OnAuthExpired(func(realmID string, accessToken string) {
+		rejected = append(rejected, realmID+":"+accessToken)
+	})
+	_, err := qbc.ForToken("token").QueryItemsCount(context.Background(), "1001", "Active = true")
+	if !errors.Is(err, ErrAuthExpired) {
+		t.Fatalf("err = %v, want ErrAuthExpired", err)
+	}
+	if len(rejected) != 1 || rejected[0] != "1001:token" {
+		t.Errorf("OnAuthExpired got %v, want the realm and its token", rejected)
+	}
+}
@@ -4,13 +4,14 @@
 package quickbooks
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"strings"
 )
 
 type InvoiceTruncated struct {
@@ -22,7 +23,7 @@ type InvoiceTruncated struct {
 	Balance     json.Number   `json:"Balance,omitempty"`
 }
 
-// ENUM of statuses
+// ENUM of the legacy DocNumber statuses, see CheckInvoiceStatus
 const (
 	INVOICE_DRAFT    = iota + 1
 	INVOICE_PENDING  = iota + 1
@@ -148,13 +149,13 @@ type DiscountLineDetail struct {
 
 // CreateInvoice creates the given Invoice on the QuickBooks server, returning
 // the resulting Invoice object.
-func (c *Client) CreateInvoice(realmID string, invoice *Invoice) (*Invoice, error) {
+func (c *RealmClient) CreateInvoice(ctx context.Context, realmID string, invoice *Invoice) (*Invoice, error) {
 	var resp struct {
 		Invoice Invoice
 		Time    Date
 	}
 
-	if err := c.post(realmID, "invoice", invoice, &resp, nil); err != nil {
+	if err := c.post(ctx, realmID, "invoice", invoice, &resp, nil); err != nil {
 		return nil, err
 	}
 
@@ -163,13 +164,13 @@ func (c *Client) CreateInvoice(realmID string, invoice *Invoice) (*Invoice, erro
 
 // CreateInvoiceWithLines creates the given Invoice on the QuickBooks server with the items on initialization, returning
 // the resulting Invoice object.
-func (c *Client) CreateInvoiceWithLines(realmID string, invoice *Invoice) (*Invoice, error) {
+func (c *RealmClient) CreateInvoiceWithLines(ctx context.Context, realmID string, invoice *Invoice) (*Invoice, error) {
 	var resp struct {
 		Invoice Invoice
 		Time    Date
 	}
 
-	if err := c.post(realmID, "invoice", invoice, &resp, nil); err != nil {
+	if err := c.post(ctx, realmID, "invoice", invoice, &resp, nil); err != nil {
 		return nil, err
 	}
 
@@ -177,13 +178,13 @@ func (c *Client) CreateInvoiceWithLines(realmID string, invoice *Invoice) (*Invo
 }
 
 // // FindInvoiceById finds the invoice by the given id
-func (c *Client) FindInvoiceById(realmID string, id string) (*Invoice, error) {
+func (c *RealmClient) FindInvoiceById(ctx context.Context, realmID string, id string) (*Invoice, error) {
 	var resp struct {
 		Invoice Invoice
 		Time    Date
 	}
 
-	if err := c.get(realmID, "invoice/"+id, &resp, nil); err != nil {
+	if err := c.get(ctx, realmID, "invoice/"+id, &resp, nil); err != nil {
 		return nil, err
 	}
 
@@ -191,7 +192,7 @@ func (c *Client) FindInvoiceById(realmID string, id string) (*Invoice, error) {
 }
 
 // // SendInvoice sends the invoice to the Invoice.BillEmail if emailAddress is left empty
-func (c *Client) SendInvoice(realmID string, invoiceId string, emailAddress string) error {
+func (c *RealmClient) SendInvoice(ctx context.Context, realmID string, invoiceId string, emailAddress string) error {
 	queryParameters := make(map[string]string)
 
 	var resp struct {
@@ -203,12 +204,12 @@ func (c *Client) SendInvoice(realmID string, invoiceId string, emailAddress stri
 		queryParameters["sendTo"] = emailAddress
 	}
 
-	return c.post(realmID, "invoice/"+invoiceId+"/send", nil, &resp, queryParameters)
+	return c.post(ctx, realmID, "invoice/"+invoiceId+"/send", nil, &resp, queryParameters)
 }
 
 // // UpdateInvoice updates the invoice
 // Usually you should know that you need to pass synctoken, so I'll leave a parameter to remind that
-func (c *Client) UpdateInvoice(realmID string, invoice interface{}) (*Invoice, error) {
+func (c *RealmClient) UpdateInvoice(ctx context.Context, realmID string, invoice interface{}) (*Invoice, error) {
 
 	// invoice.SyncToken = syncToken
 
@@ -227,14 +228,14 @@ func (c *Client) UpdateInvoice(realmID string, invoice interface{}) (*Invoice, e
 	}
 
 	var err error
-	if err = c.post(realmID, "invoice", invoice, &invoiceData, nil); err != nil {
+	if err = c.post(ctx, realmID, "invoice", invoice, &invoiceData, nil); err != nil {
 		return nil, err
 	}
 
 	return &invoiceData.Invoice, err
 }
 
-func (c *Client) VoidInvoice(realmID string, invoiceId string, syncToken string) error {
+func (c *RealmClient) VoidInvoice(ctx context.Context, realmID string, invoiceId string, syncToken string) error {
 	if invoiceId == "" {
 		return errors.New("missing invoice id")
 	}
@@ -243,10 +244,10 @@ func (c *Client) VoidInvoice(realmID string, invoiceId string, syncToken string)
 		SyncToken: syncToken,
 	}
 
-	return c.post(realmID, "invoice", invoice, nil, map[string]string{"operation": "void"})
+	return c.post(ctx, realmID, "invoice", invoice, nil, map[string]string{"operation": "void"})
 }
 
-func (c *Client) QueryInvoicesCount(realmID string, statuses string, customerRef string, searchQuery string) (int, error) {
+func (c *RealmClient) QueryInvoicesCount(ctx context.Context, realmID string, invoiceIDs []string, customerRef string, searchQuery string) (int, error) {
 
 	var resp struct {
 		QueryResponse struct {
@@ -254,58 +255,24 @@ func (c *Client) QueryInvoicesCount(realmID string, statuses string, customerRef
 		}
 	}
 
-	query := "SELECT * FROM Invoice WHERE DocNumber > 'A'"
+	query := "SELECT COUNT(*) FROM Invoice WHERE " + IDFilter(invoiceIDs)
 	if customerRef != "" {
 		query += fmt.Sprintf(" AND customerRef = '%s'", customerRef)
 	}
-	if statuses != "" {
-		// Constructs a wildcard mask for searching statuses that we want
-		// We get 21 characters for the DocNumber field
-		// 	DRAFT    = iota + 1
-		// 	PENDING  = iota + 1
-		// 	APPROVED = iota + 1
-		// 	REVISION = iota + 1
-		// 	VOID     = iota + 1
-		// 	COMPLETE = iota + 1
-		// Format is "ADPARVC0-YYMMDDHHMMSS"
-		// A is a place holder to indicate that it's from our system
-		// P(pending), R(reviewed/approved), V(voided), Z(completed) are the statuses we want to search for: 1 for the current status, 0 if we don't
-		// For example, if we want want all statuses except voided we search for ... LIKE 'A%%0%000-%'
-		// - is a separator
-		// YYMMDDHHMMSS is the timestamp
-		// Should guarantee uniqueness for now, might need to change as we scale
-		d, p, a, r, v, c := "0", "0", "0", "0", "0", "0"
-		for i := 0; i < min(len(statuses), 6); i++ {
-			switch statuses[i] {
-			case 'D':
-				d = "%"
-			case 'P':
-				p = "%"
-			case 'A':
-				a = "%"
-			case 'R':
-				r = "%"
-			case 'V':
-				v = "%"
-			case 'C':
-				c = "%"
-			}
-		}
-		query += fmt.Sprintf(" AND DocNumber LIKE 'A%s%s%s%s%s%s0-%%'", d, p, a, r, v, c)
-
-		if searchQuery != "" {
-			query += fmt.Sprintf(" AND %s", searchQuery)
-		}
+	if searchQuery != "" {
+		query += fmt.Sprintf(" AND %s", searchQuery)
 	}
 
-	if err := c.query(realmID, query, &resp); err != nil {
+	if err := c.query(ctx, realmID, query, &resp); err != nil {
 		return 0, err
 	}
 
 	return resp.QueryResponse.TotalCount, nil
 }
 
-func (c *Client) QueryInvoices(realmID string, orderBy string, pageSize string, pageToken string, statuses string, customerRef string, searchQuery string) ([]InvoiceTruncated, error) {
+// QueryInvoices returns a page of the given invoices. Order statuses aren't stored in QuickBooks,
+// so callers look up which invoice ids they want first and pass them in.
+func (c *RealmClient) QueryInvoices(ctx context.Context, realmID string, orderBy string, pageSize string, pageToken string, invoiceIDs []string, customerRef string, searchQuery string) ([]InvoiceTruncated, error) {
 	var resp struct {
 		QueryResponse struct {
 			Invoices      []InvoiceTruncated `json:"Invoice"`
@@ -314,65 +281,55 @@ func (c *Client) QueryInvoices(realmID string, orderBy string, pageSize string,
 		}
 	}
 
-	query := "SELECT * FROM Invoice WHERE DocNumber > 'A'"
+	query := "SELECT * FROM Invoice WHERE " + IDFilter(invoiceIDs)
 	if customerRef != "" {
 		query += fmt.Sprintf(" AND customerRef = '%s'", customerRef)
 	}
+	if searchQuery != "" {
+		query += fmt.Sprintf(" AND %s", searchQuery)
+	}
 
-	if statuses != "" {
-		// Constructs a wildcard mask for searching statuses that we want
-		// We get 21 characters for the DocNumber field
-		// 	DRAFT    = iota + 1
-		// 	PENDING  = iota + 1
-		// 	APPROVED = iota + 1
-		// 	REVISION = iota + 1
-		// 	VOID     = iota + 1
-		// 	COMPLETE = iota + 1
-		// Format is "ADPARVC0-YYMMDDHHMMSS"
-		// A is a place holder to indicate that it's from our system
-		// D(draft), P(pending), a(approved), R(revision/requires change), V(voided), C(completed) are the statuses we want to search for: 1 for the current status, 0 if we don't
-		// For example, if we want want all statuses except voided we search for ... LIKE 'A%%%%0%0-%'
-		// - is a separator
-		// YYMMDDHHMMSS is the timestamp
-		// Should guarantee uniqueness for now, might need to change as we scale
-		d, p, a, r, v, c := "0", "0", "0", "0", "0", "0"
-		for i := 0; i < min(len(statuses), 6); i++ {
-			switch statuses[i] {
-			case 'D':
-				d = "%"
-			case 'P':
-				p = "%"
-			case 'A':
-				a = "%"
-			case 'R':
-				r = "%"
-			case 'V':
-				v = "%"
-			case 'C':
-				c = "%"
-			}
-		}
-		query += fmt.Sprintf(" AND DocNumber LIKE 'A%s%s%s%s%s%s0-%%'", d, p, a, r, v, c)
+	query += fmt.Sprintf(" ORDER BY %s MAXRESULTS %s STARTPOSITION %s", orderBy, pageSize, pageToken)
 
-		if searchQuery != "" {
-			query += fmt.Sprintf(" AND %s", searchQuery)
-		}
+	if err := c.query(ctx, realmID, query, &resp); err != nil {
+		return nil, err
 	}
 
-	query += fmt.Sprintf(" ORDER BY %s MAXRESULTS %s STARTPOSITION %s", orderBy, pageSize, pageToken)
+	return resp.QueryResponse.Invoices, nil
+}
+
+// MaxQueryIDs is how many ids to put in one "Id IN (...)" filter at most. Queries are sent in the
+// URL, so longer lists have to be split up.
+const MaxQueryIDs = 100
 
-	if err := c.query(realmID, query, &resp); err != nil {
+// QueryInvoicePage returns a page of all of the company's invoices, oldest first. startPosition
+// starts at 1 and maxResults is at most 1000.
+func (c *RealmClient) QueryInvoicePage(ctx context.Context, realmID string, startPosition int, maxResults int) ([]Invoice, error) {
+	var resp struct {
+		QueryResponse struct {
+			Invoices []Invoice `json:"Invoice"`
+		}
+	}
+
+	query := fmt.Sprintf("SELECT * FROM Invoice ORDER BY MetaData.CreateTime ASC STARTPOSITION %d MAXRESULTS %d", startPosition, maxResults)
+	if err := c.query(ctx, realmID, query, &resp); err != nil {
 		return nil, err
 	}
 
 	return resp.QueryResponse.Invoices, nil
 }
 
-func (c *Client) GetInvoicePDF(realmID string, invoiceId string) ([]byte, error) {
-	if c.throttled {
-		return nil, errors.New("waiting for rate limit")
+// IDFilter builds an "Id IN (...)" clause for a query, escaping the ids
+func IDFilter(ids []string) string {
+	quoted := make([]string, len(ids))
+	for i, id := range ids {
+		quoted[i] = "'" + strings.ReplaceAll(id, "'", "\\'") + "'"
 	}
-	endpointUrl, err := url.Parse(string(c.endpoint) + "/v3/company/" + realmID + "/")
+	return fmt.Sprintf("Id IN (%s)", strings.Join(quoted, ", "))
+}
+
+func (c *RealmClient) GetInvoicePDF(ctx context.Context, realmID string, invoiceId string) ([]byte, error) {
+	endpointUrl, err := url.Parse(string(c.client.endpoint) + "/v3/company/" + realmID + "/")
 	if err != nil {
 		return nil, errors.New("failed to parse API endpoint")
 	}
@@ -380,21 +337,17 @@ func (c *Client) GetInvoicePDF(realmID string, invoiceId string) ([]byte, error)
 	endpointUrl.Path += "invoice/" + invoiceId + "/pdf"
 
 	urlValues := url.Values{}
-	urlValues.Set("minorversion", c.minorVersion)
+	urlValues.Set("minorversion", c.client.minorVersion)
 	urlValues.Encode()
 	endpointUrl.RawQuery = urlValues.Encode()
 
-	var marshalledJson []byte
-
-	req, err := http.NewRequest("GET", endpointUrl.String(), bytes.NewBuffer(marshalledJson))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %v", err)
-	}
-
-	// req.Header.Add("Accept", "application/json")
-	req.Header.Add("Content-Type", "application/pdf")
+	ctx, cancel := c.client.withTimeout(ctx)
+	defer cancel()
+	header := http.Header{}
+	// header.Add("Accept", "application/json")
+	header.Add("Content-Type", "application/pdf")
 
-	resp, err := c.Client.Do(req)
+	resp, err := c.do(ctx, realmID, "GET", endpointUrl.String(), nil, header)
 	if err != nil {
 		return nil, fmt.Errorf("failed to make request: %v", err)
 	}
@@ -402,13 +355,15 @@ func (c *Client) GetInvoicePDF(realmID string, invoiceId string) ([]byte, error)
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New("failed to get pdf")
+		return nil, c.failure(realmID, resp)
 	}
 
 	// Take "%PDF-1.4\r\n...\r\n%%EOF" object and return it as content-type: application/pdf
 	return io.ReadAll(resp.Body)
 }
 
+// CheckInvoiceStatus decodes the status that used to be stored in the first 8 characters of the
+// DocNumber. Statuses live in postgres now, this is only used to backfill invoices created before that.
 func CheckInvoiceStatus(invoice *Invoice) int {
 	if invoice.DocNumber == "" {
 		return 0
@@ -433,28 +388,3 @@ func CheckInvoiceStatus(invoice *Invoice) int {
 		return 0
 	}
 }
-
-func ChangeInvoiceStatus(docNumber string, status int) string {
-	if docNumber == "" {
-		return ""
-	}
-	if len(docNumber) != 21 {
-		return ""
-	}
-	switch status {
-	case INVOICE_DRAFT:
-		return "A1000000-" + docNumber[9:]
-	case INVOICE_PENDING:
-		return "A0100000-" + docNumber[9:]
-	case INVOICE_APPROVED:
-		return "A0010000-" + docNumber[9:]
-	case INVOICE_REVISION:
-		return "A0001000-" + docNumber[9:]
-	case INVOICE_VOID:
-		return "A0000100-" + docNumber[9:]
-	case INVOICE_COMPLETE:
-		return "A0000010-" + docNumber[9:]
-	default:
-		return ""
-	}
-}
@@ -0,0 +1,11 @@
+package quickbooks
+
+import "testing"
+
+func TestIDFilter(t *testing.T) {
+	got := IDFilter([]string{"7", "8') OR Id IN ('9"})
+	want := `Id IN ('7', '8\') OR Id IN (\'9')`
+	if got != want {
+		t.Errorf("IDFilter = %s, want %s", got, want)
+	}
+}
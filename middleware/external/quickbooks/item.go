@@ -4,6 +4,7 @@
 package quickbooks
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 )
@@ -39,20 +40,20 @@ type Item struct {
 }
 
 // FindItemById returns an item with a given Id.
-func (c *Client) FindItemById(realmId string, id string) (*Item, error) {
+func (c *RealmClient) FindItemById(ctx context.Context, realmId string, id string) (*Item, error) {
 	var resp struct {
 		Item Item
 		Time Date
 	}
 
-	if err := c.get(realmId, "item/"+id, &resp, nil); err != nil {
+	if err := c.get(ctx, realmId, "item/"+id, &resp, nil); err != nil {
 		return nil, err
 	}
 
 	return &resp.Item, nil
 }
 
-func (c *Client) QueryItemsCount(realmID string, searchQuery string) (int, error) {
+func (c *RealmClient) QueryItemsCount(ctx context.Context, realmID string, searchQuery string) (int, error) {
 	var resp struct {
 		QueryResponse struct {
 			TotalCount int `json:"totalCount"`
@@ -60,7 +61,7 @@ func (c *Client) QueryItemsCount(realmID string, searchQuery string) (int, error
 	}
 
 	query := fmt.Sprintf("SELECT COUNT(*) FROM Item WHERE Type='Inventory' AND %s", searchQuery)
-	if err := c.query(realmID, query, &resp); err != nil {
+	if err := c.query(ctx, realmID, query, &resp); err != nil {
 		return 0, err
 	}
 
@@ -68,7 +69,7 @@ func (c *Client) QueryItemsCount(realmID string, searchQuery string) (int, error
 }
 
 // QueryCustomers accepts an SQL query and returns all customers found using it
-func (c *Client) QueryItems(realmID string, orderBy string, pageSize string, pageToken string, searchQuery string) ([]Item, error) {
+func (c *RealmClient) QueryItems(ctx context.Context, realmID string, orderBy string, pageSize string, pageToken string, searchQuery string) ([]Item, error) {
 	var resp struct {
 		QueryResponse struct {
 			Items         []Item `json:"Item"`
@@ -82,7 +83,7 @@ func (c *Client) QueryItems(realmID string, orderBy string, pageSize string, pag
 	// Disabling inventory only for now since it requires plus and advanced plans https://qbo.intuit.com/app/obillupgrade?product=QBO
 	// query := fmt.Sprintf("SELECT * FROM Item WHERE Type='Inventory' AND %s orderBy %s MAXRESULTS %s STARTPOSITION %s", searchQuery, orderBy, pageSize, pageToken)
 	query := fmt.Sprintf("SELECT * FROM Item WHERE %s orderBy %s MAXRESULTS %s STARTPOSITION %s", searchQuery, orderBy, pageSize, pageToken)
-	if err := c.query(realmID, query, &resp); err != nil {
+	if err := c.query(ctx, realmID, query, &resp); err != nil {
 		return nil, err
 	}
 
@@ -92,3 +93,21 @@ func (c *Client) QueryItems(realmID string, orderBy string, pageSize string, pag
 
 	return resp.QueryResponse.Items, nil
 }
+
+// FindItemsByIds returns the items with the given Ids in one query. Ids that don't exist are left out.
+func (c *RealmClient) FindItemsByIds(ctx context.Context, realmID string, ids []string) ([]Item, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	var resp struct {
+		QueryResponse struct {
+			Items []Item `json:"Item"`
+		}
+	}
+
+	query := fmt.Sprintf("SELECT * FROM Item WHERE %s MAXRESULTS %d", IDFilter(ids), len(ids))
+	if err := c.query(ctx, realmID, query, &resp); err != nil {
+		return nil, err
+	}
+	return resp.QueryResponse.Items, nil
+}
@@ -0,0 +1,166 @@
+package quickbooks
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Intuit's documented limits for the accounting API, per realm
+// https://developer.intuit.com/app/developer/qbo/docs/learn/rest-api-features#limits-and-throttles
+const (
+	RealmRequestsPerMinute  = 500
+	RealmConcurrentRequests = 10
+)
+
+const (
+	// maxRetries is how many times a throttled or failed request is retried
+	maxRetries = 3
+	// retryBaseDelay is the first backoff, doubled on every retry
+	retryBaseDelay = 500 * time.Millisecond
+	// maxRetryAfter caps the wait asked for by a Retry-After header
+	maxRetryAfter = time.Minute
+)
+
+// RealmStats describes how a realm is doing against its rate limit
+type RealmStats struct {
+	Requests  int64 `json:"requests"`
+	Throttled int64 `json:"throttled"`
+	Retries   int64 `json:"retries"`
+	Waiting   int64 `json:"waiting"`
+	InFlight  int64 `json:"in_flight"`
+	// PausedUntil is set while QuickBooks asked us to back off
+	PausedUntil time.Time `json:"paused_until,omitempty"`
+}
+
+// realmLimiter queues requests to a realm so they stay under Intuit's limits
+type realmLimiter struct {
+	rate  *rate.Limiter
+	slots chan struct{}
+
+	mu          sync.Mutex
+	pausedUntil time.Time
+
+	requests  atomic.Int64
+	throttled atomic.Int64
+	retries   atomic.Int64
+	waiting   atomic.Int64
+}
+
+func newRealmLimiter() *realmLimiter {
+	return &realmLimiter{
+		rate:  rate.NewLimiter(rate.Every(time.Minute/RealmRequestsPerMinute), RealmConcurrentRequests),
+		slots: make(chan struct{}, RealmConcurrentRequests),
+	}
+}
+
+// acquire blocks until the request can be sent. Call release once the response has been read.
+func (l *realmLimiter) acquire(ctx context.Context) error {
+	l.waiting.Add(1)
+	defer l.waiting.Add(-1)
+
+	l.mu.Lock()
+	pause := time.Until(l.pausedUntil)
+	l.mu.Unlock()
+	if err := sleep(ctx, pause); err != nil {
+		return err
+	}
+	if err := l.rate.Wait(ctx); err != nil {
+		return err
+	}
+	select {
+	case l.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	l.requests.Add(1)
+	return nil
+}
+
+func (l *realmLimiter) release() {
+	<-l.slots
+}
+
+// pause holds back every request to the realm for d
+func (l *realmLimiter) pause(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until := time.Now().Add(d); until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+}
+
+func (l *realmLimiter) stats() RealmStats {
+	stats := RealmStats{
+		Requests:  l.requests.Load(),
+		Throttled: l.throttled.Load(),
+		Retries:   l.retries.Load(),
+		Waiting:   l.waiting.Load(),
+		InFlight:  int64(len(l.slots)),
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if time.Now().Before(l.pausedUntil) {
+		stats.PausedUntil = l.pausedUntil
+	}
+	return stats
+}
+
+func (c *Client) limiter(realmID string) *realmLimiter {
+	c.limitersMu.Lock()
+	defer c.limitersMu.Unlock()
+	l, ok := c.limiters[realmID]
+	if !ok {
+		l = newRealmLimiter()
+		c.limiters[realmID] = l
+	}
+	return l
+}
+
+// RateLimitStats returns the rate limit stats of a realm
+func (c *Client) RateLimitStats(realmID string) RealmStats {
+	return c.limiter(realmID).stats()
+}
+
+// backoff returns a jittered delay for the given retry, starting at 1
+func backoff(retry int) time.Duration {
+	d := retryBaseDelay << (retry - 1)
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryAfter reads the Retry-After header, which is either seconds or an HTTP date
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	header := resp.Header.Get("Retry-After")
+	if header == "" {
+		return 0, false
+	}
+	var d time.Duration
+	if seconds, err := strconv.Atoi(header); err == nil {
+		d = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(header); err == nil {
+		d = time.Until(date)
+	} else {
+		return 0, false
+	}
+	return min(max(d, 0), maxRetryAfter), true
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
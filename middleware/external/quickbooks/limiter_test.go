@@ -0,0 +1,62 @@
+package quickbooks
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestThrottledRequestIsRetriedAfterRetryAfter(t *testing.T) {
+	var calls atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"QueryResponse":{"totalCount":3}}`))
+	}))
+	defer srv.Close()
+
+	qbc := NewClientForEndpoint("id", "secret", "", EndpointUrl(srv.URL), &DiscoveryAPI{}, "75")
+	start := time.Now()
+	count, err := qbc.ForToken("token").QueryItemsCount(context.Background(), "1001", "Active = true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("got count %d, want 3", count)
+	}
+	if waited := time.Since(start); waited < time.Second {
+		t.Errorf("retried after %s, Retry-After asked for 1s", waited)
+	}
+
+	stats := qbc.RateLimitStats("1001")
+	if stats.Requests != 2 || stats.Throttled != 1 || stats.Retries != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if other := qbc.RateLimitStats("1002"); other.Requests != 0 {
+		t.Errorf("another realm was affected: %+v", other)
+	}
+}
+
+func TestFailedPostIsNotRetried(t *testing.T) {
+	var calls atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	qbc := NewClientForEndpoint("id", "secret", "", EndpointUrl(srv.URL), &DiscoveryAPI{}, "75")
+	_, err := qbc.ForToken("token").UpdateInvoice(context.Background(), "1001", &Invoice{Id: "1"})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("POST was sent %d times", n)
+	}
+}
@@ -10,8 +10,6 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
-
-	"golang.org/x/oauth2"
 )
 
 type BearerToken struct {
@@ -25,12 +23,14 @@ type BearerToken struct {
 
 // RefreshToken
 // Call the refresh endpoint to generate new tokens
-func (c *Client) RefreshToken(refreshToken string) (*BearerToken, error) {
+func (c *Client) RefreshToken(ctx context.Context, refreshToken string) (*BearerToken, error) {
 	urlValues := url.Values{}
 	urlValues.Set("grant_type", "refresh_token")
 	urlValues.Set("refresh_token", refreshToken)
 
-	req, err := http.NewRequest("POST", c.discoveryAPI.TokenEndpoint, bytes.NewBufferString(urlValues.Encode()))
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", c.discoveryAPI.TokenEndpoint, bytes.NewBufferString(urlValues.Encode()))
 	if err != nil {
 		return nil, err
 	}
@@ -39,7 +39,7 @@ func (c *Client) RefreshToken(refreshToken string) (*BearerToken, error) {
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	req.Header.Set("Authorization", "Basic "+basicAuth(c))
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -55,16 +55,13 @@ func (c *Client) RefreshToken(refreshToken string) (*BearerToken, error) {
 		return nil, errors.New(string(body))
 	}
 
-	bearerTokenResponse, err := getBearerTokenResponse(body)
-	c.Client = getHttpClient(bearerTokenResponse)
-
-	return bearerTokenResponse, err
+	return getBearerTokenResponse(body)
 }
 
 // RetrieveBearerToken
 // Method to retrieve access token (bearer token).
 // This method can only be called once
-func (c *Client) RetrieveBearerToken(authorizationCode string) (*BearerToken, error) {
+func (c *Client) RetrieveBearerToken(ctx context.Context, authorizationCode string) (*BearerToken, error) {
 	urlValues := url.Values{}
 	urlValues.Set("grant_type", "authorization_code")
 	urlValues.Set("code", authorizationCode)
@@ -72,7 +69,9 @@ func (c *Client) RetrieveBearerToken(authorizationCode string) (*BearerToken, er
 	// urlValues.Set("client_id", c.clientID)
 	// urlValues.Set("client_secret", c.clientSecret)
 
-	req, err := http.NewRequest("POST", c.discoveryAPI.TokenEndpoint, bytes.NewBufferString(urlValues.Encode()))
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", c.discoveryAPI.TokenEndpoint, bytes.NewBufferString(urlValues.Encode()))
 	if err != nil {
 		return nil, err
 	}
@@ -81,7 +80,7 @@ func (c *Client) RetrieveBearerToken(authorizationCode string) (*BearerToken, er
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	req.Header.Set("Authorization", "Basic "+basicAuth(c))
 
-	// Use http.DefaultClient instead of creating a new client
+	// Use the shared http client instead of creating a new one
 	// Log the request in a curl-like format
 	// curlCommand := "curl -X POST " + c.discoveryAPI.TokenEndpoint +
 	// 	" -H 'Accept: */*'" +
@@ -89,7 +88,7 @@ func (c *Client) RetrieveBearerToken(authorizationCode string) (*BearerToken, er
 	// 	" -d '" + urlValues.Encode() + "'"
 	// log.Println("Executing request:", curlCommand)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -109,12 +108,13 @@ func (c *Client) RetrieveBearerToken(authorizationCode string) (*BearerToken, er
 
 // RevokeToken
 // Call the revoke endpoint to revoke tokens
-func (c *Client) RevokeToken(refreshToken string) error {
-	client := &http.Client{}
+func (c *Client) RevokeToken(ctx context.Context, refreshToken string) error {
 	urlValues := url.Values{}
 	urlValues.Add("token", refreshToken)
 
-	req, err := http.NewRequest("POST", c.discoveryAPI.RevocationEndpoint, bytes.NewBufferString(urlValues.Encode()))
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", c.discoveryAPI.RevocationEndpoint, bytes.NewBufferString(urlValues.Encode()))
 	if err != nil {
 		return err
 	}
@@ -123,7 +123,7 @@ func (c *Client) RevokeToken(refreshToken string) error {
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded;charset=UTF-8")
 	req.Header.Set("Authorization", "Basic "+basicAuth(c))
 
-	resp, err := client.Do(req)
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return err
 	}
@@ -139,8 +139,6 @@ func (c *Client) RevokeToken(refreshToken string) error {
 		return errors.New(string(body))
 	}
 
-	c.Client = nil
-
 	return nil
 }
 
@@ -157,12 +155,3 @@ func getBearerTokenResponse(body []byte) (*BearerToken, error) {
 
 	return &token, nil
 }
-
-func getHttpClient(bearerToken *BearerToken) *http.Client {
-	ctx := context.Background()
-	token := oauth2.Token{
-		AccessToken: bearerToken.AccessToken,
-		TokenType:   "Bearer",
-	}
-	return oauth2.NewClient(ctx, oauth2.StaticTokenSource(&token))
-}
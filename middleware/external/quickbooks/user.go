@@ -1,6 +1,7 @@
 package quickbooks
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"net/http"
@@ -16,16 +17,18 @@ type UserInfo struct {
 	PhoneNumberVerified bool   `json:"phoneNumberVerified"`
 }
 
-func (c *Client) GetUserInfo() (*UserInfo, error) {
+func (c *RealmClient) GetUserInfo(ctx context.Context) (*UserInfo, error) {
 	// Prepare the request
-	url := c.discoveryAPI.UserinfoEndpoint
-	req, err := http.NewRequest("GET", url, nil)
+	url := c.client.discoveryAPI.UserinfoEndpoint
+	ctx, cancel := c.client.withTimeout(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	// Send the request
-	resp, err := c.Client.Do(req)
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -1,6 +1,10 @@
 package config
 
-import "github.com/kelseyhightower/envconfig"
+import (
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+)
 
 type GCP struct {
 	ProjectID string `envconfig:"GOOGLE_PROJECT_ID"`
@@ -15,6 +19,8 @@ type DB struct {
 
 type Firebase struct {
 	APIKey string `envconfig:"FIREBASE_API_KEY"`
+	// Timeout for a single call to the Firebase REST API
+	Timeout time.Duration `envconfig:"FIREBASE_TIMEOUT" default:"10s"`
 }
 
 type Quickbooks struct {
@@ -23,6 +29,23 @@ type Quickbooks struct {
 	RedirectURI  string `envconfig:"QUICKBOOKS_REDIRECT_URI"`
 	IsProduction bool   `envconfig:"QUICKBOOKS_IS_PRODUCTION"`
 	MinorVersion string `envconfig:"QUICKBOOKS_MINOR_VERSION"`
+	// Timeout for a single call to the QuickBooks API
+	Timeout time.Duration `envconfig:"QUICKBOOKS_TIMEOUT" default:"30s"`
+}
+
+type Notify struct {
+	// TwilioFrom is the Twilio number SMS are sent from
+	TwilioFrom string `envconfig:"TWILIO_FROM_NUMBER"`
+	// TwilioAuthToken signs Twilio's webhooks. The REST client reads it from the environment itself.
+	TwilioAuthToken string `envconfig:"TWILIO_AUTH_TOKEN"`
+	// TwilioWebhookURL is the public URL of the SMS webhook, as configured in Twilio. Signatures are
+	// checked against it, if empty it's rebuilt from the request.
+	TwilioWebhookURL string `envconfig:"TWILIO_WEBHOOK_URL"`
+	SendGridAPIKey   string `envconfig:"SENDGRID_API_KEY"`
+	// EmailFrom is the address emails are sent from
+	EmailFrom string `envconfig:"NOTIFY_EMAIL_FROM" default:"verification@ordrport.com"`
+	// AppURL is where the web app is served, links in notifications point there
+	AppURL string `envconfig:"APP_URL" default:"https://ordrport.com"`
 }
 
 // Config holds start up config information
@@ -31,6 +54,7 @@ type Config struct {
 	DB
 	Firebase
 	Quickbooks
+	Notify
 	Env      string `envconfig:"ENV"`
 	Port     string `envconfig:"PORT"`
 	LogDebug bool   `envconfig:"LOG_DEBUG" default:"false"`
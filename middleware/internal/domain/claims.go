@@ -1,19 +1,77 @@
 package domain
 
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
 type Claims struct {
-	QBCompanyID   string `json:"qb_company_id"`
-	QBCustomerID  string `json:"qb_customer_id"` // 0 if franchiser
-	QBBearerToken string `json:"qb_bearer_token"`
-	IsFranchiser  bool   `json:"is_franchiser"`
-	FirebaseID    string `json:"firebase_id"`
+	QBCompanyID  string `json:"qb_company_id"`
+	QBCustomerID string `json:"qb_customer_id"` // 0 if franchiser
+	IsFranchiser bool   `json:"is_franchiser"`
+	FirebaseID   string `json:"firebase_id"`
+	// Role is a staff role for franchisers and a location role for franchisees
+	Role Role `json:"role,omitempty"`
+}
+
+// Can reports whether the user's role has the permission, on the franchiser or franchisee side
+func (c Claims) Can(p Permission) bool {
+	if c.IsFranchiser {
+		return slices.Contains(staffPermissions[c.Role], p)
+	}
+	return slices.Contains(locationPermissions[c.Role], p)
 }
 
 func ClaimsToMap(claims Claims) map[string]interface{} {
 	return map[string]interface{}{
-		"qb_company_id":   claims.QBCompanyID,
-		"qb_customer_id":  claims.QBCustomerID,
-		"qb_bearer_token": claims.QBBearerToken,
-		"is_franchiser":   claims.IsFranchiser,
-		"firebase_id":     claims.FirebaseID,
+		"qb_company_id":  claims.QBCompanyID,
+		"qb_customer_id": claims.QBCustomerID,
+		"is_franchiser":  claims.IsFranchiser,
+		"firebase_id":    claims.FirebaseID,
+		"role":           string(claims.Role),
+	}
+}
+
+// ErrInvalidClaims is returned by ParseClaims for tokens that weren't minted with ClaimsToMap
+var ErrInvalidClaims = errors.New("invalid claims")
+
+// ParseClaims reads the claims ClaimsToMap put in a token back, checking each one's type. Tokens
+// minted before roles get the QuickBooks user's role, owner, or the location's only login's,
+// location admin.
+func ParseClaims(m map[string]interface{}) (Claims, error) {
+	var c Claims
+	var ok bool
+	if c.IsFranchiser, ok = m["is_franchiser"].(bool); !ok {
+		return Claims{}, fmt.Errorf("%w: is_franchiser is not a bool", ErrInvalidClaims)
+	}
+	for name, v := range map[string]*string{
+		"qb_company_id":  &c.QBCompanyID,
+		"qb_customer_id": &c.QBCustomerID,
+		"firebase_id":    &c.FirebaseID,
+	} {
+		if *v, ok = m[name].(string); !ok || *v == "" {
+			return Claims{}, fmt.Errorf("%w: %s is missing or not a string", ErrInvalidClaims, name)
+		}
+	}
+	if !c.IsFranchiser && c.QBCustomerID == "0" {
+		return Claims{}, fmt.Errorf("%w: franchisee without a customer", ErrInvalidClaims)
+	}
+
+	role, ok := m["role"].(string)
+	if m["role"] != nil && !ok {
+		return Claims{}, fmt.Errorf("%w: role is not a string", ErrInvalidClaims)
+	}
+	c.Role = Role(role)
+	switch {
+	case c.Role == "" && c.IsFranchiser:
+		c.Role = RoleOwner
+	case c.Role == "":
+		c.Role = RoleLocationAdmin
+	case c.IsFranchiser && !c.Role.IsStaff():
+		return Claims{}, fmt.Errorf("%w: %q is not a staff role", ErrInvalidClaims, role)
+	case !c.IsFranchiser && !c.Role.IsLocation():
+		return Claims{}, fmt.Errorf("%w: %q is not a location role", ErrInvalidClaims, role)
 	}
+	return c, nil
 }
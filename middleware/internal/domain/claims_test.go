@@ -0,0 +1,83 @@
+package domain
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestParseClaims(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+		want  Claims
+		err   bool
+	}{
+		{"franchiser", `{"qb_company_id":"1001","qb_customer_id":"0","is_franchiser":true,"firebase_id":"u1","role":"approver"}`,
+			Claims{QBCompanyID: "1001", QBCustomerID: "0", IsFranchiser: true, FirebaseID: "u1", Role: RoleApprover}, false},
+		{"franchisee", `{"qb_company_id":"1001","qb_customer_id":"58","is_franchiser":false,"firebase_id":"u2","role":"orderer"}`,
+			Claims{QBCompanyID: "1001", QBCustomerID: "58", FirebaseID: "u2", Role: RoleOrderer}, false},
+		{"franchiser from before roles", `{"qb_company_id":"1001","qb_customer_id":"0","is_franchiser":true,"firebase_id":"u1"}`,
+			Claims{QBCompanyID: "1001", QBCustomerID: "0", IsFranchiser: true, FirebaseID: "u1", Role: RoleOwner}, false},
+		{"franchisee from before roles", `{"qb_company_id":"1001","qb_customer_id":"58","is_franchiser":false,"firebase_id":"u2","role":""}`,
+			Claims{QBCompanyID: "1001", QBCustomerID: "58", FirebaseID: "u2", Role: RoleLocationAdmin}, false},
+		{"not a custom token", `{"email":"a@b.c"}`, Claims{}, true},
+		{"is_franchiser as a string", `{"qb_company_id":"1001","qb_customer_id":"0","is_franchiser":"true","firebase_id":"u1"}`, Claims{}, true},
+		{"company as a number", `{"qb_company_id":1001,"qb_customer_id":"0","is_franchiser":true,"firebase_id":"u1"}`, Claims{}, true},
+		{"missing firebase id", `{"qb_company_id":"1001","qb_customer_id":"0","is_franchiser":true}`, Claims{}, true},
+		{"franchisee without customer", `{"qb_company_id":"1001","qb_customer_id":"0","is_franchiser":false,"firebase_id":"u2"}`, Claims{}, true},
+		{"franchisee with staff role", `{"qb_company_id":"1001","qb_customer_id":"58","is_franchiser":false,"firebase_id":"u2","role":"owner"}`, Claims{}, true},
+		{"franchiser with location role", `{"qb_company_id":"1001","qb_customer_id":"0","is_franchiser":true,"firebase_id":"u1","role":"orderer"}`, Claims{}, true},
+		{"role as a list", `{"qb_company_id":"1001","qb_customer_id":"0","is_franchiser":true,"firebase_id":"u1","role":["owner"]}`, Claims{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m map[string]interface{}
+			if err := json.Unmarshal([]byte(tt.token), &m); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ParseClaims(m)
+			if tt.err {
+				if !errors.Is(err, ErrInvalidClaims) {
+					t.Errorf("err = %v, want ErrInvalidClaims", err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("ParseClaims = %+v, %v, want %+v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// Whatever is in a token, parsing it returns claims that can be minted again or an ErrInvalidClaims,
+// never a panic
+func FuzzParseClaims(f *testing.F) {
+	f.Add(`{"qb_company_id":"1001","qb_customer_id":"0","is_franchiser":true,"firebase_id":"u1","role":"owner"}`)
+	f.Add(`{"qb_company_id":"1001","qb_customer_id":"58","is_franchiser":false,"firebase_id":"u2"}`)
+	f.Add(`{"qb_company_id":null,"qb_customer_id":58,"is_franchiser":1,"role":{}}`)
+	f.Add(`{}`)
+	f.Fuzz(func(t *testing.T, token string) {
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(token), &m); err != nil {
+			return
+		}
+		claims, err := ParseClaims(m)
+		if err != nil {
+			if !errors.Is(err, ErrInvalidClaims) {
+				t.Fatalf("err = %v, want ErrInvalidClaims", err)
+			}
+			return
+		}
+		if claims.QBCompanyID == "" || claims.FirebaseID == "" {
+			t.Fatalf("parsed claims without a company or user: %+v", claims)
+		}
+		if claims.IsFranchiser && !claims.Role.IsStaff() || !claims.IsFranchiser && !claims.Role.IsLocation() {
+			t.Fatalf("parsed claims with a role of the other side: %+v", claims)
+		}
+		again, err := ParseClaims(ClaimsToMap(claims))
+		if err != nil || again != claims {
+			t.Fatalf("minting %+v again parsed %+v, %v", claims, again, err)
+		}
+	})
+}
@@ -6,11 +6,18 @@ import (
 	qb "github.com/Vertisphere/backend-service/external/quickbooks"
 )
 
+// DBCustomer is a login of a franchisee location, a location can have many
 type DBCustomer struct {
 	QBCustomerID string    `json:"qb_customer_id" db:"qb_customer_id"`
 	QBCompanyID  string    `json:"qb_company_id" db:"qb_company_id"`
 	FirebaseID   string    `json:"firebase_id" db:"firebase_id"`
 	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+	Email        string    `json:"email" db:"email"`
+	Name         string    `json:"name" db:"name"`
+	// Role is one of the location roles
+	Role Role `json:"role" db:"role"`
+	// InvitedBy is the location admin that sent the invite, empty if the franchiser did
+	InvitedBy string `json:"invited_by,omitempty" db:"invited_by"`
 }
 
 type Customer struct {
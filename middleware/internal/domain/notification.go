@@ -0,0 +1,64 @@
+package domain
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type NotificationStatus string
+
+const (
+	// NotificationPending is waiting for its next attempt
+	NotificationPending NotificationStatus = "pending"
+	// NotificationSending has been claimed by a worker
+	NotificationSending NotificationStatus = "sending"
+	NotificationSent    NotificationStatus = "sent"
+	// NotificationDead ran out of attempts and is only retried by hand
+	NotificationDead NotificationStatus = "dead"
+)
+
+// Notification is a message in the outbox. It's written in the same transaction as whatever it's
+// about and delivered by a background worker.
+type Notification struct {
+	ID int64 `json:"id" db:"id"`
+	// IdempotencyKey makes sure the same thing is only queued once
+	IdempotencyKey string             `json:"idempotency_key" db:"idempotency_key"`
+	QBCompanyID    string             `json:"qb_company_id" db:"qb_company_id"`
+	EventType      string             `json:"event_type" db:"event_type"`
+	Payload        json.RawMessage    `json:"payload" db:"payload"`
+	Status         NotificationStatus `json:"status" db:"status"`
+	Attempts       int                `json:"attempts" db:"attempts"`
+	// Delivered lists who the notification already went out to on which channel, so retries skip them
+	Delivered     []string   `json:"delivered" db:"delivered"`
+	LastError     string     `json:"last_error,omitempty" db:"last_error"`
+	TraceID       string     `json:"trace_id" db:"trace_id"`
+	NextAttemptAt time.Time  `json:"next_attempt_at" db:"next_attempt_at"`
+	CreatedAt     time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at" db:"updated_at"`
+	SentAt        *time.Time `json:"sent_at,omitempty" db:"sent_at"`
+}
+
+// NotificationPreferences are how a user wants to hear about things. A user without preferences
+// gets everything on every channel.
+type NotificationPreferences struct {
+	FirebaseID string `json:"-" db:"firebase_id"`
+	// Channels turns whole channels (sms, email) on or off. Channels that aren't listed are on.
+	Channels map[string]bool `json:"channels" db:"channels"`
+	// Events turns channels on or off per event type, on top of Channels
+	Events map[string]map[string]bool `json:"events" db:"events"`
+	// QuietHours holds back SMS until they're over
+	QuietHours *QuietHours `json:"quiet_hours" db:"quiet_hours"`
+	// Phone and Email replace the ones looked up from firebase and QuickBooks
+	Phone     string    `json:"phone" db:"phone"`
+	Email     string    `json:"email" db:"email"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// QuietHours is a daily window in the user's time zone. It wraps around midnight if Start is after End.
+type QuietHours struct {
+	// Start and End are HH:MM
+	Start string `json:"start"`
+	End   string `json:"end"`
+	// TimeZone is an IANA name, e.g. America/Toronto
+	TimeZone string `json:"time_zone"`
+}
@@ -1,5 +1,7 @@
 package domain
 
+import "time"
+
 // type Order {
 // 	ID int
 
@@ -13,3 +15,126 @@ type Products []struct {
 	ProductID int `json:"product_id"`
 	Quantity  int `json:"quantity"`
 }
+
+// OrderStatus is where an order is in its lifecycle. It's stored in the orders table,
+// QuickBooks only knows about the invoice itself.
+type OrderStatus string
+
+const (
+	OrderDraft    OrderStatus = "draft"
+	OrderPending  OrderStatus = "pending"
+	OrderApproved OrderStatus = "approved"
+	OrderRevision OrderStatus = "revision"
+	OrderVoid     OrderStatus = "void"
+	OrderComplete OrderStatus = "complete"
+)
+
+// OrderStatusFromCode maps the single letter codes used by the statuses query param
+// (D, P, A, R, V, C) to a status. ok is false for unknown codes.
+func OrderStatusFromCode(code byte) (OrderStatus, bool) {
+	switch code {
+	case 'D':
+		return OrderDraft, true
+	case 'P':
+		return OrderPending, true
+	case 'A':
+		return OrderApproved, true
+	case 'R':
+		return OrderRevision, true
+	case 'V':
+		return OrderVoid, true
+	case 'C':
+		return OrderComplete, true
+	default:
+		return "", false
+	}
+}
+
+// Order links a QuickBooks invoice to the franchisee that placed it and tracks its status
+type Order struct {
+	QBCompanyID  string      `json:"qb_company_id" db:"qb_company_id"`
+	QBInvoiceID  string      `json:"qb_invoice_id" db:"qb_invoice_id"`
+	QBCustomerID string      `json:"qb_customer_id" db:"qb_customer_id"`
+	Status       OrderStatus `json:"status" db:"status"`
+	CreatedAt    time.Time   `json:"created_at" db:"created_at"`
+	UpdatedAt    time.Time   `json:"updated_at" db:"updated_at"`
+}
+
+// OrderEvent is one entry in an order's history. FromStatus is empty for the event that created the order.
+type OrderEvent struct {
+	ID              int64        `json:"id" db:"id"`
+	QBCompanyID     string       `json:"qb_company_id" db:"qb_company_id"`
+	QBInvoiceID     string       `json:"qb_invoice_id" db:"qb_invoice_id"`
+	ActorFirebaseID string       `json:"actor_firebase_id" db:"actor_firebase_id"`
+	ActorRole       string       `json:"actor_role" db:"actor_role"`
+	FromStatus      OrderStatus  `json:"from_status,omitempty" db:"from_status"`
+	ToStatus        OrderStatus  `json:"to_status" db:"to_status"`
+	TraceID         string       `json:"trace_id" db:"trace_id"`
+	Reason          string       `json:"reason,omitempty" db:"reason"`
+	Review          *OrderReview `json:"review,omitempty" db:"review"`
+	Changes         []LineChange `json:"changes,omitempty" db:"changes"`
+	CreatedAt       time.Time    `json:"created_at" db:"created_at"`
+	// Notifications are queued in the outbox along with the event
+	Notifications []Notification `json:"-" db:"-"`
+}
+
+// OrderReview is what a franchiser asked to change when sending an order back for revision.
+// The overall comment is the event's Reason.
+type OrderReview struct {
+	// Lines are the invoice lines as they were when reviewed
+	Lines    []OrderLine   `json:"lines"`
+	Comments []LineComment `json:"comments"`
+}
+
+// OrderLine is a snapshot of an invoice line
+type OrderLine struct {
+	LineID   string  `json:"line_id"`
+	ItemID   string  `json:"item_id"`
+	ItemName string  `json:"item_name"`
+	Quantity float64 `json:"quantity"`
+}
+
+// LineComment is a reviewer's comment on a single invoice line
+type LineComment struct {
+	LineID  string `json:"line_id"`
+	Comment string `json:"comment"`
+}
+
+// LineChange is how the quantity of an item changed between two versions of an order.
+// Before is 0 for added items and After is 0 for removed ones.
+type LineChange struct {
+	ItemID   string  `json:"item_id"`
+	ItemName string  `json:"item_name"`
+	Before   float64 `json:"before"`
+	After    float64 `json:"after"`
+}
+
+// DiffOrderLines returns the items whose quantity differs between the two versions,
+// in the order they first appear. Lines for the same item are added together.
+func DiffOrderLines(before []OrderLine, after []OrderLine) []LineChange {
+	changes := []LineChange{}
+	index := map[string]int{}
+	add := func(line OrderLine) *LineChange {
+		i, ok := index[line.ItemID]
+		if !ok {
+			i = len(changes)
+			index[line.ItemID] = i
+			changes = append(changes, LineChange{ItemID: line.ItemID, ItemName: line.ItemName})
+		}
+		return &changes[i]
+	}
+	for _, line := range before {
+		add(line).Before += line.Quantity
+	}
+	for _, line := range after {
+		add(line).After += line.Quantity
+	}
+
+	diff := changes[:0]
+	for _, change := range changes {
+		if change.Before != change.After {
+			diff = append(diff, change)
+		}
+	}
+	return diff
+}
@@ -0,0 +1,51 @@
+package domain
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// PriceList overrides the QuickBooks prices and catalog for one customer, or for every customer of a
+// QuickBooks customer type. Customer lists win over customer type lists.
+type PriceList struct {
+	ID          int64  `json:"id" db:"id"`
+	QBCompanyID string `json:"-" db:"qb_company_id"`
+	Name        string `json:"name" db:"name"`
+	// Only one of QBCustomerID and QBCustomerTypeID is set
+	QBCustomerID     string `json:"qb_customer_id,omitempty" db:"qb_customer_id"`
+	QBCustomerTypeID string `json:"qb_customer_type_id,omitempty" db:"qb_customer_type_id"`
+	// Restricted lists are catalogs: the customers they apply to can only order the items on them
+	Restricted bool `json:"restricted" db:"restricted"`
+	// The list applies from EffectiveFrom until just before EffectiveTo, nil for no limit
+	EffectiveFrom *time.Time      `json:"effective_from,omitempty" db:"effective_from"`
+	EffectiveTo   *time.Time      `json:"effective_to,omitempty" db:"effective_to"`
+	Items         []PriceListItem `json:"items" db:"-"`
+	CreatedAt     time.Time       `json:"created_at" db:"created_at"`
+	UpdatedAt     time.Time       `json:"updated_at" db:"updated_at"`
+}
+
+// PriceListItem is a price list's entry for one QuickBooks item
+type PriceListItem struct {
+	QBItemID string `json:"qb_item_id" db:"qb_item_id"`
+	// UnitPrice replaces the item's QuickBooks UnitPrice, empty to keep it
+	UnitPrice json.Number `json:"unit_price,omitempty" db:"unit_price"`
+	// Hidden items can't be ordered
+	Hidden bool `json:"hidden" db:"hidden"`
+}
+
+// QuantityRule limits how many of an item can be ordered at once. A rule for a customer replaces the
+// item's rule for everyone else. Limits that are empty aren't checked.
+type QuantityRule struct {
+	ID          int64  `json:"id" db:"id"`
+	QBCompanyID string `json:"-" db:"qb_company_id"`
+	QBItemID    string `json:"qb_item_id" db:"qb_item_id"`
+	// QBCustomerID is empty for the rule that applies to every customer
+	QBCustomerID string      `json:"qb_customer_id,omitempty" db:"qb_customer_id"`
+	MinQty       json.Number `json:"min_qty,omitempty" db:"min_qty"`
+	// PackMultiple is the pack size, e.g. 12 for cases of 12
+	PackMultiple json.Number `json:"pack_multiple,omitempty" db:"pack_multiple"`
+	MaxQty       json.Number `json:"max_qty,omitempty" db:"max_qty"`
+	// AllowDecimal allows quantities like 1.5, e.g. for items sold by weight
+	AllowDecimal bool      `json:"allow_decimal" db:"allow_decimal"`
+	UpdatedAt    time.Time `json:"updated_at" db:"updated_at"`
+}
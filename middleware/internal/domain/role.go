@@ -0,0 +1,73 @@
+package domain
+
+// Role is what a user is allowed to do. Franchiser staff are an owner, approver, fulfillment or
+// viewer. Franchisee logins are a location admin, orderer or viewer of their location.
+type Role string
+
+const (
+	// RoleOwner can do everything, including managing the other staff users
+	RoleOwner Role = "owner"
+	// RoleApprover reviews orders: approves them, sends them back or asks for a revision
+	RoleApprover Role = "approver"
+	// RoleFulfillment marks approved orders as ready
+	RoleFulfillment Role = "fulfillment"
+	// RoleViewer can only look
+	RoleViewer Role = "viewer"
+
+	// RoleLocationAdmin orders and manages the other logins of their location
+	RoleLocationAdmin Role = "location_admin"
+	// RoleOrderer places and edits the location's orders
+	RoleOrderer Role = "orderer"
+)
+
+// Permission is something a user may need to be allowed to do. Anything that only reads is allowed
+// for every user of the company or location.
+type Permission string
+
+const (
+	// ReviewOrders is approving pending orders, sending them back and asking for revisions
+	ReviewOrders Permission = "review_orders"
+	// FulfillOrders is marking approved orders as ready
+	FulfillOrders Permission = "fulfill_orders"
+	// ManageCatalog is editing price lists, quantity rules and the order schedule
+	ManageCatalog Permission = "manage_catalog"
+	// ManageCustomers is inviting and removing franchisee logins
+	ManageCustomers Permission = "manage_customers"
+	// ManageNotifications is retrying notifications that couldn't be delivered
+	ManageNotifications Permission = "manage_notifications"
+	// ManageStaff is inviting and removing staff users and changing their roles
+	ManageStaff Permission = "manage_staff"
+	// ManageCompany is disconnecting the company from QuickBooks and signing all its users out
+	ManageCompany Permission = "manage_company"
+
+	// PlaceOrders is creating, editing, publishing and voiding the location's orders, standing orders
+	// and templates
+	PlaceOrders Permission = "place_orders"
+	// ManageLocationUsers is inviting and removing the other logins of the location
+	ManageLocationUsers Permission = "manage_location_users"
+)
+
+var staffPermissions = map[Role][]Permission{
+	RoleOwner:       {ReviewOrders, FulfillOrders, ManageCatalog, ManageCustomers, ManageNotifications, ManageStaff, ManageCompany},
+	RoleApprover:    {ReviewOrders},
+	RoleFulfillment: {FulfillOrders},
+	RoleViewer:      {},
+}
+
+var locationPermissions = map[Role][]Permission{
+	RoleLocationAdmin: {PlaceOrders, ManageLocationUsers},
+	RoleOrderer:       {PlaceOrders},
+	RoleViewer:        {},
+}
+
+// IsStaff reports whether the role is one of the franchiser staff roles
+func (r Role) IsStaff() bool {
+	_, ok := staffPermissions[r]
+	return ok
+}
+
+// IsLocation reports whether the role is one of the franchisee location roles
+func (r Role) IsLocation() bool {
+	_, ok := locationPermissions[r]
+	return ok
+}
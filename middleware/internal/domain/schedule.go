@@ -0,0 +1,41 @@
+package domain
+
+import "time"
+
+// AfterCutoff is what happens to an order published after its slot's cutoff
+type AfterCutoff string
+
+const (
+	// CutoffBlock rejects the order, the franchisee has to pick a later slot
+	CutoffBlock AfterCutoff = "block"
+	// CutoffNextSlot moves the order to the next open slot of the same kind
+	CutoffNextSlot AfterCutoff = "next_slot"
+)
+
+// OrderSchedule is when a company's franchisees can pick up or get deliveries, and how long before
+// that they have to order. Companies without windows take orders at any time.
+type OrderSchedule struct {
+	QBCompanyID string `json:"-" db:"qb_company_id"`
+	// TimeZone is an IANA time zone, e.g. America/Toronto. Windows, cutoffs and blackout dates are in it.
+	TimeZone    string        `json:"time_zone" db:"time_zone"`
+	AfterCutoff AfterCutoff   `json:"after_cutoff" db:"after_cutoff"`
+	Windows     []OrderWindow `json:"windows" db:"windows"`
+	// BlackoutDates are days without any windows, as YYYY-MM-DD
+	BlackoutDates []string  `json:"blackout_dates" db:"blackout_dates"`
+	UpdatedAt     time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// OrderWindow is a weekly pickup or delivery window
+type OrderWindow struct {
+	// Kind is pickup or delivery
+	Kind string `json:"kind"`
+	// Weekday is the lowercase English name of the day, e.g. tuesday
+	Weekday string `json:"weekday"`
+	// Start and End are HH:MM
+	Start string `json:"start"`
+	End   string `json:"end"`
+	// Orders close CutoffDays before the window at CutoffTime (HH:MM), e.g. 2 and 17:00 for a
+	// tuesday window closes on sunday at 5pm. Without CutoffTime orders close when the window starts.
+	CutoffDays int    `json:"cutoff_days"`
+	CutoffTime string `json:"cutoff_time,omitempty"`
+}
@@ -0,0 +1,17 @@
+package domain
+
+import "time"
+
+// CompanyUser is a staff user of a franchiser company. The user that connected the company to
+// QuickBooks is always an owner, the others are invited by email.
+type CompanyUser struct {
+	FirebaseID  string `json:"firebase_id" db:"firebase_id"`
+	QBCompanyID string `json:"-" db:"qb_company_id"`
+	Email       string `json:"email" db:"email"`
+	Name        string `json:"name" db:"name"`
+	Role        Role   `json:"role" db:"role"`
+	// InvitedBy is the staff user that sent the invite, empty for the QuickBooks user
+	InvitedBy string    `json:"invited_by,omitempty" db:"invited_by"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
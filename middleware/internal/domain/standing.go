@@ -0,0 +1,63 @@
+package domain
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// StandingOrder is an order a franchisee places again and again, e.g. the same bread every monday. The
+// scheduler creates a draft order with its lines on every occurrence of RRule and publishes it if
+// AutoPublish is set.
+type StandingOrder struct {
+	ID           int64          `json:"id" db:"id"`
+	QBCompanyID  string         `json:"-" db:"qb_company_id"`
+	QBCustomerID string         `json:"qb_customer_id" db:"qb_customer_id"`
+	Name         string         `json:"name" db:"name"`
+	Lines        []ItemQuantity `json:"lines" db:"lines"`
+	// RRule is when orders are placed, e.g. FREQ=WEEKLY;BYDAY=MO;BYHOUR=6. See schedule.ParseRRule.
+	RRule string `json:"rrule" db:"rrule"`
+	// TimeZone is the IANA time zone the rule is in
+	TimeZone string `json:"time_zone" db:"time_zone"`
+	// StartsAt is the first time an order can be placed, its time of day is used if the rule has none
+	StartsAt    time.Time `json:"starts_at" db:"starts_at"`
+	AutoPublish bool      `json:"auto_publish" db:"auto_publish"`
+	Paused      bool      `json:"paused" db:"paused"`
+	// NextRunAt is the next occurrence, nil when the order is paused or has no more
+	NextRunAt *time.Time `json:"next_run_at" db:"next_run_at"`
+	// CreatedBy is the franchisee user the orders are placed as
+	CreatedBy string    `json:"-" db:"created_by"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// ItemQuantity is an item and how many of it to order, a line of a standing order or order template
+type ItemQuantity struct {
+	ItemID   string      `json:"item_id"`
+	Quantity json.Number `json:"quantity"`
+}
+
+type StandingOrderRunStatus string
+
+const (
+	// RunSkipped occurrences were skipped by the franchisee ahead of time
+	RunSkipped StandingOrderRunStatus = "skipped"
+	// RunPending occurrences are being placed
+	RunPending   StandingOrderRunStatus = "pending"
+	RunCreated   StandingOrderRunStatus = "created"
+	RunPublished StandingOrderRunStatus = "published"
+	RunFailed    StandingOrderRunStatus = "failed"
+	// RunMissed occurrences were too far in the past when the scheduler got to them, e.g. after an outage
+	RunMissed StandingOrderRunStatus = "missed"
+)
+
+// StandingOrderRun is what happened on one occurrence of a standing order
+type StandingOrderRun struct {
+	ID              int64                  `json:"id" db:"id"`
+	StandingOrderID int64                  `json:"standing_order_id" db:"standing_order_id"`
+	Occurrence      time.Time              `json:"occurrence" db:"occurrence"`
+	Status          StandingOrderRunStatus `json:"status" db:"status"`
+	QBInvoiceID     string                 `json:"qb_invoice_id,omitempty" db:"qb_invoice_id"`
+	Error           string                 `json:"error,omitempty" db:"error"`
+	CreatedAt       time.Time              `json:"created_at" db:"created_at"`
+	UpdatedAt       time.Time              `json:"updated_at" db:"updated_at"`
+}
@@ -0,0 +1,22 @@
+package domain
+
+import "time"
+
+// OrderTemplate is a named list of items a franchisee orders now and then, e.g. "Weekend prep"
+type OrderTemplate struct {
+	ID           int64          `json:"id" db:"id"`
+	QBCompanyID  string         `json:"-" db:"qb_company_id"`
+	QBCustomerID string         `json:"qb_customer_id" db:"qb_customer_id"`
+	Name         string         `json:"name" db:"name"`
+	Lines        []ItemQuantity `json:"lines" db:"lines"`
+	CreatedAt    time.Time      `json:"created_at" db:"created_at"`
+	UpdatedAt    time.Time      `json:"updated_at" db:"updated_at"`
+}
+
+// FavoriteItem is an item a franchisee starred so they can find it quickly
+type FavoriteItem struct {
+	QBCompanyID  string    `json:"-" db:"qb_company_id"`
+	QBCustomerID string    `json:"-" db:"qb_customer_id"`
+	QBItemID     string    `json:"qb_item_id" db:"qb_item_id"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+}
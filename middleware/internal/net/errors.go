@@ -0,0 +1,179 @@
+package net
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Error is an error with the response the client should get for it. Handlers return them and handle
+// renders them as RFC 7807 problem details, anything else becomes a 500.
+type Error struct {
+	// Status is the HTTP status of the response
+	Status int
+	// Code is a short machine readable code, e.g. "forbidden"
+	Code string
+	// Message is shown to the client as the problem detail
+	Message string
+	// Fields lists which fields of the request were invalid
+	Fields []FieldError
+	// Extensions are added to the problem as extra members
+	Extensions map[string]any
+	// Err is the cause. It's logged but never sent to the client.
+	Err error
+}
+
+// FieldError describes a problem with one field of the request
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func badRequest(msg string, err error, fields ...FieldError) *Error {
+	return &Error{Status: http.StatusBadRequest, Code: "invalid_request", Message: msg, Fields: fields, Err: err}
+}
+
+func unauthorized(msg string, err error) *Error {
+	return &Error{Status: http.StatusUnauthorized, Code: "unauthorized", Message: msg, Err: err}
+}
+
+func forbidden(err error) *Error {
+	return &Error{Status: http.StatusForbidden, Code: "forbidden", Message: "No Access", Err: err}
+}
+
+func notFound(msg string, err error) *Error {
+	return &Error{Status: http.StatusNotFound, Code: "not_found", Message: msg, Err: err}
+}
+
+func conflict(code string, msg string, err error) *Error {
+	return &Error{Status: http.StatusConflict, Code: code, Message: msg, Err: err}
+}
+
+// unprocessable is for requests that are well formed but break a business rule, e.g. ordering an item
+// that isn't in the customer's catalog
+func unprocessable(code string, msg string, fields ...FieldError) *Error {
+	return &Error{Status: http.StatusUnprocessableEntity, Code: code, Message: msg, Fields: fields}
+}
+
+func internalError(msg string, err error) *Error {
+	return &Error{Status: http.StatusInternalServerError, Code: "internal", Message: msg, Err: err}
+}
+
+// handlerFunc is a handler that returns its error instead of writing it
+type handlerFunc func(w http.ResponseWriter, r *http.Request) error
+
+// handle adapts a handlerFunc to an http.HandlerFunc, writing and logging the error it returns
+func handle(h handlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rw := &responseWriter{ResponseWriter: w}
+		if err := h(rw, r); err != nil {
+			writeError(rw, r, err)
+		}
+	}
+}
+
+// responseWriter remembers whether the response was started, since an error can't be written after that
+type responseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+// problem is an RFC 7807 problem details object
+type problem struct {
+	Type     string       `json:"type"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Detail   string       `json:"detail,omitempty"`
+	Instance string       `json:"instance,omitempty"`
+	Code     string       `json:"code"`
+	TraceID  string       `json:"trace_id,omitempty"`
+	Fields   []FieldError `json:"fields,omitempty"`
+}
+
+// writeError logs err and writes it as a problem+json response. Errors that aren't an *Error become a 500.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var appErr *Error
+	if !errors.As(err, &appErr) {
+		appErr = internalError("Internal server error", err)
+	}
+
+	level := zerolog.WarnLevel
+	if appErr.Status >= http.StatusInternalServerError {
+		level = zerolog.ErrorLevel
+	}
+	log.WithLevel(level).
+		Err(appErr.Err).
+		Str("traceID", traceID(r.Context())).
+		Str("method", r.Method).
+		Str("path", r.URL.Path).
+		Int("status", appErr.Status).
+		Str("code", appErr.Code).
+		Msg(appErr.Message)
+
+	if rw, ok := w.(*responseWriter); ok && rw.wroteHeader {
+		return
+	}
+
+	body, err := json.Marshal(problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(appErr.Status),
+		Status:   appErr.Status,
+		Detail:   appErr.Message,
+		Instance: r.URL.Path,
+		Code:     appErr.Code,
+		TraceID:  traceID(r.Context()),
+		Fields:   appErr.Fields,
+	})
+	if err == nil && len(appErr.Extensions) > 0 {
+		body, err = withExtensions(body, appErr.Extensions)
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Could not encode problem")
+		http.Error(w, appErr.Message, appErr.Status)
+		return
+	}
+	if appErr.Status == http.StatusTooManyRequests {
+		w.Header().Set("Retry-After", "60")
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(appErr.Status)
+	w.Write(append(body, '\n'))
+}
+
+// withExtensions adds extension members to an encoded problem, without overwriting the standard ones
+func withExtensions(body []byte, extensions map[string]any) ([]byte, error) {
+	members := map[string]any{}
+	if err := json.Unmarshal(body, &members); err != nil {
+		return nil, err
+	}
+	for k, v := range extensions {
+		if _, ok := members[k]; !ok {
+			members[k] = v
+		}
+	}
+	return json.Marshal(members)
+}
@@ -0,0 +1,106 @@
+package net
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	qb "github.com/Vertisphere/backend-service/external/quickbooks"
+	"github.com/Vertisphere/backend-service/internal/domain"
+	"github.com/Vertisphere/backend-service/internal/orderstate"
+	"github.com/Vertisphere/backend-service/internal/qbtoken"
+	"github.com/Vertisphere/backend-service/internal/storage"
+)
+
+func TestHandlerErrorsAreProblems(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"Fault":{"Error":[{"Message":"Stale Object Error","Detail":"Stale Object Error : You and root were working on this at the same time.","code":"5010"}],"type":"ValidationFault"}}`))
+	}))
+	defer srv.Close()
+	qbc := qb.NewClientForEndpoint("id", "secret", "", qb.EndpointUrl(srv.URL), &qb.DiscoveryAPI{}, "75")
+	tokens := qbtoken.NewManager(tokenStore{}, noRefresh{})
+
+	tests := []struct {
+		name       string
+		handler    http.Handler
+		franchiser bool
+		status     int
+		code       string
+	}{
+		{"franchisee listing customers", newRouter(nil, nil, nil).enforce(franchisers, ListQBCustomers(qbc, tokens, nil)), false, http.StatusForbidden, "forbidden"},
+		{"stale invoice", GetQBInvoice(qbc, tokens, nil), true, http.StatusConflict, "quickbooks_stale_object"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/qbInvoice/1", nil)
+			req.SetPathValue("id", "1")
+			claims := domain.Claims{QBCompanyID: "1001", QBCustomerID: "1", IsFranchiser: tt.franchiser}
+			ctx := ContextWithClaims(req.Context(), claims)
+			ctx = context.WithValue(ctx, traceIDKey, "trace-1")
+			rec := httptest.NewRecorder()
+			tt.handler.ServeHTTP(rec, req.WithContext(ctx))
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if got := rec.Header().Get("Content-Type"); got != "application/problem+json" {
+				t.Errorf("content type = %q", got)
+			}
+			var p problem
+			if err := json.NewDecoder(rec.Body).Decode(&p); err != nil {
+				t.Fatal(err)
+			}
+			if p.Status != tt.status || p.Code != tt.code || p.TraceID != "trace-1" || p.Title != http.StatusText(tt.status) {
+				t.Errorf("got problem %+v", p)
+			}
+		})
+	}
+}
+
+func TestTransitionErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+		want   map[string]any
+	}{
+		{
+			"invalid transition",
+			&orderstate.InvalidTransitionError{From: domain.OrderDraft, To: domain.OrderApproved, Allowed: []domain.OrderStatus{domain.OrderPending, domain.OrderVoid}},
+			http.StatusConflict, "invalid_transition",
+			map[string]any{"from": "draft", "to": "approved", "allowed": []any{"pending", "void"}},
+		},
+		{"no transitions left", &orderstate.InvalidTransitionError{From: domain.OrderVoid, To: domain.OrderDraft, Allowed: []domain.OrderStatus{}},
+			http.StatusConflict, "invalid_transition", map[string]any{"from": "void", "to": "draft", "allowed": []any{}}},
+		{"moved by another request", storage.ErrOrderStatusChanged, http.StatusConflict, "order_status_changed", nil},
+		{"not allowed", orderstate.ErrForbidden, http.StatusForbidden, "forbidden", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/orders/130/transitions", nil)
+			rec := httptest.NewRecorder()
+			writeError(rec, req, transitionError(tt.err))
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			var body map[string]any
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body["code"] != tt.code {
+				t.Errorf("code = %v, want %s", body["code"], tt.code)
+			}
+			for k, v := range tt.want {
+				if !reflect.DeepEqual(body[k], v) {
+					t.Errorf("%s = %#v, want %#v", k, body[k], v)
+				}
+			}
+		})
+	}
+}
@@ -1,27 +1,29 @@
 package net
 
 import (
+	"context"
+	"database/sql"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"firebase.google.com/go/auth"
 	fb "github.com/Vertisphere/backend-service/external/firebase"
 	qb "github.com/Vertisphere/backend-service/external/quickbooks"
-	"github.com/Vertisphere/backend-service/internal/config"
 	"github.com/Vertisphere/backend-service/internal/domain"
+	"github.com/Vertisphere/backend-service/internal/notify"
+	"github.com/Vertisphere/backend-service/internal/orderstate"
+	"github.com/Vertisphere/backend-service/internal/pricing"
+	"github.com/Vertisphere/backend-service/internal/qbtoken"
 	"github.com/Vertisphere/backend-service/internal/storage"
-	"github.com/twilio/twilio-go"
-	twApi "github.com/twilio/twilio-go/rest/api/v2010"
-	"gopkg.in/square/go-jose.v2"
-
-	"github.com/sendgrid/sendgrid-go"
-	"github.com/sendgrid/sendgrid-go/helpers/mail"
 
 	"github.com/rs/zerolog/log"
 )
@@ -42,7 +44,7 @@ import (
 //			log.Println("QUICKBOOKS_CLIENT_SECRET:", c.Quickbooks.ClientSecret)
 //			log.Println("FIREBASE KEY:", c.Firebase.APIKey)
 //			log.Println("JWE_KEY:", c.JWEKey)
-//			claims := r.Context().Value("claims").(domain.Claims)
+//			claims := ClaimsFromContext(r.Context())
 //			log.Println(claims)
 //		}
 //	}
@@ -52,7 +54,7 @@ import (
 // Check if company exists in DB
 // If exists -> get firebase ID from DB -> Get custom claim Token -> Sign in with custom token -> generate JWT
 // If not exists -> create a new firebase anonymous user -> create a new company in DB -> link with firebase user -> generate JWT
-func LoginQuickbooks(fbc *fb.Client, qbc *qb.Client, a *auth.Client, s *storage.SQLStorage) http.HandlerFunc {
+func LoginQuickbooks(fbc *fb.Client, qbc *qb.Client, tokens *qbtoken.Manager, a *auth.Client, s *storage.SQLStorage) http.HandlerFunc {
 	type request struct {
 		AuthCode        string `json:"auth_code"`
 		RealmID         string `json:"realm_id"`
@@ -65,32 +67,22 @@ func LoginQuickbooks(fbc *fb.Client, qbc *qb.Client, a *auth.Client, s *storage.
 		Success bool   `json:"success"`
 	}
 
-	return func(w http.ResponseWriter, r *http.Request) {
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
 		req, err := decode[request](r)
 		if err != nil {
-			logHttpError(err, "Invalid request payload", http.StatusBadRequest, &w)
-			return
+			return badRequest("Invalid request payload", err)
 		}
 
 		// Get QB token
-		bearerToken, err := qbc.RetrieveBearerToken(req.AuthCode)
-		if err != nil {
-			logHttpError(err, "Could not get token", http.StatusInternalServerError, &w)
-			return
-		}
-
-		// Encrypt token to embed in claims
-		encryptedToken, err := encryptToken(bearerToken.AccessToken)
+		bearerToken, err := qbc.RetrieveBearerToken(r.Context(), req.AuthCode)
 		if err != nil {
-			logHttpError(err, "Could not encrypt token", http.StatusInternalServerError, &w)
-			return
+			return internalError("Could not get token", err)
 		}
 
 		// Check if company is in DB
 		companyExists, err := s.CompanyExists(req.RealmID)
 		if err != nil {
-			logHttpError(err, "Could not check if company exists", http.StatusInternalServerError, &w)
-			return
+			return internalError("Could not check if company exists", err)
 		}
 
 		var firebaseID string
@@ -98,18 +90,22 @@ func LoginQuickbooks(fbc *fb.Client, qbc *qb.Client, a *auth.Client, s *storage.
 			// Get company
 			company, err := s.GetCompany(req.RealmID)
 			if err != nil {
-				logHttpError(err, "Could not get company from DB", http.StatusInternalServerError, &w)
-				return
+				return internalError("Could not get company from DB", err)
 			}
 			// Get firebase ID (We assume firebase ID is always set)
 			firebaseID = company.FirebaseID
+			// Save the new tokens, the old refresh token may have expired or been revoked
+			err = s.UpsertCompany(req.RealmID, req.AuthCode, bearerToken.AccessToken, bearerToken.ExpiresIn, bearerToken.RefreshToken, bearerToken.XRefreshTokenExpiresIn)
+			if err != nil {
+				return internalError("Could not save token", err)
+			}
+			tokens.Forget(req.RealmID)
 		} else {
 			// Create a new firebase anonymous user
 			userToCreate := auth.UserToCreate{}
 			createdUser, err := a.CreateUser(r.Context(), &userToCreate)
 			if err != nil {
-				logHttpError(err, "Could not create user in firebase", http.StatusInternalServerError, &w)
-				return
+				return internalError("Could not create user in firebase", err)
 			}
 
 			log.Debug().Interface("createdUser", createdUser).Msg("Created user in firebase")
@@ -124,62 +120,53 @@ func LoginQuickbooks(fbc *fb.Client, qbc *qb.Client, a *auth.Client, s *storage.
 				if rollBackErr != nil {
 					log.Error().Err(rollBackErr).Msgf("Could not delete user in firebase after DB createCompany failed for user: %s", firebaseID)
 				}
-				logHttpError(err, "Could not create company in DB", http.StatusInternalServerError, &w)
-				return
+				return internalError("Could not create company in DB", err)
 			}
 		}
 
+		// Whoever can connect the company to QB is an owner, other staff sign in with LoginStaff
+		if err := s.EnsureCompanyOwner(req.RealmID, firebaseID); err != nil {
+			return internalError("Could not save company owner", err)
+		}
+
 		// With firebaseID, create a custom claims
 		customClaims := domain.Claims{
-			QBCompanyID:   req.RealmID,
-			QBCustomerID:  "0",
-			QBBearerToken: encryptedToken,
-			IsFranchiser:  true,
-			FirebaseID:    firebaseID,
-			// For future
-			// IsAdmin
+			QBCompanyID:  req.RealmID,
+			QBCustomerID: "0",
+			IsFranchiser: true,
+			FirebaseID:   firebaseID,
+			Role:         domain.RoleOwner,
 		}
 		customTokenInternal, err := a.CustomTokenWithClaims(r.Context(), firebaseID, domain.ClaimsToMap(customClaims))
 		if err != nil {
-			logHttpError(err, "Could not create custom token", http.StatusInternalServerError, &w)
-			return
+			return internalError("Could not create custom token", err)
 		}
-		signInWithCustomTokenResp, err := fbc.SignInWithCustomToken(customTokenInternal)
+		signInWithCustomTokenResp, err := fbc.SignInWithCustomToken(r.Context(), customTokenInternal)
 		if err != nil {
-			logHttpError(err, "Could not sign in with custom token", http.StatusInternalServerError, &w)
-			return
+			return internalError("Could not sign in with custom token", err)
 		}
 
 		response := response{
 			Token:   signInWithCustomTokenResp.IdToken,
 			Success: true}
-		encode(w, r, 200, response)
-	}
+		return encode(w, r, 200, response)
+	})
 }
 
-func ListQBCustomers(qbc *qb.Client, s *storage.SQLStorage) http.HandlerFunc {
+func ListQBCustomers(qbc *qb.Client, tokens *qbtoken.Manager, s *storage.SQLStorage) http.HandlerFunc {
 	type response struct {
 		TotalCount int               `json:"total_count"`
 		Customers  []domain.Customer `json:"customers"`
 	}
-	return func(w http.ResponseWriter, r *http.Request) {
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
 		// get claims from context
-		claims := r.Context().Value("claims").(domain.Claims)
-
-		// If franchisee, then don't allow
-		if !claims.IsFranchiser {
-			logHttpError(nil, "No Access", http.StatusServiceUnavailable, &w)
-			return
-		}
+		claims := ClaimsFromContext(r.Context())
 
 		// Get QB token and set jwt for QB Client
-		token, err := decryptJWE(claims.QBBearerToken)
+		qbc, err := realmClient(r.Context(), qbc, tokens, claims.QBCompanyID)
 		if err != nil {
-			logHttpError(err, "Could not decrypt QB token", http.StatusUnauthorized, &w)
-			return
+			return err
 		}
-
-		qbc.SetClient(qb.BearerToken{AccessToken: string(token)})
 		// Get query params
 		q := r.URL.Query()
 		orderBy := getQueryWithDefault(&q, "order_by", "DisplayName ASC")
@@ -188,17 +175,15 @@ func ListQBCustomers(qbc *qb.Client, s *storage.SQLStorage) http.HandlerFunc {
 		query := getQueryWithDefault(&q, "query", "DisplayName LIKE '%%'")
 
 		// Get Total Count of query
-		totalCount, err := qbc.QueryCustomersCount(claims.QBCompanyID, query)
+		totalCount, err := qbc.QueryCustomersCount(r.Context(), claims.QBCompanyID, query)
 		if err != nil {
-			logHttpError(err, "Could not get customers (total count)", http.StatusInternalServerError, &w)
-			return
+			return qbError(err, "Could not get customers (total count)")
 		}
 
 		// Get Customers from QB
-		qbCustomers, err := qbc.QueryCustomers(claims.QBCompanyID, orderBy, pageSize, pageToken, query)
+		qbCustomers, err := qbc.QueryCustomers(r.Context(), claims.QBCompanyID, orderBy, pageSize, pageToken, query)
 		if err != nil {
-			logHttpError(err, "Could not get customers", http.StatusInternalServerError, &w)
-			return
+			return qbError(err, "Could not get customers")
 		}
 		// convert qbCustomers to customer type
 		customers := make([]domain.Customer, len(qbCustomers))
@@ -212,15 +197,18 @@ func ListQBCustomers(qbc *qb.Client, s *storage.SQLStorage) http.HandlerFunc {
 		customersWithFirebaseDetails := s.GetCustomersLinkedStatuses(claims.QBCompanyID, &customers)
 		// Write customers to response
 		resp := response{TotalCount: totalCount, Customers: customersWithFirebaseDetails}
-		encode(w, r, http.StatusOK, resp)
-	}
+		return encode(w, r, http.StatusOK, resp)
+	})
 }
 
-func CreateCustomer(fbc *fb.Client, qbc *qb.Client, a *auth.Client, s *storage.SQLStorage) http.HandlerFunc {
+func CreateCustomer(fbc *fb.Client, qbc *qb.Client, tokens *qbtoken.Manager, a *auth.Client, s *storage.SQLStorage, n *notify.Service) http.HandlerFunc {
 	type request struct {
 		QBCustomerID       string `json:"qb_customer_id"`
 		CustomerEmail      string `json:"customer_email"`
 		SetQBCustomerEmail bool   `json:"set_qb_customer_email"`
+		// Role of the login at the location, defaults to location admin. Locations can have many logins.
+		Role domain.Role `json:"role"`
+		Name string      `json:"name"`
 	}
 
 	type response struct {
@@ -228,49 +216,49 @@ func CreateCustomer(fbc *fb.Client, qbc *qb.Client, a *auth.Client, s *storage.S
 		ResetLink string `json:"reset_link"`
 		Success   bool   `json:"success"`
 	}
-	return func(w http.ResponseWriter, r *http.Request) {
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
 		// get claims from context
-		claims := r.Context().Value("claims").(domain.Claims)
-		// user should be franchisor
-		if !claims.IsFranchiser {
-			http.Error(w, "No Access", http.StatusServiceUnavailable)
-			return
-		}
-
-		token, err := decryptJWE(claims.QBBearerToken)
+		claims := ClaimsFromContext(r.Context())
+		qbc, err := realmClient(r.Context(), qbc, tokens, claims.QBCompanyID)
 		if err != nil {
-			logHttpError(err, "Could not decrypt QB token", http.StatusUnauthorized, &w)
-			return
+			return err
 		}
-		qbc.SetClient(qb.BearerToken{AccessToken: string(token)})
 
 		req, err := decode[request](r)
 		if err != nil {
-			logHttpError(err, "Invalid request payload", http.StatusBadRequest, &w)
-			return
+			return badRequest("Invalid request payload", err)
+		}
+		if req.Role == "" {
+			req.Role = domain.RoleLocationAdmin
+		}
+		if !req.Role.IsLocation() {
+			return badRequest("Invalid customer login", nil, FieldError{Field: "role", Message: "must be location_admin, orderer or viewer"})
 		}
-		// TODO add check for existing row in DB
-		customer, err := qbc.GetCustomerById(claims.QBCompanyID, req.QBCustomerID)
+		customer, err := qbc.GetCustomerById(r.Context(), claims.QBCompanyID, req.QBCustomerID)
 		if err != nil {
-			logHttpError(err, "Could not get customer", http.StatusInternalServerError, &w)
-			return
+			return qbError(err, "Could not get customer")
 		}
 		// Create firebase account for customer
 		encodedRealmID := base64.StdEncoding.EncodeToString([]byte(claims.QBCompanyID))
-		phoneNumber := qbToE164Phone(customer.PrimaryPhone.FreeFormNumber)
+		phoneNumber := notify.E164Phone(customer.PrimaryPhone.FreeFormNumber)
 
-		createdUserResp, err := fbc.SignUp(req.CustomerEmail, encodedRealmID, phoneNumber)
+		createdUserResp, err := fbc.SignUp(r.Context(), req.CustomerEmail, encodedRealmID, phoneNumber)
 		if err != nil {
-			logHttpError(err, "Could not create user", http.StatusInternalServerError, &w)
-			return
+			return internalError("Could not create user", err)
 		}
-		err = s.CreateCustomer(claims.QBCompanyID, req.QBCustomerID, createdUserResp.LocalId)
+		_, err = s.CreateCustomer(domain.DBCustomer{
+			QBCompanyID:  claims.QBCompanyID,
+			QBCustomerID: req.QBCustomerID,
+			FirebaseID:   createdUserResp.LocalId,
+			Email:        req.CustomerEmail,
+			Name:         req.Name,
+			Role:         req.Role,
+		})
 		if err != nil {
-			logHttpError(err, "Could not create customer in DB", http.StatusInternalServerError, &w)
 			// TODO: this is kinda faulty
 			// TODO long after that todo: what does this even mean
 			a.DeleteUser(r.Context(), createdUserResp.LocalId)
-			return
+			return internalError("Could not create customer in DB", err)
 		}
 		emailSetting := auth.ActionCodeSettings{
 			// URL: "https://backend-435201.firebaseapp.com",
@@ -279,29 +267,20 @@ func CreateCustomer(fbc *fb.Client, qbc *qb.Client, a *auth.Client, s *storage.S
 		// a.GetUser(r.Context(), uid.UID)
 		link, err := a.PasswordResetLinkWithSettings(r.Context(), req.CustomerEmail, &emailSetting)
 		if err != nil {
-			logHttpError(err, "Could not create reset link", http.StatusInternalServerError, &w)
-			return
+			return internalError("Could not create reset link", err)
 		}
 
-		// TODO: clean this shit up
-		from := mail.NewEmail("Ordrport Support", "verification@ordrport.com")
-		subject := "Reset your password for Ordrport"
 		// TODO: add forgot password flow
-		to := mail.NewEmail("Ordrport Franchisee", req.CustomerEmail)
-		plainTextContent := "Please reset your password for your Ordrport account"
-		htmlContent := link
-		message := mail.NewSingleEmail(from, subject, to, plainTextContent, htmlContent)
-		client := sendgrid.NewSendClient(os.Getenv("SENDGRID_API_KEY"))
-		resp, err := client.Send(message)
+		err = n.Emit(r.Context(), qbc, notify.Event{
+			Type:       notify.CustomerInvited,
+			CompanyID:  claims.QBCompanyID,
+			CustomerID: req.QBCustomerID,
+			Link:       link,
+			To:         &notify.Recipient{Name: customer.DisplayName, Emails: []string{req.CustomerEmail}},
+		})
 		if err != nil {
-			log.Error().Err(err)
-			a.DeleteUser(r.Context(), createdUserResp.LocalId)
-		}
-		// TODO: IS this 202?
-		if resp.StatusCode != http.StatusAccepted {
-			log.Error().Interface("response", resp).Msg("reset email wasn't a 202")
-			// TODO: should we delete this
-			// a.DeleteUser(r.Context(), createdUserResp.LocalId)
+			// The account and customer are kept, the franchiser still gets the link back and can pass it on
+			log.Error().Err(err).Msg("Could not send invite email")
 		}
 
 		// update qb customer to use this email
@@ -311,15 +290,15 @@ func CreateCustomer(fbc *fb.Client, qbc *qb.Client, a *auth.Client, s *storage.S
 				SyncToken:        customer.SyncToken,
 				PrimaryEmailAddr: &qb.EmailAddress{Address: req.CustomerEmail},
 			}
-			_, err = qbc.UpdateCustomer(claims.QBCompanyID, &customerWithEmail)
+			_, err = qbc.UpdateCustomer(r.Context(), claims.QBCompanyID, &customerWithEmail)
 			if err != nil {
 				log.Error().Err(err).Msg("Could not update customer email in QB")
 			}
 		}
 
 		response := response{Success: true, ResetLink: link}
-		encode(w, r, 200, response)
-	}
+		return encode(w, r, 200, response)
+	})
 }
 
 func DeleteCustomer(a *auth.Client, s *storage.SQLStorage) http.HandlerFunc {
@@ -329,38 +308,37 @@ func DeleteCustomer(a *auth.Client, s *storage.SQLStorage) http.HandlerFunc {
 	type response struct {
 		Success bool `json:"success"`
 	}
-	return func(w http.ResponseWriter, r *http.Request) {
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
 		// get claims from context
-		claims := r.Context().Value("claims").(domain.Claims)
-		// User should be franchisor
-		if !claims.IsFranchiser {
-			logHttpError(nil, "No Access", http.StatusServiceUnavailable, &w)
-			return
-		}
+		claims := ClaimsFromContext(r.Context())
 		req, err := decode[request](r)
 		if err != nil {
-			logHttpError(err, "Invalid request payload", http.StatusBadRequest, &w)
-			return
+			return badRequest("Invalid request payload", err)
 		}
 
-		firebaseID, err := s.DeleteCustomer(claims.QBCompanyID, req.QBCustomerID)
+		// Every login of the location goes
+		firebaseIDs, err := s.DeleteCustomer(claims.QBCompanyID, req.QBCustomerID)
 		if err != nil {
-			logHttpError(err, "Could not delete customer in db", http.StatusInternalServerError, &w)
-			return
+			return internalError("Could not delete customer in db", err)
+		}
+		if len(firebaseIDs) == 0 {
+			return notFound("Customer has no logins", nil)
 		}
 
-		err = a.DeleteUser(r.Context(), firebaseID)
-		if err != nil {
-			logHttpError(err, "Could not delete user in firebase", http.StatusInternalServerError, &w)
-			return
+		// Their ID tokens stop working with the users, authenticate checks the user still exists
+		for _, firebaseID := range firebaseIDs {
+			err = a.DeleteUser(r.Context(), firebaseID)
+			if err != nil && !auth.IsUserNotFound(err) {
+				return internalError("Could not delete user in firebase", err)
+			}
 		}
 
 		response := response{Success: true}
-		encode(w, r, 200, response)
-	}
+		return encode(w, r, 200, response)
+	})
 }
 
-func LoginCustomer(fbc *fb.Client, qbc *qb.Client, a *auth.Client, s *storage.SQLStorage) http.HandlerFunc {
+func LoginCustomer(fbc *fb.Client, tokens *qbtoken.Manager, a *auth.Client, s *storage.SQLStorage) http.HandlerFunc {
 	type request struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
@@ -369,107 +347,66 @@ func LoginCustomer(fbc *fb.Client, qbc *qb.Client, a *auth.Client, s *storage.SQ
 		Token   string `json:"token"`
 		Success bool   `json:"success"`
 	}
-	return func(w http.ResponseWriter, r *http.Request) {
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
 		req, err := decode[request](r)
 		if err != nil {
-			logHttpError(err, "Invalid request payload", http.StatusBadRequest, &w)
-			return
+			return badRequest("Invalid request payload", err)
 		}
 
-		signInWithPasswordResponse, err := fbc.SignInWithPassword(req.Email, req.Password)
+		signInWithPasswordResponse, err := fbc.SignInWithPassword(r.Context(), req.Email, req.Password)
 		if err != nil {
-			logHttpError(err, "Could not sign in", http.StatusInternalServerError, &w)
-			return
+			return internalError("Could not sign in", err)
 		}
 		log.Debug().Interface("signInWithPasswordResponse", signInWithPasswordResponse).Msg("Sign in with password response")
 		customer, err := s.GetCustomerByFirebaseID(signInWithPasswordResponse.LocalID)
 		if err != nil {
-			logHttpError(err, "Could not get customer", http.StatusInternalServerError, &w)
-			return
+			return internalError("Could not get customer", err)
 		}
 		log.Debug().Interface("customer", customer).Msg("Fetched customer")
-		dbCompany, err := s.GetCompany(customer.QBCompanyID)
-		if err != nil {
-			logHttpError(err, "Could not get company from DB", http.StatusInternalServerError, &w)
-			return
-		}
-		if dbCompany.QBBearerToken == "" {
-			logHttpError(nil, "No cached token", http.StatusBadRequest, &w)
-			return
-		}
-		// Instead of checking for expiry, just get fresh token
-		bearerToken, err := qbc.RefreshToken(dbCompany.QBRefreshToken)
-		if err != nil {
-			logHttpError(err, "Could not refresh token in DB", http.StatusInternalServerError, &w)
-			return
-		}
-		err = s.UpsertCompany(dbCompany.QBCompanyID, dbCompany.QBAuthCode, bearerToken.AccessToken, bearerToken.ExpiresIn, bearerToken.RefreshToken, bearerToken.XRefreshTokenExpiresIn)
-		if err != nil {
-			logHttpError(err, "Could not upsert company", http.StatusInternalServerError, &w)
-			return
+		// Make sure the franchiser is still connected to QB, this also refreshes the token if needed
+		_, err = tokens.Token(r.Context(), customer.QBCompanyID)
+		if errors.Is(err, qbtoken.ErrNotConnected) {
+			return badRequest("Franchiser is not connected to QuickBooks", err)
 		}
-
-		encKey := config.LoadConfigs().JWEKey
-		rawKey, err := base64.StdEncoding.DecodeString(encKey)
-		if err != nil {
-			logHttpError(err, "Failed to decode Base64 key", http.StatusInternalServerError, &w)
-			return
-		}
-		encrypter, err := jose.NewEncrypter(jose.A256GCM, jose.Recipient{Algorithm: jose.DIRECT, Key: rawKey}, nil)
-		if err != nil {
-			logHttpError(err, "Could not create encrypter", http.StatusInternalServerError, &w)
-			return
-		}
-		object, err := encrypter.Encrypt([]byte(bearerToken.AccessToken))
-		if err != nil {
-			logHttpError(err, "Could not encrypt token", http.StatusInternalServerError, &w)
-			return
-		}
-		encryptedToken, err := object.CompactSerialize()
 		if err != nil {
-			logHttpError(err, "Could not serialize token", http.StatusInternalServerError, &w)
-			return
+			return internalError("Could not get QB token", err)
 		}
 		customClaims := domain.Claims{
-			QBCompanyID:   dbCompany.QBCompanyID,
-			QBCustomerID:  customer.QBCustomerID,
-			QBBearerToken: encryptedToken,
-			IsFranchiser:  false,
-			FirebaseID:    customer.FirebaseID,
-			// For future
-			// IsAdmin
+			QBCompanyID:  customer.QBCompanyID,
+			QBCustomerID: customer.QBCustomerID,
+			IsFranchiser: false,
+			FirebaseID:   customer.FirebaseID,
+			Role:         customer.Role,
 		}
 		customTokenInternal, err := a.CustomTokenWithClaims(r.Context(), customer.FirebaseID, domain.ClaimsToMap(customClaims))
 		if err != nil {
-			logHttpError(err, "Could not create custom token", http.StatusInternalServerError, &w)
-			return
+			return internalError("Could not create custom token", err)
 		}
-		signInWithCustomTokenResp, err := fbc.SignInWithCustomToken(customTokenInternal)
+		signInWithCustomTokenResp, err := fbc.SignInWithCustomToken(r.Context(), customTokenInternal)
 		if err != nil {
-			logHttpError(err, "Could not sign in with custom token", http.StatusInternalServerError, &w)
-			return
+			return internalError("Could not sign in with custom token", err)
 		}
 
 		response := response{
 			Token:   signInWithCustomTokenResp.IdToken,
 			Success: true}
-		encode(w, r, 200, response)
-	}
+		return encode(w, r, 200, response)
+	})
 }
-func ListQBItems(qbc *qb.Client) http.HandlerFunc {
+
+// ListQBItems lists QuickBooks items. Franchisees only see the items they can order, at their prices.
+func ListQBItems(qbc *qb.Client, tokens *qbtoken.Manager, s *storage.SQLStorage) http.HandlerFunc {
 	type response struct {
 		TotalCount int       `json:"total_count"`
 		Items      []qb.Item `json:"items"`
 	}
-	return func(w http.ResponseWriter, r *http.Request) {
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
 		// get claims from context
-		claims := r.Context().Value("claims").(domain.Claims)
-		token, err := decryptJWE(claims.QBBearerToken)
+		claims := ClaimsFromContext(r.Context())
+		qbc, err := realmClient(r.Context(), qbc, tokens, claims.QBCompanyID)
 		if err != nil {
-			http.Error(w, "Could not decrypt QB token", http.StatusUnauthorized)
-			return
+			return err
 		}
-		qbc.SetClient(qb.BearerToken{AccessToken: string(token)})
 		// Get query params
 		q := r.URL.Query()
 		orderBy := getQueryWithDefault(&q, "order_by", "Name ASC")
@@ -477,1141 +414,646 @@ func ListQBItems(qbc *qb.Client) http.HandlerFunc {
 		pageToken := getQueryWithDefault(&q, "page_token", "1")
 		query := getQueryWithDefault(&q, "query", "Name LIKE '%%'")
 
-		totalCount, err := qbc.QueryItemsCount(claims.QBCompanyID, query)
+		var catalog *pricing.Catalog
+		if !claims.IsFranchiser {
+			if catalog, err = customerCatalog(r.Context(), qbc, s, claims.QBCompanyID, claims.QBCustomerID); err != nil {
+				return err
+			}
+			// Restricted catalogs are filtered in the query so pages and counts stay right. Items hidden
+			// from a catalog that isn't restricted are dropped from the page below.
+			if catalog.Restricted() {
+				listed := catalog.Listed()
+				if len(listed) == 0 {
+					return encode(w, r, http.StatusOK, response{Items: []qb.Item{}})
+				}
+				query += " AND " + qb.IDFilter(listed)
+			}
+		}
+
+		totalCount, err := qbc.QueryItemsCount(r.Context(), claims.QBCompanyID, query)
 		if err != nil {
-			logHttpError(err, "Could not get items (total count)", http.StatusInternalServerError, &w)
-			return
+			return qbError(err, "Could not get items (total count)")
 		}
 
-		items, err := qbc.QueryItems(claims.QBCompanyID, orderBy, pageSize, pageToken, query)
+		items, err := qbc.QueryItems(r.Context(), claims.QBCompanyID, orderBy, pageSize, pageToken, query)
 		if err != nil {
-			logHttpError(err, "Could not get items", http.StatusInternalServerError, &w)
-			return
+			return qbError(err, "Could not get items")
+		}
+
+		if catalog != nil {
+			items = catalog.Apply(items)
 		}
 
 		resp := response{TotalCount: totalCount, Items: items}
-		encode(w, r, http.StatusOK, resp)
-	}
+		return encode(w, r, http.StatusOK, resp)
+	})
 }
 
-func CreateQBInvoice(qbc *qb.Client) http.HandlerFunc {
+func CreateQBInvoice(qbc *qb.Client, tokens *qbtoken.Manager, s *storage.SQLStorage) http.HandlerFunc {
 	type response struct {
 		Success bool   `json:"success"`
 		Id      string `json:"id"`
 	}
-	return func(w http.ResponseWriter, r *http.Request) {
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
 		// get claims from context
-		claims := r.Context().Value("claims").(domain.Claims)
-		// Franchisers should not be able to create invoices
-		if claims.IsFranchiser {
-			logHttpError(nil, "No Access", http.StatusServiceUnavailable, &w)
-			return
-		}
+		claims := ClaimsFromContext(r.Context())
 		// Get QB token and set jwt for QB Client
-		token, err := decryptJWE(claims.QBBearerToken)
+		qbc, err := realmClient(r.Context(), qbc, tokens, claims.QBCompanyID)
 		if err != nil {
-			logHttpError(err, "Could not decrypt QB token", http.StatusUnauthorized, &w)
-			return
+			return err
 		}
-		qbc.SetClient(qb.BearerToken{AccessToken: string(token)})
 		// Create invoice order details
-		var lines []qb.Line
-		lines = append(lines, qb.Line{
+		lines := []qb.Line{{
 			DetailType:  "DescriptionOnly",
 			Description: "Ordrport Draft: Customer #" + claims.QBCustomerID,
-		})
-
-		// Set Docnumber and customer reference for invoice
-		invoice := &qb.Invoice{
-			Line:        lines,
-			CustomerRef: qb.ReferenceType{Value: claims.QBCustomerID},
-			DocNumber:   "A1000000-" + time.Now().Format("060102150405"),
-		}
-
-		// Get customer details
-		customer, err := qbc.GetCustomerById(claims.QBCompanyID, claims.QBCustomerID)
+		}}
+		createdInvoice, err := createDraftInvoice(r.Context(), qbc, claims.QBCompanyID, claims.QBCustomerID, lines)
 		if err != nil {
-			logHttpError(err, "Could not get customer", http.StatusInternalServerError, &w)
-		}
-		if customer.PrimaryEmailAddr != nil && customer.PrimaryEmailAddr.Address != "" {
-			invoice.BillEmail = qb.EmailAddress{Address: customer.PrimaryEmailAddr.Address}
+			return err
 		}
-
-		// Create Invoice and send
-		createdInvoice, err := qbc.CreateInvoice(claims.QBCompanyID, invoice)
-		if err != nil {
-			logHttpError(err, "Could not create invoice", http.StatusInternalServerError, &w)
-			return
+		if err := createOrder(r.Context(), qbc, s, claims, createdInvoice); err != nil {
+			return err
 		}
 
 		resp := response{Success: true, Id: createdInvoice.Id}
-		encode(w, r, http.StatusOK, resp)
-	}
+		return encode(w, r, http.StatusOK, resp)
+	})
 }
 
-func UpdateQBInvoice(qbc *qb.Client) http.HandlerFunc {
-	// To be honest the only realk values we need from each item is the id, tax code, and price
-	// Maybe we should set the tax code to 0 when it's not set and then find the right values for it here?? TODO
+// UpdateQBInvoice replaces the lines of a franchisee's order. Only item IDs and quantities are taken,
+// prices and tax codes come from the customer's price lists and QuickBooks. With ?preview=true the
+// quote is returned without saving anything.
+func UpdateQBInvoice(qbc *qb.Client, tokens *qbtoken.Manager, s *storage.SQLStorage) http.HandlerFunc {
 	type Line struct {
-		Item     qb.Item `json:"item"`
-		Quantity float64 `json:"quantity"`
+		ItemID   string      `json:"item_id"`
+		Quantity json.Number `json:"quantity"`
 	}
 	type request struct {
 		Lines []Line `json:"lines"`
 	}
 	type response struct {
-		Success bool `json:"success"`
+		Success bool          `json:"success"`
+		Saved   bool          `json:"saved"`
+		Quote   pricing.Quote `json:"quote"`
 	}
-	return func(w http.ResponseWriter, r *http.Request) {
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
 		// get claims from context
-		claims := r.Context().Value("claims").(domain.Claims)
-		// Franchisers should not be able to create invoices
-		if claims.IsFranchiser {
-			http.Error(w, "No Access", http.StatusServiceUnavailable)
-			return
-		}
+		claims := ClaimsFromContext(r.Context())
 		// Get QB token and set jwt for QB Client
-		token, err := decryptJWE(claims.QBBearerToken)
+		qbc, err := realmClient(r.Context(), qbc, tokens, claims.QBCompanyID)
 		if err != nil {
-			http.Error(w, "Could not decrypt QB token", http.StatusUnauthorized)
-			return
+			return err
 		}
-		qbc.SetClient(qb.BearerToken{AccessToken: string(token)})
 
 		// get id from url
 		invoiceId := r.PathValue("id")
 		if invoiceId == "" {
-			http.Error(w, "No ID in URL", http.StatusBadRequest)
-			return
+			return badRequest("No ID in URL", nil)
 		}
+		preview := r.URL.Query().Get("preview") == "true"
 		// Get invoice by ID
-		existingInvoice, err := qbc.FindInvoiceById(claims.QBCompanyID, invoiceId)
+		existingInvoice, err := qbc.FindInvoiceById(r.Context(), claims.QBCompanyID, invoiceId)
 		if err != nil {
-			http.Error(w, "Could not verify that invoice exists or is in draft status", http.StatusInternalServerError)
-			return
+			return qbError(err, "Could not verify that invoice exists or is in draft status")
 		}
-		// Verify that the invoice status is currently in DRAFT OR PENDING
-		if qb.CheckInvoiceStatus(existingInvoice) != qb.INVOICE_DRAFT && qb.CheckInvoiceStatus(existingInvoice) != qb.INVOICE_PENDING {
-			http.Error(w, "Invoice is not in draft status", http.StatusBadRequest)
-			return
+		order, err := getOrder(s, claims.QBCompanyID, existingInvoice)
+		if err != nil {
+			return internalError("Could not get order status", err)
+		}
+		if order.QBCustomerID != claims.QBCustomerID {
+			return forbidden(nil)
+		}
+		// Verify that the invoice status is currently in DRAFT, PENDING or REVISION
+		if order.Status != domain.OrderDraft && order.Status != domain.OrderPending && order.Status != domain.OrderRevision {
+			return badRequest("Invoice can no longer be modified", nil)
 		}
 
 		// Decode request
 		req, err := decode[request](r)
 		if err != nil {
-			http.Error(w, "Invalid request payload", http.StatusBadRequest)
-			return
+			return badRequest("Invalid request payload", err)
 		}
-		// Create invoice order details
-		var lines []qb.Line
-		for _, line := range req.Lines {
-			unitPrice, err := line.Item.UnitPrice.Float64()
-			if err != nil {
-				http.Error(w, "Could not convert unit price to float64", http.StatusBadRequest)
-				return
+		var fields []FieldError
+		requested := make([]pricing.OrderLine, len(req.Lines))
+		for i, line := range req.Lines {
+			if line.ItemID == "" {
+				fields = append(fields, FieldError{Field: fmt.Sprintf("lines[%d].item_id", i), Message: "required"})
 			}
-			amount := json.Number(strconv.FormatFloat(unitPrice*line.Quantity, 'f', -1, 64))
-			lines = append(lines, qb.Line{
-				DetailType: "SalesItemLineDetail",
-				Amount:     amount,
-				SalesItemLineDetail: qb.SalesItemLineDetail{
-					ItemRef:    qb.ReferenceType{Value: line.Item.Id},
-					TaxCodeRef: qb.ReferenceType{Value: line.Item.SalesTaxCodeRef.Value},
-					Qty:        line.Quantity,
-				},
-			})
-		}
-		// slice old doc number and change status to reviewed
-		invoiceToUpdate := struct {
-			Id        string    `json:"Id"`
-			SyncToken string    `json:"SyncToken"`
-			Sparse    bool      `json:"sparse"`
-			Line      []qb.Line `json:"Line"`
-		}{
-			Id:        invoiceId,
-			SyncToken: existingInvoice.SyncToken,
-			Sparse:    true,
-			Line:      lines,
+			requested[i] = pricing.OrderLine{ItemID: line.ItemID, Quantity: line.Quantity.String()}
 		}
-		_, err = qbc.UpdateInvoice(claims.QBCompanyID, invoiceToUpdate)
-		if err != nil {
-			logHttpError(err, "Could not update invoice", http.StatusInternalServerError, &w)
-			return
+		if len(fields) > 0 {
+			return badRequest("Invalid lines", nil, fields...)
 		}
 
-		resp := response{Success: true}
-		encode(w, r, http.StatusOK, resp)
-	}
-}
-
-func PublishQBInvoice(qbc *qb.Client, auth *auth.Client, twc *twilio.RestClient) http.HandlerFunc {
-	type response struct {
-		Success bool `json:"success"`
-	}
-	return func(w http.ResponseWriter, r *http.Request) {
-		// get claims from context
-		claims := r.Context().Value("claims").(domain.Claims)
-		// Franchisers should not be able to create invoices
-		if claims.IsFranchiser {
-			http.Error(w, "No Access", http.StatusServiceUnavailable)
-			return
-		}
-		// Get QB token and set jwt for QB Client
-		token, err := decryptJWE(claims.QBBearerToken)
+		catalog, err := customerCatalog(r.Context(), qbc, s, claims.QBCompanyID, claims.QBCustomerID)
 		if err != nil {
-			http.Error(w, "Could not decrypt QB token", http.StatusUnauthorized)
-			return
+			return err
 		}
-		qbc.SetClient(qb.BearerToken{AccessToken: string(token)})
-
-		// get id from url
-		invoiceId := r.PathValue("id")
-		if invoiceId == "" {
-			http.Error(w, "No ID in URL", http.StatusBadRequest)
-			return
-		}
-		// Get invoice by ID
-		existingInvoice, err := qbc.FindInvoiceById(claims.QBCompanyID, invoiceId)
+		quote, err := quoteOrder(r.Context(), qbc, catalog, claims.QBCompanyID, requested, func(i int) string {
+			return fmt.Sprintf("lines[%d]", i)
+		})
 		if err != nil {
-			http.Error(w, "Could not verify that invoice exists or is in draft status", http.StatusInternalServerError)
-			return
+			return err
 		}
-		// Verify that the invoice status is currently in DRAFT
-		if qb.CheckInvoiceStatus(existingInvoice) != qb.INVOICE_DRAFT {
-			http.Error(w, "Invoice is not in draft status", http.StatusBadRequest)
-			return
+		if preview {
+			return encode(w, r, http.StatusOK, response{Success: true, Quote: quote})
 		}
+
 		// slice old doc number and change status to reviewed
 		invoiceToUpdate := struct {
-			Id        string `json:"Id"`
-			SyncToken string `json:"SyncToken"`
-			Sparse    bool   `json:"sparse"`
-			DocNumber string `json:"DocNumber"`
+			Id        string    `json:"Id"`
+			SyncToken string    `json:"SyncToken"`
+			Sparse    bool      `json:"sparse"`
+			Line      []qb.Line `json:"Line"`
 		}{
 			Id:        invoiceId,
 			SyncToken: existingInvoice.SyncToken,
 			Sparse:    true,
-			DocNumber: qb.ChangeInvoiceStatus(existingInvoice.DocNumber, qb.INVOICE_PENDING),
+			Line:      quote.InvoiceLines(),
 		}
-		_, err = qbc.UpdateInvoice(claims.QBCompanyID, invoiceToUpdate)
-		if err != nil {
-			logHttpError(err, "Could not update invoice", http.StatusInternalServerError, &w)
-			return
-		}
-
-		resp := response{Success: true}
-		encode(w, r, http.StatusOK, resp)
-
-		// Messaging isn't as important so we send message after we send response
-		// TODO: add twilio sms messaging
-		// add twilio message
-		// Do we get the phone number from the customer or the user??? Going to be using firebase phone number for now
-		// Okay here's how we're setting priority:
-		// 1. Check MfaEnrollment PhoneNumber (aka the phone number set for MFA)
-		// if none exist then: 2. Check firebase.UserInfo.PhoneNumber (What got set when firebase account was created)
-		// if none exist then: 3. Check qb customer phone
-		// Get firebase user phone number
-		// user, err := a.GetUser(r.Context(), claims.FirebaseID)
-		// if err != nil {
-		// 	log.Println(err)
-		// }
-		// // TODO: implement get mfa enrollment in fbc
-		// // 1. get mfaInfo
-		// // phoneNumber := fbc.GetUserInfo.MfaEnrollment.PhoneNumber
-		// var phoneNumber string
-		// // 2.
-		// if phoneNumber == "" {
-		// 	phoneNumber = user.PhoneNumber
-		// }
-		// 3.
-
-		// get phone number for franchisor to send notification to
-		var phoneNumber string
-		franchisor, err := qbc.FindCompanyInfo(claims.QBCompanyID)
-		// get customer name
-		customer, err := qbc.GetCustomerById(claims.QBCompanyID, existingInvoice.CustomerRef.Value)
+		_, err = qbc.UpdateInvoice(r.Context(), claims.QBCompanyID, invoiceToUpdate)
 		if err != nil {
-			log.Error().Err(err).Msg("Could not get company or customer to send sms message for publish")
-		} else {
-			if phoneNumber == "" {
-				phoneNumber = qbToE164Phone(franchisor.PrimaryPhone.FreeFormNumber)
-			}
+			return qbError(err, "Could not update invoice")
 		}
 
-		// TODO FOR Demo purpose
-		// if phoneNumber == "" {
-		// 	log.Println("No Phone number to send notification to. None sent.")
-		// 	return
-		// }
-		// TODO are all these phone number formats the same?
-		params := &twApi.CreateMessageParams{}
-		params.SetBody(fmt.Sprintf("An order with ID number %s has been published by franchisee: %s. For more details please visit: https://ordrport.com/franchisor/orders/pending-review", existingInvoice.Id, customer.DisplayName))
-		params.SetFrom("+16478009984")
-		params.SetTo(phoneNumber)
-
-		twResp, err := twc.Api.CreateMessage(params)
-		if err != nil {
-			log.Printf("Could not send SMS message %s", err)
-		}
-		log.Debug().Interface("twResp", twResp).Caller().Msg("Debug to take a look a twilio response")
-	}
+		resp := response{Success: true, Saved: true, Quote: quote}
+		return encode(w, r, http.StatusOK, resp)
+	})
 }
 
-func UnpublishQBInvoice(qbc *qb.Client, auth *auth.Client, twc *twilio.RestClient) http.HandlerFunc {
+func DuplicateQBInvoice(qbc *qb.Client, tokens *qbtoken.Manager, s *storage.SQLStorage) http.HandlerFunc {
 	type response struct {
-		Success bool `json:"success"`
+		Success bool   `json:"success"`
+		Id      string `json:"id"`
 	}
-	return func(w http.ResponseWriter, r *http.Request) {
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
 		// get claims from context
-		claims := r.Context().Value("claims").(domain.Claims)
+		claims := ClaimsFromContext(r.Context())
 		// Get QB token and set jwt for QB Client
-		token, err := decryptJWE(claims.QBBearerToken)
+		qbc, err := realmClient(r.Context(), qbc, tokens, claims.QBCompanyID)
 		if err != nil {
-			http.Error(w, "Could not decrypt QB token", http.StatusUnauthorized)
-			return
+			return err
 		}
-		qbc.SetClient(qb.BearerToken{AccessToken: string(token)})
 
-		// get id from url
 		invoiceId := r.PathValue("id")
 		if invoiceId == "" {
-			http.Error(w, "No ID in URL", http.StatusBadRequest)
-			return
+			return badRequest("No id in url", nil)
 		}
+
 		// Get invoice by ID
-		existingInvoice, err := qbc.FindInvoiceById(claims.QBCompanyID, invoiceId)
-		if err != nil {
-			http.Error(w, "Could not verify that invoice exists or is in draft status", http.StatusInternalServerError)
-			return
-		}
-		// Verify that the invoice status is currently in PENDING
-		if qb.CheckInvoiceStatus(existingInvoice) != qb.INVOICE_PENDING {
-			http.Error(w, "Invoice is not in pending status", http.StatusBadRequest)
-			return
-		}
-		// slice old doc number and change status to reviewed
-		invoiceToUpdate := struct {
-			Id        string `json:"Id"`
-			SyncToken string `json:"SyncToken"`
-			Sparse    bool   `json:"sparse"`
-			DocNumber string `json:"DocNumber"`
-		}{
-			Id:        invoiceId,
-			SyncToken: existingInvoice.SyncToken,
-			Sparse:    true,
-			DocNumber: qb.ChangeInvoiceStatus(existingInvoice.DocNumber, qb.INVOICE_DRAFT),
-		}
-		_, err = qbc.UpdateInvoice(claims.QBCompanyID, invoiceToUpdate)
-		if err != nil {
-			logHttpError(err, "Could not update invoice", http.StatusInternalServerError, &w)
-			return
-		}
-
-		resp := response{Success: true}
-		encode(w, r, http.StatusOK, resp)
-		// Messaging isn't as important so we send message after we send response
-		// TODO: add twilio sms messaging
-		// add twilio message
-		// Do we get the phone number from the customer or the user??? Going to be using firebase phone number for now
-		// Okay here's how we're setting priority:
-		// 1. Check MfaEnrollment PhoneNumber (aka the phone number set for MFA)
-		// if none exist then: 2. Check firebase.UserInfo.PhoneNumber (What got set when firebase account was created)
-		// if none exist then: 3. Check qb customer phone
-		// Get firebase user phone number
-		// user, err := a.GetUser(r.Context(), claims.FirebaseID)
-		// if err != nil {
-		// 	log.Println(err)
-		// }
-		// // TODO: implement get mfa enrollment in fbc
-		// // 1. get mfaInfo
-		// // phoneNumber := fbc.GetUserInfo.MfaEnrollment.PhoneNumber
-		// var phoneNumber string
-		// // 2.
-		// if phoneNumber == "" {
-		// 	phoneNumber = user.PhoneNumber
-		// }
-		// // 3.
-
-		var phoneNumber string
-		customer, err := qbc.GetCustomerById(claims.QBCompanyID, existingInvoice.CustomerRef.Value)
-		if err != nil {
-			log.Error().Err(err).Msg("Could not get customer to send sms message for unpublish")
-		} else {
-			if phoneNumber == "" {
-				phoneNumber = qbToE164Phone(customer.PrimaryPhone.FreeFormNumber)
-				if customer.PrimaryPhone.FreeFormNumber == "" {
-					phoneNumber = qbToE164Phone(customer.Mobile.FreeFormNumber)
-				}
-				if customer.Mobile.FreeFormNumber == "" {
-					phoneNumber = qbToE164Phone(customer.AlternatePhone.FreeFormNumber)
-				}
-				if err != nil {
-					log.Printf("%s", err)
-				}
+		existingInvoice, err := qbc.FindInvoiceById(r.Context(), claims.QBCompanyID, invoiceId)
+		if err != nil {
+			return qbError(err, "Could not verify that invoice exists or is in draft status")
+		}
+		// Franchisees can only duplicate their own orders
+		if existingInvoice.CustomerRef.Value != claims.QBCustomerID {
+			return forbidden(nil)
+		}
+
+		// The copy is priced for today, the lines that aren't items are copied as is
+		catalog, err := customerCatalog(r.Context(), qbc, s, claims.QBCompanyID, claims.QBCustomerID)
+		if err != nil {
+			return err
+		}
+		var otherLines []qb.Line
+		var requested []pricing.OrderLine
+		var lineIDs []string
+		for _, line := range existingInvoice.Line {
+			switch line.DetailType {
+			case "SalesItemLineDetail":
+				requested = append(requested, pricing.OrderLine{
+					ItemID:   line.SalesItemLineDetail.ItemRef.Value,
+					Quantity: pricing.FormatQuantity(line.SalesItemLineDetail.Qty),
+				})
+				lineIDs = append(lineIDs, line.Id)
+			case "SubTotalLineDetail":
+				// QB adds the subtotal back itself
+			default:
+				otherLines = append(otherLines, qb.Line{DetailType: line.DetailType, Description: line.Description, Amount: line.Amount})
 			}
 		}
-
-		// TODO FOR Demo purpose
-		if phoneNumber == "" {
-			log.Error().Msg("No phone number to send notification to. None sent.")
-			return
-		}
-		// TODO are all these phone number formats the same?
-		params := &twApi.CreateMessageParams{}
-		params.SetBody(fmt.Sprintf("An order with ID number %s has been rejected. For more details please visit: https://ordrport.com/franchisor/orders/pending-review", existingInvoice.Id))
-		params.SetFrom("+16478009984")
-		params.SetTo(phoneNumber)
-
-		twResp, err := twc.Api.CreateMessage(params)
+		quote, err := quoteOrder(r.Context(), qbc, catalog, claims.QBCompanyID, requested, func(i int) string {
+			return fmt.Sprintf("Line[Id=%s]", lineIDs[i])
+		})
 		if err != nil {
-			log.Printf("Could not send SMS message %s", err)
-		}
-		log.Debug().Interface("twResp", twResp).Caller().Msg("Debug to take a look a twilio response")
-	}
-}
-
-func ApproveQBInvoice(qbc *qb.Client, a *auth.Client, twc *twilio.RestClient) http.HandlerFunc {
-	type response struct {
-		Success bool `json:"success"`
-	}
-	return func(w http.ResponseWriter, r *http.Request) {
-		// get claims from context
-		claims := r.Context().Value("claims").(domain.Claims)
-		// Franchisers should not be able to create invoices
-		if !claims.IsFranchiser {
-			http.Error(w, "No Access", http.StatusServiceUnavailable)
-			return
+			return err
 		}
-		// Get QB token and set jwt for QB Client
-		token, err := decryptJWE(claims.QBBearerToken)
+		lines := append(otherLines, quote.InvoiceLines()...)
+		createdInvoice, err := createDraftInvoice(r.Context(), qbc, claims.QBCompanyID, claims.QBCustomerID, lines)
 		if err != nil {
-			http.Error(w, "Could not decrypt QB token", http.StatusUnauthorized)
-			return
+			return err
 		}
-		qbc.SetClient(qb.BearerToken{AccessToken: string(token)})
-
-		// get id from url
-		invoiceId := r.PathValue("id")
-		if invoiceId == "" {
-			http.Error(w, "No ID in URL", http.StatusBadRequest)
-			return
-		}
-		// Get invoice by ID
-		existingInvoice, err := qbc.FindInvoiceById(claims.QBCompanyID, invoiceId)
-		if err != nil {
-			http.Error(w, "Could not verify that invoice exists or is in draft status", http.StatusInternalServerError)
-			return
-		}
-		// Verify that the invoice status is currently in PENDING
-		if qb.CheckInvoiceStatus(existingInvoice) != qb.INVOICE_PENDING {
-			http.Error(w, "Invoice is not in pending status", http.StatusBadRequest)
-			return
-		}
-		// slice old doc number and change status to reviewed
-		invoiceToUpdate := struct {
-			Id        string `json:"Id"`
-			SyncToken string `json:"SyncToken"`
-			Sparse    bool   `json:"sparse"`
-			DocNumber string `json:"DocNumber"`
-		}{
-			Id:        invoiceId,
-			SyncToken: existingInvoice.SyncToken,
-			Sparse:    true,
-			DocNumber: qb.ChangeInvoiceStatus(existingInvoice.DocNumber, qb.INVOICE_APPROVED),
-		}
-		_, err = qbc.UpdateInvoice(claims.QBCompanyID, invoiceToUpdate)
-		if err != nil {
-			logHttpError(err, "Could not update invoice", http.StatusInternalServerError, &w)
-			return
-		}
-
-		resp := response{Success: true}
-		encode(w, r, http.StatusOK, resp)
-		// Messaging isn't as important so we send message after we send response
-		// TODO: add twilio sms messaging
-		// add twilio message
-		// Do we get the phone number from the customer or the user??? Going to be using firebase phone number for now
-		// Okay here's how we're setting priority:
-		// 1. Check MfaEnrollment PhoneNumber (aka the phone number set for MFA)
-		// if none exist then: 2. Check firebase.UserInfo.PhoneNumber (What got set when firebase account was created)
-		// if none exist then: 3. Check qb customer phone
-		// Get firebase user phone number
-		// user, err := a.GetUser(r.Context(), claims.FirebaseID)
-		// if err != nil {
-		// 	log.Println(err)
-		// }
-		// TODO: implement get mfa enrollment in fbc
-		// 1. get mfaInfo
-		// phoneNumber := fbc.GetUserInfo.MfaEnrollment.PhoneNumber
-		var phoneNumber string
-		// 2.
-		// if phoneNumber == "" {
-		// 	phoneNumber = user.PhoneNumber
-		// }
-		// // 3.
-
-		customer, err := qbc.GetCustomerById(claims.QBCompanyID, existingInvoice.CustomerRef.Value)
-		if err != nil {
-			log.Printf("%s", err)
-		} else {
-			if phoneNumber == "" {
-				phoneNumber = qbToE164Phone(customer.PrimaryPhone.FreeFormNumber)
-				if customer.PrimaryPhone.FreeFormNumber == "" {
-					phoneNumber = qbToE164Phone(customer.Mobile.FreeFormNumber)
-				}
-				if customer.Mobile.FreeFormNumber == "" {
-					phoneNumber = qbToE164Phone(customer.AlternatePhone.FreeFormNumber)
-				}
-				if err != nil {
-					log.Printf("%s", err)
-				}
-			}
+		if err := createOrder(r.Context(), qbc, s, claims, createdInvoice); err != nil {
+			return err
 		}
 
-		// TODO FOR Demo purpose
-		// if phoneNumber == "" {
-		// 	log.Println("No Phone number to send notification to. None sent.")
-		// 	return
-		// }
-		// TODO are all these phone number formats the same?
-		params := &twApi.CreateMessageParams{}
-		params.SetBody(fmt.Sprintf("Order #%s has been approved and is being prepared. For more details please visit: https://ordrport.com/franchisee/orders", invoiceId))
-		// Fuck it we hard code the phone number (for now)
-		params.SetFrom("+16478009984")
-		params.SetTo(phoneNumber)
+		resp := response{Success: true, Id: createdInvoice.Id}
+		return encode(w, r, http.StatusOK, resp)
+	})
+}
 
-		twResp, err := twc.Api.CreateMessage(params)
-		if err != nil {
-			log.Printf("Could not send SMS message %s", err)
-		}
-		log.Debug().Interface("twResp", twResp).Caller().Msg("Debug to take a look a twilio response")
-	}
+// orderSorts are the order_by fields invoice listings accept. Pages are cut in the DB, so only what
+// the DB stores about an order can be sorted by.
+var orderSorts = map[string]storage.OrderSort{
+	"metadata.createtime": storage.SortCreated,
+	"txndate":             storage.SortTxnDate,
 }
 
-func VoidQBInvoice(qbc *qb.Client, a *auth.Client, twc *twilio.RestClient) http.HandlerFunc {
-	type response struct {
-		Success bool `json:"success"`
+// parseOrderBy parses an order_by like "TxnDate DESC"
+func parseOrderBy(orderBy string) (storage.OrderSort, bool, error) {
+	fields := strings.Fields(orderBy)
+	invalid := badRequest("Invalid order", nil, FieldError{Field: "order_by", Message: "must be MetaData.CreateTime or TxnDate, then ASC or DESC"})
+	if len(fields) == 0 || len(fields) > 2 {
+		return "", false, invalid
 	}
-	return func(w http.ResponseWriter, r *http.Request) {
-		// get claims from context
-		claims := r.Context().Value("claims").(domain.Claims)
-		// Franchisers should not be able to void invoices
-		if claims.IsFranchiser {
-			http.Error(w, "No Access", http.StatusServiceUnavailable)
-			return
-		}
-		// Get QB token and set jwt for QB Client
-		token, err := decryptJWE(claims.QBBearerToken)
-		if err != nil {
-			http.Error(w, "Could not decrypt QB token", http.StatusUnauthorized)
-			return
-		}
-		qbc.SetClient(qb.BearerToken{AccessToken: string(token)})
-
-		// get id from url
-		invoiceId := r.PathValue("id")
-		if invoiceId == "" {
-			http.Error(w, "No ID in URL", http.StatusBadRequest)
-			return
-		}
-		// Get invoice by ID
-		existingInvoice, err := qbc.FindInvoiceById(claims.QBCompanyID, invoiceId)
-		if err != nil {
-			http.Error(w, "Could not verify that invoice exists or is in draft status", http.StatusInternalServerError)
-			return
-		}
-		// Verify that the invoice status is currently in PENDING
-		if qb.CheckInvoiceStatus(existingInvoice) != qb.INVOICE_PENDING && qb.CheckInvoiceStatus(existingInvoice) != qb.INVOICE_DRAFT {
-			http.Error(w, "Invoice is not in pending or draft status", http.StatusBadRequest)
-			return
-		}
-		// slice old doc number and change status to voided
-		invoiceToUpdate := struct {
-			Id        string `json:"Id"`
-			SyncToken string `json:"SyncToken"`
-			Sparse    bool   `json:"sparse"`
-			DocNumber string `json:"DocNumber"`
-		}{
-			Id:        invoiceId,
-			SyncToken: existingInvoice.SyncToken,
-			Sparse:    true,
-			DocNumber: qb.ChangeInvoiceStatus(existingInvoice.DocNumber, qb.INVOICE_VOID),
-		}
-		updatedInvoice, err := qbc.UpdateInvoice(claims.QBCompanyID, invoiceToUpdate)
-		err = qbc.VoidInvoice(claims.QBCompanyID, updatedInvoice.Id, updatedInvoice.SyncToken)
-		if err != nil {
-			logHttpError(err, "Could not void invoice", http.StatusInternalServerError, &w)
-			return
-		}
-
-		resp := response{Success: true}
-		encode(w, r, http.StatusOK, resp)
-		// send twilio message that invoice has been voided
-		user, err := a.GetUser(r.Context(), claims.FirebaseID)
-		if err != nil {
-			log.Error().Err(err).Msg("Could not get user to send sms message for void")
-		}
-		var phoneNumber string
-		if phoneNumber == "" {
-			phoneNumber = user.PhoneNumber
-		}
-		customer, err := qbc.GetCustomerById(claims.QBCompanyID, existingInvoice.CustomerRef.Value)
-		if err != nil {
-			log.Printf("%s", err)
-		} else {
-			if phoneNumber == "" {
-				phoneNumber = qbToE164Phone(customer.PrimaryPhone.FreeFormNumber)
-				if customer.PrimaryPhone.FreeFormNumber == "" {
-					phoneNumber = qbToE164Phone(customer.Mobile.FreeFormNumber)
-				}
-				if customer.Mobile.FreeFormNumber == "" {
-					phoneNumber = qbToE164Phone(customer.AlternatePhone.FreeFormNumber)
-				}
-
-				if err != nil {
-					log.Printf("%s", err)
-				}
-			}
-		}
-
-		params := &twApi.CreateMessageParams{}
-		params.SetBody(fmt.Sprintf("Order %s has been voided by: %s. For more details please visit: https://ordrport.com/franchisee/invoices", customer.DisplayName, invoiceId))
-		params.SetFrom("+16478009984")
-		params.SetTo("+15062329415")
-
-		twResp, err := twc.Api.CreateMessage(params)
-		if err != nil {
-			log.Printf("Could not send SMS message %s", err)
+	sort, ok := orderSorts[strings.ToLower(fields[0])]
+	if !ok {
+		return "", false, invalid
+	}
+	descending := false
+	if len(fields) == 2 {
+		switch strings.ToUpper(fields[1]) {
+		case "ASC":
+		case "DESC":
+			descending = true
+		default:
+			return "", false, invalid
 		}
-		log.Debug().Interface("twResp", twResp).Caller().Msg("Debug to take a look a twilio response")
 	}
+	return sort, descending, nil
 }
 
-func DeleteQBInvoice(qbc *qb.Client, a *auth.Client, twc *twilio.RestClient) http.HandlerFunc {
+// ListQBInvoices lists the company's orders, or the franchisee's own. It takes these query params:
+//   - order_by: MetaData.CreateTime or TxnDate, then ASC or DESC. Defaults to MetaData.CreateTime ASC.
+//   - page_size: defaults to 10. Sizes over qb.MaxQueryIDs are clamped to it.
+//   - page_token: the position of the first order of the page, starting at 1
+//   - statuses: the status codes to list, see domain.OrderStatusFromCode. Defaults to all of them.
+//   - customer_ref: only list the orders of this customer, franchisees only see their own
+//   - query: a QuickBooks condition the invoices have to match, e.g. TotalAmt > '100'
+func ListQBInvoices(qbc *qb.Client, tokens *qbtoken.Manager, s *storage.SQLStorage) http.HandlerFunc {
+	type invoice struct {
+		qb.InvoiceTruncated
+		Status domain.OrderStatus `json:"status"`
+	}
 	type response struct {
-		Success bool `json:"success"`
+		TotalCount int       `json:"total_count"`
+		Invoices   []invoice `json:"invoices"`
 	}
-	return func(w http.ResponseWriter, r *http.Request) {
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
 		// get claims from context
-		claims := r.Context().Value("claims").(domain.Claims)
-		// Franchisers should not be able to delete invoices
-		if claims.IsFranchiser {
-			http.Error(w, "No Access", http.StatusServiceUnavailable)
-			return
-		}
-		// Get QB token and set jwt for QB Client
-		token, err := decryptJWE(claims.QBBearerToken)
+		claims := ClaimsFromContext(r.Context())
+		// get QB token and set jwt for QB Client
+		qbc, err := realmClient(r.Context(), qbc, tokens, claims.QBCompanyID)
 		if err != nil {
-			http.Error(w, "Could not decrypt QB token", http.StatusUnauthorized)
-			return
+			return err
+		}
+		// Get query params
+		q := r.URL.Query()
+		orderBy := getQueryWithDefault(&q, "order_by", "MetaData.CreateTime ASC")
+		pageSize := getQueryWithDefault(&q, "page_size", "10")
+		pageToken := getQueryWithDefault(&q, "page_token", "1")
+		statuses := getQueryWithDefault(&q, "statuses", "DPARVC")
+		customerRef := r.URL.Query().Get("customer_ref")
+		query := getQueryWithDefault(&q, "query", "")
+		// Because quickbooks doesn't allow to query invoices by name directly, first get ids of customers based on query, and then get invoices for those customers
+		if !claims.IsFranchiser {
+			customerRef = claims.QBCustomerID
 		}
-		qbc.SetClient(qb.BearerToken{AccessToken: string(token)})
 
-		// get id from url
-		invoiceId := r.PathValue("id")
-		if invoiceId == "" {
-			http.Error(w, "No ID in URL", http.StatusBadRequest)
-			return
+		// Statuses are stored in the DB, so get the matching invoice ids there and only ask QB for those
+		var orderStatuses []domain.OrderStatus
+		for i := 0; i < len(statuses); i++ {
+			if status, ok := domain.OrderStatusFromCode(statuses[i]); ok {
+				orderStatuses = append(orderStatuses, status)
+			}
 		}
-		// Get invoice by ID
-		existingInvoice, err := qbc.FindInvoiceById(claims.QBCompanyID, invoiceId)
-		if err != nil {
-			http.Error(w, "Could not verify that invoice exists or is in draft status", http.StatusInternalServerError)
-			return
+		limit, err := strconv.Atoi(pageSize)
+		if err != nil || limit < 1 {
+			return badRequest("Invalid page size", err, FieldError{Field: "page_size", Message: "must be at least 1"})
 		}
-		// Verify that the invoice status is currently in DRAFT
-		if qb.CheckInvoiceStatus(existingInvoice) != qb.INVOICE_DRAFT {
-			http.Error(w, "Invoice is not in pending or draft status", http.StatusBadRequest)
-			return
+		// Each page is asked from QB by id in one query
+		limit = min(limit, qb.MaxQueryIDs)
+		start, err := strconv.Atoi(pageToken)
+		if err != nil || start < 1 {
+			return badRequest("Invalid page token", err, FieldError{Field: "page_token", Message: "must be a position starting at 1"})
 		}
-		err = qbc.VoidInvoice(claims.QBCompanyID, existingInvoice.Id, existingInvoice.SyncToken)
+		// The DB sorts and pages the orders, QB only fills in the invoices
+		sort, descending, err := parseOrderBy(orderBy)
 		if err != nil {
-			logHttpError(err, "Could not void invoice", http.StatusInternalServerError, &w)
-			return
+			return err
 		}
 
-		resp := response{Success: true}
-		encode(w, r, http.StatusOK, resp)
-		// send twilio message that invoice has been voided
-		user, err := a.GetUser(r.Context(), claims.FirebaseID)
-		if err != nil {
-			log.Error().Err(err).Msg("Could not get user to send sms message for void")
-		}
-		var phoneNumber string
-		if phoneNumber == "" {
-			phoneNumber = user.PhoneNumber
+		if err := backfillOrders(r.Context(), qbc, s, claims.QBCompanyID); err != nil {
+			return err
 		}
-		customer, err := qbc.GetCustomerById(claims.QBCompanyID, existingInvoice.CustomerRef.Value)
-		if err != nil {
-			log.Printf("%s", err)
-		} else {
-			if phoneNumber == "" {
-				phoneNumber = qbToE164Phone(customer.PrimaryPhone.FreeFormNumber)
-				if customer.PrimaryPhone.FreeFormNumber == "" {
-					phoneNumber = qbToE164Phone(customer.Mobile.FreeFormNumber)
-				}
-				if customer.Mobile.FreeFormNumber == "" {
-					phoneNumber = qbToE164Phone(customer.AlternatePhone.FreeFormNumber)
-				}
 
+		var totalCount int
+		var qbInvoices []qb.InvoiceTruncated
+		if query == "" {
+			var invoiceIDs []string
+			invoiceIDs, totalCount, err = s.ListOrderInvoiceIDs(claims.QBCompanyID, customerRef, orderStatuses, sort, descending, limit, start-1)
+			if err != nil {
+				return internalError("Could not get orders", err)
+			}
+			if len(invoiceIDs) > 0 {
+				qbInvoices, err = qbc.QueryInvoices(r.Context(), claims.QBCompanyID, "Id", strconv.Itoa(len(invoiceIDs)), "1", invoiceIDs, customerRef, "")
 				if err != nil {
-					log.Printf("%s", err)
+					return qbError(err, "Could not get invoices")
 				}
+				sortLike(qbInvoices, invoiceIDs)
 			}
-		}
-
-		params := &twApi.CreateMessageParams{}
-		params.SetBody(fmt.Sprintf("Order %s has been voided by: %s. For more details please visit: https://ordrport.com/franchisee/invoices", customer.DisplayName, invoiceId))
-		params.SetFrom("+16478009984")
-		params.SetTo("+15062329415")
-
-		twResp, err := twc.Api.CreateMessage(params)
-		if err != nil {
-			log.Printf("Could not send SMS message %s", err)
-		}
-		log.Debug().Interface("twResp", twResp).Caller().Msg("Debug to take a look a twilio response")
-	}
-}
-
-func CompleteQBInvoice(qbc *qb.Client, a *auth.Client, twc *twilio.RestClient, s *storage.SQLStorage) http.HandlerFunc {
-	type response struct {
-		Success bool `json:"success"`
-	}
-	return func(w http.ResponseWriter, r *http.Request) {
-		// get claims from context
-		claims := r.Context().Value("claims").(domain.Claims)
-		// Franchisers should not be able to complete invoices
-		if !claims.IsFranchiser {
-			http.Error(w, "No Access", http.StatusServiceUnavailable)
-			return
-		}
-		// Get QB token and set jwt for QB Client
-		token, err := decryptJWE(claims.QBBearerToken)
-		if err != nil {
-			http.Error(w, "Could not decrypt QB token", http.StatusUnauthorized)
-			return
-		}
-		qbc.SetClient(qb.BearerToken{AccessToken: string(token)})
-
-		// get id from url
-		invoiceId := r.PathValue("id")
-		if invoiceId == "" {
-			http.Error(w, "No ID in URL", http.StatusBadRequest)
-			return
-		}
-		// Get invoice by ID
-		existingInvoice, err := qbc.FindInvoiceById(claims.QBCompanyID, invoiceId)
-		if err != nil {
-			http.Error(w, "Could not verify that invoice exists or is in draft status", http.StatusInternalServerError)
-			return
-		}
-		// Verify that the invoice status is currently in APPROVED
-		if qb.CheckInvoiceStatus(existingInvoice) != qb.INVOICE_APPROVED {
-			http.Error(w, "Invoice is not in approved status", http.StatusBadRequest)
-			return
-		}
-		// slice old doc number and change status to completed
-		invoiceToUpdate := struct {
-			Id        string `json:"Id"`
-			SyncToken string `json:"SyncToken"`
-			Sparse    bool   `json:"sparse"`
-			DocNumber string `json:"DocNumber"`
-			DueDate   string `json:"DueDate"`
-		}{
-			Id:        invoiceId,
-			SyncToken: existingInvoice.SyncToken,
-			Sparse:    true,
-			DocNumber: qb.ChangeInvoiceStatus(existingInvoice.DocNumber, qb.INVOICE_COMPLETE),
-			// 2 weeks from now by default
-			DueDate: time.Now().AddDate(0, 0, 14).Format("2006-01-02"),
-		}
-		_, err = qbc.UpdateInvoice(claims.QBCompanyID, invoiceToUpdate)
-		if err != nil {
-			logHttpError(err, "Could not update invoice", http.StatusInternalServerError, &w)
-			return
-		}
-
-		resp := response{Success: true}
-		encode(w, r, http.StatusOK, resp)
-
-		// Basic debug observability
-		log.Debug().Interface("invoice", existingInvoice).Msg("Invoice completed")
-		log.Debug().Msg("Customer Name: " + existingInvoice.CustomerRef.Name)
-
-		// Send email with invoice
-		companyName := "OrdrPort Franchisor #" + claims.QBCompanyID
-		customerName := existingInvoice.CustomerRef.Name
-		// customerEmails is a list of emails to send to (Emails from qb and firebase)
-		// We're using map to avoid duplicates and struct since it takes no memory
-		customerEmails := map[string]struct{}{}
-		customerEmails[existingInvoice.BillEmail.Address] = struct{}{}
-		customerEmails[existingInvoice.BillEmailCC.Address] = struct{}{}
-		customerEmails[existingInvoice.BillEmailBCC.Address] = struct{}{}
-
-		// Get company information from QB to set Company
-		qbCompany, qbErr := qbc.FindCompanyInfo(claims.QBCompanyID)
-		if qbErr != nil {
-			log.Debug().Interface("qbCompany", qbCompany).Caller().Msg("Company information from QB")
-			log.Error().Err(qbErr).Msg("Could not get company information from QB to set Company")
 		} else {
-			companyName = qbCompany.CompanyName
-		}
-
-		// Get customer information from DB
-		dbCustomer, dbErr := s.GetCustomerByQBID(existingInvoice.CustomerRef.Value, claims.QBCompanyID)
-		if dbErr != nil {
-			log.Error().Err(dbErr).Msg("Could not get customer information from DB to send email")
-		} else {
-			fbCustomer, fbErr := a.GetUser(r.Context(), dbCustomer.FirebaseID)
-			if fbErr != nil {
-				log.Error().Err(fbErr).Msg("Could not get customer information from Firebase to send email")
-			} else {
-				// Add firebase email to list of emails to send to
-				customerEmails[fbCustomer.Email] = struct{}{}
+			// Only QB can search, so every order is searched a chunk at a time and the matches paged
+			invoiceIDs, _, err := s.ListOrderInvoiceIDs(claims.QBCompanyID, customerRef, orderStatuses, sort, descending, 0, 0)
+			if err != nil {
+				return internalError("Could not get orders", err)
 			}
-		}
-
-		// Subject and content
-		subject := fmt.Sprintf("Your Order %s is Ready for Pickup!", invoiceId)
-		htmlContent := fmt.Sprintf("<html><body><h1>Hello %s,</h1><p>Your order %s is ready for pickup!</p><p>To see the invoice, please visit: <a href=\"https://ordrport.com/franchisee/invoices/%s\">Invoice</a></p><p>Thank you for using OrdrPort!</p><p>Best regards,<br>%s</p></body></html>", customerName, invoiceId, invoiceId, companyName)
-		content := mail.NewContent("text/html", htmlContent)
-
-		// Get Invoice PDF
-		a_pdf := mail.NewAttachment()
-		pdf, err := qbc.GetInvoicePDF(claims.QBCompanyID, invoiceId)
-		if err != nil {
-			logHttpError(err, "Could not get PDF", http.StatusInternalServerError, &w)
-			return
-		}
-		encoded := base64.StdEncoding.EncodeToString(pdf)
-		a_pdf.SetContent(encoded)
-		a_pdf.SetType("application/pdf")
-		a_pdf.SetFilename(fmt.Sprintf("Invoice_%s.pdf", invoiceId))
-		a_pdf.SetDisposition("attachment")
-
-		// Create attachments
-		attachments := []*mail.Attachment{a_pdf}
-
-		sendEmail(companyName, customerName, customerEmails, subject, content, attachments)
-
-		// Messaging isn't as important so we send message after we send response
-		// TODO: add twilio sms messaging
-		// add twilio message
-		// Do we get the phone number from the customer or the user??? Going to be using firebase phone number for now
-		// Okay here's how we're setting priority:
-		// 1. Check MfaEnrollment PhoneNumber (aka the phone number set for MFA)
-		// if none exist then: 2. Check firebase.UserInfo.PhoneNumber (What got set when firebase account was created)
-		// if none exist then: 3. Check qb customer phone
-		// Get firebase user phone number
-		user, err := a.GetUser(r.Context(), claims.FirebaseID)
-		if err != nil {
-			log.Error().Err(err).Msg("Could not get user")
-		}
-		// TODO: implement get mfa enrollment in fbc
-		// 1. get mfaInfo
-		// phoneNumber := fbc.GetUserInfo.MfaEnrollment.PhoneNumber
-		var phoneNumber string
-		// 2.
-		if phoneNumber == "" {
-			phoneNumber = user.PhoneNumber
-		}
-		// 3.
-		customer, err := qbc.GetCustomerById(claims.QBCompanyID, existingInvoice.CustomerRef.Value)
-		if err != nil {
-			log.Printf("%s", err)
-		} else {
-			if phoneNumber == "" {
-				phoneNumber = qbToE164Phone(customer.PrimaryPhone.FreeFormNumber)
-				if customer.PrimaryPhone.FreeFormNumber == "" {
-					phoneNumber = qbToE164Phone(customer.Mobile.FreeFormNumber)
-				}
-				if customer.Mobile.FreeFormNumber == "" {
-					phoneNumber = qbToE164Phone(customer.AlternatePhone.FreeFormNumber)
-				}
-
+			var matches []qb.InvoiceTruncated
+			for chunk := range slices.Chunk(invoiceIDs, qb.MaxQueryIDs) {
+				found, err := qbc.QueryInvoices(r.Context(), claims.QBCompanyID, "Id", strconv.Itoa(len(chunk)), "1", chunk, customerRef, query)
 				if err != nil {
-					log.Printf("%s", err)
+					return qbError(err, "Could not get invoices")
 				}
+				matches = append(matches, found...)
 			}
+			sortLike(matches, invoiceIDs)
+			totalCount = len(matches)
+			qbInvoices = matches[min(start-1, totalCount):min(start-1+limit, totalCount)]
 		}
 
-		// TODO FOR Demo purpose
-		// if phoneNumber == "" {
-		// 	log.Println("No Phone number to send notification to. None sent.")
-		// 	return
-		// }
-		// TODO are all these phone number formats the same?
-		params := &twApi.CreateMessageParams{}
-		params.SetBody(fmt.Sprintf("Order %s has been completed and is ready for pickup! To see the invoice, please visit: https://ordrport.com/franchisee/invoices/%s", invoiceId, invoiceId))
-		// Fuck it we hard code the phone number (for now)
-		params.SetFrom("+16478009984")
-		params.SetTo(phoneNumber)
-
-		twResp, err := twc.Api.CreateMessage(params)
-		if err != nil {
-			log.Printf("Could not send SMS message %s", err)
-		}
-		log.Debug().Interface("twResp", twResp).Caller().Msg("Debug to take a look a twilio response")
-		// else {
-		// 	if twResp.Body == nil {
-		// 		log.Error().Interface("twResp", twResp).Msg("twRespbody was nil")
-		// 	} else {
-		// 		log.Print(twResp)
-		// 	}
-		// }
-
-		// fuinally send email as well
-		// if customer.PrimaryEmailAddr != nil && customer.PrimaryEmailAddr.Address != "" {
-		// 	err = qbc.SendInvoice(claims.QBCompanyID, invoiceId, customer.PrimaryEmailAddr.Address)
-		// 	if err != nil {
-		// 		log.Error().Err(err).Msg("Email couldn't be sent")
-		// 	}
-		// }
-	}
-}
-
-func DuplicateQBInvoice(qbc *qb.Client) http.HandlerFunc {
-	type response struct {
-		Success bool   `json:"success"`
-		Id      string `json:"id"`
-	}
-	return func(w http.ResponseWriter, r *http.Request) {
-		// get claims from context
-		claims := r.Context().Value("claims").(domain.Claims)
-		// Franchisers should not be able to create invoices
-		if claims.IsFranchiser {
-			http.Error(w, "No Access", http.StatusServiceUnavailable)
-			return
-		}
-		// Get QB token and set jwt for QB Client
-		token, err := decryptJWE(claims.QBBearerToken)
-		if err != nil {
-			http.Error(w, "Could not decrypt QB token", http.StatusUnauthorized)
-			return
-		}
-
-		invoiceId := r.PathValue("id")
-		if invoiceId == "" {
-			http.Error(w, "No id in url", http.StatusBadRequest)
-			return
+		pageIDs := make([]string, len(qbInvoices))
+		for i, qbInvoice := range qbInvoices {
+			pageIDs[i] = qbInvoice.Id
 		}
-
-		// Get invoice by ID
-		existingInvoice, err := qbc.FindInvoiceById(claims.QBCompanyID, invoiceId)
+		orderStatusesByID, err := s.GetOrderStatuses(claims.QBCompanyID, pageIDs)
 		if err != nil {
-			http.Error(w, "Could not verify that invoice exists or is in draft status", http.StatusInternalServerError)
-			return
+			return internalError("Could not get order statuses", err)
 		}
-
-		// Get existing invoice lines
-
-		qbc.SetClient(qb.BearerToken{AccessToken: string(token)})
-		// Create invoice order details
-
-		// Set Docnumber and customer reference for invoice
-		invoice := &qb.Invoice{
-			Line:        existingInvoice.Line,
-			CustomerRef: qb.ReferenceType{Value: claims.QBCustomerID},
-			DocNumber:   "A1000000-" + time.Now().Format("060102150405"),
+		invoices := make([]invoice, len(qbInvoices))
+		for i, qbInvoice := range qbInvoices {
+			invoices[i] = invoice{InvoiceTruncated: qbInvoice, Status: orderStatusesByID[qbInvoice.Id]}
 		}
 
-		// Get customer details
-		customer, err := qbc.GetCustomerById(claims.QBCompanyID, claims.QBCustomerID)
-		if err != nil {
-			log.Printf("%s", err)
-		}
-		if customer.PrimaryEmailAddr != nil && customer.PrimaryEmailAddr.Address != "" {
-			invoice.BillEmail = qb.EmailAddress{Address: customer.PrimaryEmailAddr.Address}
-		}
-
-		// Create Invoice and send
-		createdInvoice, err := qbc.CreateInvoice(claims.QBCompanyID, invoice)
-		if err != nil {
-			logHttpError(err, "Could not create invoice", http.StatusInternalServerError, &w)
-			return
-		}
-
-		resp := response{Success: true, Id: createdInvoice.Id}
-		encode(w, r, http.StatusOK, resp)
-	}
+		resp := response{TotalCount: totalCount, Invoices: invoices}
+		return encode(w, r, http.StatusOK, resp)
+	})
 }
 
-func ListQBInvoices(qbc *qb.Client) http.HandlerFunc {
-	type response struct {
-		TotalCount int                   `json:"total_count"`
-		Invoices   []qb.InvoiceTruncated `json:"invoices"`
-	}
-	return func(w http.ResponseWriter, r *http.Request) {
-		// get claims from context
-		claims := r.Context().Value("claims").(domain.Claims)
-		// get QB token and set jwt for QB Client
-		token, err := decryptJWE(claims.QBBearerToken)
-		if err != nil {
-			http.Error(w, "Could not decrypt QB token", http.StatusUnauthorized)
-			return
-		}
-		qbc.SetClient(qb.BearerToken{AccessToken: string(token)})
-		// Get query params
-		q := r.URL.Query()
-		orderBy := getQueryWithDefault(&q, "order_by", "DocNumber ASC")
-		pageSize := getQueryWithDefault(&q, "page_size", "10")
-		pageToken := getQueryWithDefault(&q, "page_token", "1")
-		statuses := getQueryWithDefault(&q, "statuses", "DPARVC")
-		customerRef := r.URL.Query().Get("customer_ref")
-		query := getQueryWithDefault(&q, "query", "")
-		// Because quickbooks doesn't allow to query invoices by name directly, first get ids of customers based on query, and then get invoices for those customers
-		if !claims.IsFranchiser {
-			customerRef = claims.QBCustomerID
-		}
-
-		totalCount, err := qbc.QueryInvoicesCount(claims.QBCompanyID, statuses, customerRef, query)
-		if err != nil {
-			http.Error(w, "Could not get customers (total count)", http.StatusInternalServerError)
-			return
-		}
-
-		invoices, err := qbc.QueryInvoices(claims.QBCompanyID, orderBy, pageSize, pageToken, statuses, customerRef, query)
-		if err != nil {
-			logHttpError(err, "Could not get invoices", http.StatusInternalServerError, &w)
-			return
-		}
-
-		resp := response{TotalCount: totalCount, Invoices: invoices}
-		encode(w, r, http.StatusOK, resp)
+// sortLike sorts invoices in the order their ids are in
+func sortLike(invoices []qb.InvoiceTruncated, ids []string) {
+	position := make(map[string]int, len(ids))
+	for i, id := range ids {
+		position[id] = i
 	}
+	slices.SortFunc(invoices, func(a, b qb.InvoiceTruncated) int {
+		return position[a.Id] - position[b.Id]
+	})
 }
 
-func GetQBCustomer(qbc *qb.Client, s *storage.SQLStorage) http.Handler {
+func GetQBCustomer(qbc *qb.Client, tokens *qbtoken.Manager, s *storage.SQLStorage) http.Handler {
 	type response struct {
 		Customer qb.Customer `json:"customer"`
 		IsLinked bool        `json:"is_linked"`
 	}
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
 		// Get claims from jwt
-		claims := r.Context().Value("claims").(domain.Claims)
-		// Decrypt JWE for QB from JWT
-		token, err := decryptJWE(claims.QBBearerToken)
+		claims := ClaimsFromContext(r.Context())
+		// Get QB token and set jwt for QB Client
+		qbc, err := realmClient(r.Context(), qbc, tokens, claims.QBCompanyID)
 		if err != nil {
-			http.Error(w, "Could not decrypt QB token", http.StatusUnauthorized)
-			return
+			return err
 		}
-		qbc.SetClient(qb.BearerToken{AccessToken: string(token)})
 		// Get Customer ID from URL
 		customerId := r.PathValue("id")
 		if customerId == "" {
-			logHttpError(err, "No ID in URL", http.StatusBadRequest, &w)
-			return
-		}
-		// If franchisee is calling, they can get only get information about themselves
-		if !claims.IsFranchiser && customerId != claims.QBCustomerID {
-			logHttpError(err, "No Access", http.StatusServiceUnavailable, &w)
-			return
+			return badRequest("No ID in URL", nil)
 		}
 		// Get customer from QB
-		customer, err := qbc.GetCustomerById(claims.QBCompanyID, customerId)
+		customer, err := qbc.GetCustomerById(r.Context(), claims.QBCompanyID, customerId)
 		if err != nil {
-			http.Error(w, "Could not get customer", http.StatusInternalServerError)
-			return
+			return qbError(err, "Could not get customer")
 		}
 		// Check if firebase account exists for QB user
 		isLinked, err := s.IsFirebaseUserCustomer(customerId)
 		if err != nil {
-			logHttpError(err, "Could not check if firebase user linked to qb customer", http.StatusInternalServerError, &w)
-			return
+			return internalError("Could not check if firebase user linked to qb customer", err)
 		}
 		// Return customer and if linked
 		resp := response{Customer: *customer, IsLinked: isLinked}
-		encode(w, r, http.StatusOK, resp)
+		return encode(w, r, http.StatusOK, resp)
 	})
 }
 
-func GetQBInvoice(qbc *qb.Client) http.Handler {
+func GetQBInvoice(qbc *qb.Client, tokens *qbtoken.Manager, s *storage.SQLStorage) http.Handler {
 	type response struct {
-		Invoice qb.Invoice `json:"invoice"`
+		Invoice qb.Invoice         `json:"invoice"`
+		Status  domain.OrderStatus `json:"status"`
 	}
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
 		// get claims from context
-		claims := r.Context().Value("claims").(domain.Claims)
+		claims := ClaimsFromContext(r.Context())
 		// Get QB token and set jwt for QB Client
-		token, err := decryptJWE(claims.QBBearerToken)
+		qbc, err := realmClient(r.Context(), qbc, tokens, claims.QBCompanyID)
 		if err != nil {
-			logHttpError(err, "Could not decrypt QB token", http.StatusUnauthorized, &w)
-			return
+			return err
 		}
-		qbc.SetClient(qb.BearerToken{AccessToken: string(token)})
 		// Get query params
 		invoiceId := r.PathValue("id")
 		if invoiceId == "" {
-			logHttpError(err, "No ID in URL", http.StatusBadRequest, &w)
-			return
+			return badRequest("No ID in URL", nil)
 		}
 		// Get Invoice from QB
-		invoice, err := qbc.FindInvoiceById(claims.QBCompanyID, invoiceId)
+		invoice, err := qbc.FindInvoiceById(r.Context(), claims.QBCompanyID, invoiceId)
 		if err != nil {
-			logHttpError(err, "Could not get invoice", http.StatusInternalServerError, &w)
-			return
+			return qbError(err, "Could not get invoice")
 		}
 		// If franchisee is calling, they can get only get information about themselves
 		if !claims.IsFranchiser && invoice.CustomerRef.Value != claims.QBCustomerID {
-			logHttpError(err, "No Access", http.StatusServiceUnavailable, &w)
-			return
+			return forbidden(err)
+		}
+		// Invoices that weren't created through OrdrPort don't have a status
+		order, err := getOrder(s, claims.QBCompanyID, invoice)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return internalError("Could not get order status", err)
 		}
 		// Write invoice to response
-		resp := response{Invoice: *invoice}
-		encode(w, r, http.StatusOK, resp)
+		resp := response{Invoice: *invoice, Status: order.Status}
+		return encode(w, r, http.StatusOK, resp)
 	})
 }
 
-func GetQBInvoicePDF(qbc *qb.Client) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+func GetQBInvoicePDF(qbc *qb.Client, tokens *qbtoken.Manager) http.Handler {
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
 		// get claims from context
-		claims := r.Context().Value("claims").(domain.Claims)
-		token, err := decryptJWE(claims.QBBearerToken)
+		claims := ClaimsFromContext(r.Context())
+		qbc, err := realmClient(r.Context(), qbc, tokens, claims.QBCompanyID)
 		if err != nil {
-			http.Error(w, "Could not decrypt QB token", http.StatusUnauthorized)
-			return
+			return err
 		}
-		qbc.SetClient(qb.BearerToken{AccessToken: string(token)})
 
 		invoiceId := r.PathValue("id")
 		if invoiceId == "" {
-			http.Error(w, "No id in url", http.StatusBadRequest)
-			return
+			return badRequest("No id in url", nil)
 		}
 		// Get PDF
-		pdf, err := qbc.GetInvoicePDF(claims.QBCompanyID, invoiceId)
+		pdf, err := qbc.GetInvoicePDF(r.Context(), claims.QBCompanyID, invoiceId)
 		if err != nil {
-			logHttpError(err, "Could not get PDF", http.StatusInternalServerError, &w)
-			return
+			return qbError(err, "Could not get PDF")
 		}
 		w.Header().Set("Content-Type", "application/pdf")
 		w.Header().Set("Content-Disposition", "attachment; filename=invoice.pdf")
-		w.Write(pdf)
+		_, err = w.Write(pdf)
+		return err
 	})
 }
 
-func getQueryWithDefault(q *url.Values, field string, fallback string) string {
-	val := q.Get(field)
-	if val == "" {
-		return fallback
-	} else {
-		return val
+// GetQBRateLimit shows how close the company is to QuickBooks' rate limit
+func GetQBRateLimit(qbc *qb.Client) http.HandlerFunc {
+	type response struct {
+		RequestsPerMinute  int           `json:"requests_per_minute"`
+		ConcurrentRequests int           `json:"concurrent_requests"`
+		Stats              qb.RealmStats `json:"stats"`
+	}
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		// get claims from context
+		claims := ClaimsFromContext(r.Context())
+		resp := response{
+			RequestsPerMinute:  qb.RealmRequestsPerMinute,
+			ConcurrentRequests: qb.RealmConcurrentRequests,
+			Stats:              qbc.RateLimitStats(claims.QBCompanyID),
+		}
+		return encode(w, r, http.StatusOK, resp)
+	})
+}
+
+// createDraftInvoice creates the invoice of a new order in QuickBooks, billed to the customer's email
+func createDraftInvoice(ctx context.Context, qbc *qb.RealmClient, companyID string, customerID string, lines []qb.Line) (*qb.Invoice, error) {
+	invoice := &qb.Invoice{
+		Line:        lines,
+		CustomerRef: qb.ReferenceType{Value: customerID},
+		DocNumber:   newDocNumber(),
+	}
+	customer, err := qbc.GetCustomerById(ctx, companyID, customerID)
+	if err != nil {
+		return nil, qbError(err, "Could not get customer")
+	}
+	if customer.PrimaryEmailAddr != nil && customer.PrimaryEmailAddr.Address != "" {
+		invoice.BillEmail = qb.EmailAddress{Address: customer.PrimaryEmailAddr.Address}
+	}
+	created, err := qbc.CreateInvoice(ctx, companyID, invoice)
+	if err != nil {
+		return nil, qbError(err, "Could not create invoice")
 	}
+	return created, nil
 }
 
-func decryptJWE(jwe string) (string, error) {
-	encKey := config.LoadConfigs().JWEKey
-	rawKey, err := base64.StdEncoding.DecodeString(encKey)
+// newDocNumber generates a DocNumber for a new invoice. It's only there so bookkeepers have something to
+// go by in QuickBooks, the order status is tracked in the DB.
+func newDocNumber() string {
+	return "ORD-" + time.Now().Format("060102150405")
+}
+
+// legacyOrderStatuses maps the statuses that used to be encoded in the DocNumber to order statuses
+var legacyOrderStatuses = map[int]domain.OrderStatus{
+	qb.INVOICE_DRAFT:    domain.OrderDraft,
+	qb.INVOICE_PENDING:  domain.OrderPending,
+	qb.INVOICE_APPROVED: domain.OrderApproved,
+	qb.INVOICE_REVISION: domain.OrderRevision,
+	qb.INVOICE_VOID:     domain.OrderVoid,
+	qb.INVOICE_COMPLETE: domain.OrderComplete,
+}
+
+// getOrder returns the order row for an invoice. Invoices created before statuses moved out of the
+// DocNumber don't have a row yet, so one is backfilled from the old DocNumber encoding.
+func getOrder(s orderStore, companyID string, invoice *qb.Invoice) (domain.Order, error) {
+	order, err := s.GetOrder(companyID, invoice.Id)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return order, err
+	}
+	status, ok := legacyOrderStatuses[qb.CheckInvoiceStatus(invoice)]
+	if !ok {
+		return domain.Order{}, fmt.Errorf("invoice %s is not an OrdrPort order: %w", invoice.Id, err)
+	}
+	err = s.BackfillOrder(companyID, invoice.Id, invoice.CustomerRef.Value, status, invoice.MetaData.CreateTime.Time, invoice.TxnDate.Time)
 	if err != nil {
-		return "", err
+		return domain.Order{}, err
 	}
-	decryptedObject, err := jose.ParseEncrypted(jwe)
+	return s.GetOrder(companyID, invoice.Id)
+}
+
+// backfillOrders gives the company's invoices from before statuses moved out of the DocNumber an
+// order row, the first time its orders are listed. Listings only show invoices with a row.
+func backfillOrders(ctx context.Context, qbc *qb.RealmClient, s *storage.SQLStorage, companyID string) error {
+	backfilled, err := s.OrdersBackfilled(companyID)
 	if err != nil {
-		return "", err
+		return internalError("Could not check for legacy orders", err)
+	}
+	if backfilled {
+		return nil
 	}
-	decrypted, err := decryptedObject.Decrypt(rawKey)
+	const pageSize = 1000
+	for start := 1; ; start += pageSize {
+		invoices, err := qbc.QueryInvoicePage(ctx, companyID, start, pageSize)
+		if err != nil {
+			return qbError(err, "Could not get legacy invoices")
+		}
+		for _, invoice := range invoices {
+			status, ok := legacyOrderStatuses[qb.CheckInvoiceStatus(&invoice)]
+			if !ok {
+				// Not one of ours, or created after statuses moved and tracked already
+				continue
+			}
+			err := s.BackfillOrder(companyID, invoice.Id, invoice.CustomerRef.Value, status, invoice.MetaData.CreateTime.Time, invoice.TxnDate.Time)
+			if err != nil {
+				return internalError("Could not backfill order", err)
+			}
+		}
+		if len(invoices) < pageSize {
+			break
+		}
+	}
+	if err := s.SetOrdersBackfilled(companyID); err != nil {
+		return internalError("Could not save legacy orders backfill", err)
+	}
+	return nil
+}
+
+// createOrder tracks a newly created invoice as a draft order. If that fails the invoice is voided
+// so we don't leave an invoice in QB that nobody can see.
+func createOrder(ctx context.Context, qbc *qb.RealmClient, s *storage.SQLStorage, claims domain.Claims, invoice *qb.Invoice) error {
+	return trackOrder(ctx, qbc, s, claims.QBCustomerID, draftEvent(ctx, claims, invoice), invoice)
+}
+
+// draftEvent is the history entry of an order created as a draft by claims
+func draftEvent(ctx context.Context, claims domain.Claims, invoice *qb.Invoice) domain.OrderEvent {
+	return domain.OrderEvent{
+		QBCompanyID:     claims.QBCompanyID,
+		QBInvoiceID:     invoice.Id,
+		ActorFirebaseID: claims.FirebaseID,
+		ActorRole:       string(orderstate.RoleOf(claims)),
+		ToStatus:        domain.OrderDraft,
+		TraceID:         traceID(ctx),
+	}
+}
+
+// trackOrder stores the order of a new invoice with the event that created it, see createOrder
+func trackOrder(ctx context.Context, qbc *qb.RealmClient, s *storage.SQLStorage, customerID string, event domain.OrderEvent, invoice *qb.Invoice) error {
+	err := s.CreateOrder(customerID, invoice.TxnDate.Time, event)
 	if err != nil {
-		return "", err
+		rollBackErr := qbc.VoidInvoice(ctx, event.QBCompanyID, invoice.Id, invoice.SyncToken)
+		if rollBackErr != nil {
+			log.Error().Err(rollBackErr).Msgf("Could not void invoice after DB createOrder failed for invoice: %s", invoice.Id)
+		}
+		return internalError("Could not create order in DB", err)
+	}
+	return nil
+}
+
+func getQueryWithDefault(q *url.Values, field string, fallback string) string {
+	val := q.Get(field)
+	if val == "" {
+		return fallback
+	} else {
+		return val
 	}
-	return string(decrypted), nil
 }
@@ -0,0 +1,193 @@
+package net
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	qb "github.com/Vertisphere/backend-service/external/quickbooks"
+	"github.com/Vertisphere/backend-service/internal/domain"
+	"github.com/Vertisphere/backend-service/internal/qbtoken"
+	"github.com/Vertisphere/backend-service/internal/storage"
+)
+
+// tokenStore hands out a fixed token per realm
+type tokenStore struct{}
+
+func (tokenStore) GetCompany(companyID string) (domain.Company, error) {
+	return domain.Company{
+		QBCompanyID:          companyID,
+		QBBearerToken:        "token-" + companyID,
+		QBBearerTokenExpiry:  time.Now().Add(time.Hour),
+		QBRefreshToken:       "refresh-" + companyID,
+		QBRefreshTokenExpiry: time.Now().Add(24 * time.Hour),
+	}, nil
+}
+
+func (tokenStore) UpdateTokenForCompany(string, string, int64, string, int64) error {
+	return nil
+}
+
+func (tokenStore) ClearTokensForCompany(string) error {
+	return nil
+}
+
+func (tokenStore) ExpireBearerToken(string, string) error {
+	return nil
+}
+
+type noRefresh struct{}
+
+func (noRefresh) RefreshToken(context.Context, string) (*qb.BearerToken, error) {
+	return nil, fmt.Errorf("tokens should not need a refresh")
+}
+
+func (noRefresh) RevokeToken(context.Context, string) error {
+	return fmt.Errorf("tokens should not be revoked")
+}
+
+// qbStub fails any request whose bearer token doesn't belong to the realm in the URL,
+// and otherwise answers with data tagged with the realm
+func qbStub(t *testing.T, mismatches *atomic.Int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// /v3/company/{realm}/...
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v3/company/"), "/")
+		realm := parts[0]
+		if got := r.Header.Get("Authorization"); got != "Bearer token-"+realm {
+			mismatches.Add(1)
+			t.Errorf("realm %s called with %q", realm, got)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/pdf"):
+			w.Write([]byte("%PDF-" + realm))
+		case strings.HasSuffix(r.URL.Path, "/query"):
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"QueryResponse":{"totalCount":1,"Item":[{"Id":%q,"Name":"item"}]}}`, realm)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func withClaims(r *http.Request, companyID string) *http.Request {
+	claims := domain.Claims{QBCompanyID: companyID, QBCustomerID: "0", IsFranchiser: true}
+	return r.WithContext(ContextWithClaims(r.Context(), claims))
+}
+
+// Run with -race: every request has to reach QuickBooks with its own company's token
+// even though all handlers share one qb.Client.
+func TestHandlersDontShareQBTokensAcrossRealms(t *testing.T) {
+	var mismatches atomic.Int64
+	srv := qbStub(t, &mismatches)
+	defer srv.Close()
+
+	qbc := qb.NewClientForEndpoint("id", "secret", "", qb.EndpointUrl(srv.URL), &qb.DiscoveryAPI{}, "75")
+	tokens := qbtoken.NewManager(tokenStore{}, noRefresh{})
+	listItems := ListQBItems(qbc, tokens, nil)
+	getPDF := GetQBInvoicePDF(qbc, tokens)
+
+	realms := []string{"1001", "1002", "1003", "1004", "1005", "1006", "1007", "1008"}
+	const requestsPerRealm = 25
+
+	var wg sync.WaitGroup
+	for _, realm := range realms {
+		for i := 0; i < requestsPerRealm; i++ {
+			wg.Add(2)
+			go func(realm string) {
+				defer wg.Done()
+				rec := httptest.NewRecorder()
+				listItems(rec, withClaims(httptest.NewRequest(http.MethodGet, "/qbItems", nil), realm))
+				if rec.Code != http.StatusOK {
+					t.Errorf("realm %s: list items returned %d: %s", realm, rec.Code, rec.Body)
+					return
+				}
+				var resp struct {
+					Items []struct {
+						Id string
+					} `json:"items"`
+				}
+				if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+					t.Errorf("realm %s: %v", realm, err)
+					return
+				}
+				if len(resp.Items) != 1 || resp.Items[0].Id != realm {
+					t.Errorf("realm %s got items %+v", realm, resp.Items)
+				}
+			}(realm)
+			go func(realm string) {
+				defer wg.Done()
+				req := httptest.NewRequest(http.MethodGet, "/qbInvoicePDF/1", nil)
+				req.SetPathValue("id", "1")
+				rec := httptest.NewRecorder()
+				getPDF.ServeHTTP(rec, withClaims(req, realm))
+				if rec.Code != http.StatusOK {
+					t.Errorf("realm %s: get pdf returned %d: %s", realm, rec.Code, rec.Body)
+					return
+				}
+				if got := rec.Body.String(); got != "%PDF-"+realm {
+					t.Errorf("realm %s got pdf %q", realm, got)
+				}
+			}(realm)
+		}
+	}
+	wg.Wait()
+
+	if n := mismatches.Load(); n > 0 {
+		t.Fatalf("%d requests were sent with another company's token", n)
+	}
+}
+
+func TestParseOrderBy(t *testing.T) {
+	tests := []struct {
+		orderBy    string
+		sort       storage.OrderSort
+		descending bool
+		err        bool
+	}{
+		{"MetaData.CreateTime ASC", storage.SortCreated, false, false},
+		{"TxnDate desc", storage.SortTxnDate, true, false},
+		{" txndate ", storage.SortTxnDate, false, false},
+		// QB could only sort these within a page
+		{"DocNumber ASC", "", false, true},
+		{"TotalAmt DESC", "", false, true},
+		{"TxnDate DESC, Id", "", false, true},
+		{"TxnDate sideways", "", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.orderBy, func(t *testing.T) {
+			sort, descending, err := parseOrderBy(tt.orderBy)
+			if tt.err {
+				if err == nil {
+					t.Errorf("parsed %q as %s, want an error", tt.orderBy, sort)
+				}
+				return
+			}
+			if err != nil || sort != tt.sort || descending != tt.descending {
+				t.Errorf("parseOrderBy = %q, %v, %v, want %q, %v", sort, descending, err, tt.sort, tt.descending)
+			}
+		})
+	}
+}
+
+// The DB cuts the pages, whatever order QB answers in
+func TestSortLike(t *testing.T) {
+	invoices := []qb.InvoiceTruncated{{Id: "10"}, {Id: "9"}, {Id: "130"}}
+	sortLike(invoices, []string{"9", "130", "10"})
+	var got []string
+	for _, invoice := range invoices {
+		got = append(got, invoice.Id)
+	}
+	if want := []string{"9", "130", "10"}; !slices.Equal(got, want) {
+		t.Errorf("sorted %v, want %v", got, want)
+	}
+}
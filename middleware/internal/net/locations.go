@@ -0,0 +1,157 @@
+package net
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+
+	"firebase.google.com/go/auth"
+	qb "github.com/Vertisphere/backend-service/external/quickbooks"
+	"github.com/Vertisphere/backend-service/internal/domain"
+	"github.com/Vertisphere/backend-service/internal/notify"
+	"github.com/Vertisphere/backend-service/internal/qbtoken"
+	"github.com/Vertisphere/backend-service/internal/storage"
+	"github.com/rs/zerolog/log"
+)
+
+// locationRoles is how the location roles are listed in validation errors
+const locationRoles = "location_admin, orderer or viewer"
+
+// ListLocationUsers lists the logins of the location admin's location
+func ListLocationUsers(s *storage.SQLStorage) http.HandlerFunc {
+	type response struct {
+		Users []domain.DBCustomer `json:"users"`
+	}
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		claims := ClaimsFromContext(r.Context())
+		users, err := s.ListCustomerUsers(claims.QBCompanyID, claims.QBCustomerID)
+		if err != nil {
+			return internalError("Could not get location users", err)
+		}
+		return encode(w, r, http.StatusOK, response{Users: users})
+	})
+}
+
+// InviteLocationUser adds a login to the location admin's location and emails them a link to set
+// their password
+func InviteLocationUser(qbc *qb.Client, tokens *qbtoken.Manager, a *auth.Client, s *storage.SQLStorage, n *notify.Service) http.HandlerFunc {
+	type request struct {
+		Email string      `json:"email"`
+		Name  string      `json:"name"`
+		Role  domain.Role `json:"role"`
+	}
+	type response struct {
+		User domain.DBCustomer `json:"user"`
+		// This is sent in the email but will put this in for for dev testing
+		ResetLink string `json:"reset_link"`
+	}
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		claims := ClaimsFromContext(r.Context())
+		req, err := decode[request](r)
+		if err != nil {
+			return badRequest("Invalid request payload", err)
+		}
+		req.Email = strings.TrimSpace(req.Email)
+		if fields := validateInvite(req.Email, req.Role, domain.Role.IsLocation, locationRoles); len(fields) > 0 {
+			return badRequest("Invalid location user", nil, fields...)
+		}
+
+		qbc, err := realmClient(r.Context(), qbc, tokens, claims.QBCompanyID)
+		if err != nil {
+			return err
+		}
+
+		var user domain.DBCustomer
+		link, err := invite(r.Context(), a, req.Email, req.Name, "/franchisee/dashboard", func(firebaseID string) error {
+			user, err = s.CreateCustomer(domain.DBCustomer{
+				QBCompanyID:  claims.QBCompanyID,
+				QBCustomerID: claims.QBCustomerID,
+				FirebaseID:   firebaseID,
+				Email:        req.Email,
+				Name:         req.Name,
+				Role:         req.Role,
+				InvitedBy:    claims.FirebaseID,
+			})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		err = n.Emit(r.Context(), qbc, notify.Event{
+			Type:       notify.CustomerInvited,
+			CompanyID:  claims.QBCompanyID,
+			CustomerID: claims.QBCustomerID,
+			Link:       link,
+			To:         &notify.Recipient{Name: req.Name, Emails: []string{req.Email}},
+		})
+		if err != nil {
+			// The location admin still gets the link back and can pass it on
+			log.Error().Err(err).Msg("Could not send location invite email")
+		}
+
+		return encode(w, r, http.StatusCreated, response{User: user, ResetLink: link})
+	})
+}
+
+// UpdateLocationUser changes the role of the location login in the URL
+func UpdateLocationUser(a *auth.Client, s *storage.SQLStorage) http.HandlerFunc {
+	type request struct {
+		Role domain.Role `json:"role"`
+	}
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		claims := ClaimsFromContext(r.Context())
+		req, err := decode[request](r)
+		if err != nil {
+			return badRequest("Invalid request payload", err)
+		}
+		if !req.Role.IsLocation() {
+			return badRequest("Invalid location user", nil, FieldError{Field: "role", Message: "must be " + locationRoles})
+		}
+
+		user, err := s.UpdateCustomerUserRole(claims.QBCompanyID, claims.QBCustomerID, r.PathValue("id"), req.Role)
+		if err != nil {
+			return locationUserError(err, "Could not update location user")
+		}
+		err = resetSession(r.Context(), a, domain.Claims{
+			QBCompanyID:  user.QBCompanyID,
+			QBCustomerID: user.QBCustomerID,
+			FirebaseID:   user.FirebaseID,
+			Role:         user.Role,
+		})
+		if err != nil {
+			return err
+		}
+		return encode(w, r, http.StatusOK, user)
+	})
+}
+
+// DeleteLocationUser removes the location login in the URL and their firebase user
+func DeleteLocationUser(a *auth.Client, s *storage.SQLStorage) http.HandlerFunc {
+	type response struct {
+		Success bool `json:"success"`
+	}
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		claims := ClaimsFromContext(r.Context())
+		firebaseID := r.PathValue("id")
+		if err := s.DeleteCustomerUser(claims.QBCompanyID, claims.QBCustomerID, firebaseID); err != nil {
+			return locationUserError(err, "Could not delete location user")
+		}
+		err := a.DeleteUser(r.Context(), firebaseID)
+		if err != nil && !auth.IsUserNotFound(err) {
+			return internalError("Could not delete user in firebase", err)
+		}
+		return encode(w, r, http.StatusOK, response{Success: true})
+	})
+}
+
+func locationUserError(err error, msg string) error {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return notFound("Location user not found", err)
+	case errors.Is(err, storage.ErrLastLocationAdmin):
+		return conflict("last_location_admin", "The location needs at least one admin", err)
+	default:
+		return internalError(msg, err)
+	}
+}
@@ -11,41 +11,61 @@ import (
 	"github.com/google/uuid"
 )
 
-func authMiddleware(c *auth.Client, h http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/franchiser/qbLogin" && r.Method == "POST" || r.URL.Path == "/franchisee/login" && r.Method == "POST" || r.URL.Path == "/" && r.Method == "GET" {
-			h.ServeHTTP(w, r)
-			return
-		}
+// contextKey is the type of the keys this package puts values in request contexts under
+type contextKey int
 
-		ctx := r.Context()
-		authHeader := strings.Split(r.Header.Get("Authorization"), "Bearer ")
-		if len(authHeader) != 2 {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-		bearer := authHeader[1]
-		token, err := c.VerifyIDToken(ctx, bearer)
-		if err != nil {
-			// Tokeen is invalid
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-		if token.Claims["is_franchiser"] == nil {
-			http.Error(w, "Not Custom Token", http.StatusUnauthorized)
-			return
-		}
-		claims := domain.Claims{
-			IsFranchiser:  token.Claims["is_franchiser"].(bool),
-			QBCompanyID:   token.Claims["qb_company_id"].(string),
-			QBCustomerID:  token.Claims["qb_customer_id"].(string),
-			QBBearerToken: token.Claims["qb_bearer_token"].(string),
-			FirebaseID:    token.Claims["firebase_id"].(string),
-		}
-		ctx = context.WithValue(ctx, "claims", claims)
-		r = r.WithContext(ctx)
-		h.ServeHTTP(w, r)
-	})
+const (
+	claimsKey contextKey = iota
+	traceIDKey
+)
+
+// ContextWithClaims returns a copy of ctx carrying the signed in user's claims
+func ContextWithClaims(ctx context.Context, claims domain.Claims) context.Context {
+	return context.WithValue(ctx, claimsKey, claims)
+}
+
+// ClaimsFromContext returns the claims the request was authenticated with. Every route that isn't
+// public has them, others get the zero Claims, which aren't allowed to do anything.
+func ClaimsFromContext(ctx context.Context) domain.Claims {
+	claims, _ := ctx.Value(claimsKey).(domain.Claims)
+	return claims
+}
+
+// bearerToken returns the token of the request's "Authorization: Bearer <token>" header
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	token = strings.TrimSpace(token)
+	return token, ok && strings.EqualFold(scheme, "Bearer") && token != ""
+}
+
+// tokenVerifier checks ID tokens. Implemented by *auth.Client.
+type tokenVerifier interface {
+	VerifyIDTokenAndCheckRevoked(ctx context.Context, idToken string) (*auth.Token, error)
+}
+
+// authenticate verifies the request's bearer token and returns its claims. Tokens of users that
+// signed out everywhere or were deleted are rejected even before they expire.
+func authenticate(ctx context.Context, c tokenVerifier, r *http.Request) (domain.Claims, error) {
+	bearer, ok := bearerToken(r)
+	if !ok {
+		return domain.Claims{}, unauthorized("Unauthorized", nil)
+	}
+	token, err := c.VerifyIDTokenAndCheckRevoked(ctx, bearer)
+	if auth.IsIDTokenRevoked(err) {
+		return domain.Claims{}, unauthorized("Token has been revoked, sign in again", err)
+	}
+	if err != nil {
+		return domain.Claims{}, unauthorized("Unauthorized", err)
+	}
+	claims, err := domain.ParseClaims(token.Claims)
+	if err != nil {
+		return domain.Claims{}, unauthorized("Not Custom Token", err)
+	}
+	// The claims are minted for the token's user, see ClaimsToMap
+	if claims.FirebaseID != token.UID {
+		return domain.Claims{}, unauthorized("Not Custom Token", nil)
+	}
+	return claims, nil
 }
 
 func corsMiddleware(next http.Handler) http.Handler {
@@ -70,7 +90,13 @@ func traceMiddleware(next http.Handler) http.Handler {
 		traceID := uuid.New().String()
 		// Add trace ID to response headers
 		w.Header().Set("X-Trace-ID", traceID)
-		r = r.WithContext(context.WithValue(r.Context(), "traceID", traceID))
+		r = r.WithContext(context.WithValue(r.Context(), traceIDKey, traceID))
 		next.ServeHTTP(w, r)
 	})
 }
+
+// traceID returns the id traceMiddleware attached to the request
+func traceID(ctx context.Context) string {
+	traceID, _ := ctx.Value(traceIDKey).(string)
+	return traceID
+}
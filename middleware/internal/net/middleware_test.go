@@ -0,0 +1,29 @@
+package net
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func FuzzBearerToken(f *testing.F) {
+	f.Add("Bearer eyJhbGciOiJSUzI1NiJ9.e30.sig")
+	f.Add("bearer  token ")
+	f.Add("Bearer ")
+	f.Add("Basic dXNlcjpwYXNz")
+	f.Add("Bearer a Bearer b")
+	f.Fuzz(func(t *testing.T, header string) {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", header)
+		token, ok := bearerToken(r)
+		if !ok {
+			return
+		}
+		if token == "" || token != strings.TrimSpace(token) {
+			t.Fatalf("bearerToken(%q) = %q", header, token)
+		}
+		if scheme, _, _ := strings.Cut(r.Header.Get("Authorization"), " "); !strings.EqualFold(scheme, "Bearer") {
+			t.Fatalf("bearerToken(%q) accepted scheme %q", header, scheme)
+		}
+	})
+}
@@ -0,0 +1,147 @@
+package net
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/mail"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/Vertisphere/backend-service/internal/domain"
+	"github.com/Vertisphere/backend-service/internal/notify"
+	"github.com/Vertisphere/backend-service/internal/storage"
+)
+
+const maxListedNotifications = 200
+
+// ListNotifications lists the company's outbox. Defaults to the dead notifications, ?status= takes a
+// comma separated list of pending, sending, sent and dead.
+func ListNotifications(s *storage.SQLStorage) http.HandlerFunc {
+	type response struct {
+		Notifications []domain.Notification `json:"notifications"`
+	}
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		claims := ClaimsFromContext(r.Context())
+		statuses := []domain.NotificationStatus{domain.NotificationDead}
+		if param := r.URL.Query().Get("status"); param != "" {
+			statuses = nil
+			for _, status := range strings.Split(param, ",") {
+				switch status := domain.NotificationStatus(strings.TrimSpace(status)); status {
+				case domain.NotificationPending, domain.NotificationSending, domain.NotificationSent, domain.NotificationDead:
+					statuses = append(statuses, status)
+				default:
+					return badRequest("Invalid status", nil, FieldError{Field: "status", Message: "unknown status " + string(status)})
+				}
+			}
+		}
+
+		notifications, err := s.ListNotifications(claims.QBCompanyID, statuses, maxListedNotifications)
+		if err != nil {
+			return internalError("Could not list notifications", err)
+		}
+		return encode(w, r, http.StatusOK, response{Notifications: notifications})
+	})
+}
+
+// RetryNotification queues a dead notification again
+func RetryNotification(s *storage.SQLStorage) http.HandlerFunc {
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		claims := ClaimsFromContext(r.Context())
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			return badRequest("Invalid notification ID", err)
+		}
+		notification, err := s.RetryNotification(claims.QBCompanyID, id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return notFound("No failed notification with that ID", err)
+		}
+		if err != nil {
+			return internalError("Could not retry notification", err)
+		}
+		return encode(w, r, http.StatusAccepted, notification)
+	})
+}
+
+// GetNotificationPreferences returns how the signed in user wants to be notified
+func GetNotificationPreferences(s *storage.SQLStorage) http.HandlerFunc {
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		claims := ClaimsFromContext(r.Context())
+
+		prefs, err := s.GetNotificationPreferences(claims.FirebaseID)
+		if errors.Is(err, sql.ErrNoRows) {
+			// Never set, which means everything is on
+			prefs = domain.NotificationPreferences{Channels: map[string]bool{}, Events: map[string]map[string]bool{}}
+			err = nil
+		}
+		if err != nil {
+			return internalError("Could not get notification preferences", err)
+		}
+		return encode(w, r, http.StatusOK, prefs)
+	})
+}
+
+// UpdateNotificationPreferences replaces how the signed in user wants to be notified
+func UpdateNotificationPreferences(s *storage.SQLStorage) http.HandlerFunc {
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		claims := ClaimsFromContext(r.Context())
+
+		prefs, err := decode[domain.NotificationPreferences](r)
+		if err != nil {
+			return badRequest("Invalid request payload", err)
+		}
+		if fields := validatePreferences(&prefs); len(fields) > 0 {
+			return badRequest("Invalid notification preferences", nil, fields...)
+		}
+		prefs.FirebaseID = claims.FirebaseID
+
+		prefs, err = s.SaveNotificationPreferences(prefs)
+		if err != nil {
+			return internalError("Could not save notification preferences", err)
+		}
+		return encode(w, r, http.StatusOK, prefs)
+	})
+}
+
+// validatePreferences checks the preferences and normalizes the phone number and email
+func validatePreferences(prefs *domain.NotificationPreferences) []FieldError {
+	var fields []FieldError
+	for channel := range prefs.Channels {
+		if !notify.Channel(channel).Valid() {
+			fields = append(fields, FieldError{Field: "channels." + channel, Message: "unknown channel"})
+		}
+	}
+	for event, channels := range prefs.Events {
+		if !notify.EventType(event).Valid() {
+			fields = append(fields, FieldError{Field: "events." + event, Message: "unknown event"})
+			continue
+		}
+		for channel := range channels {
+			if !notify.Channel(channel).Valid() {
+				fields = append(fields, FieldError{Field: "events." + event + "." + channel, Message: "unknown channel"})
+			}
+		}
+	}
+	if prefs.QuietHours != nil {
+		if _, _, _, err := notify.ParseQuietHours(*prefs.QuietHours); err != nil {
+			fields = append(fields, FieldError{Field: "quiet_hours", Message: err.Error()})
+		}
+	}
+	if prefs.Phone != "" {
+		if prefs.Phone = notify.E164Phone(prefs.Phone); prefs.Phone == "" {
+			fields = append(fields, FieldError{Field: "phone", Message: "not a North American phone number"})
+		}
+	}
+	if prefs.Email != "" {
+		address, err := mail.ParseAddress(prefs.Email)
+		if err != nil {
+			fields = append(fields, FieldError{Field: "email", Message: "not an email address"})
+		} else {
+			prefs.Email = address.Address
+		}
+	}
+	// Map iteration order is random, keep the errors stable
+	slices.SortFunc(fields, func(a, b FieldError) int { return strings.Compare(a.Field, b.Field) })
+	return fields
+}
@@ -0,0 +1,352 @@
+package net
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	qb "github.com/Vertisphere/backend-service/external/quickbooks"
+	"github.com/Vertisphere/backend-service/internal/domain"
+	"github.com/Vertisphere/backend-service/internal/notify"
+	"github.com/Vertisphere/backend-service/internal/orderstate"
+	"github.com/Vertisphere/backend-service/internal/qbtoken"
+	"github.com/Vertisphere/backend-service/internal/storage"
+)
+
+// newOrderMachine wires the side effects of each order transition into the state machine
+func newOrderMachine(s *storage.SQLStorage) *orderstate.Machine {
+	m := orderstate.New(orderstate.Transitions)
+
+	m.Before(domain.OrderPending, checkOrderQuantities(s))
+	m.Before(domain.OrderPending, diffAgainstReview(s))
+	m.Before(domain.OrderPending, scheduleOrder(s))
+	m.Before(domain.OrderVoid, voidInvoice)
+	m.Before(domain.OrderComplete, setInvoiceDueDate)
+
+	// Registered last so the notification sees what the other hooks filled in
+	for status := range orderEvents {
+		m.Before(status, notifyOrder)
+	}
+	return m
+}
+
+// orderStore is the storage moving an order needs. Implemented by storage.SQLStorage.
+type orderStore interface {
+	orderstate.Store
+	GetOrder(companyID string, invoiceID string) (domain.Order, error)
+	BackfillOrder(companyID string, invoiceID string, customerID string, status domain.OrderStatus, createdAt time.Time, txnDate time.Time) error
+}
+
+type transitionRequest struct {
+	To     domain.OrderStatus `json:"to"`
+	Reason string             `json:"reason"`
+	// Comments on individual lines, only used when asking for a revision
+	Comments []domain.LineComment `json:"comments"`
+	// Slot is the pickup or delivery slot when publishing, see GET /orderSlots
+	Slot string `json:"slot"`
+}
+
+// TransitionOrder moves an order to the status in the request body
+func TransitionOrder(m *orderstate.Machine, qbc *qb.Client, tokens *qbtoken.Manager, s *storage.SQLStorage) http.HandlerFunc {
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		req, err := decode[transitionRequest](r)
+		if err != nil {
+			return badRequest("Invalid request payload", err)
+		}
+		return transitionOrder(w, r, m, qbc, tokens, s, req)
+	})
+}
+
+// OrderTransition moves an order to a fixed status. Backs the qbInvoice:publish style endpoints,
+// which take the optional reason and slot as query params.
+func OrderTransition(m *orderstate.Machine, qbc *qb.Client, tokens *qbtoken.Manager, s *storage.SQLStorage, to domain.OrderStatus) http.HandlerFunc {
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		return transitionOrder(w, r, m, qbc, tokens, s, transitionRequest{
+			To:     to,
+			Reason: r.URL.Query().Get("reason"),
+			Slot:   r.URL.Query().Get("slot"),
+		})
+	})
+}
+
+// RequestOrderRevision sends an order back to the franchisee with the comments in the request body
+func RequestOrderRevision(m *orderstate.Machine, qbc *qb.Client, tokens *qbtoken.Manager, s *storage.SQLStorage) http.HandlerFunc {
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		req, err := decode[transitionRequest](r)
+		if err != nil {
+			return badRequest("Invalid request payload", err)
+		}
+		req.To = domain.OrderRevision
+		return transitionOrder(w, r, m, qbc, tokens, s, req)
+	})
+}
+
+func transitionOrder(w http.ResponseWriter, r *http.Request, m *orderstate.Machine, qbc *qb.Client, tokens *qbtoken.Manager, s *storage.SQLStorage, req transitionRequest) error {
+	type response struct {
+		Success bool                `json:"success"`
+		Order   domain.Order        `json:"order"`
+		Changes []domain.LineChange `json:"changes,omitempty"`
+		Slot    string              `json:"slot,omitempty"`
+	}
+
+	// get claims from context
+	claims := ClaimsFromContext(r.Context())
+	// get id from url
+	invoiceId := r.PathValue("id")
+	if invoiceId == "" {
+		return badRequest("No ID in URL", nil)
+	}
+	change, err := applyTransition(r.Context(), m, qbc, tokens, s, claims, invoiceId, req)
+	if err != nil {
+		return err
+	}
+
+	resp := response{Success: true, Order: change.Order, Changes: change.Changes, Slot: change.Slot}
+	err = encode(w, r, http.StatusOK, resp)
+
+	// Messaging isn't as important so we send message after we send response
+	m.RunAfter(context.WithoutCancel(r.Context()), change)
+	return err
+}
+
+// applyTransition moves an order on behalf of claims. It backs both the HTTP endpoints and SMS
+// commands, errors are returned as an *Error.
+func applyTransition(ctx context.Context, m *orderstate.Machine, qbc *qb.Client, tokens *qbtoken.Manager, s orderStore, claims domain.Claims, invoiceId string, req transitionRequest) (*orderstate.Change, error) {
+	// Get QB token and set jwt for QB Client
+	client, err := realmClient(ctx, qbc, tokens, claims.QBCompanyID)
+	if err != nil {
+		return nil, err
+	}
+	// Get invoice by ID
+	existingInvoice, err := client.FindInvoiceById(ctx, claims.QBCompanyID, invoiceId)
+	if err != nil {
+		return nil, qbError(err, "Could not get invoice")
+	}
+	order, err := getOrder(s, claims.QBCompanyID, existingInvoice)
+	if err != nil {
+		return nil, internalError("Could not get order status", err)
+	}
+	// Franchisees can only move their own orders
+	if !claims.IsFranchiser && order.QBCustomerID != claims.QBCustomerID {
+		return nil, forbidden(nil)
+	}
+
+	change := &orderstate.Change{
+		QB:      client,
+		Order:   order,
+		Invoice: existingInvoice,
+		Claims:  claims,
+		To:      req.To,
+		TraceID: traceID(ctx),
+		Reason:  req.Reason,
+		Slot:    req.Slot,
+	}
+	if req.To == domain.OrderRevision {
+		review, err := newOrderReview(existingInvoice, req)
+		if err != nil {
+			return nil, err
+		}
+		change.Review = review
+	}
+	if err := m.Apply(ctx, s, change); err != nil {
+		return nil, transitionError(err)
+	}
+	return change, nil
+}
+
+// transitionError turns an error applying a transition into the response
+func transitionError(err error) error {
+	var invalid *orderstate.InvalidTransitionError
+	var appErr *Error
+	switch {
+	case errors.As(err, &invalid):
+		appErr := conflict("invalid_transition", invalid.Error(), err)
+		appErr.Extensions = map[string]any{"from": invalid.From, "to": invalid.To, "allowed": invalid.Allowed}
+		return appErr
+	case errors.Is(err, orderstate.ErrForbidden):
+		return forbidden(err)
+	case errors.Is(err, storage.ErrOrderStatusChanged):
+		return conflict("order_status_changed", "Order status was changed by another request", err)
+	case errors.As(err, &appErr):
+		// Hooks that check the order return the response themselves
+		return appErr
+	default:
+		// Before hooks update the invoice in QB, so a stale SyncToken or a validation error ends up here
+		return qbError(err, "Could not update order")
+	}
+}
+
+// GetOrderHistory lists every status change of an order. Franchisees can only see their own orders.
+func GetOrderHistory(s *storage.SQLStorage) http.HandlerFunc {
+	type response struct {
+		Order  domain.Order        `json:"order"`
+		Events []domain.OrderEvent `json:"events"`
+	}
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		// get claims from context
+		claims := ClaimsFromContext(r.Context())
+
+		invoiceId := r.PathValue("id")
+		if invoiceId == "" {
+			return badRequest("No ID in URL", nil)
+		}
+		order, err := s.GetOrder(claims.QBCompanyID, invoiceId)
+		if errors.Is(err, sql.ErrNoRows) {
+			return notFound("Order not found", err)
+		}
+		if err != nil {
+			return internalError("Could not get order", err)
+		}
+		// Don't tell franchisees whether someone else's order exists
+		if !claims.IsFranchiser && order.QBCustomerID != claims.QBCustomerID {
+			return notFound("Order not found", nil)
+		}
+
+		events, err := s.ListOrderEvents(claims.QBCompanyID, invoiceId)
+		if err != nil {
+			return internalError("Could not get order history", err)
+		}
+
+		resp := response{Order: order, Events: events}
+		return encode(w, r, http.StatusOK, resp)
+	})
+}
+
+// newOrderReview snapshots the invoice lines being reviewed along with the reviewer's comments.
+// A revision needs at least one comment, and line comments have to point at lines on the invoice.
+// Validation errors are returned as an *Error listing the offending fields.
+func newOrderReview(invoice *qb.Invoice, req transitionRequest) (*domain.OrderReview, error) {
+	if req.Reason == "" && len(req.Comments) == 0 {
+		return nil, badRequest("Invalid review: a revision needs a reason or line comments", nil,
+			FieldError{Field: "reason", Message: "required without comments"},
+			FieldError{Field: "comments", Message: "required without a reason"})
+	}
+	lines := orderLines(invoice)
+	lineIDs := map[string]bool{}
+	for _, line := range lines {
+		lineIDs[line.LineID] = true
+	}
+	var fields []FieldError
+	for i, comment := range req.Comments {
+		if !lineIDs[comment.LineID] {
+			fields = append(fields, FieldError{
+				Field:   fmt.Sprintf("comments[%d].line_id", i),
+				Message: fmt.Sprintf("line %s is not on the invoice", comment.LineID),
+			})
+		}
+	}
+	if len(fields) > 0 {
+		return nil, badRequest("Invalid review: comments point at lines that are not on the invoice", nil, fields...)
+	}
+	return &domain.OrderReview{Lines: lines, Comments: req.Comments}, nil
+}
+
+// orderLines returns the item lines of an invoice, skipping subtotal and tax lines
+func orderLines(invoice *qb.Invoice) []domain.OrderLine {
+	lines := []domain.OrderLine{}
+	for _, line := range invoice.Line {
+		if line.DetailType != "SalesItemLineDetail" {
+			continue
+		}
+		lines = append(lines, domain.OrderLine{
+			LineID:   line.Id,
+			ItemID:   line.SalesItemLineDetail.ItemRef.Value,
+			ItemName: line.SalesItemLineDetail.ItemRef.Name,
+			Quantity: line.SalesItemLineDetail.Qty,
+		})
+	}
+	return lines
+}
+
+// diffAgainstReview records what the franchisee changed when resubmitting an order that was sent back for revision
+func diffAgainstReview(s *storage.SQLStorage) orderstate.Hook {
+	return func(ctx context.Context, c *orderstate.Change) error {
+		if c.From != domain.OrderRevision {
+			return nil
+		}
+		review, err := s.LatestOrderReview(c.Order.QBCompanyID, c.Order.QBInvoiceID)
+		// Orders moved to revision before reviews were stored have nothing to diff against
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("could not get review to diff against: %w", err)
+		}
+		c.Changes = domain.DiffOrderLines(review.Lines, orderLines(c.Invoice))
+		return nil
+	}
+}
+
+func voidInvoice(ctx context.Context, c *orderstate.Change) error {
+	return c.QB.VoidInvoice(ctx, c.Order.QBCompanyID, c.Invoice.Id, c.Invoice.SyncToken)
+}
+
+func setInvoiceDueDate(ctx context.Context, c *orderstate.Change) error {
+	invoiceToUpdate := struct {
+		Id        string `json:"Id"`
+		SyncToken string `json:"SyncToken"`
+		Sparse    bool   `json:"sparse"`
+		DueDate   string `json:"DueDate"`
+	}{
+		Id:        c.Invoice.Id,
+		SyncToken: c.Invoice.SyncToken,
+		Sparse:    true,
+		DueDate:   dueDate(c.Invoice).Format("2006-01-02"),
+	}
+	_, err := c.QB.UpdateInvoice(ctx, c.Order.QBCompanyID, invoiceToUpdate)
+	return err
+}
+
+// dueDate is 2 weeks after the order's pickup or delivery, or from now for orders without a slot
+func dueDate(invoice *qb.Invoice) time.Time {
+	if !invoice.ShipDate.IsZero() {
+		return invoice.ShipDate.AddDate(0, 0, 14)
+	}
+	return time.Now().AddDate(0, 0, 14)
+}
+
+// orderEvents is the notification sent when an order moves to a status
+var orderEvents = map[domain.OrderStatus]notify.EventType{
+	domain.OrderPending:  notify.OrderPublished,
+	domain.OrderDraft:    notify.OrderUnpublished,
+	domain.OrderRevision: notify.OrderRevisionRequested,
+	domain.OrderApproved: notify.OrderApproved,
+	domain.OrderVoid:     notify.OrderVoided,
+	domain.OrderComplete: notify.OrderCompleted,
+}
+
+// notifyOrder queues a notification telling the other side of the order that it moved. It's stored
+// with the transition and delivered by the outbox worker.
+func notifyOrder(ctx context.Context, c *orderstate.Change) error {
+	event := notify.Event{
+		Type:       orderEvents[c.To],
+		CompanyID:  c.Order.QBCompanyID,
+		CustomerID: c.Invoice.CustomerRef.Value,
+		InvoiceID:  c.Invoice.Id,
+		Reason:     c.Reason,
+		Changes:    len(c.Changes),
+	}
+	if c.To == domain.OrderPending && c.From == domain.OrderRevision {
+		event.Type = notify.OrderResubmitted
+	}
+	if c.To == domain.OrderVoid && c.Claims.IsFranchiser {
+		event.Type = notify.OrderCancelled
+	}
+	if c.Review != nil {
+		event.Comments = len(c.Review.Comments)
+	}
+	if c.To == domain.OrderComplete {
+		// The invoice goes out with the completed email, to the invoice's emails as well
+		event.AttachInvoice = true
+		event.Emails = []string{c.Invoice.BillEmail.Address, c.Invoice.BillEmailCC.Address, c.Invoice.BillEmailBCC.Address}
+	}
+	notification, err := notify.NewNotification(event, c.TraceID)
+	if err != nil {
+		return err
+	}
+	c.Notifications = append(c.Notifications, notification)
+	return nil
+}
@@ -0,0 +1,194 @@
+package net
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	qb "github.com/Vertisphere/backend-service/external/quickbooks"
+	"github.com/Vertisphere/backend-service/internal/domain"
+	"github.com/Vertisphere/backend-service/internal/qbtoken"
+	"github.com/Vertisphere/backend-service/internal/storage"
+)
+
+// Policy is who may call a route. Every route in addRoutes declares one and the router enforces it
+// before the handler runs, so handlers can take the claims in the context as allowed.
+type Policy struct {
+	// Public routes skip authentication. They sign users in, or check the request's signature
+	// themselves like the Twilio webhook.
+	Public bool
+	// Franchiser and Franchisee say which side may call the route
+	Franchiser bool
+	Franchisee bool
+	// Permission is what the caller's role needs, see domain.Claims.Can
+	Permission domain.Permission
+	// Owner is the resource in the URL a franchisee has to own. Franchisers' claims already scope
+	// everything to their company.
+	Owner Ownership
+}
+
+var (
+	public      = Policy{Public: true}
+	everyone    = Policy{Franchiser: true, Franchisee: true}
+	franchisers = Policy{Franchiser: true}
+	franchisees = Policy{Franchisee: true}
+)
+
+// needs returns the policy with the permission required
+func (p Policy) needs(permission domain.Permission) Policy {
+	p.Permission = permission
+	return p
+}
+
+// owns returns the policy with the franchisee required to own the resource in the URL
+func (p Policy) owns(owner Ownership) Policy {
+	p.Owner = owner
+	return p
+}
+
+// Ownership names what the {id} in a route's URL is, so it can be checked against the franchisee
+type Ownership string
+
+const (
+	// OwnCustomer is the franchisee's own QB customer
+	OwnCustomer Ownership = "customer"
+	// OwnInvoice is an invoice of the franchisee
+	OwnInvoice Ownership = "invoice"
+	// OwnStandingOrder is a standing order of the franchisee
+	OwnStandingOrder Ownership = "standing_order"
+	// OwnTemplate is an order template of the franchisee
+	OwnTemplate Ownership = "order_template"
+)
+
+// ownerCheck returns an error unless the franchisee owns the resource in the request's URL
+type ownerCheck func(ctx context.Context, r *http.Request, claims domain.Claims) error
+
+// ownerChecks are the checks behind each Ownership
+func ownerChecks(s *storage.SQLStorage, qbc *qb.Client, tokens *qbtoken.Manager) map[Ownership]ownerCheck {
+	return map[Ownership]ownerCheck{
+		OwnCustomer: func(ctx context.Context, r *http.Request, claims domain.Claims) error {
+			if r.PathValue("id") != claims.QBCustomerID {
+				return forbidden(nil)
+			}
+			return nil
+		},
+		OwnInvoice: func(ctx context.Context, r *http.Request, claims domain.Claims) error {
+			invoiceID := r.PathValue("id")
+			order, err := s.GetOrder(claims.QBCompanyID, invoiceID)
+			customerID := order.QBCustomerID
+			if errors.Is(err, sql.ErrNoRows) {
+				// Invoices from before orders were stored only have their customer in QB
+				client, err := realmClient(ctx, qbc, tokens, claims.QBCompanyID)
+				if err != nil {
+					return err
+				}
+				invoice, err := client.FindInvoiceById(ctx, claims.QBCompanyID, invoiceID)
+				if err != nil {
+					return qbError(err, "Could not get invoice")
+				}
+				customerID = invoice.CustomerRef.Value
+			} else if err != nil {
+				return internalError("Could not get order", err)
+			}
+			// Don't tell franchisees whether someone else's order exists
+			if customerID != claims.QBCustomerID {
+				return notFound("Order not found", nil)
+			}
+			return nil
+		},
+		OwnStandingOrder: func(ctx context.Context, r *http.Request, claims domain.Claims) error {
+			id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+			if err != nil {
+				return badRequest("Invalid standing order ID", err)
+			}
+			o, err := s.GetStandingOrder(claims.QBCompanyID, id)
+			if errors.Is(err, sql.ErrNoRows) || err == nil && o.QBCustomerID != claims.QBCustomerID {
+				return notFound("Standing order not found", err)
+			}
+			if err != nil {
+				return internalError("Could not get standing order", err)
+			}
+			return nil
+		},
+		OwnTemplate: func(ctx context.Context, r *http.Request, claims domain.Claims) error {
+			id, err := orderTemplateID(r, "id")
+			if err != nil {
+				return err
+			}
+			_, err = s.GetOrderTemplate(claims.QBCompanyID, claims.QBCustomerID, id)
+			if errors.Is(err, sql.ErrNoRows) {
+				return notFound("Order template not found", err)
+			}
+			if err != nil {
+				return internalError("Could not get order template", err)
+			}
+			return nil
+		},
+	}
+}
+
+// router registers routes on a mux along with their policies
+type router struct {
+	mux      *http.ServeMux
+	auth     tokenVerifier
+	owners   map[Ownership]ownerCheck
+	policies map[string]Policy
+}
+
+func newRouter(mux *http.ServeMux, a tokenVerifier, owners map[Ownership]ownerCheck) *router {
+	return &router{mux: mux, auth: a, owners: owners, policies: map[string]Policy{}}
+}
+
+// handle registers the handler for the pattern behind the policy
+func (rt *router) handle(pattern string, p Policy, h http.Handler) {
+	rt.policies[pattern] = p
+	if !p.Public {
+		h = rt.authenticate(rt.enforce(p, h))
+	}
+	rt.mux.Handle(pattern, h)
+}
+
+// authenticate puts the claims of the request's bearer token in the context
+func (rt *router) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, err := authenticate(r.Context(), rt.auth, r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		ctx := ContextWithClaims(r.Context(), claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// enforce only calls next if the policy lets the claims in the context make the request
+func (rt *router) enforce(p Policy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims := ClaimsFromContext(r.Context())
+		if err := rt.check(r.Context(), r, p, claims); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// check returns an error if the policy doesn't let claims make the request
+func (rt *router) check(ctx context.Context, r *http.Request, p Policy, claims domain.Claims) error {
+	if claims.IsFranchiser && !p.Franchiser || !claims.IsFranchiser && !p.Franchisee {
+		return forbidden(nil)
+	}
+	if p.Permission != "" && !claims.Can(p.Permission) {
+		return forbidden(nil)
+	}
+	if p.Owner != "" && !claims.IsFranchiser {
+		check, ok := rt.owners[p.Owner]
+		if !ok {
+			return internalError("Could not check access", errors.New("no check for ownership "+string(p.Owner)))
+		}
+		return check(ctx, r, claims)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package net
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Vertisphere/backend-service/internal/domain"
+)
+
+func TestRoutePolicies(t *testing.T) {
+	want := map[string]Policy{
+		"POST /franchiser/qbLogin":                 public,
+		"POST /franchiser/login":                   public,
+		"POST /franchisee/login":                   public,
+		"POST /logout":                             everyone,
+		"POST /companies/{id}/sessions:revoke-all": franchisers.needs(domain.ManageCompany),
+		"POST /franchiser/qbDisconnect":            franchisers.needs(domain.ManageCompany),
+		"GET /companyUsers":                        franchisers.needs(domain.ManageStaff),
+		"POST /companyUsers":                       franchisers.needs(domain.ManageStaff),
+		"PUT /companyUsers/{id}":                   franchisers.needs(domain.ManageStaff),
+		"DELETE /companyUsers/{id}":                franchisers.needs(domain.ManageStaff),
+		"GET /qbCustomer/{id}":                     everyone.owns(OwnCustomer),
+		"GET /qbCustomers":                         franchisers,
+		"GET /qbInvoicePDF/{id}":                   everyone.owns(OwnInvoice),
+		"GET /qbInvoice:create":                    franchisees.needs(domain.PlaceOrders),
+		"POST /qbInvoice:modify/{id}":              franchisees.needs(domain.PlaceOrders).owns(OwnInvoice),
+		"POST /orders/{id}/transitions":            everyone.owns(OwnInvoice),
+		"GET /orders/{id}/history":                 everyone.owns(OwnInvoice),
+		"GET /qbInvoice:publish/{id}":              franchisees.needs(domain.PlaceOrders).owns(OwnInvoice),
+		"GET /qbInvoice:unpublish/{id}":            everyone.owns(OwnInvoice),
+		"GET /qbInvoice:approve/{id}":              franchisers.needs(domain.ReviewOrders),
+		"GET /qbInvoice:void/{id}":                 franchisees.needs(domain.PlaceOrders).owns(OwnInvoice),
+		"GET /qbInvoice:duplicate/{id}":            franchisees.needs(domain.PlaceOrders).owns(OwnInvoice),
+		"POST /qbInvoice:reject/{id}":              franchisers.needs(domain.ReviewOrders),
+		"GET /qbInvoice:complete/{id}":             franchisers.needs(domain.FulfillOrders),
+		"GET /qbInvoice/{id}":                      everyone.owns(OwnInvoice),
+		"GET /qbInvoices":                          everyone,
+		"POST /customer":                           franchisers.needs(domain.ManageCustomers),
+		"DELETE /customer":                         franchisers.needs(domain.ManageCustomers),
+		"GET /locationUsers":                       franchisees.needs(domain.ManageLocationUsers),
+		"POST /locationUsers":                      franchisees.needs(domain.ManageLocationUsers),
+		"PUT /locationUsers/{id}":                  franchisees.needs(domain.ManageLocationUsers),
+		"DELETE /locationUsers/{id}":               franchisees.needs(domain.ManageLocationUsers),
+		"GET /qbItems":                             everyone,
+		"GET /priceLists":                          franchisers,
+		"POST /priceLists":                         franchisers.needs(domain.ManageCatalog),
+		"PUT /priceLists/{id}":                     franchisers.needs(domain.ManageCatalog),
+		"DELETE /priceLists/{id}":                  franchisers.needs(domain.ManageCatalog),
+		"GET /quantityRules":                       franchisers,
+		"PUT /quantityRules":                       franchisers.needs(domain.ManageCatalog),
+		"DELETE /quantityRules/{id}":               franchisers.needs(domain.ManageCatalog),
+		"GET /orderSchedule":                       everyone,
+		"PUT /orderSchedule":                       franchisers.needs(domain.ManageCatalog),
+		"GET /orderSlots":                          everyone,
+		"GET /standingOrders":                      everyone,
+		"POST /standingOrders":                     franchisees.needs(domain.PlaceOrders),
+		"PUT /standingOrders/{id}":                 franchisees.needs(domain.PlaceOrders).owns(OwnStandingOrder),
+		"DELETE /standingOrders/{id}":              franchisees.needs(domain.PlaceOrders).owns(OwnStandingOrder),
+		"GET /standingOrders/{id}/occurrences":     everyone.owns(OwnStandingOrder),
+		"POST /standingOrders/{id}/skip":           franchisees.needs(domain.PlaceOrders).owns(OwnStandingOrder),
+		"POST /standingOrders/{id}/unskip":         franchisees.needs(domain.PlaceOrders).owns(OwnStandingOrder),
+		"GET /orderTemplates":                      franchisees,
+		"POST /orderTemplates":                     franchisees.needs(domain.PlaceOrders),
+		"GET /orderTemplates/{id}":                 franchisees.owns(OwnTemplate),
+		"PUT /orderTemplates/{id}":                 franchisees.needs(domain.PlaceOrders).owns(OwnTemplate),
+		"DELETE /orderTemplates/{id}":              franchisees.needs(domain.PlaceOrders).owns(OwnTemplate),
+		"POST /orders:fromTemplate/{id}":           franchisees.needs(domain.PlaceOrders).owns(OwnTemplate),
+		"GET /favorites":                           franchisees,
+		"PUT /favorites/{itemId}":                  franchisees.needs(domain.PlaceOrders),
+		"DELETE /favorites/{itemId}":               franchisees.needs(domain.PlaceOrders),
+		"GET /qbRateLimit":                         franchisers,
+		"POST /webhooks/twilio/sms":                public,
+		"GET /me/notification-preferences":         everyone,
+		"PUT /me/notification-preferences":         everyone,
+		"GET /admin/notifications":                 franchisers,
+		"POST /admin/notifications/{id}/retry":     franchisers.needs(domain.ManageNotifications),
+	}
+
+	got := addRoutes(context.Background(), http.NewServeMux(), nil, nil, nil, nil, nil, nil, nil)
+	for pattern, p := range got {
+		w, ok := want[pattern]
+		if !ok {
+			t.Errorf("%s has no policy in the test, add one", pattern)
+			continue
+		}
+		if p != w {
+			t.Errorf("%s policy = %+v, want %+v", pattern, p, w)
+		}
+	}
+	for pattern := range want {
+		if _, ok := got[pattern]; !ok {
+			t.Errorf("%s isn't registered", pattern)
+		}
+	}
+}
+
+// Franchisees can reach another location's resources by changing an ID in the URL, unless the route
+// checks they own it or storage only looks within their location
+func TestFranchiseeRoutesCheckOwnership(t *testing.T) {
+	scopedByStorage := map[string]bool{
+		// The {id} is a login, looked up within the caller's location
+		"PUT /locationUsers/{id}":    true,
+		"DELETE /locationUsers/{id}": true,
+		// The {itemId} is a QB item, favorites are stored per location
+		"PUT /favorites/{itemId}":    true,
+		"DELETE /favorites/{itemId}": true,
+	}
+	routes := addRoutes(context.Background(), http.NewServeMux(), nil, nil, nil, nil, nil, nil, nil)
+	for pattern, p := range routes {
+		if !p.Franchisee || !strings.Contains(pattern, "{") {
+			continue
+		}
+		if p.Owner == "" && !scopedByStorage[pattern] {
+			t.Errorf("%s takes an ID from franchisees but doesn't check they own it", pattern)
+		}
+		if p.Owner != "" && scopedByStorage[pattern] {
+			t.Errorf("%s checks ownership, take it out of scopedByStorage", pattern)
+		}
+	}
+}
+
+func TestPolicyCheck(t *testing.T) {
+	rt := newRouter(nil, nil, map[Ownership]ownerCheck{
+		OwnInvoice: func(ctx context.Context, r *http.Request, claims domain.Claims) error {
+			if r.PathValue("id") != "own" {
+				return notFound("Order not found", nil)
+			}
+			return nil
+		},
+	})
+	owner := domain.Claims{QBCompanyID: "1001", IsFranchiser: true, Role: domain.RoleOwner}
+	viewer := domain.Claims{QBCompanyID: "1001", IsFranchiser: true, Role: domain.RoleViewer}
+	admin := domain.Claims{QBCompanyID: "1001", QBCustomerID: "1", Role: domain.RoleLocationAdmin}
+	locationViewer := domain.Claims{QBCompanyID: "1001", QBCustomerID: "1", Role: domain.RoleViewer}
+
+	tests := []struct {
+		name   string
+		policy Policy
+		claims domain.Claims
+		id     string
+		status int
+	}{
+		{"franchiser on franchiser route", franchisers, viewer, "", http.StatusOK},
+		{"franchisee on franchiser route", franchisers, admin, "", http.StatusForbidden},
+		{"franchiser on franchisee route", franchisees, owner, "", http.StatusForbidden},
+		{"role with permission", franchisers.needs(domain.ReviewOrders), owner, "", http.StatusOK},
+		{"role without permission", franchisers.needs(domain.ReviewOrders), viewer, "", http.StatusForbidden},
+		{"location role without permission", franchisees.needs(domain.PlaceOrders), locationViewer, "", http.StatusForbidden},
+		{"franchisee owns resource", everyone.owns(OwnInvoice), admin, "own", http.StatusOK},
+		{"franchisee doesn't own resource", everyone.owns(OwnInvoice), admin, "other", http.StatusNotFound},
+		{"franchisers aren't checked for ownership", everyone.owns(OwnInvoice), viewer, "other", http.StatusOK},
+		{"ownership without a check", everyone.owns(OwnStandingOrder), admin, "own", http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.SetPathValue("id", tt.id)
+			req = req.WithContext(ContextWithClaims(req.Context(), tt.claims))
+			rec := httptest.NewRecorder()
+			rt.enforce(tt.policy, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})).ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,288 @@
+package net
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	qb "github.com/Vertisphere/backend-service/external/quickbooks"
+	"github.com/Vertisphere/backend-service/internal/domain"
+	"github.com/Vertisphere/backend-service/internal/orderstate"
+	"github.com/Vertisphere/backend-service/internal/pricing"
+	"github.com/Vertisphere/backend-service/internal/storage"
+)
+
+// customerCatalog loads what the customer can order today
+func customerCatalog(ctx context.Context, qbc *qb.RealmClient, s *storage.SQLStorage, companyID string, customerID string) (*pricing.Catalog, error) {
+	customer, err := qbc.GetCustomerById(ctx, companyID, customerID)
+	if err != nil {
+		return nil, qbError(err, "Could not get customer")
+	}
+	catalog, err := pricing.ForCustomer(s, companyID, customer, time.Now())
+	if err != nil {
+		return nil, internalError("Could not get price lists", err)
+	}
+	return catalog, nil
+}
+
+// quoteOrder prices the order for the customer with the items and tax codes in QuickBooks. Whatever
+// prices the client has are never used. field names line i of the request in errors.
+func quoteOrder(ctx context.Context, qbc *qb.RealmClient, catalog *pricing.Catalog, companyID string, lines []pricing.OrderLine, field func(i int) string) (pricing.Quote, error) {
+	ids := make([]string, 0, len(lines))
+	for _, line := range lines {
+		ids = append(ids, line.ItemID)
+	}
+	found, err := qbc.FindItemsByIds(ctx, companyID, ids)
+	if err != nil {
+		return pricing.Quote{}, qbError(err, "Could not get items")
+	}
+	items := make(map[string]qb.Item, len(found))
+	for _, item := range found {
+		items[item.Id] = item
+	}
+	codes, err := qbc.FindTaxCodes(ctx, companyID)
+	if err != nil {
+		return pricing.Quote{}, qbError(err, "Could not get tax codes")
+	}
+	rates, err := qbc.FindTaxRates(ctx, companyID)
+	if err != nil {
+		return pricing.Quote{}, qbError(err, "Could not get tax rates")
+	}
+
+	quote, lineErrs := catalog.Quote(lines, items, pricing.NewTaxRates(codes, rates))
+	if len(lineErrs) > 0 {
+		fields := make([]FieldError, len(lineErrs))
+		for i, e := range lineErrs {
+			fields[i] = FieldError{Field: field(e.Line) + "." + e.Field, Message: e.Message}
+		}
+		return pricing.Quote{}, unprocessable("invalid_lines", "Some lines can't be ordered", fields...)
+	}
+	return quote, nil
+}
+
+// checkOrderQuantities stops an order from being published with quantities its items' rules don't allow,
+// e.g. one that was edited in QuickBooks or saved before the rules changed
+func checkOrderQuantities(s *storage.SQLStorage) orderstate.Hook {
+	return func(ctx context.Context, c *orderstate.Change) error {
+		catalog, err := customerCatalog(ctx, c.QB, s, c.Order.QBCompanyID, c.Invoice.CustomerRef.Value)
+		if err != nil {
+			return err
+		}
+		var fields []FieldError
+		for _, line := range c.Invoice.Line {
+			if line.DetailType != "SalesItemLineDetail" {
+				continue
+			}
+			field := fmt.Sprintf("Line[Id=%s].quantity", line.Id)
+			qty, err := pricing.ParseDecimal(pricing.FormatQuantity(line.SalesItemLineDetail.Qty))
+			if err != nil {
+				fields = append(fields, FieldError{Field: field, Message: "not a number"})
+				continue
+			}
+			for _, problem := range catalog.CheckQuantity(line.SalesItemLineDetail.ItemRef.Value, qty) {
+				fields = append(fields, FieldError{Field: field, Message: problem})
+			}
+		}
+		if len(fields) > 0 {
+			return unprocessable("invalid_lines", "Some lines can't be ordered", fields...)
+		}
+		return nil
+	}
+}
+
+// ListPriceLists lists the company's price lists
+func ListPriceLists(s *storage.SQLStorage) http.HandlerFunc {
+	type response struct {
+		PriceLists []domain.PriceList `json:"price_lists"`
+	}
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		claims := ClaimsFromContext(r.Context())
+		lists, err := s.ListPriceLists(claims.QBCompanyID)
+		if err != nil {
+			return internalError("Could not get price lists", err)
+		}
+		return encode(w, r, http.StatusOK, response{PriceLists: lists})
+	})
+}
+
+// SavePriceList creates a price list, or replaces the one in the URL
+func SavePriceList(s *storage.SQLStorage) http.HandlerFunc {
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		claims := ClaimsFromContext(r.Context())
+		list, err := decode[domain.PriceList](r)
+		if err != nil {
+			return badRequest("Invalid request payload", err)
+		}
+		list.ID = 0
+		status := http.StatusCreated
+		if id := r.PathValue("id"); id != "" {
+			if list.ID, err = strconv.ParseInt(id, 10, 64); err != nil {
+				return badRequest("Invalid price list ID", err)
+			}
+			status = http.StatusOK
+		}
+		list.QBCompanyID = claims.QBCompanyID
+		if fields := validatePriceList(&list); len(fields) > 0 {
+			return badRequest("Invalid price list", nil, fields...)
+		}
+
+		list, err = s.SavePriceList(list)
+		if errors.Is(err, sql.ErrNoRows) {
+			return notFound("Price list not found", err)
+		}
+		if err != nil {
+			return internalError("Could not save price list", err)
+		}
+		return encode(w, r, status, list)
+	})
+}
+
+// DeletePriceList deletes the price list in the URL
+func DeletePriceList(s *storage.SQLStorage) http.HandlerFunc {
+	type response struct {
+		Success bool `json:"success"`
+	}
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		claims := ClaimsFromContext(r.Context())
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			return badRequest("Invalid price list ID", err)
+		}
+		err = s.DeletePriceList(claims.QBCompanyID, id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return notFound("Price list not found", err)
+		}
+		if err != nil {
+			return internalError("Could not delete price list", err)
+		}
+		return encode(w, r, http.StatusOK, response{Success: true})
+	})
+}
+
+// validatePriceList checks the price list and normalizes its prices
+func validatePriceList(l *domain.PriceList) []FieldError {
+	var fields []FieldError
+	l.Name = strings.TrimSpace(l.Name)
+	if l.Name == "" {
+		fields = append(fields, FieldError{Field: "name", Message: "required"})
+	}
+	if (l.QBCustomerID == "") == (l.QBCustomerTypeID == "") {
+		fields = append(fields, FieldError{Field: "qb_customer_id", Message: "set either a customer or a customer type"})
+	}
+	if l.EffectiveFrom != nil && l.EffectiveTo != nil && !l.EffectiveFrom.Before(*l.EffectiveTo) {
+		fields = append(fields, FieldError{Field: "effective_to", Message: "must be after effective_from"})
+	}
+	seen := map[string]bool{}
+	for i, item := range l.Items {
+		field := fmt.Sprintf("items[%d]", i)
+		if item.QBItemID == "" {
+			fields = append(fields, FieldError{Field: field + ".qb_item_id", Message: "required"})
+		} else if seen[item.QBItemID] {
+			fields = append(fields, FieldError{Field: field + ".qb_item_id", Message: "item is listed twice"})
+		}
+		seen[item.QBItemID] = true
+		if item.UnitPrice != "" {
+			price, err := pricing.ParseDecimal(item.UnitPrice.String())
+			if err != nil || price.Sign() < 0 {
+				fields = append(fields, FieldError{Field: field + ".unit_price", Message: "must be a number, 0 or more"})
+			}
+		}
+	}
+	return fields
+}
+
+// ListQuantityRules lists the company's quantity rules
+func ListQuantityRules(s *storage.SQLStorage) http.HandlerFunc {
+	type response struct {
+		QuantityRules []domain.QuantityRule `json:"quantity_rules"`
+	}
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		claims := ClaimsFromContext(r.Context())
+		rules, err := s.ListQuantityRules(claims.QBCompanyID)
+		if err != nil {
+			return internalError("Could not get quantity rules", err)
+		}
+		return encode(w, r, http.StatusOK, response{QuantityRules: rules})
+	})
+}
+
+// SaveQuantityRule creates or replaces the rule for an item, or for an item and customer
+func SaveQuantityRule(s *storage.SQLStorage) http.HandlerFunc {
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		claims := ClaimsFromContext(r.Context())
+		rule, err := decode[domain.QuantityRule](r)
+		if err != nil {
+			return badRequest("Invalid request payload", err)
+		}
+		rule.QBCompanyID = claims.QBCompanyID
+		if fields := validateQuantityRule(&rule); len(fields) > 0 {
+			return badRequest("Invalid quantity rule", nil, fields...)
+		}
+		rule, err = s.SaveQuantityRule(rule)
+		if err != nil {
+			return internalError("Could not save quantity rule", err)
+		}
+		return encode(w, r, http.StatusOK, rule)
+	})
+}
+
+// DeleteQuantityRule deletes the quantity rule in the URL
+func DeleteQuantityRule(s *storage.SQLStorage) http.HandlerFunc {
+	type response struct {
+		Success bool `json:"success"`
+	}
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		claims := ClaimsFromContext(r.Context())
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			return badRequest("Invalid quantity rule ID", err)
+		}
+		err = s.DeleteQuantityRule(claims.QBCompanyID, id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return notFound("Quantity rule not found", err)
+		}
+		if err != nil {
+			return internalError("Could not delete quantity rule", err)
+		}
+		return encode(w, r, http.StatusOK, response{Success: true})
+	})
+}
+
+// validateQuantityRule checks the rule's limits are positive and fit together
+func validateQuantityRule(rule *domain.QuantityRule) []FieldError {
+	var fields []FieldError
+	if rule.QBItemID == "" {
+		fields = append(fields, FieldError{Field: "qb_item_id", Message: "required"})
+	}
+	limits := []struct {
+		field string
+		value json.Number
+	}{{"min_qty", rule.MinQty}, {"pack_multiple", rule.PackMultiple}, {"max_qty", rule.MaxQty}}
+	parsed := map[string]*big.Rat{}
+	for _, limit := range limits {
+		if limit.value == "" {
+			continue
+		}
+		value, err := pricing.ParseDecimal(limit.value.String())
+		if err != nil || value.Sign() <= 0 {
+			fields = append(fields, FieldError{Field: limit.field, Message: "must be a number more than 0"})
+			continue
+		}
+		if !rule.AllowDecimal && !value.IsInt() {
+			fields = append(fields, FieldError{Field: limit.field, Message: "must be a whole number unless allow_decimal is set"})
+			continue
+		}
+		parsed[limit.field] = value
+	}
+	if min, max := parsed["min_qty"], parsed["max_qty"]; min != nil && max != nil && min.Cmp(max) > 0 {
+		fields = append(fields, FieldError{Field: "max_qty", Message: "must be at least min_qty"})
+	}
+	return fields
+}
@@ -7,10 +7,13 @@ import (
 	"firebase.google.com/go/auth"
 	fb "github.com/Vertisphere/backend-service/external/firebase"
 	qb "github.com/Vertisphere/backend-service/external/quickbooks"
+	"github.com/Vertisphere/backend-service/internal/domain"
+	"github.com/Vertisphere/backend-service/internal/notify"
+	"github.com/Vertisphere/backend-service/internal/qbtoken"
 	"github.com/Vertisphere/backend-service/internal/storage"
-	"github.com/twilio/twilio-go"
 )
 
+// addRoutes registers every route along with who may call it, and returns the policies by pattern
 func addRoutes(
 	ctx context.Context,
 	mux *http.ServeMux,
@@ -18,63 +21,141 @@ func addRoutes(
 	storage *storage.SQLStorage,
 	fbc *fb.Client,
 	qbc *qb.Client,
-	twc *twilio.RestClient,
+	tokens *qbtoken.Manager,
+	notifier *notify.Service,
+	twilioWebhook *TwilioWebhook,
 
-) {
+) map[string]Policy {
 	// mux.Handle("/", http.NotFoundHandler())
 
+	orders := newOrderMachine(storage)
+	rt := newRouter(mux, auth, ownerChecks(storage, qbc, tokens))
+
 	// THE FRANCHISER FRANCHISEE prefixes are not really necessary but keeping them for dev clarity purposes for now
 
-	// Login endpoints (These are ignored in the middleware)
-	mux.Handle("POST /franchiser/qbLogin", LoginQuickbooks(fbc, qbc, auth, storage))
-	mux.Handle("POST /franchisee/login", LoginCustomer(fbc, qbc, auth, storage))
+	// Login endpoints
+	rt.handle("POST /franchiser/qbLogin", public, LoginQuickbooks(fbc, qbc, tokens, auth, storage))
+	rt.handle("POST /franchiser/login", public, LoginStaff(fbc, tokens, auth, storage))
+	rt.handle("POST /franchisee/login", public, LoginCustomer(fbc, tokens, auth, storage))
+
+	// Signing out the user everywhere, or everyone in the company, and disconnecting QuickBooks
+	rt.handle("POST /logout", everyone, Logout(auth))
+	rt.handle("POST /companies/{id}/sessions:revoke-all", franchisers.needs(domain.ManageCompany), RevokeCompanySessions(auth, storage))
+	rt.handle("POST /franchiser/qbDisconnect", franchisers.needs(domain.ManageCompany), DisconnectQuickbooks(tokens))
+
+	// The franchiser's staff users and their roles, see domain.Role
+	rt.handle("GET /companyUsers", franchisers.needs(domain.ManageStaff), ListCompanyUsers(storage))
+	rt.handle("POST /companyUsers", franchisers.needs(domain.ManageStaff), InviteCompanyUser(qbc, tokens, auth, storage, notifier))
+	rt.handle("PUT /companyUsers/{id}", franchisers.needs(domain.ManageStaff), UpdateCompanyUser(auth, storage))
+	rt.handle("DELETE /companyUsers/{id}", franchisers.needs(domain.ManageStaff), DeleteCompanyUser(auth, storage))
 
 	// QBCustomers
-	mux.Handle("GET /qbCustomer/{id}", GetQBCustomer(qbc, storage))
-	mux.Handle("GET /qbCustomers", ListQBCustomers(qbc, storage))
+	rt.handle("GET /qbCustomer/{id}", everyone.owns(OwnCustomer), GetQBCustomer(qbc, tokens, storage))
+	rt.handle("GET /qbCustomers", franchisers, ListQBCustomers(qbc, tokens, storage))
 
 	// QBInvoices
 
-	mux.Handle("GET /qbInvoicePDF/{id}", GetQBInvoicePDF(qbc))
+	rt.handle("GET /qbInvoicePDF/{id}", everyone.owns(OwnInvoice), GetQBInvoicePDF(qbc, tokens))
 
 	// Create a Invoice: DRAFT
-	mux.Handle("GET /qbInvoice:create", CreateQBInvoice(qbc))
+	rt.handle("GET /qbInvoice:create", franchisees.needs(domain.PlaceOrders), CreateQBInvoice(qbc, tokens, storage))
 
 	// modify a Invoice: DRAFT
-	mux.Handle("POST /qbInvoice:modify/{id}", UpdateQBInvoice(qbc))
-
-	// Set QBInvoice to pending (review) FROM DRAFT, REVISION
-	mux.Handle("GET /qbInvoice:publish/{id}", PublishQBInvoice(qbc, auth, twc))
-	// Set QBInvoice to DRAFT FROM PENDING
-	mux.Handle("GET /qbInvoice:unpublish/{id}", UnpublishQBInvoice(qbc, auth, twc))
+	rt.handle("POST /qbInvoice:modify/{id}", franchisees.needs(domain.PlaceOrders).owns(OwnInvoice), UpdateQBInvoice(qbc, tokens, storage))
+
+	// Move an order between statuses, see orderstate.Transitions for what's allowed. The machine
+	// checks the permission each transition needs.
+	rt.handle("POST /orders/{id}/transitions", everyone.owns(OwnInvoice), TransitionOrder(orders, qbc, tokens, storage))
+	// Who moved an order between statuses and when
+	rt.handle("GET /orders/{id}/history", everyone.owns(OwnInvoice), GetOrderHistory(storage))
+
+	// Set QBInvoice to pending (review) FROM DRAFT
+	rt.handle("GET /qbInvoice:publish/{id}", franchisees.needs(domain.PlaceOrders).owns(OwnInvoice), OrderTransition(orders, qbc, tokens, storage, domain.OrderPending))
+	// Set QBInvoice to DRAFT FROM PENDING, franchisees pull it back and franchisers send it back
+	rt.handle("GET /qbInvoice:unpublish/{id}", everyone.owns(OwnInvoice), OrderTransition(orders, qbc, tokens, storage, domain.OrderDraft))
 	// Set QBInvoice to approved (in preparation) FROM PENDING
-	mux.Handle("GET /qbInvoice:approve/{id}", ApproveQBInvoice(qbc, auth, twc))
-	mux.Handle("GET /qbInvoice:void/{id}", VoidQBInvoice(qbc, auth, twc))
+	rt.handle("GET /qbInvoice:approve/{id}", franchisers.needs(domain.ReviewOrders), OrderTransition(orders, qbc, tokens, storage, domain.OrderApproved))
+	rt.handle("GET /qbInvoice:void/{id}", franchisees.needs(domain.PlaceOrders).owns(OwnInvoice), OrderTransition(orders, qbc, tokens, storage, domain.OrderVoid))
 
 	// Duplicate qbInvoice
-	mux.Handle("GET /qbInvoice:duplicate/{id}", DuplicateQBInvoice(qbc))
+	rt.handle("GET /qbInvoice:duplicate/{id}", franchisees.needs(domain.PlaceOrders).owns(OwnInvoice), DuplicateQBInvoice(qbc, tokens, storage))
 
-	// Set QBInvoice to revision (needs change)
-	// WE'RE NOT USING REJECTED FOR NOW. WILL USE DRAFT INSTEAD
-	// mux.Handle("GET /qbInvoice:reject/{id}", RejectQBInvoice(qbc))
+	// Set QBInvoice to revision (needs change) FROM PENDING, with the reviewer's comments in the body.
+	// The franchisee modifies it and publishes it again.
+	rt.handle("POST /qbInvoice:reject/{id}", franchisers.needs(domain.ReviewOrders), RequestOrderRevision(orders, qbc, tokens, storage))
 	// Set QBInvoice to complete (ready for pick up)
-	mux.Handle("GET /qbInvoice:complete/{id}", CompleteQBInvoice(qbc, auth, twc, storage))
-
-	mux.Handle("GET /qbInvoice/{id}", GetQBInvoice(qbc))
-
-	mux.Handle("GET /qbInvoices", ListQBInvoices(qbc))
-
-	// We're creating a firebase user for franchisee
-	mux.Handle("POST /customer", CreateCustomer(fbc, qbc, auth, storage))
-	// We're deleting a firebase user for franchisee
-	mux.Handle("DELETE /customer", DeleteCustomer(auth, storage))
-
-	// login for franchisee
-	mux.Handle("GET /qbItems", ListQBItems(qbc))
-	// TODO add role management in these handlers
-
-	// This should really be the same thing since we cane use the claims to determine the role
+	rt.handle("GET /qbInvoice:complete/{id}", franchisers.needs(domain.FulfillOrders), OrderTransition(orders, qbc, tokens, storage, domain.OrderComplete))
+
+	rt.handle("GET /qbInvoice/{id}", everyone.owns(OwnInvoice), GetQBInvoice(qbc, tokens, storage))
+
+	rt.handle("GET /qbInvoices", everyone, ListQBInvoices(qbc, tokens, storage))
+
+	// We're creating a firebase user for franchisee, locations can have many
+	rt.handle("POST /customer", franchisers.needs(domain.ManageCustomers), CreateCustomer(fbc, qbc, tokens, auth, storage, notifier))
+	// We're deleting every firebase user of the franchisee
+	rt.handle("DELETE /customer", franchisers.needs(domain.ManageCustomers), DeleteCustomer(auth, storage))
+
+	// The logins of the signed in franchisee's location, managed by its location admins
+	rt.handle("GET /locationUsers", franchisees.needs(domain.ManageLocationUsers), ListLocationUsers(storage))
+	rt.handle("POST /locationUsers", franchisees.needs(domain.ManageLocationUsers), InviteLocationUser(qbc, tokens, auth, storage, notifier))
+	rt.handle("PUT /locationUsers/{id}", franchisees.needs(domain.ManageLocationUsers), UpdateLocationUser(auth, storage))
+	rt.handle("DELETE /locationUsers/{id}", franchisees.needs(domain.ManageLocationUsers), DeleteLocationUser(auth, storage))
+
+	// Franchisees only see the items they can order, at their prices
+	rt.handle("GET /qbItems", everyone, ListQBItems(qbc, tokens, storage))
+
+	// Franchiser managed prices and catalogs per customer or customer type, and order quantities per item
+	rt.handle("GET /priceLists", franchisers, ListPriceLists(storage))
+	rt.handle("POST /priceLists", franchisers.needs(domain.ManageCatalog), SavePriceList(storage))
+	rt.handle("PUT /priceLists/{id}", franchisers.needs(domain.ManageCatalog), SavePriceList(storage))
+	rt.handle("DELETE /priceLists/{id}", franchisers.needs(domain.ManageCatalog), DeletePriceList(storage))
+	rt.handle("GET /quantityRules", franchisers, ListQuantityRules(storage))
+	rt.handle("PUT /quantityRules", franchisers.needs(domain.ManageCatalog), SaveQuantityRule(storage))
+	rt.handle("DELETE /quantityRules/{id}", franchisers.needs(domain.ManageCatalog), DeleteQuantityRule(storage))
+
+	// Pickup and delivery windows, order cutoffs and blackout dates. Franchisees pick one of the
+	// slots when publishing.
+	rt.handle("GET /orderSchedule", everyone, GetOrderSchedule(storage))
+	rt.handle("PUT /orderSchedule", franchisers.needs(domain.ManageCatalog), SaveOrderSchedule(storage))
+	rt.handle("GET /orderSlots", everyone, ListOrderSlots(storage))
+
+	// Orders franchisees place on a schedule, placed by the standing.Scheduler started in main
+	rt.handle("GET /standingOrders", everyone, ListStandingOrders(storage))
+	rt.handle("POST /standingOrders", franchisees.needs(domain.PlaceOrders), SaveStandingOrder(qbc, tokens, storage))
+	rt.handle("PUT /standingOrders/{id}", franchisees.needs(domain.PlaceOrders).owns(OwnStandingOrder), SaveStandingOrder(qbc, tokens, storage))
+	rt.handle("DELETE /standingOrders/{id}", franchisees.needs(domain.PlaceOrders).owns(OwnStandingOrder), DeleteStandingOrder(storage))
+	rt.handle("GET /standingOrders/{id}/occurrences", everyone.owns(OwnStandingOrder), ListStandingOrderOccurrences(storage))
+	rt.handle("POST /standingOrders/{id}/skip", franchisees.needs(domain.PlaceOrders).owns(OwnStandingOrder), SkipStandingOrderOccurrence(storage, true))
+	rt.handle("POST /standingOrders/{id}/unskip", franchisees.needs(domain.PlaceOrders).owns(OwnStandingOrder), SkipStandingOrderOccurrence(storage, false))
+
+	// Franchisees' named order templates and favorite items. Favorites are stored per location, the
+	// {itemId} is a QB item so there's nothing to own.
+	rt.handle("GET /orderTemplates", franchisees, ListOrderTemplates(storage))
+	rt.handle("POST /orderTemplates", franchisees.needs(domain.PlaceOrders), SaveOrderTemplate(qbc, tokens, storage))
+	rt.handle("GET /orderTemplates/{id}", franchisees.owns(OwnTemplate), GetOrderTemplate(qbc, tokens, storage))
+	rt.handle("PUT /orderTemplates/{id}", franchisees.needs(domain.PlaceOrders).owns(OwnTemplate), SaveOrderTemplate(qbc, tokens, storage))
+	rt.handle("DELETE /orderTemplates/{id}", franchisees.needs(domain.PlaceOrders).owns(OwnTemplate), DeleteOrderTemplate(storage))
+	rt.handle("POST /orders:fromTemplate/{id}", franchisees.needs(domain.PlaceOrders).owns(OwnTemplate), CreateOrderFromTemplate(qbc, tokens, storage))
+	rt.handle("GET /favorites", franchisees, ListFavoriteItems(storage))
+	rt.handle("PUT /favorites/{itemId}", franchisees.needs(domain.PlaceOrders), AddFavoriteItem(qbc, tokens, storage))
+	rt.handle("DELETE /favorites/{itemId}", franchisees.needs(domain.PlaceOrders), RemoveFavoriteItem(storage))
+
+	// How much of the company's QuickBooks rate limit is in use
+	rt.handle("GET /qbRateLimit", franchisers, GetQBRateLimit(qbc))
+
+	// Franchisers approving and voiding orders by replying to the SMS notifications. Twilio signs
+	// its webhooks instead, see TwilioWebhook.
+	rt.handle("POST /webhooks/twilio/sms", public, TwilioSMS(twilioWebhook, auth, orders, qbc, tokens, storage))
+
+	// How the signed in user wants to be notified
+	rt.handle("GET /me/notification-preferences", everyone, GetNotificationPreferences(storage))
+	rt.handle("PUT /me/notification-preferences", everyone, UpdateNotificationPreferences(storage))
+
+	// Notifications that couldn't be delivered, and retrying them
+	rt.handle("GET /admin/notifications", franchisers, ListNotifications(storage))
+	rt.handle("POST /admin/notifications/{id}/retry", franchisers.needs(domain.ManageNotifications), RetryNotification(storage))
 
 	// mux.Handle("GET /", ShowClaims())
 
+	return rt.policies
 }
@@ -0,0 +1,199 @@
+package net
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Vertisphere/backend-service/internal/domain"
+	"github.com/Vertisphere/backend-service/internal/orderstate"
+	"github.com/Vertisphere/backend-service/internal/schedule"
+	"github.com/Vertisphere/backend-service/internal/storage"
+)
+
+// orderKinds are the kinds of windows a company can have
+var orderKinds = map[string]string{"pickup": "Pickup", "delivery": "Delivery"}
+
+// scheduleOrder puts a published order into the slot the franchisee picked and writes it to the invoice.
+// Companies without windows take orders at any time.
+func scheduleOrder(s *storage.SQLStorage) orderstate.Hook {
+	return func(ctx context.Context, c *orderstate.Change) error {
+		sched, err := s.GetOrderSchedule(c.Order.QBCompanyID)
+		if errors.Is(err, sql.ErrNoRows) || err == nil && !schedule.Enabled(sched) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("could not get order schedule: %w", err)
+		}
+
+		slot, err := schedule.Choose(sched, c.Slot, time.Now())
+		var pastCutoff *schedule.PastCutoffError
+		switch {
+		case errors.As(err, &pastCutoff):
+			appErr := unprocessable("past_cutoff", "Orders for this slot have closed, pick a later one", FieldError{Field: "slot", Message: pastCutoff.Error()})
+			appErr.Extensions = map[string]any{"cutoff": pastCutoff.Slot.Cutoff}
+			return appErr
+		case errors.Is(err, schedule.ErrUnknownSlot):
+			return unprocessable("unknown_slot", "Slot is not available", FieldError{Field: "slot", Message: "no such slot"})
+		case errors.Is(err, schedule.ErrNoSlots):
+			return unprocessable("no_slots", "There are no open slots to order for")
+		case err != nil:
+			return fmt.Errorf("could not choose slot: %w", err)
+		}
+
+		invoiceToUpdate := struct {
+			Id           string `json:"Id"`
+			SyncToken    string `json:"SyncToken"`
+			Sparse       bool   `json:"sparse"`
+			ShipDate     string `json:"ShipDate"`
+			DeliveryInfo struct {
+				DeliveryType string `json:"DeliveryType"`
+				DeliveryTime string `json:"DeliveryTime"`
+			} `json:"DeliveryInfo"`
+		}{
+			Id:        c.Invoice.Id,
+			SyncToken: c.Invoice.SyncToken,
+			Sparse:    true,
+			ShipDate:  slot.Date,
+		}
+		invoiceToUpdate.DeliveryInfo.DeliveryType = orderKinds[slot.Kind]
+		invoiceToUpdate.DeliveryInfo.DeliveryTime = slot.StartsAt.Format(time.RFC3339)
+		updated, err := c.QB.UpdateInvoice(ctx, c.Order.QBCompanyID, invoiceToUpdate)
+		if err != nil {
+			return err
+		}
+		c.Invoice = updated
+		c.Slot = slot.ID
+		return nil
+	}
+}
+
+// GetOrderSchedule returns the company's windows, cutoffs and blackout dates
+func GetOrderSchedule(s *storage.SQLStorage) http.HandlerFunc {
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		claims := ClaimsFromContext(r.Context())
+		sched, err := s.GetOrderSchedule(claims.QBCompanyID)
+		if errors.Is(err, sql.ErrNoRows) {
+			sched = domain.OrderSchedule{
+				TimeZone:      "UTC",
+				AfterCutoff:   domain.CutoffBlock,
+				Windows:       []domain.OrderWindow{},
+				BlackoutDates: []string{},
+			}
+		} else if err != nil {
+			return internalError("Could not get order schedule", err)
+		}
+		return encode(w, r, http.StatusOK, sched)
+	})
+}
+
+// SaveOrderSchedule replaces the company's windows, cutoffs and blackout dates
+func SaveOrderSchedule(s *storage.SQLStorage) http.HandlerFunc {
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		claims := ClaimsFromContext(r.Context())
+		sched, err := decode[domain.OrderSchedule](r)
+		if err != nil {
+			return badRequest("Invalid request payload", err)
+		}
+		sched.QBCompanyID = claims.QBCompanyID
+		if fields := validateOrderSchedule(&sched); len(fields) > 0 {
+			return badRequest("Invalid order schedule", nil, fields...)
+		}
+		sched, err = s.SaveOrderSchedule(sched)
+		if err != nil {
+			return internalError("Could not save order schedule", err)
+		}
+		return encode(w, r, http.StatusOK, sched)
+	})
+}
+
+// ListOrderSlots lists the slots that can still be ordered for, optionally only of one ?kind=
+func ListOrderSlots(s *storage.SQLStorage) http.HandlerFunc {
+	type response struct {
+		Slots []schedule.Slot `json:"slots"`
+	}
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		claims := ClaimsFromContext(r.Context())
+		sched, err := s.GetOrderSchedule(claims.QBCompanyID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return encode(w, r, http.StatusOK, response{Slots: []schedule.Slot{}})
+		}
+		if err != nil {
+			return internalError("Could not get order schedule", err)
+		}
+		slots, err := schedule.Upcoming(sched, time.Now())
+		if err != nil {
+			return internalError("Could not list slots", err)
+		}
+		if kind := r.URL.Query().Get("kind"); kind != "" {
+			filtered := []schedule.Slot{}
+			for _, slot := range slots {
+				if slot.Kind == kind {
+					filtered = append(filtered, slot)
+				}
+			}
+			slots = filtered
+		}
+		return encode(w, r, http.StatusOK, response{Slots: slots})
+	})
+}
+
+// validateOrderSchedule checks the schedule's time zone, windows and dates
+func validateOrderSchedule(sched *domain.OrderSchedule) []FieldError {
+	var fields []FieldError
+	if _, err := time.LoadLocation(sched.TimeZone); err != nil || sched.TimeZone == "" {
+		fields = append(fields, FieldError{Field: "time_zone", Message: "must be an IANA time zone"})
+	}
+	if sched.AfterCutoff == "" {
+		sched.AfterCutoff = domain.CutoffBlock
+	}
+	if sched.AfterCutoff != domain.CutoffBlock && sched.AfterCutoff != domain.CutoffNextSlot {
+		fields = append(fields, FieldError{Field: "after_cutoff", Message: "must be block or next_slot"})
+	}
+
+	seen := map[string]bool{}
+	for i, window := range sched.Windows {
+		field := fmt.Sprintf("windows[%d]", i)
+		window.Weekday = strings.ToLower(window.Weekday)
+		sched.Windows[i].Weekday = window.Weekday
+		if _, ok := orderKinds[window.Kind]; !ok {
+			fields = append(fields, FieldError{Field: field + ".kind", Message: "must be pickup or delivery"})
+		}
+		if _, err := schedule.ParseWeekday(window.Weekday); err != nil {
+			fields = append(fields, FieldError{Field: field + ".weekday", Message: err.Error()})
+		}
+		start, err := schedule.ParseClock(window.Start)
+		if err != nil {
+			fields = append(fields, FieldError{Field: field + ".start", Message: err.Error()})
+		}
+		end, err := schedule.ParseClock(window.End)
+		if err != nil {
+			fields = append(fields, FieldError{Field: field + ".end", Message: err.Error()})
+		} else if end <= start {
+			fields = append(fields, FieldError{Field: field + ".end", Message: "must be after start"})
+		}
+		if window.CutoffTime != "" {
+			if _, err := schedule.ParseClock(window.CutoffTime); err != nil {
+				fields = append(fields, FieldError{Field: field + ".cutoff_time", Message: err.Error()})
+			}
+		}
+		if window.CutoffDays < 0 || window.CutoffDays > 14 {
+			fields = append(fields, FieldError{Field: field + ".cutoff_days", Message: "must be between 0 and 14"})
+		}
+		key := window.Kind + window.Weekday + window.Start
+		if seen[key] {
+			fields = append(fields, FieldError{Field: field, Message: "another window has the same kind, day and start"})
+		}
+		seen[key] = true
+	}
+	for i, date := range sched.BlackoutDates {
+		if _, err := schedule.ParseDate(date); err != nil {
+			fields = append(fields, FieldError{Field: fmt.Sprintf("blackout_dates[%d]", i), Message: "must be YYYY-MM-DD"})
+		}
+	}
+	return fields
+}
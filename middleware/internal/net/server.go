@@ -7,8 +7,9 @@ import (
 	"firebase.google.com/go/auth"
 	fb "github.com/Vertisphere/backend-service/external/firebase"
 	qb "github.com/Vertisphere/backend-service/external/quickbooks"
+	"github.com/Vertisphere/backend-service/internal/notify"
+	"github.com/Vertisphere/backend-service/internal/qbtoken"
 	"github.com/Vertisphere/backend-service/internal/storage"
-	"github.com/twilio/twilio-go"
 )
 
 func NewServer(
@@ -17,7 +18,9 @@ func NewServer(
 	store *storage.SQLStorage,
 	firebaseClient *fb.Client,
 	quickbooksClient *qb.Client,
-	twilioClient *twilio.RestClient,
+	tokens *qbtoken.Manager,
+	notifier *notify.Service,
+	twilioWebhook *TwilioWebhook,
 
 ) http.Handler {
 	mux := http.NewServeMux()
@@ -28,11 +31,13 @@ func NewServer(
 		store,
 		firebaseClient,
 		quickbooksClient,
-		twilioClient,
+		tokens,
+		notifier,
+		twilioWebhook,
 	)
+	// Routes authenticate and authorize their own requests, see Policy
 	var handler http.Handler = mux
 	// The later the middleware is added the earlier it is executed
-	handler = authMiddleware(auth, handler)
 	handler = corsMiddleware(handler)
 	handler = traceMiddleware(handler)
 	return handler
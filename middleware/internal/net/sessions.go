@@ -0,0 +1,72 @@
+package net
+
+import (
+	"net/http"
+
+	"firebase.google.com/go/auth"
+	"github.com/Vertisphere/backend-service/internal/qbtoken"
+	"github.com/Vertisphere/backend-service/internal/storage"
+)
+
+// Logout revokes the signed in user's refresh tokens, so their ID tokens stop working right away
+// instead of when they expire, see authenticate. Firebase can't revoke a single session, so the
+// user is signed out on every device.
+func Logout(a *auth.Client) http.HandlerFunc {
+	type response struct {
+		Success bool `json:"success"`
+	}
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		claims := ClaimsFromContext(r.Context())
+		if err := a.RevokeRefreshTokens(r.Context(), claims.FirebaseID); err != nil {
+			return internalError("Could not revoke tokens in firebase", err)
+		}
+		return encode(w, r, http.StatusOK, response{Success: true})
+	})
+}
+
+// RevokeCompanySessions signs out every staff user and franchisee login of the company in the URL,
+// including the caller, e.g. after a password leaked
+func RevokeCompanySessions(a *auth.Client, s *storage.SQLStorage) http.HandlerFunc {
+	type response struct {
+		Revoked int `json:"revoked"`
+	}
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		claims := ClaimsFromContext(r.Context())
+		if r.PathValue("id") != claims.QBCompanyID {
+			return forbidden(nil)
+		}
+
+		firebaseIDs, err := s.ListCompanyFirebaseIDs(claims.QBCompanyID)
+		if err != nil {
+			return internalError("Could not get company users", err)
+		}
+		revoked := 0
+		for _, firebaseID := range firebaseIDs {
+			err := a.RevokeRefreshTokens(r.Context(), firebaseID)
+			if auth.IsUserNotFound(err) {
+				continue
+			}
+			if err != nil {
+				// Revoking again is harmless, so the request can just be retried
+				return internalError("Could not revoke tokens in firebase", err)
+			}
+			revoked++
+		}
+		return encode(w, r, http.StatusOK, response{Revoked: revoked})
+	})
+}
+
+// DisconnectQuickbooks revokes the company's QuickBooks tokens and forgets them. The company's users
+// stay, but nothing that needs QuickBooks works until the franchiser logs in to QuickBooks again.
+func DisconnectQuickbooks(tokens *qbtoken.Manager) http.HandlerFunc {
+	type response struct {
+		Success bool `json:"success"`
+	}
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		claims := ClaimsFromContext(r.Context())
+		if err := tokens.Disconnect(r.Context(), claims.QBCompanyID); err != nil {
+			return internalError("Could not disconnect from QuickBooks", err)
+		}
+		return encode(w, r, http.StatusOK, response{Success: true})
+	})
+}
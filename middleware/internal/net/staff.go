@@ -0,0 +1,314 @@
+package net
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/mail"
+	"os"
+	"strings"
+
+	"firebase.google.com/go/auth"
+	fb "github.com/Vertisphere/backend-service/external/firebase"
+	qb "github.com/Vertisphere/backend-service/external/quickbooks"
+	"github.com/Vertisphere/backend-service/internal/domain"
+	"github.com/Vertisphere/backend-service/internal/notify"
+	"github.com/Vertisphere/backend-service/internal/qbtoken"
+	"github.com/Vertisphere/backend-service/internal/storage"
+	"github.com/rs/zerolog/log"
+)
+
+// staffRoles is how the staff roles are listed in validation errors
+const staffRoles = "owner, approver, fulfillment or viewer"
+
+// signIn mints a custom token with the claims and exchanges it for an ID token
+func signIn(ctx context.Context, fbc *fb.Client, a *auth.Client, claims domain.Claims) (string, error) {
+	customToken, err := a.CustomTokenWithClaims(ctx, claims.FirebaseID, domain.ClaimsToMap(claims))
+	if err != nil {
+		return "", internalError("Could not create custom token", err)
+	}
+	resp, err := fbc.SignInWithCustomToken(ctx, customToken)
+	if err != nil {
+		return "", internalError("Could not sign in with custom token", err)
+	}
+	return resp.IdToken, nil
+}
+
+// sessions changes the claims of a signed in user. Implemented by *auth.Client.
+type sessions interface {
+	SetCustomUserClaims(ctx context.Context, uid string, customClaims map[string]interface{}) error
+	RevokeRefreshTokens(ctx context.Context, uid string) error
+}
+
+// resetSession gives the user their new claims and signs them out everywhere. Their ID tokens keep
+// the claims they were minted with across refreshes, so a role change only takes effect this way.
+func resetSession(ctx context.Context, a sessions, claims domain.Claims) error {
+	err := a.SetCustomUserClaims(ctx, claims.FirebaseID, domain.ClaimsToMap(claims))
+	if auth.IsUserNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return internalError("Could not update claims in firebase", err)
+	}
+	if err := a.RevokeRefreshTokens(ctx, claims.FirebaseID); err != nil {
+		return internalError("Could not revoke tokens in firebase", err)
+	}
+	return nil
+}
+
+// LoginStaff signs in a franchiser's staff user with their email and password. Unlike LoginQuickbooks
+// it doesn't go through QuickBooks, the company only has to still be connected.
+func LoginStaff(fbc *fb.Client, tokens *qbtoken.Manager, a *auth.Client, s *storage.SQLStorage) http.HandlerFunc {
+	type request struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	type response struct {
+		Name    string      `json:"name"`
+		Role    domain.Role `json:"role"`
+		Token   string      `json:"token"`
+		Success bool        `json:"success"`
+	}
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		req, err := decode[request](r)
+		if err != nil {
+			return badRequest("Invalid request payload", err)
+		}
+
+		signInWithPasswordResponse, err := fbc.SignInWithPassword(r.Context(), req.Email, req.Password)
+		if err != nil {
+			return unauthorized("Invalid email or password", err)
+		}
+		user, err := s.GetCompanyUser(signInWithPasswordResponse.LocalID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return unauthorized("Not a staff account", err)
+		}
+		if err != nil {
+			return internalError("Could not get staff user", err)
+		}
+		// Make sure the company is still connected to QB, this also refreshes the token if needed
+		_, err = tokens.Token(r.Context(), user.QBCompanyID)
+		if errors.Is(err, qbtoken.ErrNotConnected) {
+			return badRequest("Franchiser is not connected to QuickBooks", err)
+		}
+		if err != nil {
+			return internalError("Could not get QB token", err)
+		}
+
+		token, err := signIn(r.Context(), fbc, a, domain.Claims{
+			QBCompanyID:  user.QBCompanyID,
+			QBCustomerID: "0",
+			IsFranchiser: true,
+			FirebaseID:   user.FirebaseID,
+			Role:         user.Role,
+		})
+		if err != nil {
+			return err
+		}
+		return encode(w, r, http.StatusOK, response{Name: user.Name, Role: user.Role, Token: token, Success: true})
+	})
+}
+
+// invite creates a firebase user for email and returns a link for them to set their password, which
+// lands them on the web app's page at path. save stores who the user is, the firebase user is deleted
+// again if it fails.
+func invite(ctx context.Context, a *auth.Client, email string, name string, path string, save func(firebaseID string) error) (string, error) {
+	// The user sets their password through the reset link, so there's none to create them with
+	userToCreate := (&auth.UserToCreate{}).Email(email)
+	if name != "" {
+		userToCreate = userToCreate.DisplayName(name)
+	}
+	createdUser, err := a.CreateUser(ctx, userToCreate)
+	if auth.IsEmailAlreadyExists(err) {
+		return "", conflict("email_taken", "There is already an account with this email", err)
+	}
+	if err != nil {
+		return "", internalError("Could not create user in firebase", err)
+	}
+	if err := save(createdUser.UID); err != nil {
+		if rollBackErr := a.DeleteUser(ctx, createdUser.UID); rollBackErr != nil {
+			log.Error().Err(rollBackErr).Msgf("Could not delete user in firebase after saving the invite failed for user: %s", createdUser.UID)
+		}
+		return "", internalError("Could not save invited user in DB", err)
+	}
+
+	emailSetting := auth.ActionCodeSettings{
+		URL: os.Getenv("CLIENT_ENDPOINT") + path,
+	}
+	link, err := a.PasswordResetLinkWithSettings(ctx, email, &emailSetting)
+	if err != nil {
+		return "", internalError("Could not create reset link", err)
+	}
+	return link, nil
+}
+
+// validateInvite checks the email and role of an invite, valid says which roles can be given
+func validateInvite(email string, role domain.Role, valid func(domain.Role) bool, roles string) []FieldError {
+	var fields []FieldError
+	if _, err := mail.ParseAddress(email); err != nil {
+		fields = append(fields, FieldError{Field: "email", Message: "must be an email address"})
+	}
+	if !valid(role) {
+		fields = append(fields, FieldError{Field: "role", Message: "must be " + roles})
+	}
+	return fields
+}
+
+// ListCompanyUsers lists the company's staff users
+func ListCompanyUsers(s *storage.SQLStorage) http.HandlerFunc {
+	type response struct {
+		Users []domain.CompanyUser `json:"users"`
+	}
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		claims := ClaimsFromContext(r.Context())
+		users, err := s.ListCompanyUsers(claims.QBCompanyID)
+		if err != nil {
+			return internalError("Could not get staff users", err)
+		}
+		return encode(w, r, http.StatusOK, response{Users: users})
+	})
+}
+
+// InviteCompanyUser creates a firebase user for a new staff user and emails them a link to set their
+// password, the same way franchisees are invited in CreateCustomer
+func InviteCompanyUser(qbc *qb.Client, tokens *qbtoken.Manager, a *auth.Client, s *storage.SQLStorage, n *notify.Service) http.HandlerFunc {
+	type request struct {
+		Email string      `json:"email"`
+		Name  string      `json:"name"`
+		Role  domain.Role `json:"role"`
+	}
+	type response struct {
+		User domain.CompanyUser `json:"user"`
+		// This is sent in the email but will put this in for for dev testing
+		ResetLink string `json:"reset_link"`
+	}
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		claims := ClaimsFromContext(r.Context())
+		req, err := decode[request](r)
+		if err != nil {
+			return badRequest("Invalid request payload", err)
+		}
+		req.Email = strings.TrimSpace(req.Email)
+		if fields := validateInvite(req.Email, req.Role, domain.Role.IsStaff, staffRoles); len(fields) > 0 {
+			return badRequest("Invalid staff user", nil, fields...)
+		}
+
+		qbc, err := realmClient(r.Context(), qbc, tokens, claims.QBCompanyID)
+		if err != nil {
+			return err
+		}
+
+		var user domain.CompanyUser
+		link, err := invite(r.Context(), a, req.Email, req.Name, "/franchiser/dashboard", func(firebaseID string) error {
+			user, err = s.CreateCompanyUser(domain.CompanyUser{
+				FirebaseID:  firebaseID,
+				QBCompanyID: claims.QBCompanyID,
+				Email:       req.Email,
+				Name:        req.Name,
+				Role:        req.Role,
+				InvitedBy:   claims.FirebaseID,
+			})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		err = n.Emit(r.Context(), qbc, notify.Event{
+			Type:      notify.StaffInvited,
+			CompanyID: claims.QBCompanyID,
+			Link:      link,
+			To:        &notify.Recipient{Name: req.Name, Emails: []string{req.Email}},
+		})
+		if err != nil {
+			// The owner still gets the link back and can pass it on
+			log.Error().Err(err).Msg("Could not send staff invite email")
+		}
+
+		return encode(w, r, http.StatusCreated, response{User: user, ResetLink: link})
+	})
+}
+
+// UpdateCompanyUser changes the role of the staff user in the URL
+func UpdateCompanyUser(a *auth.Client, s *storage.SQLStorage) http.HandlerFunc {
+	type request struct {
+		Role domain.Role `json:"role"`
+	}
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		claims := ClaimsFromContext(r.Context())
+		req, err := decode[request](r)
+		if err != nil {
+			return badRequest("Invalid request payload", err)
+		}
+		if !req.Role.IsStaff() {
+			return badRequest("Invalid staff user", nil, FieldError{Field: "role", Message: "must be " + staffRoles})
+		}
+		firebaseID := r.PathValue("id")
+		if err := notQuickbooksUser(s, claims.QBCompanyID, firebaseID); err != nil {
+			return err
+		}
+
+		user, err := s.UpdateCompanyUserRole(claims.QBCompanyID, firebaseID, req.Role)
+		if err != nil {
+			return companyUserError(err, "Could not update staff user")
+		}
+		err = resetSession(r.Context(), a, domain.Claims{
+			QBCompanyID:  user.QBCompanyID,
+			QBCustomerID: "0",
+			IsFranchiser: true,
+			FirebaseID:   user.FirebaseID,
+			Role:         user.Role,
+		})
+		if err != nil {
+			return err
+		}
+		return encode(w, r, http.StatusOK, user)
+	})
+}
+
+// DeleteCompanyUser removes the staff user in the URL and their firebase user
+func DeleteCompanyUser(a *auth.Client, s *storage.SQLStorage) http.HandlerFunc {
+	type response struct {
+		Success bool `json:"success"`
+	}
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		claims := ClaimsFromContext(r.Context())
+		firebaseID := r.PathValue("id")
+		if err := notQuickbooksUser(s, claims.QBCompanyID, firebaseID); err != nil {
+			return err
+		}
+
+		if err := s.DeleteCompanyUser(claims.QBCompanyID, firebaseID); err != nil {
+			return companyUserError(err, "Could not delete staff user")
+		}
+		err := a.DeleteUser(r.Context(), firebaseID)
+		if err != nil && !auth.IsUserNotFound(err) {
+			return internalError("Could not delete user in firebase", err)
+		}
+		return encode(w, r, http.StatusOK, response{Success: true})
+	})
+}
+
+// notQuickbooksUser returns an error if the user is the one that connected the company to QuickBooks.
+// LoginQuickbooks signs in as them, so they stay an owner for as long as the company exists.
+func notQuickbooksUser(s *storage.SQLStorage, companyID string, firebaseID string) error {
+	company, err := s.GetCompany(companyID)
+	if err != nil {
+		return internalError("Could not get company", err)
+	}
+	if company.FirebaseID == firebaseID {
+		return conflict("quickbooks_user", "The QuickBooks user is always an owner", nil)
+	}
+	return nil
+}
+
+func companyUserError(err error, msg string) error {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return notFound("Staff user not found", err)
+	case errors.Is(err, storage.ErrLastOwner):
+		return conflict("last_owner", "The company needs at least one owner", err)
+	default:
+		return internalError(msg, err)
+	}
+}
@@ -0,0 +1,114 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"firebase.google.com/go/auth"
+	"github.com/Vertisphere/backend-service/internal/domain"
+)
+
+// fakeFirebase signs users in and checks their ID tokens like firebase: a token has the claims the
+// user had when they signed in, and stops working once the user's refresh tokens are revoked
+type fakeFirebase struct {
+	claims   map[string]map[string]interface{}
+	sessions map[string]int
+	tokens   map[string]fakeToken
+}
+
+type fakeToken struct {
+	uid     string
+	claims  map[string]interface{}
+	session int
+}
+
+func newFakeFirebase() *fakeFirebase {
+	return &fakeFirebase{claims: map[string]map[string]interface{}{}, sessions: map[string]int{}, tokens: map[string]fakeToken{}}
+}
+
+func (f *fakeFirebase) signIn(uid string) string {
+	token := fmt.Sprintf("%s-%d", uid, len(f.tokens))
+	f.tokens[token] = fakeToken{uid: uid, claims: f.claims[uid], session: f.sessions[uid]}
+	return token
+}
+
+func (f *fakeFirebase) VerifyIDTokenAndCheckRevoked(ctx context.Context, idToken string) (*auth.Token, error) {
+	t, ok := f.tokens[idToken]
+	if !ok {
+		return nil, errors.New("invalid ID token")
+	}
+	if t.session < f.sessions[t.uid] {
+		return nil, errors.New("ID token has been revoked")
+	}
+	return &auth.Token{UID: t.uid, Claims: t.claims}, nil
+}
+
+func (f *fakeFirebase) SetCustomUserClaims(ctx context.Context, uid string, claims map[string]interface{}) error {
+	f.claims[uid] = claims
+	return nil
+}
+
+func (f *fakeFirebase) RevokeRefreshTokens(ctx context.Context, uid string) error {
+	f.sessions[uid]++
+	return nil
+}
+
+func TestRoleChangeTakesEffect(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   Policy
+		claims   domain.Claims
+		demoted  domain.Role
+		promoted domain.Role
+	}{
+		{
+			"staff", franchisers.needs(domain.ReviewOrders),
+			domain.Claims{QBCompanyID: "1001", QBCustomerID: "0", IsFranchiser: true, FirebaseID: "staff"},
+			domain.RoleViewer, domain.RoleApprover,
+		},
+		{
+			"location", franchisees.needs(domain.ManageLocationUsers),
+			domain.Claims{QBCompanyID: "1001", QBCustomerID: "58", FirebaseID: "login"},
+			domain.RoleOrderer, domain.RoleLocationAdmin,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeFirebase()
+			rt := newRouter(nil, f, nil)
+			h := rt.authenticate(rt.enforce(tt.policy, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})))
+			call := func(token string) int {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.Header.Set("Authorization", "Bearer "+token)
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, req)
+				return rec.Code
+			}
+
+			claims := tt.claims
+			claims.Role = tt.promoted
+			f.claims[claims.FirebaseID] = domain.ClaimsToMap(claims)
+			before := f.signIn(claims.FirebaseID)
+			if status := call(before); status != http.StatusOK {
+				t.Fatalf("before the change: status = %d, want 200", status)
+			}
+
+			claims.Role = tt.demoted
+			if err := resetSession(context.Background(), f, claims); err != nil {
+				t.Fatal(err)
+			}
+			if status := call(before); status != http.StatusUnauthorized {
+				t.Errorf("token from before the change: status = %d, want 401", status)
+			}
+			if status := call(f.signIn(claims.FirebaseID)); status != http.StatusForbidden {
+				t.Errorf("signed in again: status = %d, want 403 with the new role", status)
+			}
+		})
+	}
+}
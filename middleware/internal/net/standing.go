@@ -0,0 +1,349 @@
+package net
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	qb "github.com/Vertisphere/backend-service/external/quickbooks"
+	"github.com/Vertisphere/backend-service/internal/domain"
+	"github.com/Vertisphere/backend-service/internal/notify"
+	"github.com/Vertisphere/backend-service/internal/pricing"
+	"github.com/Vertisphere/backend-service/internal/qbtoken"
+	"github.com/Vertisphere/backend-service/internal/schedule"
+	"github.com/Vertisphere/backend-service/internal/standing"
+	"github.com/Vertisphere/backend-service/internal/storage"
+	"github.com/google/uuid"
+)
+
+// upcomingOccurrences is how many occurrences are listed ahead, and how far ahead they can be skipped
+const upcomingOccurrences = 8
+
+// PlaceStandingOrder places a standing order for the scheduler: a draft order priced like the
+// franchisee placed it, published as well if the standing order says so. The franchisee is told
+// about it, and the franchiser too when it's published.
+func PlaceStandingOrder(qbc *qb.Client, tokens *qbtoken.Manager, s *storage.SQLStorage) standing.Placer {
+	m := newOrderMachine(s)
+	return func(ctx context.Context, o domain.StandingOrder, occurrence time.Time) (string, bool, error) {
+		ctx = context.WithValue(ctx, traceIDKey, uuid.New().String())
+		// Only logins that place orders can save standing orders, so the orders are placed as an orderer
+		// even if the login that created it has since lost the role
+		claims := domain.Claims{QBCompanyID: o.QBCompanyID, QBCustomerID: o.QBCustomerID, FirebaseID: o.CreatedBy, Role: domain.RoleOrderer}
+
+		client, err := realmClient(ctx, qbc, tokens, o.QBCompanyID)
+		if err != nil {
+			return "", false, err
+		}
+		catalog, err := customerCatalog(ctx, client, s, o.QBCompanyID, o.QBCustomerID)
+		if err != nil {
+			return "", false, err
+		}
+		quote, err := quoteOrder(ctx, client, catalog, o.QBCompanyID, standingOrderLines(o), standingOrderLineField)
+		if err != nil {
+			return "", false, errorWithFields(err)
+		}
+		created, err := createDraftInvoice(ctx, client, o.QBCompanyID, o.QBCustomerID, quote.InvoiceLines())
+		if err != nil {
+			return "", false, err
+		}
+
+		event := draftEvent(ctx, claims, created)
+		event.Reason = fmt.Sprintf("Standing order %q for %s", o.Name, occurrence.Format(time.RFC3339))
+		notification, err := notify.NewNotification(notify.Event{
+			Type:       notify.StandingOrderPlaced,
+			CompanyID:  o.QBCompanyID,
+			CustomerID: o.QBCustomerID,
+			InvoiceID:  created.Id,
+			Reason:     o.Name,
+		}, traceID(ctx))
+		if err != nil {
+			return "", false, err
+		}
+		event.Notifications = append(event.Notifications, notification)
+		if err := trackOrder(ctx, client, s, o.QBCustomerID, event, created); err != nil {
+			return "", false, err
+		}
+		if !o.AutoPublish {
+			return created.Id, false, nil
+		}
+
+		change, err := applyTransition(ctx, m, qbc, tokens, s, claims, created.Id, transitionRequest{
+			To:     domain.OrderPending,
+			Reason: fmt.Sprintf("Standing order %q", o.Name),
+		})
+		if err != nil {
+			return created.Id, false, errorWithFields(err)
+		}
+		m.RunAfter(ctx, change)
+		return created.Id, true, nil
+	}
+}
+
+// errorWithFields adds the fields of an *Error to its message, for errors that are stored rather than
+// sent to the client
+func errorWithFields(err error) error {
+	var appErr *Error
+	if !errors.As(err, &appErr) || len(appErr.Fields) == 0 {
+		return err
+	}
+	fields := make([]string, len(appErr.Fields))
+	for i, f := range appErr.Fields {
+		fields[i] = f.Field + ": " + f.Message
+	}
+	return fmt.Errorf("%w (%s)", err, strings.Join(fields, ", "))
+}
+
+func standingOrderLines(o domain.StandingOrder) []pricing.OrderLine {
+	lines := make([]pricing.OrderLine, len(o.Lines))
+	for i, line := range o.Lines {
+		lines[i] = pricing.OrderLine{ItemID: line.ItemID, Quantity: line.Quantity.String()}
+	}
+	return lines
+}
+
+func standingOrderLineField(i int) string {
+	return fmt.Sprintf("lines[%d]", i)
+}
+
+// standingOrderFor returns the standing order in the URL if claims can see it. Franchisees only see their own.
+func standingOrderFor(r *http.Request, s *storage.SQLStorage, claims domain.Claims) (domain.StandingOrder, error) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		return domain.StandingOrder{}, badRequest("Invalid standing order ID", err)
+	}
+	o, err := s.GetStandingOrder(claims.QBCompanyID, id)
+	if errors.Is(err, sql.ErrNoRows) || err == nil && !claims.IsFranchiser && o.QBCustomerID != claims.QBCustomerID {
+		return domain.StandingOrder{}, notFound("Standing order not found", err)
+	}
+	if err != nil {
+		return domain.StandingOrder{}, internalError("Could not get standing order", err)
+	}
+	return o, nil
+}
+
+// ListStandingOrders lists the franchisee's standing orders. Franchisers see every customer's, or
+// the ?customer= one's.
+func ListStandingOrders(s *storage.SQLStorage) http.HandlerFunc {
+	type response struct {
+		StandingOrders []domain.StandingOrder `json:"standing_orders"`
+	}
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		claims := ClaimsFromContext(r.Context())
+		customerID := claims.QBCustomerID
+		if claims.IsFranchiser {
+			customerID = r.URL.Query().Get("customer")
+		}
+		orders, err := s.ListStandingOrders(claims.QBCompanyID, customerID)
+		if err != nil {
+			return internalError("Could not get standing orders", err)
+		}
+		return encode(w, r, http.StatusOK, response{StandingOrders: orders})
+	})
+}
+
+// SaveStandingOrder creates a standing order for the franchisee, or replaces the one in the URL. The
+// lines are checked against the franchisee's catalog like an order would be.
+func SaveStandingOrder(qbc *qb.Client, tokens *qbtoken.Manager, s *storage.SQLStorage) http.HandlerFunc {
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		claims := ClaimsFromContext(r.Context())
+		o, err := decode[domain.StandingOrder](r)
+		if err != nil {
+			return badRequest("Invalid request payload", err)
+		}
+		o.ID = 0
+		status := http.StatusCreated
+		if r.PathValue("id") != "" {
+			existing, err := standingOrderFor(r, s, claims)
+			if err != nil {
+				return err
+			}
+			o.ID = existing.ID
+			status = http.StatusOK
+		}
+		o.QBCompanyID, o.QBCustomerID, o.CreatedBy = claims.QBCompanyID, claims.QBCustomerID, claims.FirebaseID
+		if fields := validateStandingOrder(&o); len(fields) > 0 {
+			return badRequest("Invalid standing order", nil, fields...)
+		}
+
+		client, err := realmClient(r.Context(), qbc, tokens, claims.QBCompanyID)
+		if err != nil {
+			return err
+		}
+		catalog, err := customerCatalog(r.Context(), client, s, claims.QBCompanyID, claims.QBCustomerID)
+		if err != nil {
+			return err
+		}
+		_, err = quoteOrder(r.Context(), client, catalog, claims.QBCompanyID, standingOrderLines(o), standingOrderLineField)
+		if err != nil {
+			return err
+		}
+
+		o.NextRunAt = nil
+		if !o.Paused {
+			if o.NextRunAt, err = standing.Next(o, time.Now()); err != nil {
+				return badRequest("Invalid standing order", err, FieldError{Field: "rrule", Message: err.Error()})
+			}
+		}
+		o, err = s.SaveStandingOrder(o)
+		if errors.Is(err, sql.ErrNoRows) {
+			return notFound("Standing order not found", err)
+		}
+		if err != nil {
+			return internalError("Could not save standing order", err)
+		}
+		return encode(w, r, status, o)
+	})
+}
+
+// DeleteStandingOrder deletes the franchisee's standing order in the URL. Orders it already placed stay.
+func DeleteStandingOrder(s *storage.SQLStorage) http.HandlerFunc {
+	type response struct {
+		Success bool `json:"success"`
+	}
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		claims := ClaimsFromContext(r.Context())
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			return badRequest("Invalid standing order ID", err)
+		}
+		err = s.DeleteStandingOrder(claims.QBCompanyID, claims.QBCustomerID, id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return notFound("Standing order not found", err)
+		}
+		if err != nil {
+			return internalError("Could not delete standing order", err)
+		}
+		return encode(w, r, http.StatusOK, response{Success: true})
+	})
+}
+
+// ListStandingOrderOccurrences lists the next occurrences of a standing order, saying which are
+// skipped, and what happened on the ones of the last 30 days
+func ListStandingOrderOccurrences(s *storage.SQLStorage) http.HandlerFunc {
+	type occurrence struct {
+		Occurrence time.Time `json:"occurrence"`
+		Skipped    bool      `json:"skipped"`
+	}
+	type response struct {
+		Upcoming []occurrence              `json:"upcoming"`
+		Runs     []domain.StandingOrderRun `json:"runs"`
+	}
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		claims := ClaimsFromContext(r.Context())
+		o, err := standingOrderFor(r, s, claims)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		runs, err := s.ListStandingOrderRuns(o.ID, now.AddDate(0, 0, -30))
+		if err != nil {
+			return internalError("Could not get standing order runs", err)
+		}
+		skipped := map[int64]bool{}
+		for _, run := range runs {
+			if run.Status == domain.RunSkipped {
+				skipped[run.Occurrence.Unix()] = true
+			}
+		}
+
+		upcoming := []occurrence{}
+		after := now
+		if o.NextRunAt != nil && o.NextRunAt.Before(now) {
+			// Due but not placed yet
+			after = o.NextRunAt.Add(-time.Second)
+		}
+		for !o.Paused && len(upcoming) < upcomingOccurrences {
+			next, err := standing.Next(o, after)
+			if err != nil {
+				return internalError("Could not work out occurrences", err)
+			}
+			if next == nil {
+				break
+			}
+			upcoming = append(upcoming, occurrence{Occurrence: *next, Skipped: skipped[next.Unix()]})
+			after = *next
+		}
+		return encode(w, r, http.StatusOK, response{Upcoming: upcoming, Runs: runs})
+	})
+}
+
+// SkipStandingOrderOccurrence skips, or with skip false unskips, one upcoming occurrence of the
+// franchisee's standing order
+func SkipStandingOrderOccurrence(s *storage.SQLStorage, skip bool) http.HandlerFunc {
+	type request struct {
+		Occurrence time.Time `json:"occurrence"`
+	}
+	type response struct {
+		Success bool `json:"success"`
+	}
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		claims := ClaimsFromContext(r.Context())
+		o, err := standingOrderFor(r, s, claims)
+		if err != nil {
+			return err
+		}
+		req, err := decode[request](r)
+		if err != nil {
+			return badRequest("Invalid request payload", err)
+		}
+
+		// Only real occurrences that haven't been placed yet can be skipped
+		next, err := standing.Next(o, req.Occurrence.Add(-time.Second))
+		if err != nil {
+			return internalError("Could not work out occurrences", err)
+		}
+		if next == nil || !next.Equal(req.Occurrence) {
+			return badRequest("Not an occurrence of the standing order", nil, FieldError{Field: "occurrence", Message: "not an occurrence"})
+		}
+		if o.NextRunAt == nil || req.Occurrence.Before(*o.NextRunAt) {
+			return conflict("occurrence_placed", "The occurrence has already been placed", nil)
+		}
+
+		if skip {
+			_, err = s.SkipStandingOrderOccurrence(o.ID, req.Occurrence)
+		} else {
+			err = s.UnskipStandingOrderOccurrence(o.ID, req.Occurrence)
+		}
+		switch {
+		case errors.Is(err, storage.ErrOccurrenceTaken):
+			return conflict("occurrence_placed", "The occurrence has already been placed", err)
+		case errors.Is(err, sql.ErrNoRows):
+			return notFound("Occurrence is not skipped", err)
+		case err != nil:
+			return internalError("Could not update occurrence", err)
+		}
+		return encode(w, r, http.StatusOK, response{Success: true})
+	})
+}
+
+// validateStandingOrder checks everything about a standing order but its lines' items
+func validateStandingOrder(o *domain.StandingOrder) []FieldError {
+	var fields []FieldError
+	o.Name = strings.TrimSpace(o.Name)
+	if o.Name == "" {
+		fields = append(fields, FieldError{Field: "name", Message: "required"})
+	}
+	if len(o.Lines) == 0 {
+		fields = append(fields, FieldError{Field: "lines", Message: "at least one line is required"})
+	}
+	for i, line := range o.Lines {
+		if line.ItemID == "" {
+			fields = append(fields, FieldError{Field: standingOrderLineField(i) + ".item_id", Message: "required"})
+		}
+	}
+	if _, err := time.LoadLocation(o.TimeZone); err != nil || o.TimeZone == "" {
+		fields = append(fields, FieldError{Field: "time_zone", Message: "must be an IANA time zone"})
+	}
+	if o.StartsAt.IsZero() {
+		o.StartsAt = time.Now()
+	}
+	if _, err := schedule.ParseRRule(o.RRule); err != nil {
+		fields = append(fields, FieldError{Field: "rrule", Message: err.Error()})
+	}
+	return fields
+}
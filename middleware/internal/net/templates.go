@@ -0,0 +1,354 @@
+package net
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	qb "github.com/Vertisphere/backend-service/external/quickbooks"
+	"github.com/Vertisphere/backend-service/internal/domain"
+	"github.com/Vertisphere/backend-service/internal/pricing"
+	"github.com/Vertisphere/backend-service/internal/qbtoken"
+	"github.com/Vertisphere/backend-service/internal/storage"
+)
+
+// templateLine is a line of an order template checked against the items in QuickBooks today
+type templateLine struct {
+	ItemID   string      `json:"item_id"`
+	ItemName string      `json:"item_name,omitempty"`
+	Quantity json.Number `json:"quantity"`
+	// Discontinued is set when the item was deleted or made inactive in QuickBooks
+	Discontinued bool     `json:"discontinued"`
+	Problems     []string `json:"problems,omitempty"`
+}
+
+// checkTemplateLines looks up every item of the lines with FindItemById, which unlike the item query
+// also finds inactive items, and checks the customer can still order them. fields has every problem
+// under the line's field.
+func checkTemplateLines(ctx context.Context, qbc *qb.RealmClient, catalog *pricing.Catalog, companyID string, lines []domain.ItemQuantity) (checked []templateLine, fields []FieldError, err error) {
+	items := map[string]*qb.Item{}
+	checked = make([]templateLine, len(lines))
+	for i, line := range lines {
+		field := fmt.Sprintf("lines[%d]", i)
+		checked[i] = templateLine{ItemID: line.ItemID, Quantity: line.Quantity}
+		problem := func(name string, msg string) {
+			checked[i].Problems = append(checked[i].Problems, msg)
+			fields = append(fields, FieldError{Field: field + "." + name, Message: msg})
+		}
+
+		item, seen := items[line.ItemID]
+		if !seen {
+			item, err = qbc.FindItemById(ctx, companyID, line.ItemID)
+			if errors.Is(err, qb.ErrNotFound) {
+				item, err = nil, nil
+			}
+			if err != nil {
+				return nil, nil, qbError(err, "Could not get item")
+			}
+			items[line.ItemID] = item
+		}
+		switch {
+		case item == nil:
+			checked[i].Discontinued = true
+			problem("item_id", "item no longer exists")
+			continue
+		case !item.Active:
+			checked[i].ItemName = item.Name
+			checked[i].Discontinued = true
+			problem("item_id", "item is discontinued")
+			continue
+		}
+		checked[i].ItemName = item.Name
+		if !catalog.Orderable(item.Id) {
+			problem("item_id", "item can't be ordered")
+		}
+		qty, err := pricing.ParseDecimal(line.Quantity.String())
+		if err != nil {
+			problem("quantity", "not a number")
+			continue
+		}
+		for _, msg := range catalog.CheckQuantity(item.Id, qty) {
+			problem("quantity", msg)
+		}
+	}
+	return checked, fields, nil
+}
+
+// orderTemplateID returns the template ID in the URL
+func orderTemplateID(r *http.Request, name string) (int64, error) {
+	id, err := strconv.ParseInt(r.PathValue(name), 10, 64)
+	if err != nil {
+		return 0, badRequest("Invalid order template ID", err)
+	}
+	return id, nil
+}
+
+// ListOrderTemplates lists the franchisee's order templates
+func ListOrderTemplates(s *storage.SQLStorage) http.HandlerFunc {
+	type response struct {
+		Templates []domain.OrderTemplate `json:"templates"`
+	}
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		claims := ClaimsFromContext(r.Context())
+		templates, err := s.ListOrderTemplates(claims.QBCompanyID, claims.QBCustomerID)
+		if err != nil {
+			return internalError("Could not get order templates", err)
+		}
+		return encode(w, r, http.StatusOK, response{Templates: templates})
+	})
+}
+
+// GetOrderTemplate returns one of the franchisee's order templates with its lines checked against
+// QuickBooks, so lines for discontinued items can be shown as such
+func GetOrderTemplate(qbc *qb.Client, tokens *qbtoken.Manager, s *storage.SQLStorage) http.HandlerFunc {
+	type response struct {
+		Template domain.OrderTemplate `json:"template"`
+		Lines    []templateLine       `json:"lines"`
+	}
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		claims := ClaimsFromContext(r.Context())
+		id, err := orderTemplateID(r, "id")
+		if err != nil {
+			return err
+		}
+		t, err := s.GetOrderTemplate(claims.QBCompanyID, claims.QBCustomerID, id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return notFound("Order template not found", err)
+		}
+		if err != nil {
+			return internalError("Could not get order template", err)
+		}
+
+		client, err := realmClient(r.Context(), qbc, tokens, claims.QBCompanyID)
+		if err != nil {
+			return err
+		}
+		catalog, err := customerCatalog(r.Context(), client, s, claims.QBCompanyID, claims.QBCustomerID)
+		if err != nil {
+			return err
+		}
+		lines, _, err := checkTemplateLines(r.Context(), client, catalog, claims.QBCompanyID, t.Lines)
+		if err != nil {
+			return err
+		}
+		return encode(w, r, http.StatusOK, response{Template: t, Lines: lines})
+	})
+}
+
+// SaveOrderTemplate creates an order template for the franchisee, or replaces the one in the URL.
+// Every line has to be orderable today.
+func SaveOrderTemplate(qbc *qb.Client, tokens *qbtoken.Manager, s *storage.SQLStorage) http.HandlerFunc {
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		claims := ClaimsFromContext(r.Context())
+		t, err := decode[domain.OrderTemplate](r)
+		if err != nil {
+			return badRequest("Invalid request payload", err)
+		}
+		t.ID = 0
+		status := http.StatusCreated
+		if r.PathValue("id") != "" {
+			if t.ID, err = orderTemplateID(r, "id"); err != nil {
+				return err
+			}
+			status = http.StatusOK
+		}
+		t.QBCompanyID, t.QBCustomerID = claims.QBCompanyID, claims.QBCustomerID
+		t.Name = strings.TrimSpace(t.Name)
+		if t.Name == "" {
+			return badRequest("Invalid order template", nil, FieldError{Field: "name", Message: "required"})
+		}
+		if len(t.Lines) == 0 {
+			return badRequest("Invalid order template", nil, FieldError{Field: "lines", Message: "at least one line is required"})
+		}
+
+		client, err := realmClient(r.Context(), qbc, tokens, claims.QBCompanyID)
+		if err != nil {
+			return err
+		}
+		catalog, err := customerCatalog(r.Context(), client, s, claims.QBCompanyID, claims.QBCustomerID)
+		if err != nil {
+			return err
+		}
+		_, fields, err := checkTemplateLines(r.Context(), client, catalog, claims.QBCompanyID, t.Lines)
+		if err != nil {
+			return err
+		}
+		if len(fields) > 0 {
+			return unprocessable("invalid_lines", "Some lines can't be ordered", fields...)
+		}
+
+		t, err = s.SaveOrderTemplate(t)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return notFound("Order template not found", err)
+		case errors.Is(err, storage.ErrDuplicateName):
+			return conflict("duplicate_name", "There's already an order template with that name", err)
+		case err != nil:
+			return internalError("Could not save order template", err)
+		}
+		return encode(w, r, status, t)
+	})
+}
+
+// DeleteOrderTemplate deletes the franchisee's order template in the URL
+func DeleteOrderTemplate(s *storage.SQLStorage) http.HandlerFunc {
+	type response struct {
+		Success bool `json:"success"`
+	}
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		claims := ClaimsFromContext(r.Context())
+		id, err := orderTemplateID(r, "id")
+		if err != nil {
+			return err
+		}
+		err = s.DeleteOrderTemplate(claims.QBCompanyID, claims.QBCustomerID, id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return notFound("Order template not found", err)
+		}
+		if err != nil {
+			return internalError("Could not delete order template", err)
+		}
+		return encode(w, r, http.StatusOK, response{Success: true})
+	})
+}
+
+// CreateOrderFromTemplate creates a draft order with the lines of one of the franchisee's templates,
+// priced for today. Lines for discontinued items are left out and returned as skipped, any other
+// problem with a line fails the request.
+func CreateOrderFromTemplate(qbc *qb.Client, tokens *qbtoken.Manager, s *storage.SQLStorage) http.HandlerFunc {
+	type response struct {
+		Success bool           `json:"success"`
+		Id      string         `json:"id"`
+		Skipped []templateLine `json:"skipped"`
+	}
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		claims := ClaimsFromContext(r.Context())
+		id, err := orderTemplateID(r, "id")
+		if err != nil {
+			return err
+		}
+		t, err := s.GetOrderTemplate(claims.QBCompanyID, claims.QBCustomerID, id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return notFound("Order template not found", err)
+		}
+		if err != nil {
+			return internalError("Could not get order template", err)
+		}
+
+		client, err := realmClient(r.Context(), qbc, tokens, claims.QBCompanyID)
+		if err != nil {
+			return err
+		}
+		catalog, err := customerCatalog(r.Context(), client, s, claims.QBCompanyID, claims.QBCustomerID)
+		if err != nil {
+			return err
+		}
+		checked, _, err := checkTemplateLines(r.Context(), client, catalog, claims.QBCompanyID, t.Lines)
+		if err != nil {
+			return err
+		}
+		skipped := []templateLine{}
+		var requested []pricing.OrderLine
+		var lineIndexes []int
+		for i, line := range checked {
+			if line.Discontinued {
+				skipped = append(skipped, line)
+				continue
+			}
+			requested = append(requested, pricing.OrderLine{ItemID: line.ItemID, Quantity: line.Quantity.String()})
+			lineIndexes = append(lineIndexes, i)
+		}
+		if len(requested) == 0 {
+			return unprocessable("no_orderable_lines", "Every item of the template is discontinued")
+		}
+		quote, err := quoteOrder(r.Context(), client, catalog, claims.QBCompanyID, requested, func(i int) string {
+			return fmt.Sprintf("lines[%d]", lineIndexes[i])
+		})
+		if err != nil {
+			return err
+		}
+
+		createdInvoice, err := createDraftInvoice(r.Context(), client, claims.QBCompanyID, claims.QBCustomerID, quote.InvoiceLines())
+		if err != nil {
+			return err
+		}
+		if err := createOrder(r.Context(), client, s, claims, createdInvoice); err != nil {
+			return err
+		}
+		return encode(w, r, http.StatusOK, response{Success: true, Id: createdInvoice.Id, Skipped: skipped})
+	})
+}
+
+// ListFavoriteItems lists the franchisee's favorite items
+func ListFavoriteItems(s *storage.SQLStorage) http.HandlerFunc {
+	type response struct {
+		Favorites []domain.FavoriteItem `json:"favorites"`
+	}
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		claims := ClaimsFromContext(r.Context())
+		favorites, err := s.ListFavoriteItems(claims.QBCompanyID, claims.QBCustomerID)
+		if err != nil {
+			return internalError("Could not get favorite items", err)
+		}
+		return encode(w, r, http.StatusOK, response{Favorites: favorites})
+	})
+}
+
+// AddFavoriteItem adds the item in the URL to the franchisee's favorites, if they can order it
+func AddFavoriteItem(qbc *qb.Client, tokens *qbtoken.Manager, s *storage.SQLStorage) http.HandlerFunc {
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		claims := ClaimsFromContext(r.Context())
+		itemID := r.PathValue("itemId")
+		client, err := realmClient(r.Context(), qbc, tokens, claims.QBCompanyID)
+		if err != nil {
+			return err
+		}
+		item, err := client.FindItemById(r.Context(), claims.QBCompanyID, itemID)
+		if err != nil {
+			return qbError(err, "Could not get item")
+		}
+		catalog, err := customerCatalog(r.Context(), client, s, claims.QBCompanyID, claims.QBCustomerID)
+		if err != nil {
+			return err
+		}
+		if !item.Active {
+			return unprocessable("item_discontinued", "Item is discontinued")
+		}
+		if !catalog.Orderable(item.Id) {
+			return unprocessable("item_not_orderable", "Item can't be ordered")
+		}
+
+		favorite, err := s.AddFavoriteItem(domain.FavoriteItem{
+			QBCompanyID:  claims.QBCompanyID,
+			QBCustomerID: claims.QBCustomerID,
+			QBItemID:     item.Id,
+		})
+		if err != nil {
+			return internalError("Could not add favorite item", err)
+		}
+		return encode(w, r, http.StatusOK, favorite)
+	})
+}
+
+// RemoveFavoriteItem removes the item in the URL from the franchisee's favorites
+func RemoveFavoriteItem(s *storage.SQLStorage) http.HandlerFunc {
+	type response struct {
+		Success bool `json:"success"`
+	}
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		claims := ClaimsFromContext(r.Context())
+		err := s.RemoveFavoriteItem(claims.QBCompanyID, claims.QBCustomerID, r.PathValue("itemId"))
+		if errors.Is(err, sql.ErrNoRows) {
+			return notFound("Item is not a favorite", err)
+		}
+		if err != nil {
+			return internalError("Could not remove favorite item", err)
+		}
+		return encode(w, r, http.StatusOK, response{Success: true})
+	})
+}
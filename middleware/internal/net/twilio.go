@@ -0,0 +1,199 @@
+package net
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"firebase.google.com/go/auth"
+	qb "github.com/Vertisphere/backend-service/external/quickbooks"
+	"github.com/Vertisphere/backend-service/internal/domain"
+	"github.com/Vertisphere/backend-service/internal/orderstate"
+	"github.com/Vertisphere/backend-service/internal/qbtoken"
+	"github.com/Vertisphere/backend-service/internal/storage"
+	"github.com/rs/zerolog/log"
+	"github.com/twilio/twilio-go/client"
+	"github.com/twilio/twilio-go/twiml"
+)
+
+const smsHelp = "Reply APPROVE <order> or VOID <order> <reason>, e.g. VOID 1234 out of stock."
+
+var (
+	errUnknownSender   = errors.New("phone number is not linked to anyone")
+	errNotFranchiser   = errors.New("phone number belongs to a franchisee")
+	errAmbiguousSender = errors.New("phone number belongs to more than one user")
+)
+
+// TwilioWebhook checks that webhook requests were signed by Twilio
+type TwilioWebhook struct {
+	authToken string
+	validator client.RequestValidator
+	// url is the webhook's public URL, empty to rebuild it from the request
+	url string
+}
+
+func NewTwilioWebhook(authToken string, url string) *TwilioWebhook {
+	return &TwilioWebhook{authToken: authToken, validator: client.NewRequestValidator(authToken), url: url}
+}
+
+// verify parses the form and checks its X-Twilio-Signature
+func (t *TwilioWebhook) verify(r *http.Request) error {
+	if t.authToken == "" {
+		return errors.New("TWILIO_AUTH_TOKEN is not set")
+	}
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	url := t.url
+	if url == "" {
+		// Cloud Run terminates TLS, Twilio only calls https
+		url = "https://" + r.Host + r.URL.RequestURI()
+	}
+	params := make(map[string]string, len(r.PostForm))
+	for key := range r.PostForm {
+		params[key] = r.PostForm.Get(key)
+	}
+	if !t.validator.Validate(url, params, r.Header.Get("X-Twilio-Signature")) {
+		return errors.New("invalid twilio signature")
+	}
+	return nil
+}
+
+// TwilioSMS runs the commands franchisers text back to the order notifications, e.g. "APPROVE 1234" or
+// "VOID 1234 out of stock". They go through the same transitions as POST /orders/{id}/transitions,
+// and every command is answered with a reply SMS.
+func TwilioSMS(webhook *TwilioWebhook, a *auth.Client, m *orderstate.Machine, qbc *qb.Client, tokens *qbtoken.Manager, s *storage.SQLStorage) http.HandlerFunc {
+	return handle(func(w http.ResponseWriter, r *http.Request) error {
+		if err := webhook.verify(r); err != nil {
+			return forbidden(err)
+		}
+		ctx := r.Context()
+		logger := log.With().Str("traceID", traceID(ctx)).Str("from", r.PostForm.Get("From")).Logger()
+
+		claims, err := smsSender(ctx, a, s, r.PostForm.Get("From"))
+		switch {
+		case errors.Is(err, errUnknownSender):
+			// Don't answer strangers
+			logger.Warn().Msg("SMS from unknown number")
+			return replySMS(w, "")
+		case errors.Is(err, errNotFranchiser):
+			return replySMS(w, "Only franchisors can manage orders by SMS.")
+		case errors.Is(err, errAmbiguousSender):
+			logger.Warn().Msg("SMS from a number with more than one user")
+			return replySMS(w, "This number belongs to more than one account, please use the app.")
+		case err != nil:
+			logger.Error().Err(err).Msg("Could not look up SMS sender")
+			return replySMS(w, "Something went wrong, please try again.")
+		}
+
+		cmd, err := parseSMSCommand(r.PostForm.Get("Body"))
+		if err != nil {
+			return replySMS(w, err.Error()+" "+smsHelp)
+		}
+		change, err := applyTransition(ctx, m, qbc, tokens, s, claims, cmd.InvoiceID, transitionRequest{To: cmd.To, Reason: cmd.Reason})
+		if err != nil {
+			var appErr *Error
+			if !errors.As(err, &appErr) {
+				appErr = internalError("Something went wrong", err)
+			}
+			logger.Warn().Err(appErr.Err).Str("invoiceID", cmd.InvoiceID).Msg(appErr.Message)
+			return replySMS(w, fmt.Sprintf("Could not %s order %s: %s", strings.ToLower(cmd.Verb), cmd.InvoiceID, appErr.Message))
+		}
+
+		err = replySMS(w, fmt.Sprintf("Order %s is now %s.", cmd.InvoiceID, change.Order.Status))
+		m.RunAfter(context.WithoutCancel(ctx), change)
+		return err
+	})
+}
+
+type smsCommand struct {
+	Verb      string
+	To        domain.OrderStatus
+	InvoiceID string
+	Reason    string
+}
+
+// smsVerbs are the commands that can be texted, and the status they move the order to
+var smsVerbs = map[string]domain.OrderStatus{
+	"APPROVE": domain.OrderApproved,
+	"VOID":    domain.OrderVoid,
+}
+
+// parseSMSCommand parses "<verb> <invoice id> [reason...]". Errors are texted back to the sender as is.
+func parseSMSCommand(body string) (smsCommand, error) {
+	fields := strings.Fields(body)
+	if len(fields) == 0 {
+		return smsCommand{}, errors.New("Empty message.")
+	}
+	cmd := smsCommand{Verb: strings.ToUpper(fields[0])}
+	to, ok := smsVerbs[cmd.Verb]
+	if !ok {
+		return smsCommand{}, fmt.Errorf("Unknown command %q.", fields[0])
+	}
+	cmd.To = to
+	if len(fields) < 2 {
+		return smsCommand{}, fmt.Errorf("Which order should be %s?", strings.ToLower(string(to)))
+	}
+	cmd.InvoiceID = strings.TrimPrefix(fields[1], "#")
+	if cmd.InvoiceID == "" || strings.Trim(cmd.InvoiceID, "0123456789") != "" {
+		return smsCommand{}, fmt.Errorf("%q is not an order number.", fields[1])
+	}
+	cmd.Reason = strings.Join(fields[2:], " ")
+	return cmd, nil
+}
+
+// smsSender finds the franchiser staff user texting from phone by the phone number on their firebase
+// account, which firebase verified when they signed in with it. The numbers in notification
+// preferences aren't verified, anyone could save someone else's, so they don't count.
+func smsSender(ctx context.Context, a *auth.Client, s *storage.SQLStorage, phone string) (domain.Claims, error) {
+	if phone == "" {
+		return domain.Claims{}, errUnknownSender
+	}
+	user, err := a.GetUserByPhoneNumber(ctx, phone)
+	if auth.IsUserNotFound(err) {
+		return domain.Claims{}, errUnknownSender
+	}
+	if err != nil {
+		return domain.Claims{}, err
+	}
+
+	staff, err := s.GetCompanyUser(user.UID)
+	isStaff := err == nil
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return domain.Claims{}, err
+	}
+	_, err = s.GetCustomerByFirebaseID(user.UID)
+	isLocation := err == nil
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return domain.Claims{}, err
+	}
+	switch {
+	case isStaff && isLocation:
+		// Don't guess which of them the command is from
+		return domain.Claims{}, errAmbiguousSender
+	case isLocation:
+		return domain.Claims{}, errNotFranchiser
+	case !isStaff:
+		return domain.Claims{}, errUnknownSender
+	}
+	return domain.Claims{QBCompanyID: staff.QBCompanyID, QBCustomerID: "0", IsFranchiser: true, FirebaseID: user.UID, Role: staff.Role}, nil
+}
+
+// replySMS answers a Twilio webhook with TwiML, replying with body unless it's empty
+func replySMS(w http.ResponseWriter, body string) error {
+	var verbs []twiml.Element
+	if body != "" {
+		verbs = append(verbs, &twiml.MessagingMessage{Body: body})
+	}
+	xml, err := twiml.Messages(verbs)
+	if err != nil {
+		return internalError("Could not build reply", err)
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write([]byte(xml))
+	return err
+}
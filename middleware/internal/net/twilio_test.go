@@ -0,0 +1,205 @@
+package net
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	qb "github.com/Vertisphere/backend-service/external/quickbooks"
+	"github.com/Vertisphere/backend-service/internal/domain"
+	"github.com/Vertisphere/backend-service/internal/notify"
+	"github.com/Vertisphere/backend-service/internal/orderstate"
+	"github.com/Vertisphere/backend-service/internal/qbtoken"
+	"github.com/Vertisphere/backend-service/internal/storage"
+)
+
+func TestParseSMSCommand(t *testing.T) {
+	tests := []struct {
+		body    string
+		want    smsCommand
+		wantErr string
+	}{
+		{body: "APPROVE 1234", want: smsCommand{Verb: "APPROVE", To: domain.OrderApproved, InvoiceID: "1234"}},
+		{body: "  approve #1234 ", want: smsCommand{Verb: "APPROVE", To: domain.OrderApproved, InvoiceID: "1234"}},
+		{body: "Void 1234 out of  stock", want: smsCommand{Verb: "VOID", To: domain.OrderVoid, InvoiceID: "1234", Reason: "out of stock"}},
+		{body: "", wantErr: "Empty message."},
+		{body: "PUBLISH 1234", wantErr: `Unknown command "PUBLISH".`},
+		{body: "VOID", wantErr: "Which order should be void?"},
+		{body: "APPROVE it", wantErr: `"it" is not an order number.`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.body, func(t *testing.T) {
+			got, err := parseSMSCommand(tt.body)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("got %+v, %v, want %+v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// twilioSignature signs a webhook the way Twilio does
+func twilioSignature(authToken string, webhookURL string, form url.Values) string {
+	keys := make([]string, 0, len(form))
+	for key := range form {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	payload := webhookURL
+	for _, key := range keys {
+		payload += key + form.Get(key)
+	}
+	mac := hmac.New(sha1.New, []byte(authToken))
+	mac.Write([]byte(payload))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestTwilioWebhookVerify(t *testing.T) {
+	form := url.Values{"From": {"+14165550101"}, "Body": {"APPROVE 1234"}}
+	const webhookURL = "https://api.example.com/webhooks/twilio/sms"
+	tests := []struct {
+		name      string
+		authToken string
+		url       string
+		signature string
+		ok        bool
+	}{
+		{"signed", "secret", "", twilioSignature("secret", webhookURL, form), true},
+		{"configured url", "secret", "https://public.example.com/sms", twilioSignature("secret", "https://public.example.com/sms", form), true},
+		{"wrong token", "secret", "", twilioSignature("other", webhookURL, form), false},
+		{"unsigned", "secret", "", "", false},
+		{"no token", "", "", twilioSignature("", webhookURL, form), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", webhookURL, strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.Header.Set("X-Twilio-Signature", tt.signature)
+			err := NewTwilioWebhook(tt.authToken, tt.url).verify(r)
+			if (err == nil) != tt.ok {
+				t.Errorf("verify() = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+// orderRows keeps orders in memory, keyed by invoice ID
+type orderRows map[string]*domain.Order
+
+func (o orderRows) GetOrder(companyID string, invoiceID string) (domain.Order, error) {
+	order, ok := o[invoiceID]
+	if !ok {
+		return domain.Order{}, sql.ErrNoRows
+	}
+	return *order, nil
+}
+
+func (o orderRows) BackfillOrder(string, string, string, domain.OrderStatus, time.Time, time.Time) error {
+	return errors.New("orders should not need a backfill")
+}
+
+func (o orderRows) TransitionOrder(companyID string, invoiceID string, from domain.OrderStatus, apply func() (domain.OrderEvent, error)) error {
+	order := o[invoiceID]
+	if order.Status != from {
+		return storage.ErrOrderStatusChanged
+	}
+	event, err := apply()
+	if err != nil {
+		return err
+	}
+	order.Status = event.ToStatus
+	return nil
+}
+
+// Franchisers text back to the publish notification, the commands go through the same transitions as the app
+func TestSMSCommandsMoveOrders(t *testing.T) {
+	var voided []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		invoiceID := strings.TrimPrefix(r.URL.Path, "/v3/company/1001/invoice/")
+		switch {
+		case r.Method == http.MethodGet:
+			fmt.Fprintf(w, `{"Invoice":{"Id":%q,"SyncToken":"0","CustomerRef":{"value":"58"}}}`, invoiceID)
+		case r.URL.Query().Get("operation") == "void":
+			var invoice qb.Invoice
+			json.NewDecoder(r.Body).Decode(&invoice)
+			voided = append(voided, invoice.Id)
+			fmt.Fprintf(w, `{"Invoice":{"Id":%q}}`, invoice.Id)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	qbc := qb.NewClientForEndpoint("id", "secret", "", qb.EndpointUrl(srv.URL), &qb.DiscoveryAPI{}, "75")
+	tokens := qbtoken.NewManager(tokenStore{}, noRefresh{})
+
+	m := orderstate.New(orderstate.Transitions)
+	m.Before(domain.OrderVoid, voidInvoice)
+	for status := range orderEvents {
+		m.Before(status, notifyOrder)
+	}
+	approver := domain.Claims{QBCompanyID: "1001", QBCustomerID: "0", IsFranchiser: true, FirebaseID: "approver", Role: domain.RoleApprover}
+	viewer := approver
+	viewer.Role = domain.RoleViewer
+
+	tests := []struct {
+		body   string
+		claims domain.Claims
+		status int
+		want   domain.OrderStatus
+		event  notify.EventType
+	}{
+		{"APPROVE 130", approver, http.StatusOK, domain.OrderApproved, notify.OrderApproved},
+		{"VOID 131 out of stock", approver, http.StatusOK, domain.OrderVoid, notify.OrderCancelled},
+		{"VOID 132 out of stock", viewer, http.StatusForbidden, domain.OrderPending, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.body, func(t *testing.T) {
+			cmd, err := parseSMSCommand(tt.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			orders := orderRows{cmd.InvoiceID: {QBCompanyID: "1001", QBInvoiceID: cmd.InvoiceID, QBCustomerID: "58", Status: domain.OrderPending}}
+			change, err := applyTransition(context.Background(), m, qbc, tokens, orders, tt.claims, cmd.InvoiceID, transitionRequest{To: cmd.To, Reason: cmd.Reason})
+
+			if got := orders[cmd.InvoiceID].Status; got != tt.want {
+				t.Errorf("order is %s, want %s", got, tt.want)
+			}
+			if tt.status != http.StatusOK {
+				var appErr *Error
+				if !errors.As(err, &appErr) || appErr.Status != tt.status {
+					t.Fatalf("err = %v, want status %d", err, tt.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(change.Notifications) != 1 || change.Notifications[0].EventType != string(tt.event) {
+				t.Errorf("queued %+v, want a %s notification", change.Notifications, tt.event)
+			}
+		})
+	}
+	// Only the franchiser's VOID reached QuickBooks
+	if !slices.Equal(voided, []string{"131"}) {
+		t.Errorf("voided %v in QB, want 131", voided)
+	}
+}
@@ -1,97 +1,61 @@
 package net
 
 import (
-	"encoding/base64"
+	"context"
+	"errors"
 	"net/http"
-	"os"
-	"regexp"
 
-	"github.com/Vertisphere/backend-service/internal/config"
-	"github.com/rs/zerolog/log"
-	"gopkg.in/square/go-jose.v2"
-
-	"github.com/sendgrid/sendgrid-go"
-	"github.com/sendgrid/sendgrid-go/helpers/mail"
+	qb "github.com/Vertisphere/backend-service/external/quickbooks"
+	"github.com/Vertisphere/backend-service/internal/qbtoken"
 )
 
-func logHttpError(err error, msg string, statusCode int, w *http.ResponseWriter) {
-	log.Error().Err(err).Msg(msg)
-	http.Error(*w, msg, statusCode)
-}
-
-func qbToE164Phone(phone string) string {
-	// Remove all non-digit characters
-	reg := regexp.MustCompile(`[^0-9]`)
-	cleaned := reg.ReplaceAllString(phone, "")
-
-	// Validate length (10 digits for US numbers)
-	if len(cleaned) == 10 {
-		return "+1" + cleaned
-	}
-	if len(cleaned) == 11 && cleaned[0] == '1' {
-		return "+" + cleaned
-	}
-	log.Error().Msgf("Couldn't convert qb phone number to E164 %s", phone)
-	return ""
-}
-
-func encryptToken(token string) (string, error) {
-	encKey := config.LoadConfigs().JWEKey
-	rawKey, err := base64.StdEncoding.DecodeString(encKey)
-	if err != nil {
-		return "", err
-	}
-	encrypter, err := jose.NewEncrypter(jose.A256GCM, jose.Recipient{Algorithm: jose.DIRECT, Key: rawKey}, nil)
-	if err != nil {
-		return "", err
-	}
-	object, err := encrypter.Encrypt([]byte(token))
-	if err != nil {
-		return "", err
+// realmClient returns a QB client using the company's token
+func realmClient(ctx context.Context, qbc *qb.Client, tokens *qbtoken.Manager, companyID string) (*qb.RealmClient, error) {
+	token, err := tokens.Token(ctx, companyID)
+	if errors.Is(err, qbtoken.ErrNotConnected) {
+		return nil, unauthorized("Company is not connected to QuickBooks, please log in again", err)
 	}
-	encryptedToken, err := object.CompactSerialize()
 	if err != nil {
-		return "", err
+		return nil, internalError("Could not get QB token", err)
 	}
-	return encryptedToken, nil
+	return qbc.ForToken(token), nil
 }
 
-// Send email via sendgrid
-func sendEmail(fromName string, toName string, emails map[string]struct{}, subject string, content *mail.Content, attachments []*mail.Attachment) {
-	// Initialize mail
-	m := mail.NewV3Mail()
-
-	from := mail.NewEmail(fromName, "verification@ordrport.com")
+// qbErrorStatuses maps the QuickBooks errors clients can act on to a response status
+var qbErrorStatuses = []struct {
+	err    error
+	status int
+	code   string
+	msg    string
+}{
+	{qb.ErrStaleObject, http.StatusConflict, "quickbooks_stale_object", "The object was changed in QuickBooks, reload it and try again"},
+	{qb.ErrAuthExpired, http.StatusUnauthorized, "quickbooks_auth_expired", "QuickBooks authentication expired, please log in again"},
+	{qb.ErrNotFound, http.StatusNotFound, "quickbooks_not_found", "The object was not found in QuickBooks"},
+	{qb.ErrThrottled, http.StatusTooManyRequests, "quickbooks_throttled", "Too many requests to QuickBooks, try again later"},
+	{qb.ErrValidation, http.StatusUnprocessableEntity, "quickbooks_validation", "QuickBooks rejected the request"},
+}
 
-	personalization := mail.NewPersonalization()
-	// For each key in the map (we use it like a map), we add to recipient list
-	personalization.Subject = subject
-	for email := range emails {
-		if email == "" {
+// qbError turns an error returned by QuickBooks into an *Error. Errors the client can act on get their own
+// status along with the QB element and detail, anything else is a 500 with msg.
+func qbError(err error, msg string) *Error {
+	for _, e := range qbErrorStatuses {
+		if !errors.Is(err, e.err) {
 			continue
 		}
-		to := mail.NewEmail(toName, email)
-		personalization.AddTos(to)
-	}
-
-	m.SetFrom(from)
-	m.AddContent(content)
-	m.AddPersonalizations(personalization)
-	// TODO: add template id
-
-	for _, attachment := range attachments {
-		m.AddAttachment(attachment)
-	}
-
-	client := sendgrid.NewSendClient(os.Getenv("SENDGRID_API_KEY"))
-
-	resp, err := client.Send(m)
-	if err != nil {
-		log.Error().Err(err).Msg("error sending email")
-	}
-
-	// TODO: IS this 202?
-	if resp.StatusCode != http.StatusAccepted {
-		log.Error().Interface("response", resp).Msg("reset email wasn't a 202")
+		appErr := &Error{Status: e.status, Code: e.code, Message: e.msg, Err: err}
+		var failure qb.Failure
+		if errors.As(err, &failure) {
+			if detail := failure.Detail(); detail != "" {
+				appErr.Message += ": " + detail
+			}
+			if element := failure.Element(); element != "" {
+				appErr.Fields = []FieldError{{Field: element, Message: failure.Detail()}}
+			}
+			if code := failure.Code(); code != "" {
+				appErr.Extensions = map[string]any{"quickbooks_code": code}
+			}
+		}
+		return appErr
 	}
+	return internalError(msg, err)
 }
@@ -0,0 +1,131 @@
+// Package notify tells franchisers and franchisees about what happened to their orders. Handlers emit an
+// Event, the Service works out who should hear about it, renders the event's templates and hands the
+// messages to a Notifier per channel (SMS through Twilio, email through SendGrid).
+//
+// Order events aren't sent from the request. They're queued in the notification outbox in the same
+// transaction as the order change and the Worker delivers them in the background.
+package notify
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Vertisphere/backend-service/internal/domain"
+)
+
+// EventType names something that happened. It's also the name of the event's templates.
+type EventType string
+
+const (
+	OrderPublished         EventType = "order_published"
+	OrderResubmitted       EventType = "order_resubmitted"
+	OrderUnpublished       EventType = "order_unpublished"
+	OrderRevisionRequested EventType = "order_revision_requested"
+	OrderApproved          EventType = "order_approved"
+	OrderVoided            EventType = "order_voided"
+	OrderCompleted         EventType = "order_completed"
+	CustomerInvited        EventType = "customer_invited"
+	// StaffInvited is sent to someone invited to a franchiser company's staff
+	StaffInvited EventType = "staff_invited"
+	// StandingOrderPlaced is sent when the scheduler places one of the franchisee's standing orders
+	StandingOrderPlaced EventType = "standing_order_placed"
+	// OrderCancelled is sent to the franchisee when the franchiser voids their order
+	OrderCancelled EventType = "order_cancelled"
+)
+
+// Audience is who hears about an event
+type Audience int
+
+const (
+	// Franchisee is the customer the order belongs to
+	Franchisee Audience = iota
+	// Franchiser is the company the customer orders from
+	Franchiser
+)
+
+// audiences says who hears about each event
+var audiences = map[EventType]Audience{
+	OrderPublished:         Franchiser,
+	OrderResubmitted:       Franchiser,
+	OrderUnpublished:       Franchisee,
+	OrderRevisionRequested: Franchisee,
+	OrderApproved:          Franchisee,
+	OrderVoided:            Franchiser,
+	OrderCancelled:         Franchisee,
+	OrderCompleted:         Franchisee,
+	CustomerInvited:        Franchisee,
+	StaffInvited:           Franchiser,
+	StandingOrderPlaced:    Franchisee,
+}
+
+// Event is something the franchiser or franchisee should hear about. Events are queued in the outbox
+// as JSON, so everything needed to send one has to survive a round trip.
+type Event struct {
+	Type       EventType `json:"type"`
+	CompanyID  string    `json:"company_id"`
+	CustomerID string    `json:"customer_id,omitempty"`
+	InvoiceID  string    `json:"invoice_id,omitempty"`
+	// Reason the order was moved, if the actor gave one
+	Reason string `json:"reason,omitempty"`
+	// Comments is the number of line comments on a revision request
+	Comments int `json:"comments,omitempty"`
+	// Changes is the number of lines the franchisee changed when resubmitting
+	Changes int `json:"changes,omitempty"`
+	// Link is an event specific link, e.g. the password reset link of an invite
+	Link string `json:"link,omitempty"`
+	// Emails are sent the email on top of the first resolved recipient's, e.g. the invoice's BillEmail
+	Emails []string `json:"emails,omitempty"`
+	// AttachInvoice attaches the invoice PDF to the email. It's fetched when the email is sent rather
+	// than stored with the event.
+	AttachInvoice bool         `json:"attach_invoice,omitempty"`
+	Attachments   []Attachment `json:"-"`
+	// To skips recipient resolution, e.g. for an invite to an email that isn't linked to anything yet
+	To *Recipient `json:"to,omitempty"`
+}
+
+// Recipient is where a notification goes
+type Recipient struct {
+	// ID is the firebase user being notified, empty for contact details that aren't a user's
+	ID   string `json:"-"`
+	Name string `json:"name"`
+	// Phone is in E.164, empty if there is no phone number to text
+	Phone  string   `json:"phone,omitempty"`
+	Emails []string `json:"emails,omitempty"`
+	// Preferences of the user being notified, nil if they have none
+	Preferences *domain.NotificationPreferences `json:"-"`
+}
+
+// Attachment is a file sent along with an email
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Content     []byte
+}
+
+// Channel is how a message is delivered. The channel picks which of the event's templates get rendered.
+type Channel string
+
+const (
+	SMS   Channel = "sms"
+	Email Channel = "email"
+)
+
+// Message is a rendered notification, ready to send
+type Message struct {
+	Event EventType
+	// From is the sender's name, for channels that show one
+	From    string
+	Subject string
+	// Body is plain text for SMS and HTML for email
+	Body        string
+	Attachments []Attachment
+}
+
+// Notifier delivers messages over one channel
+type Notifier interface {
+	Channel() Channel
+	Send(ctx context.Context, to Recipient, msg Message) error
+}
+
+// ErrNoRecipient is returned when the recipient has no address for the channel
+var ErrNoRecipient = errors.New("no recipient to send notification to")
@@ -0,0 +1,171 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Vertisphere/backend-service/internal/domain"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// MaxAttempts is how many times a notification is tried before it's dead
+	MaxAttempts = 8
+	// firstRetryDelay doubles with every attempt, up to maxRetryDelay
+	firstRetryDelay = 30 * time.Second
+	maxRetryDelay   = time.Hour
+	// sendTimeout bounds one attempt. A batch is claimed for claimLease and each notification's lease
+	// is taken again for as long right before it's sent, so it can't expire mid-send.
+	sendTimeout  = time.Minute
+	claimLease   = 2 * sendTimeout
+	pollInterval = 5 * time.Second
+	claimBatch   = 20
+)
+
+// NewNotification wraps an event so it can be queued in the outbox
+func NewNotification(e Event, traceID string) (domain.Notification, error) {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return domain.Notification{}, err
+	}
+	return domain.Notification{
+		QBCompanyID: e.CompanyID,
+		EventType:   string(e.Type),
+		Payload:     payload,
+		TraceID:     traceID,
+	}, nil
+}
+
+// Outbox is where queued notifications are claimed from. Implemented by storage.SQLStorage.
+type Outbox interface {
+	ClaimNotifications(limit int, lease time.Duration) ([]domain.Notification, error)
+	RenewNotificationLease(id int64, attempt int, lease time.Duration) (bool, error)
+	CompleteNotification(id int64, attempt int, delivered []string) (bool, error)
+	FailNotification(id int64, attempt int, delivered []string, lastError string, retryAt time.Time, dead bool) (bool, error)
+	DeferNotification(id int64, attempt int, delivered []string, until time.Time) (bool, error)
+}
+
+// Realms returns a QuickBooks client for a company
+type Realms func(ctx context.Context, companyID string) (QuickBooks, error)
+
+// Worker delivers the notifications queued in the outbox. Failed notifications are retried with
+// exponential backoff until MaxAttempts, then left dead until someone retries them by hand.
+type Worker struct {
+	outbox  Outbox
+	service *Service
+	realms  Realms
+}
+
+func NewWorker(outbox Outbox, service *Service, realms Realms) *Worker {
+	return &Worker{outbox: outbox, service: service, realms: realms}
+}
+
+// Run delivers notifications until ctx is cancelled
+func (w *Worker) Run(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		// Keep going while there's a backlog, otherwise wait for the next tick
+		if w.deliverBatch(ctx) == claimBatch && ctx.Err() == nil {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// deliverBatch claims and delivers a batch of notifications, returning how many were claimed
+func (w *Worker) deliverBatch(ctx context.Context) int {
+	notifications, err := w.outbox.ClaimNotifications(claimBatch, claimLease)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not claim notifications")
+		return 0
+	}
+	for _, n := range notifications {
+		// The notifications before this one may have taken most of the batch's lease, if it ran out
+		// another worker may have claimed the notification since
+		ok, err := w.outbox.RenewNotificationLease(n.ID, n.Attempts, claimLease)
+		if err != nil {
+			log.Error().Err(err).Int64("notificationID", n.ID).Msg("Could not renew notification lease")
+			continue
+		}
+		if !ok {
+			log.Info().Int64("notificationID", n.ID).Msg("Notification was claimed by another worker")
+			continue
+		}
+		w.deliver(ctx, n)
+	}
+	return len(notifications)
+}
+
+func (w *Worker) deliver(ctx context.Context, n domain.Notification) {
+	// A notification that was claimed is finished even if we're shutting down
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), sendTimeout)
+	defer cancel()
+	logger := log.With().Int64("notificationID", n.ID).Str("event", n.EventType).Str("traceID", n.TraceID).
+		Int("attempt", n.Attempts).Logger()
+
+	delivered, sendErr := w.send(ctx, n, n.Delivered)
+
+	var ok bool
+	var err error
+	var deferred *DeferredError
+	switch {
+	case sendErr == nil:
+		if ok, err = w.outbox.CompleteNotification(n.ID, n.Attempts, delivered); err != nil {
+			logger.Error().Err(err).Msg("Could not mark notification as sent")
+			return
+		}
+	case errors.As(sendErr, &deferred):
+		if ok, err = w.outbox.DeferNotification(n.ID, n.Attempts, delivered, deferred.Until); err != nil {
+			logger.Error().Err(err).Msg("Could not defer notification")
+			return
+		}
+	default:
+		dead := n.Attempts >= MaxAttempts
+		retryAt := time.Now().Add(Backoff(n.Attempts))
+		if dead {
+			logger.Error().Err(sendErr).Msg("Notification failed for the last time")
+		} else {
+			logger.Warn().Err(sendErr).Time("retryAt", retryAt).Msg("Notification failed, will retry")
+		}
+		if ok, err = w.outbox.FailNotification(n.ID, n.Attempts, delivered, sendErr.Error(), retryAt, dead); err != nil {
+			logger.Error().Err(err).Msg("Could not record failed notification")
+			return
+		}
+	}
+	// The lease ran out mid-send, the worker that claimed the notification again finishes it
+	if !ok {
+		logger.Warn().Strs("delivered", delivered).Msg("Lost the notification's lease while sending it")
+	}
+}
+
+func (w *Worker) send(ctx context.Context, n domain.Notification, delivered []string) ([]string, error) {
+	var e Event
+	if err := json.Unmarshal(n.Payload, &e); err != nil {
+		return delivered, fmt.Errorf("could not decode notification: %w", err)
+	}
+	quickbooks, err := w.realms(ctx, n.QBCompanyID)
+	if err != nil {
+		return delivered, fmt.Errorf("could not get QuickBooks client: %w", err)
+	}
+	return w.service.Send(ctx, quickbooks, e, delivered)
+}
+
+// Backoff is how long to wait after the given attempt failed
+func Backoff(attempt int) time.Duration {
+	delay := firstRetryDelay
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if delay >= maxRetryDelay {
+			return maxRetryDelay
+		}
+	}
+	return delay
+}
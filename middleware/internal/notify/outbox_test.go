@@ -0,0 +1,225 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	qb "github.com/Vertisphere/backend-service/external/quickbooks"
+	"github.com/Vertisphere/backend-service/internal/domain"
+)
+
+type fakeOutbox struct {
+	queued    []domain.Notification
+	completed map[int64][]string
+	failed    map[int64][]string
+	dead      map[int64]bool
+	deferred  map[int64]time.Time
+	// reclaimed are taken by another worker after being claimed
+	reclaimed map[int64]bool
+	// expiring are taken by another worker while they're sent
+	expiring map[int64]bool
+	// leases has the attempt holding each notification's lease
+	leases map[int64]int
+}
+
+func (o *fakeOutbox) ClaimNotifications(limit int, _ time.Duration) ([]domain.Notification, error) {
+	claimed := o.queued
+	o.queued = nil
+	for i := range claimed {
+		claimed[i].Attempts++
+		o.leases[claimed[i].ID] = claimed[i].Attempts
+	}
+	return claimed, nil
+}
+
+func (o *fakeOutbox) RenewNotificationLease(id int64, _ int, _ time.Duration) (bool, error) {
+	if o.expiring[id] {
+		o.leases[id]++
+	}
+	return !o.reclaimed[id], nil
+}
+
+func (o *fakeOutbox) CompleteNotification(id int64, attempt int, delivered []string) (bool, error) {
+	if o.leases[id] != attempt {
+		return false, nil
+	}
+	o.completed[id] = delivered
+	return true, nil
+}
+
+func (o *fakeOutbox) FailNotification(id int64, attempt int, delivered []string, _ string, _ time.Time, dead bool) (bool, error) {
+	if o.leases[id] != attempt {
+		return false, nil
+	}
+	o.failed[id] = delivered
+	o.dead[id] = dead
+	return true, nil
+}
+
+func (o *fakeOutbox) DeferNotification(id int64, attempt int, delivered []string, until time.Time) (bool, error) {
+	if o.leases[id] != attempt {
+		return false, nil
+	}
+	o.completed[id] = delivered
+	o.deferred[id] = until
+	return true, nil
+}
+
+func newFakeOutbox() *fakeOutbox {
+	return &fakeOutbox{
+		completed: map[int64][]string{},
+		failed:    map[int64][]string{},
+		dead:      map[int64]bool{},
+		deferred:  map[int64]time.Time{},
+		reclaimed: map[int64]bool{},
+		expiring:  map[int64]bool{},
+		leases:    map[int64]int{},
+	}
+}
+
+func TestWorkerRetriesOnlyUndeliveredChannels(t *testing.T) {
+	templates, err := DefaultTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sms := &fakeNotifier{channel: SMS}
+	email := &fakeNotifier{channel: Email, err: errors.New("sendgrid is down")}
+	customers := fakeQuickBooks{"7": {Id: "7", DisplayName: "Franchisee", PrimaryPhone: qb.TelephoneNumber{FreeFormNumber: "416-555-0101"}}}
+	s := NewService(templates, NewResolver(fakeUsers{}, nil, fakeDirectory{}), "https://app.example.com", sms, email)
+
+	n, err := NewNotification(Event{Type: OrderCompleted, CompanyID: "1001", CustomerID: "7", InvoiceID: "42", AttachInvoice: true, Emails: []string{"bill@example.com"}}, "trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.ID = 1
+	outbox := newFakeOutbox()
+	w := NewWorker(outbox, s, func(context.Context, string) (QuickBooks, error) { return customers, nil })
+
+	// The SMS goes out, the email fails and is retried
+	outbox.queued = []domain.Notification{n}
+	w.deliverBatch(context.Background())
+	if !slices.Equal(outbox.failed[1], []string{"sms"}) || outbox.dead[1] {
+		t.Fatalf("first attempt: failed %v dead %v", outbox.failed[1], outbox.dead[1])
+	}
+
+	// The retry only sends the email, with the invoice attached
+	email.err = nil
+	n.Delivered = outbox.failed[1]
+	outbox.queued = []domain.Notification{n}
+	w.deliverBatch(context.Background())
+	if !slices.Equal(outbox.completed[1], []string{"sms", "email"}) {
+		t.Fatalf("retry completed with %v", outbox.completed[1])
+	}
+	if len(sms.sent) != 1 || len(email.sent) != 1 || len(email.sent[0].msg.Attachments) != 1 {
+		t.Errorf("sent %d sms and %d emails", len(sms.sent), len(email.sent))
+	}
+}
+
+func TestWorkerDeadLettersAfterMaxAttempts(t *testing.T) {
+	templates, err := DefaultTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewService(templates, NewResolver(fakeUsers{}, nil, fakeDirectory{}), "https://app.example.com")
+	outbox := newFakeOutbox()
+	w := NewWorker(outbox, s, func(context.Context, string) (QuickBooks, error) {
+		return nil, errors.New("quickbooks is not connected")
+	})
+
+	n, err := NewNotification(Event{Type: OrderApproved, CompanyID: "1001", CustomerID: "7"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for attempt := 1; attempt <= MaxAttempts; attempt++ {
+		n.Attempts = attempt - 1
+		outbox.queued = []domain.Notification{n}
+		w.deliverBatch(context.Background())
+		if dead := outbox.dead[n.ID]; dead != (attempt == MaxAttempts) {
+			t.Errorf("attempt %d: dead = %v", attempt, dead)
+		}
+	}
+}
+
+func TestWorkerSkipsReclaimedNotifications(t *testing.T) {
+	templates, err := DefaultTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sms := &fakeNotifier{channel: SMS}
+	customers := fakeQuickBooks{"7": {Id: "7", DisplayName: "Franchisee", PrimaryPhone: qb.TelephoneNumber{FreeFormNumber: "416-555-0101"}}}
+	s := NewService(templates, NewResolver(fakeUsers{}, nil, fakeDirectory{}), "https://app.example.com", sms)
+	outbox := newFakeOutbox()
+	w := NewWorker(outbox, s, func(context.Context, string) (QuickBooks, error) { return customers, nil })
+
+	var batch []domain.Notification
+	for id := int64(1); id <= 2; id++ {
+		n, err := NewNotification(Event{Type: OrderApproved, CompanyID: "1001", CustomerID: "7", InvoiceID: "42"}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.ID = id
+		batch = append(batch, n)
+	}
+	// The lease on the second ran out while the first was sent, and another worker has it now
+	outbox.reclaimed[2] = true
+	outbox.queued = batch
+	w.deliverBatch(context.Background())
+
+	if _, ok := outbox.completed[1]; !ok {
+		t.Errorf("first notification wasn't completed")
+	}
+	if _, ok := outbox.completed[2]; ok {
+		t.Errorf("reclaimed notification was completed")
+	}
+	if len(sms.sent) != 1 {
+		t.Errorf("sent %d sms, want only the first notification's", len(sms.sent))
+	}
+}
+
+func TestWorkerDoesNotFinishNotificationsItLostTheLeaseOn(t *testing.T) {
+	templates, err := DefaultTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sms := &fakeNotifier{channel: SMS, err: errors.New("twilio is down")}
+	customers := fakeQuickBooks{"7": {Id: "7", DisplayName: "Franchisee", PrimaryPhone: qb.TelephoneNumber{FreeFormNumber: "416-555-0101"}}}
+	s := NewService(templates, NewResolver(fakeUsers{}, nil, fakeDirectory{}), "https://app.example.com", sms)
+	outbox := newFakeOutbox()
+	w := NewWorker(outbox, s, func(context.Context, string) (QuickBooks, error) { return customers, nil })
+
+	var batch []domain.Notification
+	for id := int64(1); id <= 2; id++ {
+		n, err := NewNotification(Event{Type: OrderApproved, CompanyID: "1001", CustomerID: "7", InvoiceID: "42"}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.ID = id
+		batch = append(batch, n)
+	}
+	// The second's send took longer than its lease and another worker claimed it meanwhile
+	outbox.expiring[2] = true
+	outbox.queued = batch
+	w.deliverBatch(context.Background())
+
+	if _, ok := outbox.failed[1]; !ok {
+		t.Errorf("first notification's failure wasn't recorded")
+	}
+	if _, ok := outbox.failed[2]; ok {
+		t.Errorf("failure was recorded on a notification another worker has")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	want := []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute}
+	for i, delay := range want {
+		if got := Backoff(i + 1); got != delay {
+			t.Errorf("Backoff(%d) = %v, want %v", i+1, got, delay)
+		}
+	}
+	if got := Backoff(20); got != maxRetryDelay {
+		t.Errorf("Backoff(20) = %v, want %v", got, maxRetryDelay)
+	}
+}
@@ -0,0 +1,28 @@
+package notify
+
+import (
+	"regexp"
+
+	"github.com/rs/zerolog/log"
+)
+
+var nonDigits = regexp.MustCompile(`[^0-9]`)
+
+// E164Phone converts a North American phone number as typed into QuickBooks to E.164.
+// It returns "" if the number can't be converted.
+func E164Phone(phone string) string {
+	// Remove all non-digit characters
+	cleaned := nonDigits.ReplaceAllString(phone, "")
+
+	// Validate length (10 digits for US numbers)
+	if len(cleaned) == 10 {
+		return "+1" + cleaned
+	}
+	if len(cleaned) == 11 && cleaned[0] == '1' {
+		return "+" + cleaned
+	}
+	if phone != "" {
+		log.Error().Msgf("Couldn't convert qb phone number to E164 %s", phone)
+	}
+	return ""
+}
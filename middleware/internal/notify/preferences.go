@@ -0,0 +1,93 @@
+package notify
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Vertisphere/backend-service/internal/domain"
+)
+
+// Valid reports whether the event type is one that's sent
+func (t EventType) Valid() bool {
+	_, ok := audiences[t]
+	return ok
+}
+
+// Valid reports whether the channel is one that's sent on
+func (c Channel) Valid() bool {
+	return c == SMS || c == Email
+}
+
+// Allowed reports whether the user wants event over channel. Event toggles win over channel toggles,
+// anything not set is allowed.
+func Allowed(p *domain.NotificationPreferences, event EventType, channel Channel) bool {
+	if p == nil {
+		return true
+	}
+	if on, ok := p.Events[string(event)][string(channel)]; ok {
+		return on
+	}
+	if on, ok := p.Channels[string(channel)]; ok {
+		return on
+	}
+	return true
+}
+
+// QuietUntil returns when the quiet hours t falls in end, or false if t isn't in quiet hours
+func QuietUntil(q *domain.QuietHours, t time.Time) (time.Time, bool) {
+	if q == nil {
+		return time.Time{}, false
+	}
+	loc, start, end, err := ParseQuietHours(*q)
+	if err != nil || start == end {
+		return time.Time{}, false
+	}
+	local := t.In(loc)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+	startAt, endAt := midnight.Add(start), midnight.Add(end)
+	if start < end {
+		if !local.Before(startAt) && local.Before(endAt) {
+			return endAt, true
+		}
+		return time.Time{}, false
+	}
+	// Wraps around midnight, e.g. 22:00 to 07:00
+	if local.Before(endAt) {
+		return endAt, true
+	}
+	if !local.Before(startAt) {
+		return endAt.AddDate(0, 0, 1), true
+	}
+	return time.Time{}, false
+}
+
+// ParseQuietHours returns the time zone of the quiet hours and when they start and end as the time since midnight
+func ParseQuietHours(q domain.QuietHours) (loc *time.Location, start time.Duration, end time.Duration, err error) {
+	if loc, err = time.LoadLocation(q.TimeZone); err != nil {
+		return nil, 0, 0, fmt.Errorf("unknown time zone %q", q.TimeZone)
+	}
+	if start, err = parseClock(q.Start); err != nil {
+		return nil, 0, 0, err
+	}
+	if end, err = parseClock(q.End); err != nil {
+		return nil, 0, 0, err
+	}
+	return loc, start, end, nil
+}
+
+func parseClock(clock string) (time.Duration, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not HH:MM", clock)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// DeferredError is returned when nothing failed but some channels have to wait, e.g. for quiet hours to end
+type DeferredError struct {
+	Until time.Time
+}
+
+func (e *DeferredError) Error() string {
+	return fmt.Sprintf("deferred until %s", e.Until.Format(time.RFC3339))
+}
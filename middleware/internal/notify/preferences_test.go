@@ -0,0 +1,105 @@
+package notify
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"firebase.google.com/go/auth"
+	qb "github.com/Vertisphere/backend-service/external/quickbooks"
+	"github.com/Vertisphere/backend-service/internal/domain"
+)
+
+func TestQuietUntil(t *testing.T) {
+	toronto, err := time.LoadLocation("America/Toronto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	overnight := &domain.QuietHours{Start: "22:00", End: "07:00", TimeZone: "America/Toronto"}
+	lunch := &domain.QuietHours{Start: "12:00", End: "13:30", TimeZone: "America/Toronto"}
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2025, time.March, day, hour, minute, 0, 0, toronto)
+	}
+
+	tests := []struct {
+		name  string
+		quiet *domain.QuietHours
+		t     time.Time
+		until time.Time
+	}{
+		{"no quiet hours", nil, at(3, 23, 0), time.Time{}},
+		{"before overnight", overnight, at(3, 21, 59), time.Time{}},
+		{"evening", overnight, at(3, 22, 0), at(4, 7, 0)},
+		{"early morning", overnight, at(4, 6, 59), at(4, 7, 0)},
+		{"after overnight", overnight, at(4, 7, 0), time.Time{}},
+		{"during lunch", lunch, at(3, 12, 15), at(3, 13, 30)},
+		{"after lunch", lunch, at(3, 13, 30), time.Time{}},
+		{"other time zone", lunch, at(3, 12, 15).UTC(), at(3, 13, 30)},
+		{"bad time zone", &domain.QuietHours{Start: "00:00", End: "23:59", TimeZone: "Mars/Olympus"}, at(3, 12, 0), time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			until, quiet := QuietUntil(tt.quiet, tt.t)
+			if quiet != !tt.until.IsZero() || !until.Equal(tt.until) {
+				t.Errorf("got %v %v, want %v", until, quiet, tt.until)
+			}
+		})
+	}
+}
+
+func TestSendHonoursPreferences(t *testing.T) {
+	templates, err := DefaultTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	customers := fakeQuickBooks{"7": {
+		Id: "7", DisplayName: "Franchisee",
+		PrimaryPhone:     qb.TelephoneNumber{FreeFormNumber: "416-555-0101"},
+		PrimaryEmailAddr: &qb.EmailAddress{Address: "qb@example.com"},
+	}}
+	directory := prefsDirectory{
+		fakeDirectory: fakeDirectory{"7": "fb-7"},
+		prefs: map[string]domain.NotificationPreferences{"fb-7": {
+			Channels:   map[string]bool{"email": false},
+			Events:     map[string]map[string]bool{"order_completed": {"email": true}, "order_voided": {"sms": false}},
+			QuietHours: &domain.QuietHours{Start: "22:00", End: "07:00", TimeZone: "America/Toronto"},
+			Phone:      "(647) 555-0177",
+			Email:      "me@example.com",
+		}},
+	}
+	sms := &fakeNotifier{channel: SMS}
+	email := &fakeNotifier{channel: Email}
+	s := NewService(templates, NewResolver(fakeUsers{"fb-7": {UserInfo: &auth.UserInfo{}}}, nil, directory), "https://app.example.com", sms, email)
+	noon := time.Date(2025, time.March, 3, 17, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return noon }
+
+	// Email is off, except for completed orders, which go to the override
+	delivered, err := s.Send(context.Background(), customers, Event{Type: OrderCompleted, CompanyID: "1001", CustomerID: "7", InvoiceID: "42"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(delivered, []string{"fb-7:sms", "fb-7:email"}) {
+		t.Errorf("delivered on %v", delivered)
+	}
+	if len(sms.sent) != 1 || sms.sent[0].to.Phone != "+16475550177" {
+		t.Errorf("sms sent %+v", sms.sent)
+	}
+	if len(email.sent) != 1 || !slices.Equal(email.sent[0].to.Emails, []string{"me@example.com"}) {
+		t.Errorf("email sent %+v", email.sent)
+	}
+
+	// SMS waits for quiet hours to end
+	s.now = func() time.Time { return noon.Add(12 * time.Hour) }
+	delivered, err = s.Send(context.Background(), customers, Event{Type: OrderApproved, CompanyID: "1001", CustomerID: "7", InvoiceID: "42"}, nil)
+	deferred, ok := err.(*DeferredError)
+	if !ok || len(delivered) != 0 {
+		t.Fatalf("got %v %v, want deferred", delivered, err)
+	}
+	if want := time.Date(2025, time.March, 4, 12, 0, 0, 0, time.UTC); !deferred.Until.Equal(want) {
+		t.Errorf("deferred until %v, want %v", deferred.Until, want)
+	}
+	if len(sms.sent) != 1 || len(email.sent) != 1 {
+		t.Errorf("sent %d sms and %d emails", len(sms.sent), len(email.sent))
+	}
+}
@@ -0,0 +1,211 @@
+package notify
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"firebase.google.com/go/auth"
+	qb "github.com/Vertisphere/backend-service/external/quickbooks"
+	"github.com/Vertisphere/backend-service/internal/domain"
+	"github.com/rs/zerolog/log"
+)
+
+// Users looks up firebase users. Implemented by *auth.Client.
+type Users interface {
+	GetUser(ctx context.Context, uid string) (*auth.UserRecord, error)
+}
+
+// MFA looks up the phone number a user enrolled as a second factor. Implemented by *firebase.Client.
+type MFA interface {
+	MFAPhoneNumber(ctx context.Context, uid string) (string, error)
+}
+
+// Directory finds the firebase users of companies and customers and their notification preferences.
+// Implemented by storage.SQLStorage.
+type Directory interface {
+	GetCompany(companyID string) (domain.Company, error)
+	ListCompanyUsers(companyID string) ([]domain.CompanyUser, error)
+	ListCustomerUsers(companyID string, customerID string) ([]domain.DBCustomer, error)
+	GetNotificationPreferences(firebaseID string) (domain.NotificationPreferences, error)
+}
+
+// staffPermissions says which staff users hear about an event, e.g. only the ones that can review
+// orders hear about new orders. Events that aren't listed go to every staff user.
+var staffPermissions = map[EventType]domain.Permission{
+	OrderPublished:   domain.ReviewOrders,
+	OrderResubmitted: domain.ReviewOrders,
+	OrderVoided:      domain.ReviewOrders,
+}
+
+// Resolver works out who hears about an event and where to reach them. Franchisee events go to every
+// login of the location, franchiser events to the staff users allowed to act on them. Each recipient
+// is one firebase user, with their own notification preferences.
+//
+// Phone numbers are picked in this order:
+//  1. the phone number enrolled for MFA
+//  2. the phone number on the firebase account
+//  3. the QuickBooks Primary, Mobile then Alternate phone
+//
+// Emails go to the firebase account. The QuickBooks phone numbers and email only go to the location's
+// first admin and the company's QuickBooks user, or to no user at all if there is no one to send to.
+//
+// A phone number or email set in the user's notification preferences replaces all of the above.
+type Resolver struct {
+	users     Users
+	mfa       MFA
+	directory Directory
+}
+
+func NewResolver(users Users, mfa MFA, directory Directory) *Resolver {
+	return &Resolver{users: users, mfa: mfa, directory: directory}
+}
+
+// Franchisee returns how to reach the logins of the QB customer
+func (r *Resolver) Franchisee(ctx context.Context, companyID string, customer *qb.Customer) []Recipient {
+	var qbEmail string
+	if customer.PrimaryEmailAddr != nil {
+		qbEmail = customer.PrimaryEmailAddr.Address
+	}
+	qbPhones := []string{customer.PrimaryPhone.FreeFormNumber, customer.Mobile.FreeFormNumber, customer.AlternatePhone.FreeFormNumber}
+
+	logins, err := r.directory.ListCustomerUsers(companyID, customer.Id)
+	if err != nil {
+		log.Error().Err(err).Str("customerID", customer.Id).Msg("Could not get customer logins to resolve recipients")
+	}
+	if len(logins) == 0 {
+		return []Recipient{r.recipient(ctx, "", customer.DisplayName, qbEmail, qbPhones...)}
+	}
+
+	// The QuickBooks details are the location's, they go to its first admin or its first login if it has no admin
+	primary := logins[0].FirebaseID
+	for _, login := range logins {
+		if login.Role == domain.RoleLocationAdmin {
+			primary = login.FirebaseID
+			break
+		}
+	}
+	recipients := make([]Recipient, 0, len(logins))
+	for _, login := range logins {
+		if login.FirebaseID == primary {
+			recipients = append(recipients, r.recipient(ctx, login.FirebaseID, customer.DisplayName, qbEmail, qbPhones...))
+		} else {
+			recipients = append(recipients, r.recipient(ctx, login.FirebaseID, customer.DisplayName, ""))
+		}
+	}
+	return recipients
+}
+
+// Franchiser returns how to reach the company's staff users that should hear about event
+func (r *Resolver) Franchiser(ctx context.Context, companyID string, event EventType, company *qb.CompanyInfo) []Recipient {
+	// The company's QuickBooks user, who gets the QuickBooks phone number
+	var primary string
+	dbCompany, err := r.directory.GetCompany(companyID)
+	if err != nil {
+		log.Error().Err(err).Str("companyID", companyID).Msg("Could not get company to resolve recipients")
+	} else {
+		primary = dbCompany.FirebaseID
+	}
+	staff, err := r.directory.ListCompanyUsers(companyID)
+	if err != nil {
+		log.Error().Err(err).Str("companyID", companyID).Msg("Could not get staff users to resolve recipients")
+	}
+	if len(staff) == 0 {
+		// Companies from before staff users only have their QuickBooks user
+		return []Recipient{r.recipient(ctx, primary, company.CompanyName, "", company.PrimaryPhone.FreeFormNumber)}
+	}
+
+	permission, needed := staffPermissions[event]
+	var recipients []Recipient
+	for _, u := range staff {
+		if needed && !(domain.Claims{IsFranchiser: true, Role: u.Role}).Can(permission) {
+			continue
+		}
+		if u.FirebaseID == primary {
+			recipients = append(recipients, r.recipient(ctx, u.FirebaseID, company.CompanyName, "", company.PrimaryPhone.FreeFormNumber))
+		} else {
+			recipients = append(recipients, r.recipient(ctx, u.FirebaseID, company.CompanyName, ""))
+		}
+	}
+	return recipients
+}
+
+// recipient returns how to reach a firebase user. The QuickBooks email is sent to as well and the
+// QuickBooks phone numbers are used if the user has none. Without a firebase user only the QuickBooks
+// details are used.
+func (r *Resolver) recipient(ctx context.Context, firebaseID string, name string, qbEmail string, qbPhones ...string) Recipient {
+	recipient := Recipient{ID: firebaseID, Name: name}
+	recipient.Emails = appendEmail(recipient.Emails, qbEmail)
+	phone, email := r.firebaseContact(ctx, firebaseID)
+	recipient.Emails = appendEmail(recipient.Emails, email)
+	recipient.Phone = firstPhone(phone, qbPhones...)
+	r.applyPreferences(&recipient)
+	return recipient
+}
+
+// applyPreferences attaches the user's notification preferences to the recipient and applies their overrides
+func (r *Resolver) applyPreferences(recipient *Recipient) {
+	if recipient.ID == "" {
+		return
+	}
+	p, err := r.directory.GetNotificationPreferences(recipient.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return
+	}
+	if err != nil {
+		// Sending to someone who opted out beats not sending at all
+		log.Error().Err(err).Str("firebaseID", recipient.ID).Msg("Could not get notification preferences")
+		return
+	}
+	recipient.Preferences = &p
+	if p.Phone != "" {
+		recipient.Phone = E164Phone(p.Phone)
+	}
+	if p.Email != "" {
+		recipient.Emails = []string{p.Email}
+	}
+}
+
+// firebaseContact returns the best phone number and the email of a firebase user. Lookups that fail
+// are logged and skipped so the QuickBooks details can still be used.
+func (r *Resolver) firebaseContact(ctx context.Context, firebaseID string) (phone string, email string) {
+	if firebaseID == "" {
+		return "", ""
+	}
+	if r.mfa != nil {
+		mfaPhone, err := r.mfa.MFAPhoneNumber(ctx, firebaseID)
+		if err != nil {
+			log.Warn().Err(err).Str("firebaseID", firebaseID).Msg("Could not get MFA phone number")
+		}
+		phone = mfaPhone
+	}
+	user, err := r.users.GetUser(ctx, firebaseID)
+	if err != nil {
+		log.Error().Err(err).Str("firebaseID", firebaseID).Msg("Could not get firebase user")
+		return phone, ""
+	}
+	if phone == "" {
+		phone = user.PhoneNumber
+	}
+	return phone, user.Email
+}
+
+// firstPhone returns the first phone number set. The first one is already in E.164, the rest are QuickBooks numbers.
+func firstPhone(e164 string, qbPhones ...string) string {
+	if e164 != "" {
+		return e164
+	}
+	for _, phone := range qbPhones {
+		if phone != "" {
+			return E164Phone(phone)
+		}
+	}
+	return ""
+}
+
+func appendEmail(emails []string, email string) []string {
+	if email == "" {
+		return emails
+	}
+	return append(emails, email)
+}
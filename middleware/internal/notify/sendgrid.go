@@ -0,0 +1,71 @@
+package notify
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sendgrid/sendgrid-go"
+	"github.com/sendgrid/sendgrid-go/helpers/mail"
+)
+
+// SendGrid sends emails through SendGrid
+type SendGrid struct {
+	client *sendgrid.Client
+	// from is the address emails are sent from
+	from string
+}
+
+func NewSendGrid(apiKey string, from string) *SendGrid {
+	return &SendGrid{client: sendgrid.NewSendClient(apiKey), from: from}
+}
+
+func (s *SendGrid) Channel() Channel {
+	return Email
+}
+
+func (s *SendGrid) Send(ctx context.Context, to Recipient, msg Message) error {
+	m := mail.NewV3Mail()
+	fromName := msg.From
+	if fromName == "" {
+		fromName = "Ordrport"
+	}
+	m.SetFrom(mail.NewEmail(fromName, s.from))
+
+	personalization := mail.NewPersonalization()
+	personalization.Subject = msg.Subject
+	// The same address can come from both QB and firebase
+	seen := map[string]bool{}
+	for _, email := range to.Emails {
+		if email == "" || seen[email] {
+			continue
+		}
+		seen[email] = true
+		personalization.AddTos(mail.NewEmail(to.Name, email))
+	}
+	if len(seen) == 0 {
+		return ErrNoRecipient
+	}
+	m.AddPersonalizations(personalization)
+	m.AddContent(mail.NewContent("text/html", msg.Body))
+
+	for _, attachment := range msg.Attachments {
+		a := mail.NewAttachment()
+		a.SetContent(base64.StdEncoding.EncodeToString(attachment.Content))
+		a.SetType(attachment.ContentType)
+		a.SetFilename(attachment.Filename)
+		a.SetDisposition("attachment")
+		m.AddAttachment(a)
+	}
+
+	resp, err := s.client.SendWithContext(ctx, m)
+	if err != nil {
+		return fmt.Errorf("could not send email: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("sendgrid responded with %d: %s", resp.StatusCode, resp.Body)
+	}
+	log.Debug().Int("status", resp.StatusCode).Str("event", string(msg.Event)).Msg("Sent email")
+	return nil
+}
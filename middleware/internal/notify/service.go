@@ -0,0 +1,159 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	qb "github.com/Vertisphere/backend-service/external/quickbooks"
+	"github.com/rs/zerolog/log"
+)
+
+// QuickBooks looks up the names, QuickBooks contact details and invoice of an event. Implemented by *qb.RealmClient.
+type QuickBooks interface {
+	GetCustomerById(ctx context.Context, realmID string, customerID string) (*qb.Customer, error)
+	FindCompanyInfo(ctx context.Context, realmID string) (*qb.CompanyInfo, error)
+	GetInvoicePDF(ctx context.Context, realmID string, invoiceID string) ([]byte, error)
+}
+
+// Service sends events to whoever should hear about them
+type Service struct {
+	templates *Templates
+	resolver  *Resolver
+	notifiers []Notifier
+	appURL    string
+	now       func() time.Time
+}
+
+func NewService(templates *Templates, resolver *Resolver, appURL string, notifiers ...Notifier) *Service {
+	return &Service{templates: templates, resolver: resolver, notifiers: notifiers, appURL: appURL, now: time.Now}
+}
+
+// Emit sends the event over every channel it has templates for. quickbooks has to be a client for the
+// event's company. A channel failing doesn't stop the others, all errors are returned together.
+// Channels held back by quiet hours aren't sent, only the outbox retries.
+func (s *Service) Emit(ctx context.Context, quickbooks QuickBooks, e Event) error {
+	_, err := s.Send(ctx, quickbooks, e, nil)
+	var deferred *DeferredError
+	if errors.As(err, &deferred) {
+		return nil
+	}
+	return err
+}
+
+// Send is Emit for retries: deliveries in delivered are skipped. It returns the deliveries made so
+// far, including the ones in delivered, see Delivery.
+//
+// Every recipient gets the event on the channels they didn't turn off. SMS sent during a recipient's
+// quiet hours is held back, if nothing else failed a *DeferredError says until when the first of them ends.
+func (s *Service) Send(ctx context.Context, quickbooks QuickBooks, e Event, delivered []string) ([]string, error) {
+	audience, ok := audiences[e.Type]
+	if !ok {
+		return delivered, fmt.Errorf("unknown event %q", e.Type)
+	}
+	data := Data{Event: e, AppURL: s.appURL}
+
+	var customer *qb.Customer
+	if e.CustomerID != "" {
+		var err error
+		customer, err = quickbooks.GetCustomerById(ctx, e.CompanyID, e.CustomerID)
+		if err != nil {
+			return delivered, fmt.Errorf("could not get customer to send %s: %w", e.Type, err)
+		}
+		data.CustomerName = customer.DisplayName
+	}
+	company, err := quickbooks.FindCompanyInfo(ctx, e.CompanyID)
+	if err != nil {
+		// Only the name and phone number come from there, the firebase account may still do
+		log.Error().Err(err).Str("companyID", e.CompanyID).Msg("Could not get company information from QB")
+		company = &qb.CompanyInfo{}
+	}
+	data.CompanyName = company.CompanyName
+	if data.CompanyName == "" {
+		data.CompanyName = "OrdrPort Franchisor #" + e.CompanyID
+	}
+
+	var recipients []Recipient
+	switch {
+	case e.To != nil:
+		recipients = []Recipient{*e.To}
+	case audience == Franchiser:
+		recipients = s.resolver.Franchiser(ctx, e.CompanyID, e.Type, company)
+	case customer == nil:
+		return delivered, fmt.Errorf("%s goes to the franchisee but has no customer", e.Type)
+	default:
+		recipients = s.resolver.Franchisee(ctx, e.CompanyID, customer)
+	}
+	if len(recipients) == 0 {
+		log.Warn().Str("event", string(e.Type)).Str("companyID", e.CompanyID).Msg("No one to send the event to")
+		return delivered, nil
+	}
+	recipients[0].Emails = append(recipients[0].Emails, e.Emails...)
+
+	var errs []error
+	var deferred time.Time
+	var pdf []byte
+	for _, to := range recipients {
+		data.Recipient = to
+		for _, n := range s.notifiers {
+			if wasDelivered(delivered, to, n.Channel()) || !Allowed(to.Preferences, e.Type, n.Channel()) {
+				continue
+			}
+			if n.Channel() == SMS && to.Preferences != nil {
+				if until, quiet := QuietUntil(to.Preferences.QuietHours, s.now()); quiet {
+					if deferred.IsZero() || until.Before(deferred) {
+						deferred = until
+					}
+					continue
+				}
+			}
+			msg, ok, err := s.templates.Render(n.Channel(), data)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if !ok {
+				continue
+			}
+			if n.Channel() == Email && e.AttachInvoice {
+				if pdf == nil {
+					if pdf, err = quickbooks.GetInvoicePDF(ctx, e.CompanyID, e.InvoiceID); err != nil {
+						errs = append(errs, fmt.Errorf("could not get invoice PDF to send %s: %w", e.Type, err))
+						continue
+					}
+				}
+				msg.Attachments = append(msg.Attachments, Attachment{
+					Filename:    fmt.Sprintf("Invoice_%s.pdf", e.InvoiceID),
+					ContentType: "application/pdf",
+					Content:     pdf,
+				})
+			}
+			if err := n.Send(ctx, to, msg); err != nil {
+				errs = append(errs, fmt.Errorf("could not send %s over %s: %w", e.Type, n.Channel(), err))
+				continue
+			}
+			delivered = append(delivered, Delivery(to, n.Channel()))
+		}
+	}
+	if len(errs) == 0 && !deferred.IsZero() {
+		return delivered, &DeferredError{Until: deferred}
+	}
+	return delivered, errors.Join(errs...)
+}
+
+// Delivery names the event going out to the recipient over the channel: the recipient's firebase ID
+// and the channel, or only the channel for a recipient that isn't a user
+func Delivery(to Recipient, channel Channel) string {
+	if to.ID == "" {
+		return string(channel)
+	}
+	return to.ID + ":" + string(channel)
+}
+
+// wasDelivered reports whether the event already went out to the recipient over the channel.
+// Notifications queued when events had a single recipient only recorded the channel.
+func wasDelivered(delivered []string, to Recipient, channel Channel) bool {
+	return slices.Contains(delivered, string(channel)) || slices.Contains(delivered, Delivery(to, channel))
+}
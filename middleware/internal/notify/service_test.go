@@ -0,0 +1,315 @@
+package notify
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"firebase.google.com/go/auth"
+	qb "github.com/Vertisphere/backend-service/external/quickbooks"
+	"github.com/Vertisphere/backend-service/internal/domain"
+)
+
+type fakeUsers map[string]*auth.UserRecord
+
+func (u fakeUsers) GetUser(_ context.Context, uid string) (*auth.UserRecord, error) {
+	user, ok := u[uid]
+	if !ok {
+		return nil, errors.New("no such user")
+	}
+	return user, nil
+}
+
+type fakeMFA map[string]string
+
+func (m fakeMFA) MFAPhoneNumber(_ context.Context, uid string) (string, error) {
+	return m[uid], nil
+}
+
+type fakeDirectory map[string]string
+
+func (d fakeDirectory) GetCompany(companyID string) (domain.Company, error) {
+	return domain.Company{QBCompanyID: companyID, FirebaseID: d["company"]}, nil
+}
+
+// ListCompanyUsers returns no staff users, like a company from before staff users
+func (d fakeDirectory) ListCompanyUsers(string) ([]domain.CompanyUser, error) {
+	return []domain.CompanyUser{}, nil
+}
+
+// ListCustomerUsers returns the customer's admin, if it has one
+func (d fakeDirectory) ListCustomerUsers(companyID string, customerID string) ([]domain.DBCustomer, error) {
+	firebaseID, ok := d[customerID]
+	if !ok {
+		return []domain.DBCustomer{}, nil
+	}
+	return []domain.DBCustomer{{QBCustomerID: customerID, QBCompanyID: companyID, FirebaseID: firebaseID, Role: domain.RoleLocationAdmin}}, nil
+}
+
+func (d fakeDirectory) GetNotificationPreferences(string) (domain.NotificationPreferences, error) {
+	return domain.NotificationPreferences{}, sql.ErrNoRows
+}
+
+// prefsDirectory is a fakeDirectory where some users have notification preferences
+type prefsDirectory struct {
+	fakeDirectory
+	prefs map[string]domain.NotificationPreferences
+}
+
+func (d prefsDirectory) GetNotificationPreferences(firebaseID string) (domain.NotificationPreferences, error) {
+	p, ok := d.prefs[firebaseID]
+	if !ok {
+		return domain.NotificationPreferences{}, sql.ErrNoRows
+	}
+	return p, nil
+}
+
+type fakeQuickBooks map[string]*qb.Customer
+
+func (q fakeQuickBooks) GetCustomerById(_ context.Context, _ string, customerID string) (*qb.Customer, error) {
+	return q[customerID], nil
+}
+
+func (q fakeQuickBooks) FindCompanyInfo(context.Context, string) (*qb.CompanyInfo, error) {
+	return &qb.CompanyInfo{CompanyName: "Bagel Co", PrimaryPhone: qb.TelephoneNumber{FreeFormNumber: "(416) 555-0100"}}, nil
+}
+
+func (q fakeQuickBooks) GetInvoicePDF(context.Context, string, string) ([]byte, error) {
+	return []byte("%PDF"), nil
+}
+
+type sent struct {
+	to  Recipient
+	msg Message
+}
+
+type fakeNotifier struct {
+	channel Channel
+	sent    []sent
+	// err is returned by Send, the message isn't recorded then
+	err error
+}
+
+func (n *fakeNotifier) Channel() Channel {
+	return n.channel
+}
+
+func (n *fakeNotifier) Send(_ context.Context, to Recipient, msg Message) error {
+	if n.err != nil {
+		return n.err
+	}
+	n.sent = append(n.sent, sent{to, msg})
+	return nil
+}
+
+func TestEmitResolvesPhoneByPriority(t *testing.T) {
+	customers := fakeQuickBooks{}
+	for _, id := range []string{"mfa", "firebase", "primary", "mobile", "alternate"} {
+		customers[id] = &qb.Customer{Id: id, DisplayName: "Franchisee " + id, AlternatePhone: qb.TelephoneNumber{FreeFormNumber: "416-555-0105"}}
+	}
+	customers["mfa"].PrimaryPhone.FreeFormNumber = "416-555-0199"
+	customers["firebase"].PrimaryPhone.FreeFormNumber = "416-555-0199"
+	customers["primary"].PrimaryPhone.FreeFormNumber = "416-555-0103"
+	customers["primary"].Mobile.FreeFormNumber = "416-555-0199"
+	customers["mobile"].Mobile.FreeFormNumber = "1 416 555 0104"
+
+	users := fakeUsers{
+		"fb-mfa":      {UserInfo: &auth.UserInfo{PhoneNumber: "+14165550198", Email: "mfa@example.com"}},
+		"fb-firebase": {UserInfo: &auth.UserInfo{PhoneNumber: "+14165550102"}},
+		"fb-primary":  {UserInfo: &auth.UserInfo{}},
+	}
+	mfa := fakeMFA{"fb-mfa": "+14165550101"}
+	directory := fakeDirectory{"mfa": "fb-mfa", "firebase": "fb-firebase", "primary": "fb-primary"}
+
+	templates, err := DefaultTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sms := &fakeNotifier{channel: SMS}
+	email := &fakeNotifier{channel: Email}
+	s := NewService(templates, NewResolver(users, mfa, directory), "https://app.example.com", sms, email)
+
+	want := map[string]string{
+		"mfa":       "+14165550101",
+		"firebase":  "+14165550102",
+		"primary":   "+14165550103",
+		"mobile":    "+14165550104",
+		"alternate": "+14165550105",
+	}
+	for customerID, phone := range want {
+		sms.sent = nil
+		err := s.Emit(context.Background(), customers, Event{Type: OrderApproved, CompanyID: "1001", CustomerID: customerID, InvoiceID: "42"})
+		if err != nil {
+			t.Fatalf("%s: %v", customerID, err)
+		}
+		if len(sms.sent) != 1 {
+			t.Fatalf("%s: sent %d sms", customerID, len(sms.sent))
+		}
+		if got := sms.sent[0].to.Phone; got != phone {
+			t.Errorf("%s: sent to %s, want %s", customerID, got, phone)
+		}
+		if body := sms.sent[0].msg.Body; !strings.Contains(body, "Order #42 has been approved") || !strings.Contains(body, "https://app.example.com/franchisee/orders") {
+			t.Errorf("%s: body %q", customerID, body)
+		}
+	}
+	if len(email.sent) != 0 {
+		t.Errorf("approved orders have no email template but %d were sent", len(email.sent))
+	}
+}
+
+func TestEmitRendersEmail(t *testing.T) {
+	templates, err := DefaultTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	email := &fakeNotifier{channel: Email}
+	customers := fakeQuickBooks{"7": {Id: "7", DisplayName: "Tom & Jerry's", PrimaryEmailAddr: &qb.EmailAddress{Address: "qb@example.com"}}}
+	s := NewService(templates, NewResolver(fakeUsers{}, nil, fakeDirectory{}), "https://app.example.com", email)
+
+	err = s.Emit(context.Background(), customers, Event{
+		Type: OrderCompleted, CompanyID: "1001", CustomerID: "7", InvoiceID: "42",
+		Emails:      []string{"bill@example.com"},
+		Attachments: []Attachment{{Filename: "Invoice_42.pdf", ContentType: "application/pdf", Content: []byte("%PDF")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(email.sent) != 1 {
+		t.Fatalf("sent %d emails", len(email.sent))
+	}
+	got := email.sent[0]
+	if got.msg.Subject != "Your Order 42 is Ready for Pickup!" || got.msg.From != "Bagel Co" {
+		t.Errorf("got subject %q from %q", got.msg.Subject, got.msg.From)
+	}
+	if !strings.Contains(got.msg.Body, "Hello Tom &amp; Jerry&#39;s,") {
+		t.Errorf("customer name isn't escaped in %q", got.msg.Body)
+	}
+	if strings.Join(got.to.Emails, ",") != "qb@example.com,bill@example.com" || len(got.msg.Attachments) != 1 {
+		t.Errorf("got %+v", got)
+	}
+}
+
+// teamDirectory has staff users and location logins, some with notification preferences
+type teamDirectory struct {
+	prefsDirectory
+	staff  []domain.CompanyUser
+	logins []domain.DBCustomer
+}
+
+func (d teamDirectory) ListCompanyUsers(string) ([]domain.CompanyUser, error) {
+	return d.staff, nil
+}
+
+func (d teamDirectory) ListCustomerUsers(string, string) ([]domain.DBCustomer, error) {
+	return d.logins, nil
+}
+
+func TestSendReachesEveryRecipient(t *testing.T) {
+	templates, err := DefaultTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := fakeUsers{}
+	for i, uid := range []string{"owner", "approver", "fulfillment", "viewer", "admin", "orderer", "looker"} {
+		users[uid] = &auth.UserRecord{UserInfo: &auth.UserInfo{PhoneNumber: fmt.Sprintf("+1416555010%d", i)}}
+	}
+	users["owner"].PhoneNumber = ""
+	directory := teamDirectory{
+		prefsDirectory: prefsDirectory{
+			fakeDirectory: fakeDirectory{"company": "owner"},
+			prefs: map[string]domain.NotificationPreferences{
+				"admin":   {Channels: map[string]bool{"sms": false}},
+				"orderer": {QuietHours: &domain.QuietHours{Start: "00:00", End: "23:59", TimeZone: "UTC"}},
+			},
+		},
+		staff: []domain.CompanyUser{
+			{FirebaseID: "owner", Role: domain.RoleOwner},
+			{FirebaseID: "approver", Role: domain.RoleApprover},
+			{FirebaseID: "fulfillment", Role: domain.RoleFulfillment},
+			{FirebaseID: "viewer", Role: domain.RoleViewer},
+		},
+		logins: []domain.DBCustomer{
+			{FirebaseID: "orderer", Role: domain.RoleOrderer},
+			{FirebaseID: "admin", Role: domain.RoleLocationAdmin},
+			{FirebaseID: "looker", Role: domain.RoleViewer},
+		},
+	}
+	customers := fakeQuickBooks{"7": {Id: "7", DisplayName: "Franchisee", PrimaryEmailAddr: &qb.EmailAddress{Address: "qb@example.com"}}}
+	sms := &fakeNotifier{channel: SMS}
+	s := NewService(templates, NewResolver(users, nil, directory), "https://app.example.com", sms)
+	s.now = func() time.Time { return time.Date(2025, time.March, 3, 12, 0, 0, 0, time.UTC) }
+	phones := func() []string {
+		var phones []string
+		for _, sent := range sms.sent {
+			phones = append(phones, sent.to.Phone)
+		}
+		return phones
+	}
+
+	// New orders go to the staff that can review them, the owner has no phone of their own
+	delivered, err := s.Send(context.Background(), customers, Event{Type: OrderPublished, CompanyID: "1001", CustomerID: "7", InvoiceID: "42"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"+14165550100", "+14165550101"}; !slices.Equal(phones(), want) {
+		t.Errorf("order published texted %v, want %v", phones(), want)
+	}
+	if want := []string{"owner:sms", "approver:sms"}; !slices.Equal(delivered, want) {
+		t.Errorf("delivered %v, want %v", delivered, want)
+	}
+
+	// Every login of the location hears about its orders, on their own terms
+	sms.sent = nil
+	delivered, err = s.Send(context.Background(), customers, Event{Type: OrderApproved, CompanyID: "1001", CustomerID: "7", InvoiceID: "42"}, nil)
+	var deferred *DeferredError
+	if !errors.As(err, &deferred) {
+		t.Fatalf("err = %v, want the orderer's SMS deferred", err)
+	}
+	if want := []string{"+14165550106"}; !slices.Equal(phones(), want) {
+		t.Errorf("order approved texted %v, want only the location viewer", phones())
+	}
+
+	// The retry only goes to the orderer once their quiet hours are over
+	sms.sent = nil
+	s.now = func() time.Time { return deferred.Until }
+	delivered, err = s.Send(context.Background(), customers, Event{Type: OrderApproved, CompanyID: "1001", CustomerID: "7", InvoiceID: "42"}, delivered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"+14165550105"}; !slices.Equal(phones(), want) {
+		t.Errorf("retry texted %v, want only the orderer", phones())
+	}
+	if want := []string{"looker:sms", "orderer:sms"}; !slices.Equal(delivered, want) {
+		t.Errorf("delivered %v, want %v", delivered, want)
+	}
+}
+
+func TestFranchiseeQuickBooksDetailsGoToFirstAdmin(t *testing.T) {
+	users := fakeUsers{
+		"orderer": {UserInfo: &auth.UserInfo{Email: "orderer@example.com"}},
+		"admin":   {UserInfo: &auth.UserInfo{Email: "admin@example.com"}},
+	}
+	directory := teamDirectory{logins: []domain.DBCustomer{
+		{FirebaseID: "orderer", Role: domain.RoleOrderer},
+		{FirebaseID: "admin", Role: domain.RoleLocationAdmin},
+	}}
+	customer := &qb.Customer{Id: "7", DisplayName: "Franchisee",
+		PrimaryEmailAddr: &qb.EmailAddress{Address: "qb@example.com"},
+		PrimaryPhone:     qb.TelephoneNumber{FreeFormNumber: "416-555-0101"},
+	}
+
+	got := NewResolver(users, nil, directory).Franchisee(context.Background(), "1001", customer)
+	want := []Recipient{
+		{ID: "orderer", Name: "Franchisee", Emails: []string{"orderer@example.com"}},
+		{ID: "admin", Name: "Franchisee", Phone: "+14165550101", Emails: []string{"qb@example.com", "admin@example.com"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Franchisee = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,157 @@
+package notify
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	texttemplate "text/template"
+)
+
+//go:embed templates/*.tmpl
+var defaultTemplates embed.FS
+
+// Data is what an event's templates are rendered with
+type Data struct {
+	Event
+	Recipient    Recipient
+	CustomerName string
+	CompanyName  string
+	// AppURL is where the web app is served, links in messages point there
+	AppURL string
+}
+
+// Templates holds the templates of each event, per channel. An event is only sent over the channels
+// it has templates for.
+type Templates struct {
+	sms     map[EventType]*texttemplate.Template
+	subject map[EventType]*texttemplate.Template
+	email   map[EventType]*htmltemplate.Template
+}
+
+func NewTemplates() *Templates {
+	return &Templates{
+		sms:     map[EventType]*texttemplate.Template{},
+		subject: map[EventType]*texttemplate.Template{},
+		email:   map[EventType]*htmltemplate.Template{},
+	}
+}
+
+// DefaultTemplates returns the templates shipped in the templates directory
+func DefaultTemplates() (*Templates, error) {
+	return LoadTemplates(defaultTemplates, "templates")
+}
+
+// LoadTemplates parses the templates in dir. Files are named <event>.sms.tmpl for SMS, and
+// <event>.subject.tmpl and <event>.email.tmpl for email.
+func LoadTemplates(fsys fs.FS, dir string) (*Templates, error) {
+	t := NewTemplates()
+	files, err := fs.Glob(fsys, path.Join(dir, "*.tmpl"))
+	if err != nil {
+		return nil, err
+	}
+	emails := map[EventType]string{}
+	subjects := map[EventType]string{}
+	for _, file := range files {
+		b, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+		event, kind, ok := strings.Cut(strings.TrimSuffix(path.Base(file), ".tmpl"), ".")
+		if !ok {
+			return nil, fmt.Errorf("template %s is not named <event>.<kind>.tmpl", file)
+		}
+		switch kind {
+		case "sms":
+			if err := t.RegisterSMS(EventType(event), string(b)); err != nil {
+				return nil, err
+			}
+		case "subject":
+			subjects[EventType(event)] = string(b)
+		case "email":
+			emails[EventType(event)] = string(b)
+		default:
+			return nil, fmt.Errorf("template %s has unknown kind %q", file, kind)
+		}
+	}
+	for event, body := range emails {
+		subject, ok := subjects[event]
+		if !ok {
+			return nil, fmt.Errorf("email template for %s has no subject", event)
+		}
+		if err := t.RegisterEmail(event, subject, body); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// RegisterSMS sets the text of the SMS sent for event
+func (t *Templates) RegisterSMS(event EventType, text string) error {
+	tmpl, err := texttemplate.New(string(event) + ".sms").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return fmt.Errorf("could not parse sms template for %s: %w", event, err)
+	}
+	t.sms[event] = tmpl
+	return nil
+}
+
+// RegisterEmail sets the subject and HTML body of the email sent for event
+func (t *Templates) RegisterEmail(event EventType, subject string, html string) error {
+	subjectTmpl, err := texttemplate.New(string(event) + ".subject").Option("missingkey=error").Parse(subject)
+	if err != nil {
+		return fmt.Errorf("could not parse subject template for %s: %w", event, err)
+	}
+	htmlTmpl, err := htmltemplate.New(string(event) + ".email").Option("missingkey=error").Parse(html)
+	if err != nil {
+		return fmt.Errorf("could not parse email template for %s: %w", event, err)
+	}
+	t.subject[event] = subjectTmpl
+	t.email[event] = htmlTmpl
+	return nil
+}
+
+// Render renders the message for an event on a channel. It returns false if the event isn't sent on that channel.
+func (t *Templates) Render(channel Channel, data Data) (Message, bool, error) {
+	msg := Message{Event: data.Type, From: data.CompanyName, Attachments: data.Attachments}
+	var err error
+	switch channel {
+	case SMS:
+		tmpl, ok := t.sms[data.Type]
+		if !ok {
+			return Message{}, false, nil
+		}
+		msg.Body, err = execute(tmpl, data)
+	case Email:
+		tmpl, ok := t.email[data.Type]
+		if !ok {
+			return Message{}, false, nil
+		}
+		if msg.Subject, err = execute(t.subject[data.Type], data); err != nil {
+			break
+		}
+		msg.Body, err = execute(tmpl, data)
+	default:
+		return Message{}, false, nil
+	}
+	if err != nil {
+		return Message{}, false, fmt.Errorf("could not render %s %s: %w", data.Type, channel, err)
+	}
+	return msg, true, nil
+}
+
+type template interface {
+	Execute(w io.Writer, data any) error
+}
+
+func execute(tmpl template, data Data) (string, error) {
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(b.String()), nil
+}
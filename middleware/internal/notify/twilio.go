@@ -0,0 +1,45 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	"github.com/twilio/twilio-go"
+	twApi "github.com/twilio/twilio-go/rest/api/v2010"
+)
+
+// Twilio sends SMS through Twilio
+type Twilio struct {
+	client *twilio.RestClient
+	// from is the Twilio number messages are sent from
+	from string
+}
+
+func NewTwilio(client *twilio.RestClient, from string) *Twilio {
+	return &Twilio{client: client, from: from}
+}
+
+func (t *Twilio) Channel() Channel {
+	return SMS
+}
+
+func (t *Twilio) Send(ctx context.Context, to Recipient, msg Message) error {
+	if to.Phone == "" {
+		return ErrNoRecipient
+	}
+	if t.from == "" {
+		return errors.New("no twilio number to send sms from")
+	}
+	params := &twApi.CreateMessageParams{}
+	params.SetBody(msg.Body)
+	params.SetFrom(t.from)
+	params.SetTo(to.Phone)
+	twResp, err := t.client.Api.CreateMessage(params)
+	if err != nil {
+		return fmt.Errorf("could not send SMS message: %w", err)
+	}
+	log.Debug().Interface("twResp", twResp).Str("event", string(msg.Event)).Msg("Sent SMS")
+	return nil
+}
@@ -0,0 +1,223 @@
+// Package orderstate defines the order lifecycle: which statuses an order can move between,
+// who is allowed to move it, and what has to happen when it does.
+package orderstate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	qb "github.com/Vertisphere/backend-service/external/quickbooks"
+	"github.com/Vertisphere/backend-service/internal/domain"
+	"github.com/rs/zerolog/log"
+)
+
+// Role is the kind of user triggering a transition
+type Role string
+
+const (
+	Franchiser Role = "franchiser"
+	Franchisee Role = "franchisee"
+)
+
+// RoleOf returns the role of the user the claims belong to
+func RoleOf(claims domain.Claims) Role {
+	if claims.IsFranchiser {
+		return Franchiser
+	}
+	return Franchisee
+}
+
+// Transition is a move from one status to another that the given roles may trigger. Franchiser
+// staff also need Permission, franchisees need domain.PlaceOrders for all of theirs.
+type Transition struct {
+	From       domain.OrderStatus
+	To         domain.OrderStatus
+	Roles      []Role
+	Permission domain.Permission
+}
+
+// Transitions is the order lifecycle
+var Transitions = []Transition{
+	// franchisee submits the order for review
+	{From: domain.OrderDraft, To: domain.OrderPending, Roles: []Role{Franchisee}},
+	// franchisee pulls the order back, or the franchiser sends it back
+	{From: domain.OrderPending, To: domain.OrderDraft, Roles: []Role{Franchisee, Franchiser}, Permission: domain.ReviewOrders},
+	// franchiser asks for changes, franchisee edits and resubmits
+	{From: domain.OrderPending, To: domain.OrderRevision, Roles: []Role{Franchiser}, Permission: domain.ReviewOrders},
+	{From: domain.OrderRevision, To: domain.OrderPending, Roles: []Role{Franchisee}},
+	// franchiser accepts the order and starts preparing it
+	{From: domain.OrderPending, To: domain.OrderApproved, Roles: []Role{Franchiser}, Permission: domain.ReviewOrders},
+	// franchisee cancels the order before it's approved, or the franchiser turns it down
+	{From: domain.OrderDraft, To: domain.OrderVoid, Roles: []Role{Franchisee}},
+	{From: domain.OrderPending, To: domain.OrderVoid, Roles: []Role{Franchisee, Franchiser}, Permission: domain.ReviewOrders},
+	{From: domain.OrderRevision, To: domain.OrderVoid, Roles: []Role{Franchisee, Franchiser}, Permission: domain.ReviewOrders},
+	// franchiser marks the order as ready for pick up
+	{From: domain.OrderApproved, To: domain.OrderComplete, Roles: []Role{Franchiser}, Permission: domain.FulfillOrders},
+}
+
+// ErrForbidden is returned when the transition exists but the user isn't allowed to trigger it
+var ErrForbidden = errors.New("role is not allowed to make this transition")
+
+// InvalidTransitionError is returned when there is no transition between the two statuses
+type InvalidTransitionError struct {
+	From    domain.OrderStatus
+	To      domain.OrderStatus
+	Allowed []domain.OrderStatus
+}
+
+func (e *InvalidTransitionError) Error() string {
+	return fmt.Sprintf("cannot move order from %s to %s", e.From, e.To)
+}
+
+// Change is a single transition being applied to an order
+type Change struct {
+	// QB is authenticated as the order's company
+	QB      *qb.RealmClient
+	Order   domain.Order
+	Invoice *qb.Invoice
+	Claims  domain.Claims
+	From    domain.OrderStatus
+	To      domain.OrderStatus
+	// TraceID and Reason end up in the order's history
+	TraceID string
+	Reason  string
+	// Slot is the pickup or delivery slot asked for when publishing, hooks set it to the one the order got
+	Slot string
+	// Review is set when sending an order back for revision, Changes when resubmitting it
+	Review  *domain.OrderReview
+	Changes []domain.LineChange
+	// Notifications are queued in the same transaction as the status, see domain.Notification
+	Notifications []domain.Notification
+}
+
+// Event returns the history entry for the change
+func (c *Change) Event() domain.OrderEvent {
+	return domain.OrderEvent{
+		QBCompanyID:     c.Order.QBCompanyID,
+		QBInvoiceID:     c.Order.QBInvoiceID,
+		ActorFirebaseID: c.Claims.FirebaseID,
+		ActorRole:       string(RoleOf(c.Claims)),
+		FromStatus:      c.From,
+		ToStatus:        c.To,
+		TraceID:         c.TraceID,
+		Reason:          c.Reason,
+		Review:          c.Review,
+		Changes:         c.Changes,
+		Notifications:   c.Notifications,
+	}
+}
+
+// Hook is a side effect of moving an order into a status
+type Hook func(ctx context.Context, c *Change) error
+
+// Store persists status changes along with the order's history. TransitionOrder holds the order in
+// status from while apply runs, and saves the event apply returns unless it fails.
+type Store interface {
+	TransitionOrder(companyID string, invoiceID string, from domain.OrderStatus, apply func() (domain.OrderEvent, error)) error
+}
+
+// Machine applies transitions and runs their hooks
+type Machine struct {
+	transitions []Transition
+	before      map[domain.OrderStatus][]Hook
+	after       map[domain.OrderStatus][]Hook
+}
+
+func New(transitions []Transition) *Machine {
+	return &Machine{
+		transitions: transitions,
+		before:      map[domain.OrderStatus][]Hook{},
+		after:       map[domain.OrderStatus][]Hook{},
+	}
+}
+
+// Before registers a hook that runs before an order is moved into the status. The order is held in
+// its current status while it runs, and keeps it if the hook fails, so use it for things that have
+// to happen, like voiding in QB.
+func (m *Machine) Before(to domain.OrderStatus, h Hook) {
+	m.before[to] = append(m.before[to], h)
+}
+
+// After registers a hook that runs once the status has been saved. Failures are only logged.
+func (m *Machine) After(to domain.OrderStatus, h Hook) {
+	m.after[to] = append(m.after[to], h)
+}
+
+// Allowed returns the statuses the user can move an order into from the given status
+func (m *Machine) Allowed(from domain.OrderStatus, claims domain.Claims) []domain.OrderStatus {
+	allowed := []domain.OrderStatus{}
+	for _, t := range m.transitions {
+		if t.From == from && t.allows(claims) {
+			allowed = append(allowed, t.To)
+		}
+	}
+	return allowed
+}
+
+// Check returns an error if the user can't move an order from one status to the other
+func (m *Machine) Check(from domain.OrderStatus, to domain.OrderStatus, claims domain.Claims) error {
+	for _, t := range m.transitions {
+		if t.From != from || t.To != to {
+			continue
+		}
+		if !t.allows(claims) {
+			return ErrForbidden
+		}
+		return nil
+	}
+	return &InvalidTransitionError{From: from, To: to, Allowed: m.Allowed(from, claims)}
+}
+
+// Apply checks the transition, runs the before hooks and saves the new status and history entry.
+// The hooks only run once the store holds the order in its status, so a request moving it at the
+// same time fails before changing anything in QB. Call RunAfter once the response has been written.
+func (m *Machine) Apply(ctx context.Context, store Store, c *Change) error {
+	c.From = c.Order.Status
+	if err := m.Check(c.From, c.To, c.Claims); err != nil {
+		return err
+	}
+	err := store.TransitionOrder(c.Order.QBCompanyID, c.Order.QBInvoiceID, c.From, func() (domain.OrderEvent, error) {
+		for _, h := range m.before[c.To] {
+			if err := h(ctx, c); err != nil {
+				return domain.OrderEvent{}, err
+			}
+		}
+		return c.Event(), nil
+	})
+	if err != nil {
+		return err
+	}
+	c.Order.Status = c.To
+	return nil
+}
+
+// RunAfter runs the after hooks for an applied change
+func (m *Machine) RunAfter(ctx context.Context, c *Change) {
+	for _, h := range m.after[c.To] {
+		if err := h(ctx, c); err != nil {
+			log.Error().Err(err).Str("invoice_id", c.Order.QBInvoiceID).Msgf("order %s hook failed", c.To)
+		}
+	}
+}
+
+// allows reports whether the user may trigger the transition
+func (t Transition) allows(claims domain.Claims) bool {
+	role := RoleOf(claims)
+	if !hasRole(t.Roles, role) {
+		return false
+	}
+	if role == Franchisee {
+		return claims.Can(domain.PlaceOrders)
+	}
+	return t.Permission == "" || claims.Can(t.Permission)
+}
+
+func hasRole(roles []Role, role Role) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
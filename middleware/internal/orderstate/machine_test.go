@@ -0,0 +1,152 @@
+package orderstate
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/Vertisphere/backend-service/internal/domain"
+)
+
+var (
+	owner    = domain.Claims{QBCompanyID: "1001", QBCustomerID: "0", IsFranchiser: true, FirebaseID: "owner", Role: domain.RoleOwner}
+	approver = domain.Claims{QBCompanyID: "1001", QBCustomerID: "0", IsFranchiser: true, FirebaseID: "approver", Role: domain.RoleApprover}
+	viewer   = domain.Claims{QBCompanyID: "1001", QBCustomerID: "0", IsFranchiser: true, FirebaseID: "viewer", Role: domain.RoleViewer}
+	orderer  = domain.Claims{QBCompanyID: "1001", QBCustomerID: "58", FirebaseID: "orderer", Role: domain.RoleOrderer}
+	looker   = domain.Claims{QBCompanyID: "1001", QBCustomerID: "58", FirebaseID: "looker", Role: domain.RoleViewer}
+)
+
+var errStatusChanged = errors.New("status changed")
+
+// store holds an order in memory. steps records the order things happened in.
+type store struct {
+	status domain.OrderStatus
+	events []domain.OrderEvent
+	steps  *[]string
+}
+
+func (s *store) TransitionOrder(companyID string, invoiceID string, from domain.OrderStatus, apply func() (domain.OrderEvent, error)) error {
+	*s.steps = append(*s.steps, "lock")
+	if s.status != from {
+		return errStatusChanged
+	}
+	event, err := apply()
+	if err != nil {
+		return err
+	}
+	*s.steps = append(*s.steps, "save")
+	s.status = event.ToStatus
+	s.events = append(s.events, event)
+	return nil
+}
+
+func TestAllowed(t *testing.T) {
+	m := New(Transitions)
+	tests := []struct {
+		name   string
+		from   domain.OrderStatus
+		claims domain.Claims
+		want   []domain.OrderStatus
+	}{
+		{"orderer with a draft", domain.OrderDraft, orderer, []domain.OrderStatus{domain.OrderPending, domain.OrderVoid}},
+		{"orderer with a pending order", domain.OrderPending, orderer, []domain.OrderStatus{domain.OrderDraft, domain.OrderVoid}},
+		{"location viewer with a draft", domain.OrderDraft, looker, []domain.OrderStatus{}},
+		{"owner with a pending order", domain.OrderPending, owner, []domain.OrderStatus{domain.OrderDraft, domain.OrderRevision, domain.OrderApproved, domain.OrderVoid}},
+		{"approver with an order in revision", domain.OrderRevision, approver, []domain.OrderStatus{domain.OrderVoid}},
+		{"viewer with a pending order", domain.OrderPending, viewer, []domain.OrderStatus{}},
+		{"approver with an approved order", domain.OrderApproved, approver, []domain.OrderStatus{}},
+		{"owner with an approved order", domain.OrderApproved, owner, []domain.OrderStatus{domain.OrderComplete}},
+		{"owner with a void order", domain.OrderVoid, owner, []domain.OrderStatus{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := m.Allowed(tt.from, tt.claims); !slices.Equal(got, tt.want) {
+				t.Errorf("Allowed = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	m := New(Transitions)
+	if err := m.Check(domain.OrderPending, domain.OrderApproved, approver); err != nil {
+		t.Errorf("approver approving: %v", err)
+	}
+	if err := m.Check(domain.OrderPending, domain.OrderApproved, viewer); !errors.Is(err, ErrForbidden) {
+		t.Errorf("viewer approving: err = %v, want ErrForbidden", err)
+	}
+	if err := m.Check(domain.OrderPending, domain.OrderApproved, orderer); !errors.Is(err, ErrForbidden) {
+		t.Errorf("franchisee approving: err = %v, want ErrForbidden", err)
+	}
+
+	err := m.Check(domain.OrderComplete, domain.OrderDraft, orderer)
+	var invalid *InvalidTransitionError
+	if !errors.As(err, &invalid) {
+		t.Fatalf("complete to draft: err = %v, want an InvalidTransitionError", err)
+	}
+	if invalid.From != domain.OrderComplete || invalid.To != domain.OrderDraft || len(invalid.Allowed) != 0 {
+		t.Errorf("got %+v", invalid)
+	}
+	err = m.Check(domain.OrderDraft, domain.OrderApproved, orderer)
+	if !errors.As(err, &invalid) || !slices.Equal(invalid.Allowed, []domain.OrderStatus{domain.OrderPending, domain.OrderVoid}) {
+		t.Errorf("draft to approved: err = %v, want the statuses the orderer can move a draft to", err)
+	}
+}
+
+func TestApply(t *testing.T) {
+	errHook := errors.New("qb is down")
+	tests := []struct {
+		name      string
+		stored    domain.OrderStatus
+		claims    domain.Claims
+		hookErr   error
+		err       error
+		steps     []string
+		wantSaved bool
+	}{
+		{"hooks run once the order is held", domain.OrderPending, orderer, nil, nil, []string{"lock", "before", "save"}, true},
+		{"moved by another request", domain.OrderDraft, orderer, nil, errStatusChanged, []string{"lock"}, false},
+		{"hook fails", domain.OrderPending, orderer, errHook, errHook, []string{"lock", "before"}, false},
+		{"not allowed", domain.OrderPending, looker, nil, ErrForbidden, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var steps []string
+			m := New(Transitions)
+			m.Before(domain.OrderVoid, func(ctx context.Context, c *Change) error {
+				steps = append(steps, "before")
+				c.Reason = "voided by hook"
+				return tt.hookErr
+			})
+			s := &store{status: tt.stored, steps: &steps}
+			c := &Change{
+				Order:  domain.Order{QBCompanyID: "1001", QBInvoiceID: "130", Status: domain.OrderPending},
+				Claims: tt.claims,
+				To:     domain.OrderVoid,
+			}
+
+			err := m.Apply(context.Background(), s, c)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if !slices.Equal(steps, tt.steps) {
+				t.Errorf("steps = %v, want %v", steps, tt.steps)
+			}
+			if !tt.wantSaved {
+				if len(s.events) > 0 || c.Order.Status != domain.OrderPending {
+					t.Errorf("saved %+v, order %+v", s.events, c.Order)
+				}
+				return
+			}
+			if c.Order.Status != domain.OrderVoid || s.status != domain.OrderVoid {
+				t.Errorf("order status = %s, stored %s, want void", c.Order.Status, s.status)
+			}
+			e := s.events[0]
+			// The event is taken after the hooks so it has what they filled in
+			if e.FromStatus != domain.OrderPending || e.ToStatus != domain.OrderVoid || e.ActorFirebaseID != "orderer" || e.ActorRole != string(Franchisee) || e.Reason != "voided by hook" {
+				t.Errorf("saved event %+v", e)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+// Package pricing works out what each franchisee pays for QuickBooks items and which items they can
+// order, from the price lists the franchiser keeps in Postgres.
+package pricing
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	qb "github.com/Vertisphere/backend-service/external/quickbooks"
+	"github.com/Vertisphere/backend-service/internal/domain"
+)
+
+// Store loads price lists and quantity rules. Implemented by storage.SQLStorage.
+type Store interface {
+	ListPriceLists(companyID string) ([]domain.PriceList, error)
+	ListQuantityRules(companyID string) ([]domain.QuantityRule, error)
+}
+
+// Catalog is what one customer can order and at what price.
+//
+// The price lists that apply to the customer on the day are searched from most to least specific:
+// lists for the customer, then lists for its QuickBooks customer type, newest first within each. The
+// first list with an entry for an item decides whether it's hidden and its price, items without a
+// UnitPrice on that entry keep their QuickBooks price. Items no list mentions can be ordered at their
+// QuickBooks price unless one of the lists is restricted.
+type Catalog struct {
+	lists      []domain.PriceList
+	restricted bool
+	customerID string
+	// rules is the quantity rule of each item for the customer
+	rules map[string]domain.QuantityRule
+}
+
+// ForCustomer loads the catalog of a QuickBooks customer
+func ForCustomer(s Store, companyID string, customer *qb.Customer, on time.Time) (*Catalog, error) {
+	lists, err := s.ListPriceLists(companyID)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := s.ListQuantityRules(companyID)
+	if err != nil {
+		return nil, err
+	}
+	return NewCatalog(lists, customer.Id, customer.CustomerTypeRef.Value, on).WithQuantityRules(rules), nil
+}
+
+// NewCatalog picks the lists that apply to the customer on the day
+func NewCatalog(lists []domain.PriceList, customerID string, customerTypeID string, on time.Time) *Catalog {
+	c := &Catalog{customerID: customerID}
+	for _, l := range lists {
+		forCustomer := l.QBCustomerID != "" && l.QBCustomerID == customerID
+		forType := l.QBCustomerTypeID != "" && l.QBCustomerTypeID == customerTypeID
+		if !forCustomer && !forType || !Effective(l, on) {
+			continue
+		}
+		c.lists = append(c.lists, l)
+		c.restricted = c.restricted || l.Restricted
+	}
+	sort.SliceStable(c.lists, func(i, j int) bool {
+		a, b := c.lists[i], c.lists[j]
+		if (a.QBCustomerID != "") != (b.QBCustomerID != "") {
+			return a.QBCustomerID != ""
+		}
+		if !from(a).Equal(from(b)) {
+			return from(a).After(from(b))
+		}
+		return a.ID > b.ID
+	})
+	return c
+}
+
+// Effective reports whether the price list applies on the day
+func Effective(l domain.PriceList, on time.Time) bool {
+	if l.EffectiveFrom != nil && on.Before(*l.EffectiveFrom) {
+		return false
+	}
+	if l.EffectiveTo != nil && !on.Before(*l.EffectiveTo) {
+		return false
+	}
+	return true
+}
+
+func from(l domain.PriceList) time.Time {
+	if l.EffectiveFrom == nil {
+		return time.Time{}
+	}
+	return *l.EffectiveFrom
+}
+
+// entry returns the entry that decides an item
+func (c *Catalog) entry(itemID string) (domain.PriceListItem, bool) {
+	for _, l := range c.lists {
+		for _, item := range l.Items {
+			if item.QBItemID == itemID {
+				return item, true
+			}
+		}
+	}
+	return domain.PriceListItem{}, false
+}
+
+// Orderable reports whether the customer can order the item
+func (c *Catalog) Orderable(itemID string) bool {
+	entry, ok := c.entry(itemID)
+	if !ok {
+		return !c.restricted
+	}
+	return !entry.Hidden
+}
+
+// UnitPrice returns what the customer pays for one of the item
+func (c *Catalog) UnitPrice(item qb.Item) json.Number {
+	if entry, ok := c.entry(item.Id); ok && entry.UnitPrice != "" {
+		return entry.UnitPrice
+	}
+	return item.UnitPrice
+}
+
+// Restricted reports whether the customer can only order the items on their price lists
+func (c *Catalog) Restricted() bool {
+	return c.restricted
+}
+
+// Listed returns the items the customer can order from their lists. Only useful if the catalog is
+// restricted, otherwise items that aren't listed can be ordered too.
+func (c *Catalog) Listed() []string {
+	seen := map[string]bool{}
+	var ids []string
+	for _, l := range c.lists {
+		for _, item := range l.Items {
+			if seen[item.QBItemID] {
+				continue
+			}
+			seen[item.QBItemID] = true
+			if c.Orderable(item.QBItemID) {
+				ids = append(ids, item.QBItemID)
+			}
+		}
+	}
+	return ids
+}
+
+// Apply drops the items the customer can't order and sets the customer's prices on the rest
+func (c *Catalog) Apply(items []qb.Item) []qb.Item {
+	priced := make([]qb.Item, 0, len(items))
+	for _, item := range items {
+		if !c.Orderable(item.Id) {
+			continue
+		}
+		item.UnitPrice = c.UnitPrice(item)
+		priced = append(priced, item)
+	}
+	return priced
+}
@@ -0,0 +1,82 @@
+package pricing
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+
+	qb "github.com/Vertisphere/backend-service/external/quickbooks"
+	"github.com/Vertisphere/backend-service/internal/domain"
+)
+
+func date(s string) *time.Time {
+	t, err := time.Parse(time.DateOnly, s)
+	if err != nil {
+		panic(err)
+	}
+	return &t
+}
+
+func TestCatalog(t *testing.T) {
+	lists := []domain.PriceList{
+		{ID: 1, QBCustomerTypeID: "wholesale", Items: []domain.PriceListItem{
+			{QBItemID: "bagel", UnitPrice: "1.10"},
+			{QBItemID: "coffee", UnitPrice: "9.00"},
+			{QBItemID: "secret", Hidden: true},
+		}},
+		{ID: 2, QBCustomerID: "7", Items: []domain.PriceListItem{
+			{QBItemID: "bagel", UnitPrice: "0.95"},
+			{QBItemID: "secret"},
+		}},
+		{ID: 3, QBCustomerTypeID: "wholesale", EffectiveFrom: date("2025-12-01"), EffectiveTo: date("2026-01-01"), Items: []domain.PriceListItem{
+			{QBItemID: "coffee", UnitPrice: "7.50"},
+		}},
+		{ID: 4, QBCustomerID: "8", Restricted: true, Items: []domain.PriceListItem{
+			{QBItemID: "bagel"},
+			{QBItemID: "coffee", Hidden: true},
+		}},
+	}
+	items := []qb.Item{
+		{Id: "bagel", UnitPrice: "1.25"},
+		{Id: "coffee", UnitPrice: "10"},
+		{Id: "secret", UnitPrice: "5"},
+		{Id: "muffin", UnitPrice: "2"},
+	}
+
+	tests := []struct {
+		name         string
+		customerID   string
+		customerType string
+		on           time.Time
+		want         map[string]json.Number
+	}{
+		{"no lists", "1", "", *date("2025-06-01"), map[string]json.Number{"bagel": "1.25", "coffee": "10", "secret": "5", "muffin": "2"}},
+		{"customer type", "1", "wholesale", *date("2025-06-01"), map[string]json.Number{"bagel": "1.10", "coffee": "9.00", "muffin": "2"}},
+		{"seasonal list", "1", "wholesale", *date("2025-12-24"), map[string]json.Number{"bagel": "1.10", "coffee": "7.50", "muffin": "2"}},
+		{"seasonal list ended", "1", "wholesale", *date("2026-01-01"), map[string]json.Number{"bagel": "1.10", "coffee": "9.00", "muffin": "2"}},
+		{"customer beats type", "7", "wholesale", *date("2025-06-01"), map[string]json.Number{"bagel": "0.95", "coffee": "9.00", "secret": "5", "muffin": "2"}},
+		{"restricted", "8", "", *date("2025-06-01"), map[string]json.Number{"bagel": "1.25"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCatalog(lists, tt.customerID, tt.customerType, tt.on)
+			got := map[string]json.Number{}
+			for _, item := range c.Apply(items) {
+				got[item.Id] = item.UnitPrice
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for id, price := range tt.want {
+				if got[id] != price {
+					t.Errorf("%s costs %s, want %s", id, got[id], price)
+				}
+			}
+		})
+	}
+
+	if listed := NewCatalog(lists, "8", "", *date("2025-06-01")).Listed(); !slices.Equal(listed, []string{"bagel"}) {
+		t.Errorf("restricted catalog lists %v", listed)
+	}
+}
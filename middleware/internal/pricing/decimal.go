@@ -0,0 +1,39 @@
+package pricing
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// ParseDecimal parses a decimal number like "12.50" exactly. Prices and quantities are never floats,
+// 0.1 * 3 has to be 0.3.
+func ParseDecimal(s string) (*big.Rat, error) {
+	s = strings.TrimSpace(s)
+	// big.Rat also takes fractions like 1/3, which aren't prices
+	if strings.Contains(s, "/") {
+		return nil, fmt.Errorf("%q is not a decimal number", s)
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return nil, fmt.Errorf("%q is not a decimal number", s)
+	}
+	return r, nil
+}
+
+// Round rounds r half away from zero to the given number of decimal places
+func Round(r *big.Rat, places int) *big.Rat {
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(places)), nil)
+	scaled := new(big.Rat).Mul(r, new(big.Rat).SetInt(scale))
+	q, rem := new(big.Int).QuoRem(scaled.Num(), scaled.Denom(), new(big.Int))
+	// |rem| / denom >= 1/2
+	if new(big.Int).Mul(new(big.Int).Abs(rem), big.NewInt(2)).Cmp(scaled.Denom()) >= 0 {
+		q.Add(q, big.NewInt(int64(scaled.Sign())))
+	}
+	return new(big.Rat).SetFrac(q, scale)
+}
+
+// FormatCents formats r as an amount of money, e.g. 12.50
+func FormatCents(r *big.Rat) string {
+	return Round(r, 2).FloatString(2)
+}
@@ -0,0 +1,201 @@
+package pricing
+
+import (
+	"encoding/json"
+	"math/big"
+	"strconv"
+	"strings"
+
+	qb "github.com/Vertisphere/backend-service/external/quickbooks"
+)
+
+// OrderLine is an item and how many of it a customer wants
+type OrderLine struct {
+	ItemID string
+	// Quantity is a decimal, e.g. "2" or "1.5"
+	Quantity string
+}
+
+// LineError is a problem with one line of an order
+type LineError struct {
+	// Line is the index of the line in the order
+	Line int
+	// Field is the field of the line that's wrong, item_id or quantity
+	Field   string
+	Message string
+}
+
+// QuoteLine is a line of an order at the customer's price
+type QuoteLine struct {
+	ItemID    string `json:"item_id"`
+	Name      string `json:"name"`
+	Quantity  string `json:"quantity"`
+	UnitPrice string `json:"unit_price"`
+	Amount    string `json:"amount"`
+	TaxCode   string `json:"tax_code"`
+	// Tax is empty if QuickBooks works it out when the invoice is saved
+	Tax string `json:"tax,omitempty"`
+
+	quantity *big.Rat
+}
+
+// Quote is what an order will cost
+type Quote struct {
+	Lines    []QuoteLine `json:"lines"`
+	Subtotal string      `json:"subtotal"`
+	Tax      string      `json:"tax"`
+	Total    string      `json:"total"`
+	// TaxIncomplete is set when QuickBooks works out some of the tax when the invoice is saved, e.g. US
+	// sales tax, so Tax and Total are lower than what will be charged
+	TaxIncomplete bool `json:"tax_incomplete"`
+}
+
+// TaxRates is the combined rate of each tax code in percent. Codes whose rate only QuickBooks knows
+// aren't in it.
+type TaxRates map[string]*big.Rat
+
+// NewTaxRates works out the rate of each of the company's tax codes
+func NewTaxRates(codes []qb.TaxCode, rates []qb.TaxRate) TaxRates {
+	byID := make(map[string]*big.Rat, len(rates))
+	for _, rate := range rates {
+		if value, err := ParseDecimal(rate.RateValue.String()); err == nil {
+			byID[rate.Id] = value
+		}
+	}
+	t := TaxRates{"NON": new(big.Rat)}
+	for _, code := range codes {
+		details := code.SalesTaxRateList.TaxRateDetail
+		if len(details) == 0 {
+			// US TAX has no rates of its own, NON is never taxed
+			if !code.Taxable {
+				t[code.Id] = new(big.Rat)
+			}
+			continue
+		}
+		sum, known := new(big.Rat), true
+		for _, detail := range details {
+			rate, ok := byID[detail.TaxRateRef.Value]
+			// Taxes on taxes depend on the order they're applied in, leave those to QuickBooks
+			if !ok || detail.TaxTypeApplicable == "TaxOnAmountPlusTax" {
+				known = false
+				break
+			}
+			sum.Add(sum, rate)
+		}
+		if known {
+			t[code.Id] = sum
+		}
+	}
+	return t
+}
+
+// Quote prices an order for the customer. items are the order's QuickBooks items by ID, rates the
+// company's tax rates. Lines for items that don't exist or the customer can't order and quantities
+// that aren't numbers or break the item's quantity rule come back as LineErrors.
+func (c *Catalog) Quote(lines []OrderLine, items map[string]qb.Item, rates TaxRates) (Quote, []LineError) {
+	var errs []LineError
+	quote := Quote{Lines: []QuoteLine{}}
+	subtotal, tax := new(big.Rat), new(big.Rat)
+	for i, line := range lines {
+		item, ok := items[line.ItemID]
+		switch {
+		case !ok:
+			errs = append(errs, LineError{Line: i, Field: "item_id", Message: "no such item"})
+			continue
+		case !c.Orderable(item.Id):
+			errs = append(errs, LineError{Line: i, Field: "item_id", Message: "item can't be ordered"})
+			continue
+		}
+		quantity, err := ParseDecimal(line.Quantity)
+		if err != nil {
+			errs = append(errs, LineError{Line: i, Field: "quantity", Message: "not a number"})
+			continue
+		}
+		if problems := c.CheckQuantity(item.Id, quantity); len(problems) > 0 {
+			for _, problem := range problems {
+				errs = append(errs, LineError{Line: i, Field: "quantity", Message: problem})
+			}
+			continue
+		}
+		unitPrice := c.UnitPrice(item)
+		price, err := ParseDecimal(unitPrice.String())
+		if err != nil {
+			errs = append(errs, LineError{Line: i, Field: "item_id", Message: "item has no valid price"})
+			continue
+		}
+
+		amount := Round(new(big.Rat).Mul(price, quantity), 2)
+		subtotal.Add(subtotal, amount)
+		q := QuoteLine{
+			ItemID:    item.Id,
+			Name:      item.Name,
+			Quantity:  formatDecimal(quantity),
+			UnitPrice: unitPrice.String(),
+			Amount:    FormatCents(amount),
+			TaxCode:   taxCode(item),
+			quantity:  quantity,
+		}
+		if rate, ok := rates[q.TaxCode]; ok {
+			lineTax := new(big.Rat).Mul(amount, rate)
+			lineTax.Quo(lineTax, big.NewRat(100, 1))
+			tax.Add(tax, lineTax)
+			q.Tax = FormatCents(lineTax)
+		} else {
+			quote.TaxIncomplete = true
+		}
+		quote.Lines = append(quote.Lines, q)
+	}
+	if len(errs) > 0 {
+		return Quote{}, errs
+	}
+	// Tax is rounded once for the whole order, like QuickBooks does
+	tax = Round(tax, 2)
+	quote.Subtotal = FormatCents(subtotal)
+	quote.Tax = FormatCents(tax)
+	quote.Total = FormatCents(new(big.Rat).Add(subtotal, tax))
+	return quote, nil
+}
+
+// taxCode returns the tax code an item is sold with. US items only say whether they're taxable.
+func taxCode(item qb.Item) string {
+	if item.SalesTaxCodeRef.Value != "" {
+		return item.SalesTaxCodeRef.Value
+	}
+	if item.Taxable {
+		return "TAX"
+	}
+	return "NON"
+}
+
+// InvoiceLines returns the quote as QuickBooks invoice lines
+func (q Quote) InvoiceLines() []qb.Line {
+	lines := make([]qb.Line, len(q.Lines))
+	for i, l := range q.Lines {
+		// QuickBooks takes the quantity as a float, it's only shown there and Amount is already exact
+		qty, _ := l.quantity.Float64()
+		lines[i] = qb.Line{
+			DetailType: "SalesItemLineDetail",
+			Amount:     json.Number(l.Amount),
+			SalesItemLineDetail: qb.SalesItemLineDetail{
+				ItemRef:    qb.ReferenceType{Value: l.ItemID, Name: l.Name},
+				UnitPrice:  json.Number(l.UnitPrice),
+				TaxCodeRef: qb.ReferenceType{Value: l.TaxCode},
+				Qty:        qty,
+			},
+		}
+	}
+	return lines
+}
+
+// formatDecimal formats r without trailing zeros, e.g. 2 or 1.5
+func formatDecimal(r *big.Rat) string {
+	if r.IsInt() {
+		return r.Num().String()
+	}
+	return strings.TrimRight(r.FloatString(6), "0")
+}
+
+// FormatQuantity formats a QuickBooks quantity for an OrderLine
+func FormatQuantity(qty float64) string {
+	return strconv.FormatFloat(qty, 'f', -1, 64)
+}
@@ -0,0 +1,119 @@
+package pricing
+
+import (
+	"math/big"
+	"testing"
+
+	qb "github.com/Vertisphere/backend-service/external/quickbooks"
+	"github.com/Vertisphere/backend-service/internal/domain"
+)
+
+func TestRound(t *testing.T) {
+	tests := map[string]string{
+		"0.125":  "0.13",
+		"0.124":  "0.12",
+		"-0.125": "-0.13",
+		"2":      "2.00",
+		"0.3":    "0.30",
+	}
+	for in, want := range tests {
+		r, err := ParseDecimal(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := FormatCents(r); got != want {
+			t.Errorf("FormatCents(%s) = %s, want %s", in, got, want)
+		}
+	}
+	if _, err := ParseDecimal("1/3"); err == nil {
+		t.Error("fractions should not parse")
+	}
+}
+
+func TestQuote(t *testing.T) {
+	codes := []qb.TaxCode{
+		{Id: "13", Name: "HST ON", Taxable: true, SalesTaxRateList: qb.TaxRateList{TaxRateDetail: []qb.TaxRateDetail{
+			{TaxRateRef: qb.ReferenceType{Value: "1"}, TaxTypeApplicable: "TaxOnAmount"},
+		}}},
+		{Id: "5", Name: "GST/QST", Taxable: true, SalesTaxRateList: qb.TaxRateList{TaxRateDetail: []qb.TaxRateDetail{
+			{TaxRateRef: qb.ReferenceType{Value: "2"}, TaxTypeApplicable: "TaxOnAmount"},
+			{TaxRateRef: qb.ReferenceType{Value: "3"}, TaxTypeApplicable: "TaxOnAmount"},
+		}}},
+		{Id: "TAX", Name: "TAX", Taxable: true},
+	}
+	rates := NewTaxRates(codes, []qb.TaxRate{{Id: "1", RateValue: "13"}, {Id: "2", RateValue: "5"}, {Id: "3", RateValue: "9.975"}})
+	if rates["5"].Cmp(big.NewRat(14975, 1000)) != 0 {
+		t.Errorf("GST/QST rate is %s", rates["5"].FloatString(3))
+	}
+
+	items := map[string]qb.Item{
+		"1": {Id: "1", Name: "Bagel", UnitPrice: "0.10", SalesTaxCodeRef: qb.ReferenceType{Value: "13"}},
+		"2": {Id: "2", Name: "Coffee", UnitPrice: "9.99", SalesTaxCodeRef: qb.ReferenceType{Value: "5"}},
+		"3": {Id: "3", Name: "Napkins", UnitPrice: "1.50"},
+	}
+	c := NewCatalog(nil, "7", "", *date("2025-06-01")).WithQuantityRules([]domain.QuantityRule{
+		{QBItemID: "2", AllowDecimal: true},
+	})
+
+	quote, errs := c.Quote([]OrderLine{{ItemID: "1", Quantity: "3"}, {ItemID: "2", Quantity: "1.5"}, {ItemID: "3", Quantity: "2"}}, items, rates)
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	// 0.30 + 14.99 (14.985 rounded) + 3.00, tax 0.039 + 2.2447...
+	if quote.Subtotal != "18.29" || quote.Tax != "2.28" || quote.Total != "20.57" || quote.TaxIncomplete {
+		t.Errorf("got %+v", quote)
+	}
+	if quote.Lines[1].Quantity != "1.5" || quote.Lines[1].Amount != "14.99" || quote.Lines[2].TaxCode != "NON" {
+		t.Errorf("got lines %+v", quote.Lines)
+	}
+	if lines := quote.InvoiceLines(); lines[1].SalesItemLineDetail.Qty != 1.5 || lines[0].Amount != "0.30" {
+		t.Errorf("got invoice lines %+v", lines)
+	}
+
+	us := map[string]qb.Item{"4": {Id: "4", Name: "Cheese", UnitPrice: "4", Taxable: true}}
+	quote, _ = c.Quote([]OrderLine{{ItemID: "4", Quantity: "1"}}, us, rates)
+	if !quote.TaxIncomplete || quote.Lines[0].Tax != "" {
+		t.Errorf("US sales tax should be left to QuickBooks, got %+v", quote)
+	}
+
+	_, errs = c.Quote([]OrderLine{{ItemID: "9", Quantity: "1"}, {ItemID: "1", Quantity: "a lot"}}, items, rates)
+	if len(errs) != 2 || errs[0].Field != "item_id" || errs[1] != (LineError{Line: 1, Field: "quantity", Message: "not a number"}) {
+		t.Errorf("got errors %+v", errs)
+	}
+}
+
+func TestCheckQuantity(t *testing.T) {
+	c := NewCatalog(nil, "7", "", *date("2025-06-01")).WithQuantityRules([]domain.QuantityRule{
+		{QBItemID: "1", MinQty: "12", PackMultiple: "6", MaxQty: "48"},
+		{QBItemID: "1", QBCustomerID: "7", MinQty: "6", PackMultiple: "6"},
+		{QBItemID: "1", QBCustomerID: "8", MinQty: "100"},
+		{QBItemID: "2", MinQty: "0.5", PackMultiple: "0.25", AllowDecimal: true},
+	})
+	tests := []struct {
+		item string
+		qty  string
+		want int
+	}{
+		{"1", "6", 0},
+		// customer 7's own rule replaces the max of the rule for everyone
+		{"1", "120", 0},
+		{"1", "8", 1},
+		{"1", "1.5", 3},
+		{"2", "0.75", 0},
+		{"2", "0.3", 2},
+		// items without a rule take any positive whole quantity
+		{"3", "1", 0},
+		{"3", "0", 1},
+		{"3", "-2", 1},
+		{"3", "2.5", 1},
+	}
+	for _, tt := range tests {
+		qty, err := ParseDecimal(tt.qty)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.CheckQuantity(tt.item, qty); len(got) != tt.want {
+			t.Errorf("CheckQuantity(%s, %s) = %q, want %d problems", tt.item, tt.qty, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package pricing
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+
+	"github.com/Vertisphere/backend-service/internal/domain"
+)
+
+// WithQuantityRules sets the rules the customer's quantities are checked against. The customer's own rule
+// for an item replaces the rule for everyone.
+func (c *Catalog) WithQuantityRules(rules []domain.QuantityRule) *Catalog {
+	c.rules = make(map[string]domain.QuantityRule, len(rules))
+	for _, rule := range rules {
+		switch rule.QBCustomerID {
+		case c.customerID:
+			c.rules[rule.QBItemID] = rule
+		case "":
+			if _, ok := c.rules[rule.QBItemID]; !ok {
+				c.rules[rule.QBItemID] = rule
+			}
+		}
+	}
+	return c
+}
+
+// QuantityRule returns the rule for an item. Items without one can be ordered in any positive whole quantity.
+func (c *Catalog) QuantityRule(itemID string) domain.QuantityRule {
+	if rule, ok := c.rules[itemID]; ok {
+		return rule
+	}
+	return domain.QuantityRule{QBItemID: itemID}
+}
+
+// CheckQuantity returns everything that's wrong with ordering qty of the item, nothing if it can be ordered
+func (c *Catalog) CheckQuantity(itemID string, qty *big.Rat) []string {
+	rule := c.QuantityRule(itemID)
+	var problems []string
+	if qty.Sign() <= 0 {
+		return []string{"must be more than 0"}
+	}
+	if !rule.AllowDecimal && !qty.IsInt() {
+		problems = append(problems, "must be a whole number")
+	}
+	if min, ok := ruleLimit(rule.MinQty); ok && qty.Cmp(min) < 0 {
+		problems = append(problems, fmt.Sprintf("must be at least %s", formatDecimal(min)))
+	}
+	if multiple, ok := ruleLimit(rule.PackMultiple); ok && !new(big.Rat).Quo(qty, multiple).IsInt() {
+		problems = append(problems, fmt.Sprintf("must be a multiple of %s", formatDecimal(multiple)))
+	}
+	if max, ok := ruleLimit(rule.MaxQty); ok && qty.Cmp(max) > 0 {
+		problems = append(problems, fmt.Sprintf("must be at most %s", formatDecimal(max)))
+	}
+	return problems
+}
+
+// ruleLimit parses a limit of a rule, ok is false if it isn't set
+func ruleLimit(n json.Number) (*big.Rat, bool) {
+	if n.String() == "" {
+		return nil, false
+	}
+	r, err := ParseDecimal(n.String())
+	if err != nil || r.Sign() <= 0 {
+		return nil, false
+	}
+	return r, true
+}
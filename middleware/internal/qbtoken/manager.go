@@ -0,0 +1,196 @@
+// Package qbtoken hands out QuickBooks access tokens per company. Tokens live in the company table
+// and are refreshed with the company's refresh token shortly before they expire, so handlers never
+// have to deal with an expired token or keep one in the user's JWT.
+package qbtoken
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	qb "github.com/Vertisphere/backend-service/external/quickbooks"
+	"github.com/Vertisphere/backend-service/internal/domain"
+)
+
+// RefreshMargin is how long before expiry a token gets refreshed
+const RefreshMargin = 5 * time.Minute
+
+// ErrNotConnected is returned when the company has no QuickBooks tokens, or its refresh token
+// expired and the franchiser has to log in to QuickBooks again.
+var ErrNotConnected = errors.New("company is not connected to quickbooks")
+
+// Store loads and saves a company's tokens
+type Store interface {
+	GetCompany(companyID string) (domain.Company, error)
+	UpdateTokenForCompany(companyId string, bearerToken string, bearerExpiresIn int64, refreshToken string, refreshExpiresIn int64) error
+	ClearTokensForCompany(companyId string) error
+	ExpireBearerToken(companyId string, bearerToken string) error
+}
+
+// Refresher exchanges a refresh token for new tokens, or revokes it. Implemented by *qb.Client.
+type Refresher interface {
+	RefreshToken(ctx context.Context, refreshToken string) (*qb.BearerToken, error)
+	RevokeToken(ctx context.Context, refreshToken string) error
+}
+
+type token struct {
+	accessToken string
+	expiry      time.Time
+}
+
+// Manager caches access tokens in memory and refreshes them when they're about to expire.
+// Refreshes are serialized per company so concurrent requests only refresh once.
+type Manager struct {
+	store     Store
+	refresher Refresher
+	now       func() time.Time
+
+	mu     sync.Mutex
+	tokens map[string]token
+	locks  map[string]*sync.Mutex
+}
+
+func NewManager(store Store, refresher Refresher) *Manager {
+	return &Manager{
+		store:     store,
+		refresher: refresher,
+		now:       time.Now,
+		tokens:    map[string]token{},
+		locks:     map[string]*sync.Mutex{},
+	}
+}
+
+// Token returns a valid access token for the company, refreshing it if needed
+func (m *Manager) Token(ctx context.Context, companyID string) (string, error) {
+	if t, ok := m.cached(companyID); ok {
+		return t.accessToken, nil
+	}
+
+	lock := m.lock(companyID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Another request may have refreshed while we were waiting
+	if t, ok := m.cached(companyID); ok {
+		return t.accessToken, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	company, err := m.store.GetCompany(companyID)
+	if err != nil {
+		return "", fmt.Errorf("could not get tokens for company %s: %w", companyID, err)
+	}
+	if company.QBRefreshToken == "" {
+		return "", ErrNotConnected
+	}
+	// The DB copy may be fresher than ours, e.g. after a login or a refresh by another instance
+	if company.QBBearerToken != "" && m.fresh(company.QBBearerTokenExpiry) {
+		m.remember(companyID, token{accessToken: company.QBBearerToken, expiry: company.QBBearerTokenExpiry})
+		return company.QBBearerToken, nil
+	}
+	if !company.QBRefreshTokenExpiry.IsZero() && !m.now().Before(company.QBRefreshTokenExpiry) {
+		return "", ErrNotConnected
+	}
+
+	// Intuit may rotate the refresh token, so finish the refresh and save it even if the request goes away
+	bearerToken, err := m.refresher.RefreshToken(context.WithoutCancel(ctx), company.QBRefreshToken)
+	if err != nil {
+		return "", fmt.Errorf("could not refresh token for company %s: %w", companyID, err)
+	}
+	err = m.store.UpdateTokenForCompany(companyID, bearerToken.AccessToken, bearerToken.ExpiresIn, bearerToken.RefreshToken, bearerToken.XRefreshTokenExpiresIn)
+	if err != nil {
+		return "", fmt.Errorf("could not save refreshed token for company %s: %w", companyID, err)
+	}
+	m.remember(companyID, token{
+		accessToken: bearerToken.AccessToken,
+		expiry:      m.now().Add(time.Duration(bearerToken.ExpiresIn) * time.Second),
+	})
+	return bearerToken.AccessToken, nil
+}
+
+// Forget drops the cached token for the company, so the next call to Token reads the DB again.
+// Call it after writing new tokens for the company outside the manager, e.g. on login.
+func (m *Manager) Forget(companyID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.tokens, companyID)
+}
+
+// Disconnect revokes the company's refresh token, and with it its access tokens, and clears them
+// from the DB. Token returns ErrNotConnected until the franchiser logs in to QuickBooks again.
+func (m *Manager) Disconnect(ctx context.Context, companyID string) error {
+	lock := m.lock(companyID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	company, err := m.store.GetCompany(companyID)
+	if err != nil {
+		return fmt.Errorf("could not get tokens for company %s: %w", companyID, err)
+	}
+	// An expired refresh token can't be used anymore and Intuit won't revoke it. Rows saved before the
+	// expiry was stored have none, their token may still work.
+	refreshExpired := !company.QBRefreshTokenExpiry.IsZero() && !m.now().Before(company.QBRefreshTokenExpiry)
+	if company.QBRefreshToken != "" && !refreshExpired {
+		if err := m.refresher.RevokeToken(ctx, company.QBRefreshToken); err != nil {
+			return fmt.Errorf("could not revoke token for company %s: %w", companyID, err)
+		}
+	}
+	if err := m.store.ClearTokensForCompany(companyID); err != nil {
+		return fmt.Errorf("could not clear tokens for company %s: %w", companyID, err)
+	}
+	// Other instances keep their cached access token until it expires, but Intuit no longer takes it
+	m.Forget(companyID)
+	return nil
+}
+
+// Expire drops an access token QuickBooks rejected, e.g. because the connection was revoked in
+// QuickBooks, so the next call to Token refreshes it instead of handing it out until it would have
+// expired. Tokens that were already replaced are left alone. Set it as the qb.Client's OnAuthExpired.
+func (m *Manager) Expire(companyID string, accessToken string) error {
+	m.mu.Lock()
+	if t, ok := m.tokens[companyID]; ok && t.accessToken == accessToken {
+		delete(m.tokens, companyID)
+	}
+	m.mu.Unlock()
+	// Token would take it from the DB again otherwise
+	if err := m.store.ExpireBearerToken(companyID, accessToken); err != nil {
+		return fmt.Errorf("could not expire token for company %s: %w", companyID, err)
+	}
+	return nil
+}
+
+func (m *Manager) cached(companyID string) (token, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tokens[companyID]
+	if !ok || !m.fresh(t.expiry) {
+		return token{}, false
+	}
+	return t, true
+}
+
+func (m *Manager) remember(companyID string, t token) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokens[companyID] = t
+}
+
+func (m *Manager) lock(companyID string) *sync.Mutex {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lock, ok := m.locks[companyID]
+	if !ok {
+		lock = &sync.Mutex{}
+		m.locks[companyID] = lock
+	}
+	return lock
+}
+
+// fresh is true if a token expiring at expiry doesn't need a refresh yet
+func (m *Manager) fresh(expiry time.Time) bool {
+	return m.now().Add(RefreshMargin).Before(expiry)
+}
@@ -0,0 +1,264 @@
+package qbtoken
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	qb "github.com/Vertisphere/backend-service/external/quickbooks"
+	"github.com/Vertisphere/backend-service/internal/domain"
+)
+
+var now = time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+// store keeps companies in memory and records what was done to them in steps
+type store struct {
+	mu        sync.Mutex
+	companies map[string]domain.Company
+	steps     []string
+}
+
+func (s *store) GetCompany(companyID string) (domain.Company, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.companies[companyID], nil
+}
+
+func (s *store) UpdateTokenForCompany(companyID string, bearerToken string, bearerExpiresIn int64, refreshToken string, refreshExpiresIn int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.companies[companyID]
+	c.QBBearerToken = bearerToken
+	c.QBBearerTokenExpiry = now.Add(time.Duration(bearerExpiresIn) * time.Second)
+	c.QBRefreshToken = refreshToken
+	c.QBRefreshTokenExpiry = now.Add(time.Duration(refreshExpiresIn) * time.Second)
+	s.companies[companyID] = c
+	s.steps = append(s.steps, "save")
+	return nil
+}
+
+func (s *store) ClearTokensForCompany(companyID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.companies[companyID] = domain.Company{QBCompanyID: companyID}
+	s.steps = append(s.steps, "clear")
+	return nil
+}
+
+func (s *store) ExpireBearerToken(companyID string, bearerToken string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.companies[companyID]
+	if c.QBBearerToken == bearerToken {
+		c.QBBearerTokenExpiry = now
+		s.companies[companyID] = c
+	}
+	s.steps = append(s.steps, "expire")
+	return nil
+}
+
+func (s *store) step(step string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.steps = append(s.steps, step)
+}
+
+// refresher hands out new tokens after a while, counting the refreshes
+type refresher struct {
+	store     *store
+	delay     time.Duration
+	refreshes atomic.Int64
+	// ctxErr is the refresh context's error once the refresh is done
+	ctxErr  error
+	revoked []string
+}
+
+func (r *refresher) RefreshToken(ctx context.Context, refreshToken string) (*qb.BearerToken, error) {
+	n := r.refreshes.Add(1)
+	time.Sleep(r.delay)
+	r.ctxErr = ctx.Err()
+	return &qb.BearerToken{
+		AccessToken:            "access-" + string(rune('0'+n)),
+		ExpiresIn:              3600,
+		RefreshToken:           refreshToken + "-rotated",
+		XRefreshTokenExpiresIn: 86400,
+	}, nil
+}
+
+func (r *refresher) RevokeToken(ctx context.Context, refreshToken string) error {
+	r.store.step("revoke")
+	r.revoked = append(r.revoked, refreshToken)
+	return nil
+}
+
+func newTestManager(companies ...domain.Company) (*Manager, *store, *refresher) {
+	s := &store{companies: map[string]domain.Company{}}
+	for _, c := range companies {
+		s.companies[c.QBCompanyID] = c
+	}
+	r := &refresher{store: s}
+	m := NewManager(s, r)
+	m.now = func() time.Time { return now }
+	return m, s, r
+}
+
+// expired is a company whose access token expired but whose refresh token is still good
+func expired(companyID string) domain.Company {
+	return domain.Company{
+		QBCompanyID:          companyID,
+		QBBearerToken:        "stale",
+		QBBearerTokenExpiry:  now.Add(-time.Minute),
+		QBRefreshToken:       "refresh",
+		QBRefreshTokenExpiry: now.Add(24 * time.Hour),
+	}
+}
+
+func TestTokenRefreshesOnceForConcurrentCalls(t *testing.T) {
+	m, _, r := newTestManager(expired("1001"))
+	r.delay = 50 * time.Millisecond
+
+	var wg sync.WaitGroup
+	tokens := make([]string, 20)
+	for i := range tokens {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := m.Token(context.Background(), "1001")
+			if err != nil {
+				t.Error(err)
+			}
+			tokens[i] = token
+		}()
+	}
+	wg.Wait()
+
+	if n := r.refreshes.Load(); n != 1 {
+		t.Errorf("refreshed %d times, want once", n)
+	}
+	for _, token := range tokens {
+		if token != "access-1" {
+			t.Errorf("token = %q, want the refreshed one", token)
+		}
+	}
+}
+
+func TestTokenRefreshesExpiredToken(t *testing.T) {
+	m, s, r := newTestManager(expired("1001"))
+
+	token, err := m.Token(context.Background(), "1001")
+	if err != nil || token != "access-1" {
+		t.Fatalf("Token = %q, %v", token, err)
+	}
+	saved := s.companies["1001"]
+	if saved.QBBearerToken != "access-1" || saved.QBRefreshToken != "refresh-rotated" {
+		t.Errorf("saved %+v, want the refreshed and rotated tokens", saved)
+	}
+
+	// The refreshed token is cached and the one in the DB is fresh
+	if token, err := m.Token(context.Background(), "1001"); err != nil || token != "access-1" {
+		t.Errorf("second Token = %q, %v", token, err)
+	}
+	if n := r.refreshes.Load(); n != 1 {
+		t.Errorf("refreshed %d times, want once", n)
+	}
+}
+
+func TestTokenFinishesRefreshAfterCancel(t *testing.T) {
+	m, s, r := newTestManager(expired("1001"))
+	r.delay = 50 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	if _, err := m.Token(ctx, "1001"); err != nil {
+		t.Fatal(err)
+	}
+	// Intuit may have rotated the refresh token, so it has to be saved
+	if r.ctxErr != nil {
+		t.Errorf("refresh context = %v, want it not canceled with the request", r.ctxErr)
+	}
+	if s.companies["1001"].QBRefreshToken != "refresh-rotated" {
+		t.Errorf("rotated refresh token wasn't saved")
+	}
+}
+
+func TestTokenNotConnected(t *testing.T) {
+	noRefreshToken := domain.Company{QBCompanyID: "1001"}
+	refreshExpired := expired("1002")
+	refreshExpired.QBRefreshTokenExpiry = now.Add(-time.Hour)
+	m, _, r := newTestManager(noRefreshToken, refreshExpired)
+
+	for _, companyID := range []string{"1001", "1002"} {
+		if _, err := m.Token(context.Background(), companyID); !errors.Is(err, ErrNotConnected) {
+			t.Errorf("company %s: err = %v, want ErrNotConnected", companyID, err)
+		}
+	}
+	if n := r.refreshes.Load(); n != 0 {
+		t.Errorf("refreshed %d times, want no refresh", n)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	m, s, r := newTestManager(expired("1001"))
+	if _, err := m.Token(context.Background(), "1001"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Disconnect(context.Background(), "1001"); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"save", "revoke", "clear"}; !slices.Equal(s.steps, want) {
+		t.Errorf("steps = %v, want %v", s.steps, want)
+	}
+	if !slices.Equal(r.revoked, []string{"refresh-rotated"}) {
+		t.Errorf("revoked %v, want the current refresh token", r.revoked)
+	}
+	// The cached access token went with the DB ones
+	if token, err := m.Token(context.Background(), "1001"); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("Token after Disconnect = %q, %v, want ErrNotConnected", token, err)
+	}
+}
+
+func TestDisconnectWithoutRefreshExpiry(t *testing.T) {
+	// Connected before refresh token expiries were stored
+	company := expired("1001")
+	company.QBRefreshTokenExpiry = time.Time{}
+	m, _, r := newTestManager(company)
+
+	if err := m.Disconnect(context.Background(), "1001"); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(r.revoked, []string{"refresh"}) {
+		t.Errorf("revoked %v, want the stored refresh token", r.revoked)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	m, _, r := newTestManager(expired("1001"))
+	if _, err := m.Token(context.Background(), "1001"); err != nil {
+		t.Fatal(err)
+	}
+
+	// QuickBooks rejected access-1, the next call has to get a new one
+	if err := m.Expire("1001", "access-1"); err != nil {
+		t.Fatal(err)
+	}
+	token, err := m.Token(context.Background(), "1001")
+	if err != nil || token != "access-2" {
+		t.Errorf("Token after Expire = %q, %v, want a refreshed one", token, err)
+	}
+
+	// A token that was already replaced doesn't throw away the current one
+	if err := m.Expire("1001", "access-1"); err != nil {
+		t.Fatal(err)
+	}
+	if token, err := m.Token(context.Background(), "1001"); err != nil || token != "access-2" {
+		t.Errorf("Token after expiring an old token = %q, %v, want access-2", token, err)
+	}
+	if n := r.refreshes.Load(); n != 2 {
+		t.Errorf("refreshed %d times, want twice", n)
+	}
+}
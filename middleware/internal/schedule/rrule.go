@@ -0,0 +1,151 @@
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Recurrence is the subset of an RFC 5545 RRULE that standing orders use: FREQ=DAILY or WEEKLY with
+// INTERVAL, BYDAY, BYHOUR and BYMINUTE, e.g. FREQ=WEEKLY;BYDAY=MO;BYHOUR=6
+type Recurrence struct {
+	Weekly   bool
+	Interval int
+	// Days are the days a weekly rule happens on, the start's day if empty
+	Days []time.Weekday
+	// Hour and Minute are the time of day, the start's if negative
+	Hour   int
+	Minute int
+}
+
+// rruleDays are the two letter days of an RRULE
+var rruleDays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+// ParseRRule parses an RRULE, with or without the RRULE: prefix
+func ParseRRule(rule string) (Recurrence, error) {
+	r := Recurrence{Interval: 1, Hour: -1, Minute: -1}
+	rule = strings.TrimPrefix(strings.TrimSpace(rule), "RRULE:")
+	if rule == "" {
+		return Recurrence{}, fmt.Errorf("empty rule")
+	}
+	freq := false
+	for _, part := range strings.Split(rule, ";") {
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return Recurrence{}, fmt.Errorf("%q is not NAME=VALUE", part)
+		}
+		switch strings.ToUpper(name) {
+		case "FREQ":
+			switch strings.ToUpper(value) {
+			case "WEEKLY":
+				r.Weekly = true
+			case "DAILY":
+			default:
+				return Recurrence{}, fmt.Errorf("FREQ must be DAILY or WEEKLY")
+			}
+			freq = true
+		case "INTERVAL":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > 52 {
+				return Recurrence{}, fmt.Errorf("INTERVAL must be between 1 and 52")
+			}
+			r.Interval = n
+		case "BYDAY":
+			for _, day := range strings.Split(value, ",") {
+				weekday, ok := rruleDays[strings.ToUpper(day)]
+				if !ok {
+					return Recurrence{}, fmt.Errorf("%q is not a day, use MO, TU, ...", day)
+				}
+				r.Days = append(r.Days, weekday)
+			}
+		case "BYHOUR":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 || n > 23 {
+				return Recurrence{}, fmt.Errorf("BYHOUR must be one hour between 0 and 23")
+			}
+			r.Hour = n
+		case "BYMINUTE":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 || n > 59 {
+				return Recurrence{}, fmt.Errorf("BYMINUTE must be one minute between 0 and 59")
+			}
+			r.Minute = n
+		default:
+			return Recurrence{}, fmt.Errorf("%s is not supported", name)
+		}
+	}
+	if !freq {
+		return Recurrence{}, fmt.Errorf("FREQ is required")
+	}
+	if !r.Weekly && len(r.Days) > 0 {
+		return Recurrence{}, fmt.Errorf("BYDAY is only supported with FREQ=WEEKLY")
+	}
+	return r, nil
+}
+
+// Next returns the first occurrence after after. start is the first possible occurrence, its time zone
+// is the one the rule's days and times are in. ok is false if there is none within a year of intervals.
+func (r Recurrence) Next(start time.Time, after time.Time) (next time.Time, ok bool) {
+	loc := start.Location()
+	hour, minute := r.Hour, r.Minute
+	if hour < 0 {
+		hour = start.Hour()
+	}
+	if minute < 0 {
+		minute = start.Minute()
+	}
+	days := r.Days
+	if len(days) == 0 {
+		days = []time.Weekday{start.Weekday()}
+	}
+
+	from := start
+	if after.After(from) {
+		from = after.In(loc)
+	}
+	day := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, loc)
+	for i := 0; i <= 366*r.Interval; i++ {
+		d := day.AddDate(0, 0, i)
+		if !r.on(start, d, days) {
+			continue
+		}
+		t := time.Date(d.Year(), d.Month(), d.Day(), hour, minute, 0, 0, loc)
+		if t.After(after) && !t.Before(start) {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// on reports whether the rule happens on day
+func (r Recurrence) on(start time.Time, day time.Time, days []time.Weekday) bool {
+	elapsed := civilDay(day) - civilDay(start)
+	if !r.Weekly {
+		return elapsed%int64(r.Interval) == 0
+	}
+	// Weeks start on monday, like the RRULE default WKST
+	weeks := (civilDay(day) - mondayOffset(day)) / 7
+	startWeeks := (civilDay(start) - mondayOffset(start)) / 7
+	if (weeks-startWeeks)%int64(r.Interval) != 0 {
+		return false
+	}
+	for _, d := range days {
+		if d == day.Weekday() {
+			return true
+		}
+	}
+	return false
+}
+
+// civilDay numbers the calendar day of t, ignoring its time zone offset
+func civilDay(t time.Time) int64 {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).Unix() / 86400
+}
+
+func mondayOffset(t time.Time) int64 {
+	return int64((t.Weekday() + 6) % 7)
+}
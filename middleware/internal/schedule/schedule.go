@@ -0,0 +1,220 @@
+// Package schedule works out the pickup and delivery slots franchisees can order for from their
+// franchiser's weekly windows, cutoffs and blackout dates.
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Vertisphere/backend-service/internal/domain"
+)
+
+// Horizon is how far ahead slots are offered
+const Horizon = 28 * 24 * time.Hour
+
+const (
+	dateFormat  = "2006-01-02"
+	clockFormat = "15:04"
+)
+
+var (
+	// ErrUnknownSlot is returned for slots that aren't one of the company's windows, fall on a blackout
+	// date or are beyond the horizon
+	ErrUnknownSlot = errors.New("no such slot")
+	// ErrNoSlots is returned when no slot is open within the horizon
+	ErrNoSlots = errors.New("no open slots")
+)
+
+// PastCutoffError is returned when orders for the slot have closed and the company blocks late orders
+type PastCutoffError struct {
+	Slot Slot
+}
+
+func (e *PastCutoffError) Error() string {
+	return fmt.Sprintf("orders for %s closed at %s", e.Slot.ID, e.Slot.Cutoff.Format(time.RFC3339))
+}
+
+// Slot is one occurrence of a window
+type Slot struct {
+	// ID is the date, start and kind, e.g. 2025-06-03T08:00/pickup
+	ID    string `json:"id"`
+	Kind  string `json:"kind"`
+	Date  string `json:"date"`
+	Start string `json:"start"`
+	End   string `json:"end"`
+	// Cutoff is when orders for the slot close
+	Cutoff time.Time `json:"cutoff"`
+	// StartsAt is when the slot starts
+	StartsAt time.Time `json:"starts_at"`
+}
+
+// Enabled reports whether the company takes orders for slots. Companies without windows take orders at any time.
+func Enabled(s domain.OrderSchedule) bool {
+	return len(s.Windows) > 0
+}
+
+// ParseWeekday parses the lowercase English name of a day
+func ParseWeekday(name string) (time.Weekday, error) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.ToLower(d.String()) == name {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("%q is not a day of the week", name)
+}
+
+// ParseClock parses HH:MM into the time since midnight
+func ParseClock(clock string) (time.Duration, error) {
+	t, err := time.Parse(clockFormat, clock)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not HH:MM", clock)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// ParseDate parses a YYYY-MM-DD date
+func ParseDate(date string) (time.Time, error) {
+	return time.Parse(dateFormat, date)
+}
+
+// Upcoming returns the slots that are still open at now and start within the horizon, earliest first
+func Upcoming(s domain.OrderSchedule, now time.Time) ([]Slot, error) {
+	loc, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %q", s.TimeZone)
+	}
+	blackout := make(map[string]bool, len(s.BlackoutDates))
+	for _, date := range s.BlackoutDates {
+		blackout[date] = true
+	}
+
+	local := now.In(loc)
+	today := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+	slots := []Slot{}
+	for day := today; day.Before(now.Add(Horizon)); day = day.AddDate(0, 0, 1) {
+		if blackout[day.Format(dateFormat)] {
+			continue
+		}
+		for _, w := range s.Windows {
+			if weekday, err := ParseWeekday(w.Weekday); err != nil || weekday != day.Weekday() {
+				continue
+			}
+			slot, err := newSlot(w, day)
+			if err != nil {
+				return nil, err
+			}
+			if now.Before(slot.Cutoff) {
+				slots = append(slots, slot)
+			}
+		}
+	}
+	sort.SliceStable(slots, func(i, j int) bool {
+		return slots[i].StartsAt.Before(slots[j].StartsAt)
+	})
+	return slots, nil
+}
+
+// Choose picks the slot an order published at now goes into. Without an id it's the first open slot,
+// an id that's still open has to be one Upcoming offers. If orders for the slot have closed it's the next open slot of the same kind when the company allows
+// it, otherwise a *PastCutoffError.
+func Choose(s domain.OrderSchedule, id string, now time.Time) (Slot, error) {
+	open, err := Upcoming(s, now)
+	if err != nil {
+		return Slot{}, err
+	}
+	if id == "" {
+		if len(open) == 0 {
+			return Slot{}, ErrNoSlots
+		}
+		return open[0], nil
+	}
+
+	slot, err := find(s, id)
+	if err != nil {
+		return Slot{}, err
+	}
+	if now.Before(slot.Cutoff) {
+		for _, o := range open {
+			if o.ID == slot.ID {
+				return o, nil
+			}
+		}
+		// Beyond the horizon
+		return Slot{}, ErrUnknownSlot
+	}
+	if s.AfterCutoff != domain.CutoffNextSlot {
+		return Slot{}, &PastCutoffError{Slot: slot}
+	}
+	for _, next := range open {
+		if next.Kind == slot.Kind && next.StartsAt.After(slot.StartsAt) {
+			return next, nil
+		}
+	}
+	return Slot{}, ErrNoSlots
+}
+
+// find returns the slot with the ID whether or not it's still open
+func find(s domain.OrderSchedule, id string) (Slot, error) {
+	when, kind, ok := strings.Cut(id, "/")
+	if !ok {
+		return Slot{}, ErrUnknownSlot
+	}
+	date, start, ok := strings.Cut(when, "T")
+	if !ok {
+		return Slot{}, ErrUnknownSlot
+	}
+	loc, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		return Slot{}, fmt.Errorf("unknown time zone %q", s.TimeZone)
+	}
+	day, err := time.ParseInLocation(dateFormat, date, loc)
+	if err != nil {
+		return Slot{}, ErrUnknownSlot
+	}
+	for _, blackout := range s.BlackoutDates {
+		if blackout == date {
+			return Slot{}, ErrUnknownSlot
+		}
+	}
+	for _, w := range s.Windows {
+		weekday, err := ParseWeekday(w.Weekday)
+		if err != nil || weekday != day.Weekday() || w.Kind != kind || w.Start != start {
+			continue
+		}
+		return newSlot(w, day)
+	}
+	return Slot{}, ErrUnknownSlot
+}
+
+// newSlot returns the occurrence of the window on day, which is midnight in the schedule's time zone
+func newSlot(w domain.OrderWindow, day time.Time) (Slot, error) {
+	start, err := ParseClock(w.Start)
+	if err != nil {
+		return Slot{}, err
+	}
+	cutoffClock := start
+	if w.CutoffTime != "" {
+		if cutoffClock, err = ParseClock(w.CutoffTime); err != nil {
+			return Slot{}, err
+		}
+	}
+	cutoffDay := day.AddDate(0, 0, -w.CutoffDays)
+	date := day.Format(dateFormat)
+	return Slot{
+		ID:       date + "T" + w.Start + "/" + w.Kind,
+		Kind:     w.Kind,
+		Date:     date,
+		Start:    w.Start,
+		End:      w.End,
+		Cutoff:   at(cutoffDay, cutoffClock),
+		StartsAt: at(day, start),
+	}, nil
+}
+
+// at returns the time on day, going by the wall clock so days that change to or from DST work
+func at(day time.Time, clock time.Duration) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), int(clock/time.Hour), int(clock%time.Hour/time.Minute), 0, 0, day.Location())
+}
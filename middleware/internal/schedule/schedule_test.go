@@ -0,0 +1,103 @@
+package schedule
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Vertisphere/backend-service/internal/domain"
+)
+
+func TestChoose(t *testing.T) {
+	toronto, err := time.LoadLocation("America/Toronto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := domain.OrderSchedule{
+		TimeZone:    "America/Toronto",
+		AfterCutoff: domain.CutoffBlock,
+		Windows: []domain.OrderWindow{
+			{Kind: "pickup", Weekday: "tuesday", Start: "08:00", End: "12:00", CutoffDays: 2, CutoffTime: "17:00"},
+			{Kind: "delivery", Weekday: "friday", Start: "06:00", End: "10:00", CutoffDays: 1},
+		},
+		BlackoutDates: []string{"2025-06-10"},
+	}
+	// Saturday 2025-05-31, noon
+	now := time.Date(2025, 5, 31, 12, 0, 0, 0, toronto)
+
+	slot, err := Choose(s, "", now)
+	if err != nil || slot.ID != "2025-06-03T08:00/pickup" {
+		t.Errorf("first open slot = %+v, %v", slot, err)
+	}
+	if want := time.Date(2025, 6, 1, 17, 0, 0, 0, toronto); !slot.Cutoff.Equal(want) {
+		t.Errorf("cutoff = %s, want %s", slot.Cutoff, want)
+	}
+
+	// Sunday after 5pm the tuesday pickup has closed
+	late := time.Date(2025, 6, 1, 18, 0, 0, 0, toronto)
+	_, err = Choose(s, "2025-06-03T08:00/pickup", late)
+	var pastCutoff *PastCutoffError
+	if !errors.As(err, &pastCutoff) {
+		t.Errorf("late order: got %v, want PastCutoffError", err)
+	}
+
+	// Rolled over, skipping the blackout on the 10th
+	s.AfterCutoff = domain.CutoffNextSlot
+	slot, err = Choose(s, "2025-06-03T08:00/pickup", late)
+	if err != nil || slot.ID != "2025-06-17T08:00/pickup" {
+		t.Errorf("rolled slot = %+v, %v", slot, err)
+	}
+
+	// 2025-07-01 is a tuesday past the horizon
+	for _, id := range []string{"2025-06-10T08:00/pickup", "2025-06-04T08:00/pickup", "2025-06-03T09:00/pickup", "2025-07-01T08:00/pickup", "nonsense"} {
+		if _, err := Choose(s, id, now); !errors.Is(err, ErrUnknownSlot) {
+			t.Errorf("Choose(%s) = %v, want ErrUnknownSlot", id, err)
+		}
+	}
+
+	slots, err := Upcoming(s, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 4 weeks of fridays and 3 tuesdays, less the blackout
+	if len(slots) != 7 || slots[1].ID != "2025-06-06T06:00/delivery" {
+		t.Errorf("got %d slots %+v", len(slots), slots)
+	}
+}
+
+func TestRecurrence(t *testing.T) {
+	toronto, err := time.LoadLocation("America/Toronto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Wednesday 2025-03-05 10:00
+	start := time.Date(2025, 3, 5, 10, 0, 0, 0, toronto)
+	tests := []struct {
+		rule  string
+		after time.Time
+		want  time.Time
+	}{
+		{"FREQ=WEEKLY;BYDAY=MO;BYHOUR=6", start, time.Date(2025, 3, 10, 6, 0, 0, 0, toronto)},
+		// the monday after DST starts is still 6am local
+		{"RRULE:FREQ=WEEKLY;BYDAY=MO;BYHOUR=6", time.Date(2025, 3, 10, 7, 0, 0, 0, toronto), time.Date(2025, 3, 17, 6, 0, 0, 0, toronto)},
+		{"FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,TH", time.Date(2025, 3, 7, 0, 0, 0, 0, toronto), time.Date(2025, 3, 17, 10, 0, 0, 0, toronto)},
+		{"FREQ=WEEKLY", start, time.Date(2025, 3, 12, 10, 0, 0, 0, toronto)},
+		{"FREQ=DAILY;INTERVAL=3;BYMINUTE=30", start.Add(time.Hour), time.Date(2025, 3, 8, 10, 30, 0, 0, toronto)},
+		// before the start the first occurrence is the start
+		{"FREQ=DAILY", start.AddDate(0, -1, 0), start},
+	}
+	for _, tt := range tests {
+		r, err := ParseRRule(tt.rule)
+		if err != nil {
+			t.Fatalf("ParseRRule(%s): %v", tt.rule, err)
+		}
+		if got, ok := r.Next(start, tt.after); !ok || !got.Equal(tt.want) {
+			t.Errorf("%s after %s = %s, want %s", tt.rule, tt.after, got, tt.want)
+		}
+	}
+	for _, bad := range []string{"", "FREQ=MONTHLY", "BYDAY=MO", "FREQ=WEEKLY;BYDAY=XX", "FREQ=DAILY;BYDAY=MO", "FREQ=WEEKLY;COUNT=3"} {
+		if _, err := ParseRRule(bad); err == nil {
+			t.Errorf("ParseRRule(%q) should fail", bad)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// Package standing places standing orders: orders a franchisee wants placed again and again on a
+// schedule, e.g. the same bread every monday.
+package standing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Vertisphere/backend-service/internal/domain"
+	"github.com/Vertisphere/backend-service/internal/schedule"
+	"github.com/Vertisphere/backend-service/internal/storage"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	pollInterval = time.Minute
+	dueBatch     = 20
+	placeTimeout = 2 * time.Minute
+	// MissedAfter is how late an occurrence can be placed, e.g. after an outage. Older ones are recorded
+	// as missed rather than placing last week's order.
+	MissedAfter = 24 * time.Hour
+)
+
+// Next returns the standing order's first occurrence after after, nil if there is none
+func Next(o domain.StandingOrder, after time.Time) (*time.Time, error) {
+	rule, err := schedule.ParseRRule(o.RRule)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := time.LoadLocation(o.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %q", o.TimeZone)
+	}
+	next, ok := rule.Next(o.StartsAt.In(loc), after)
+	if !ok {
+		return nil, nil
+	}
+	return &next, nil
+}
+
+// Store is where standing orders are kept. Implemented by storage.SQLStorage.
+type Store interface {
+	DueStandingOrders(now time.Time, limit int) ([]domain.StandingOrder, error)
+	StartStandingOrderRun(o domain.StandingOrder, next *time.Time) (domain.StandingOrderRun, error)
+	FinishStandingOrderRun(run domain.StandingOrderRun) error
+}
+
+// Placer places the order for one occurrence and returns its invoice. published is set if the order
+// was published too. An invoice ID along with an error means the draft was created but publishing failed.
+type Placer func(ctx context.Context, o domain.StandingOrder, occurrence time.Time) (invoiceID string, published bool, err error)
+
+// Scheduler places standing orders when they're due. Every occurrence is taken by one scheduler only,
+// so running one per instance is fine.
+type Scheduler struct {
+	store Store
+	place Placer
+	now   func() time.Time
+}
+
+func NewScheduler(store Store, place Placer) *Scheduler {
+	return &Scheduler{store: store, place: place, now: time.Now}
+}
+
+// Run places due standing orders until ctx is cancelled
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		if s.runDue(ctx) == dueBatch && ctx.Err() == nil {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runDue places a batch of due standing orders, returning how many were due
+func (s *Scheduler) runDue(ctx context.Context) int {
+	due, err := s.store.DueStandingOrders(s.now(), dueBatch)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not get due standing orders")
+		return 0
+	}
+	for _, o := range due {
+		s.run(ctx, o)
+	}
+	return len(due)
+}
+
+// run takes the standing order's next occurrence and places it, unless it was skipped
+func (s *Scheduler) run(ctx context.Context, o domain.StandingOrder) {
+	logger := log.With().Int64("standingOrderID", o.ID).Str("companyID", o.QBCompanyID).Logger()
+	now := s.now()
+	occurrence := *o.NextRunAt
+
+	// After an outage the next occurrence is the first one from now, not one of the ones that were missed
+	after := occurrence
+	if now.After(after) {
+		after = now
+	}
+	next, err := Next(o, after)
+	if err != nil {
+		// The rule was checked when it was saved, so this only happens if it's been edited by hand
+		logger.Error().Err(err).Msg("Could not work out next occurrence of standing order, pausing it")
+	}
+	run, err := s.store.StartStandingOrderRun(o, next)
+	if errors.Is(err, storage.ErrOccurrenceTaken) {
+		return
+	}
+	if err != nil {
+		logger.Error().Err(err).Msg("Could not start standing order run")
+		return
+	}
+	if run.Status != domain.RunPending {
+		logger.Info().Time("occurrence", occurrence).Str("status", string(run.Status)).Msg("Standing order occurrence not placed")
+		return
+	}
+
+	if now.Sub(occurrence) > MissedAfter {
+		run.Status = domain.RunMissed
+	} else {
+		// An occurrence that was taken is finished even if we're shutting down
+		placeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), placeTimeout)
+		invoiceID, published, err := s.place(placeCtx, o, occurrence)
+		cancel()
+		run.QBInvoiceID = invoiceID
+		switch {
+		case err != nil && invoiceID == "":
+			run.Status = domain.RunFailed
+			run.Error = err.Error()
+		case err != nil:
+			run.Status = domain.RunCreated
+			run.Error = "could not publish: " + err.Error()
+		case published:
+			run.Status = domain.RunPublished
+		default:
+			run.Status = domain.RunCreated
+		}
+		if err != nil {
+			logger.Error().Err(err).Time("occurrence", occurrence).Str("invoiceID", invoiceID).Msg("Could not place standing order")
+		}
+	}
+	if err := s.store.FinishStandingOrderRun(run); err != nil {
+		logger.Error().Err(err).Int64("runID", run.ID).Msg("Could not record standing order run")
+	}
+}
@@ -0,0 +1,101 @@
+package standing
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Vertisphere/backend-service/internal/domain"
+	"github.com/Vertisphere/backend-service/internal/storage"
+)
+
+type fakeStore struct {
+	orders  []domain.StandingOrder
+	skipped map[time.Time]bool
+	taken   map[time.Time]bool
+	runs    []domain.StandingOrderRun
+}
+
+func (s *fakeStore) DueStandingOrders(now time.Time, _ int) ([]domain.StandingOrder, error) {
+	var due []domain.StandingOrder
+	for _, o := range s.orders {
+		if o.NextRunAt != nil && !o.NextRunAt.After(now) {
+			due = append(due, o)
+		}
+	}
+	return due, nil
+}
+
+func (s *fakeStore) StartStandingOrderRun(o domain.StandingOrder, next *time.Time) (domain.StandingOrderRun, error) {
+	occurrence := *o.NextRunAt
+	if s.taken[occurrence] {
+		return domain.StandingOrderRun{}, storage.ErrOccurrenceTaken
+	}
+	s.taken[occurrence] = true
+	s.orders[0].NextRunAt = next
+	run := domain.StandingOrderRun{ID: int64(len(s.taken)), Occurrence: occurrence, Status: domain.RunPending}
+	if s.skipped[occurrence] {
+		run.Status = domain.RunSkipped
+	}
+	return run, nil
+}
+
+func (s *fakeStore) FinishStandingOrderRun(run domain.StandingOrderRun) error {
+	s.runs = append(s.runs, run)
+	return nil
+}
+
+func TestSchedulerPlacesSkipsAndMisses(t *testing.T) {
+	utc := func(day int, hour int) time.Time { return time.Date(2025, 6, day, hour, 0, 0, 0, time.UTC) }
+	// Mondays at 6, the 2nd is skipped
+	first := utc(2, 6)
+	store := &fakeStore{
+		orders: []domain.StandingOrder{{
+			ID: 1, RRule: "FREQ=WEEKLY;BYDAY=MO;BYHOUR=6", TimeZone: "UTC", StartsAt: utc(1, 0),
+			AutoPublish: true, NextRunAt: &first,
+		}},
+		skipped: map[time.Time]bool{first: true},
+		taken:   map[time.Time]bool{},
+	}
+	var placed []time.Time
+	publishFails := false
+	s := NewScheduler(store, func(_ context.Context, o domain.StandingOrder, occurrence time.Time) (string, bool, error) {
+		placed = append(placed, occurrence)
+		if publishFails {
+			return "42", false, errors.New("cutoff passed")
+		}
+		return "41", true, nil
+	})
+
+	// The skipped occurrence moves the order on without placing it
+	s.now = func() time.Time { return utc(2, 6) }
+	s.runDue(context.Background())
+	if len(placed) != 0 || !store.orders[0].NextRunAt.Equal(utc(9, 6)) {
+		t.Fatalf("skipped occurrence: placed %v, next %v", placed, store.orders[0].NextRunAt)
+	}
+
+	s.now = func() time.Time { return utc(9, 6).Add(time.Minute) }
+	s.runDue(context.Background())
+	if len(store.runs) != 1 || store.runs[0].Status != domain.RunPublished || store.runs[0].QBInvoiceID != "41" {
+		t.Fatalf("got runs %+v", store.runs)
+	}
+
+	// A draft that couldn't be published is still recorded with its invoice
+	publishFails = true
+	s.now = func() time.Time { return utc(16, 7) }
+	s.runDue(context.Background())
+	if run := store.runs[1]; run.Status != domain.RunCreated || run.QBInvoiceID != "42" || run.Error == "" {
+		t.Fatalf("got run %+v", run)
+	}
+
+	// After an outage the old occurrence is missed and the next one is the first after now
+	s.now = func() time.Time { return utc(25, 12) }
+	s.runDue(context.Background())
+	if run := store.runs[2]; run.Status != domain.RunMissed || len(placed) != 2 {
+		t.Fatalf("got run %+v, placed %v", run, placed)
+	}
+	if !store.orders[0].NextRunAt.Equal(utc(30, 6)) {
+		t.Errorf("next run at %s", store.orders[0].NextRunAt)
+	}
+}
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/Vertisphere/backend-service/internal/domain"
+)
+
+// ErrLastLocationAdmin is returned when a change would leave a location without an admin
+var ErrLastLocationAdmin = errors.New("location needs at least one admin")
+
+// ListCustomerUsers returns the logins of a franchisee location, oldest first
+func (s SQLStorage) ListCustomerUsers(companyID string, customerID string) ([]domain.DBCustomer, error) {
+	query := "SELECT " + customerColumns + " FROM customer WHERE qb_company_id = $1 AND qb_customer_id = $2 ORDER BY created_at"
+	rows, err := s.db.Query(query, companyID, customerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []domain.DBCustomer{}
+	for rows.Next() {
+		u, err := scanCustomer(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// UpdateCustomerUserRole changes the role of one of the location's logins. It returns sql.ErrNoRows if
+// there's no such login and ErrLastLocationAdmin if they're the location's only admin.
+func (s SQLStorage) UpdateCustomerUserRole(companyID string, customerID string, firebaseID string, role domain.Role) (domain.DBCustomer, error) {
+	var u domain.DBCustomer
+	err := s.withLocationAdminCheck(companyID, customerID, firebaseID, role == domain.RoleLocationAdmin, func(tx *sql.Tx) error {
+		query := "UPDATE customer SET role = $4 WHERE firebase_id = $1 AND qb_company_id = $2 AND qb_customer_id = $3 RETURNING " + customerColumns
+		var err error
+		u, err = scanCustomer(tx.QueryRow(query, firebaseID, companyID, customerID, role))
+		return err
+	})
+	return u, err
+}
+
+// DeleteCustomerUser removes one of the location's logins. It returns sql.ErrNoRows if there's no such
+// login and ErrLastLocationAdmin if they're the location's only admin.
+func (s SQLStorage) DeleteCustomerUser(companyID string, customerID string, firebaseID string) error {
+	return s.withLocationAdminCheck(companyID, customerID, firebaseID, false, func(tx *sql.Tx) error {
+		_, err := tx.Exec("DELETE FROM customer WHERE firebase_id = $1 AND qb_company_id = $2 AND qb_customer_id = $3",
+			firebaseID, companyID, customerID)
+		return err
+	})
+}
+
+// withLocationAdminCheck is withOwnerCheck for the logins of a location. The location has no row of
+// its own to lock, so its logins are locked instead.
+func (s SQLStorage) withLocationAdminCheck(companyID string, customerID string, firebaseID string, staysAdmin bool, change func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT firebase_id, role FROM customer WHERE qb_company_id = $1 AND qb_customer_id = $2 FOR UPDATE",
+		companyID, customerID)
+	if err != nil {
+		return err
+	}
+	found, otherAdmins, isAdmin := false, 0, false
+	for rows.Next() {
+		var id string
+		var role domain.Role
+		if err := rows.Scan(&id, &role); err != nil {
+			rows.Close()
+			return err
+		}
+		switch {
+		case id == firebaseID:
+			found, isAdmin = true, role == domain.RoleLocationAdmin
+		case role == domain.RoleLocationAdmin:
+			otherAdmins++
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if !found {
+		return sql.ErrNoRows
+	}
+	if isAdmin && !staysAdmin && otherAdmins == 0 {
+		return ErrLastLocationAdmin
+	}
+	if err := change(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
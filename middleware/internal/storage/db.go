@@ -3,6 +3,7 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -11,6 +12,7 @@ import (
 
 	"cloud.google.com/go/cloudsqlconn"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/stdlib"
 )
 
@@ -141,6 +143,31 @@ func (s SQLStorage) UpdateTokenForCompany(companyId string, bearerToken string,
 	return nil
 }
 
+// ClearTokensForCompany forgets the company's QuickBooks tokens when it disconnects. The company and
+// its users stay, logging in to QuickBooks again saves new tokens.
+func (s SQLStorage) ClearTokensForCompany(companyId string) error {
+	query := `UPDATE company SET
+			qb_auth_code = '',
+			qb_bearer_token = '',
+			qb_bearer_token_expiry = NOW(),
+			qb_refresh_token = '',
+			qb_refresh_token_expiry = NOW()
+		WHERE qb_company_id = $1;`
+	_, err := s.db.Exec(query, companyId)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ExpireBearerToken marks the company's access token as expired if it's still bearerToken, so the
+// next request refreshes it
+func (s SQLStorage) ExpireBearerToken(companyId string, bearerToken string) error {
+	query := "UPDATE company SET qb_bearer_token_expiry = NOW() WHERE qb_company_id = $1 AND qb_bearer_token = $2"
+	_, err := s.db.Exec(query, companyId, bearerToken)
+	return err
+}
+
 func (s SQLStorage) IsFirebaseUser(companyID string) (string, error) {
 	var firebaseID sql.NullString
 	query := "SELECT firebase_id FROM company where qb_company_id = $1"
@@ -247,63 +274,91 @@ func (s SQLStorage) GetCompany(companyID string) (domain.Company, error) {
 	return company, nil
 }
 
-func (s SQLStorage) SetCompanyFirebaseID(companyID string, firebaseID string) error {
-	query := "UPDATE company SET firebase_id = $1 WHERE qb_company_id = $2"
-	_, err := s.db.Exec(query, firebaseID, companyID)
-	if err != nil {
-		return err
+// GetCompanyByFirebaseID returns the company the franchiser's firebase user belongs to
+func (s SQLStorage) GetCompanyByFirebaseID(firebaseID string) (domain.Company, error) {
+	var companyID string
+	query := "SELECT qb_company_id FROM company WHERE firebase_id = $1"
+	if err := s.db.QueryRow(query, firebaseID).Scan(&companyID); err != nil {
+		return domain.Company{}, err
 	}
-	return nil
+	return s.GetCompany(companyID)
 }
 
-func (s SQLStorage) CreateCustomer(companyID string, customerID string, firebaseID string) error {
-	query := "INSERT INTO customer(qb_company_id, qb_customer_id, firebase_id) VALUES($1, $2, $3)"
-	_, err := s.db.Exec(query, companyID, customerID, firebaseID)
+func (s SQLStorage) SetCompanyFirebaseID(companyID string, firebaseID string) error {
+	query := "UPDATE company SET firebase_id = $1 WHERE qb_company_id = $2"
+	_, err := s.db.Exec(query, firebaseID, companyID)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// return firebase id
-func (s SQLStorage) DeleteCustomer(companyID string, customerID string) (string, error) {
-	var firebaseID string
-	query := "DELETE FROM customer WHERE qb_company_id = $1 AND qb_customer_id = $2 RETURNING firebase_id"
-	err := s.db.QueryRow(query, companyID, customerID).Scan(&firebaseID)
-	if err != nil {
-		return "", err
-	}
-	return firebaseID, nil
-}
+const customerColumns = `qb_customer_id, qb_company_id, firebase_id, created_at, email, name, role, COALESCE(invited_by, '')`
 
-func (s SQLStorage) GetCustomerByFirebaseID(firebaseID string) (domain.DBCustomer, error) {
+func scanCustomer(row interface{ Scan(dest ...any) error }) (domain.DBCustomer, error) {
 	var customer domain.DBCustomer
-	domainQuery := "SELECT * FROM customer WHERE firebase_id = $1"
-	err := s.db.QueryRow(domainQuery, firebaseID).Scan(
+	err := row.Scan(
 		&customer.QBCustomerID,
 		&customer.QBCompanyID,
 		&customer.FirebaseID,
 		&customer.CreatedAt,
+		&customer.Email,
+		&customer.Name,
+		&customer.Role,
+		&customer.InvitedBy,
 	)
+	return customer, err
+}
+
+// CreateCustomer adds a login to a franchisee location. It returns ErrDuplicateUser if the firebase
+// user already is one.
+func (s SQLStorage) CreateCustomer(customer domain.DBCustomer) (domain.DBCustomer, error) {
+	query := `INSERT INTO customer(qb_company_id, qb_customer_id, firebase_id, email, name, role, invited_by)
+		VALUES($1, $2, $3, $4, $5, $6, NULLIF($7, ''))
+		RETURNING created_at`
+	err := s.db.QueryRow(query, customer.QBCompanyID, customer.QBCustomerID, customer.FirebaseID, customer.Email,
+		customer.Name, customer.Role, customer.InvitedBy).Scan(&customer.CreatedAt)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+		return domain.DBCustomer{}, ErrDuplicateUser
+	}
 	if err != nil {
-		return customer, err
+		return domain.DBCustomer{}, err
 	}
 	return customer, nil
 }
 
-func (s SQLStorage) GetCustomerByQBID(qbID string, companyID string) (domain.DBCustomer, error) {
-	var customer domain.DBCustomer
-	domainQuery := "SELECT * FROM customer WHERE qb_customer_id = $1 AND qb_company_id = $2"
-	err := s.db.QueryRow(domainQuery, qbID, companyID).Scan(
-		&customer.QBCustomerID,
-		&customer.QBCompanyID,
-		&customer.FirebaseID,
-		&customer.CreatedAt,
-	)
+// DeleteCustomer removes every login of the location and returns their firebase IDs
+func (s SQLStorage) DeleteCustomer(companyID string, customerID string) ([]string, error) {
+	query := "DELETE FROM customer WHERE qb_company_id = $1 AND qb_customer_id = $2 RETURNING firebase_id"
+	rows, err := s.db.Query(query, companyID, customerID)
 	if err != nil {
-		return customer, err
+		return nil, err
 	}
-	return customer, nil
+	defer rows.Close()
+
+	var firebaseIDs []string
+	for rows.Next() {
+		var firebaseID string
+		if err := rows.Scan(&firebaseID); err != nil {
+			return nil, err
+		}
+		firebaseIDs = append(firebaseIDs, firebaseID)
+	}
+	return firebaseIDs, rows.Err()
+}
+
+func (s SQLStorage) GetCustomerByFirebaseID(firebaseID string) (domain.DBCustomer, error) {
+	domainQuery := "SELECT " + customerColumns + " FROM customer WHERE firebase_id = $1"
+	return scanCustomer(s.db.QueryRow(domainQuery, firebaseID))
+}
+
+// GetCustomerByQBID returns the location's first admin, or its first login if it has no admin
+func (s SQLStorage) GetCustomerByQBID(qbID string, companyID string) (domain.DBCustomer, error) {
+	domainQuery := "SELECT " + customerColumns + ` FROM customer WHERE qb_customer_id = $1 AND qb_company_id = $2
+		ORDER BY role = 'location_admin' DESC, created_at
+		LIMIT 1`
+	return scanCustomer(s.db.QueryRow(domainQuery, qbID, companyID))
 }
 
 func (s SQLStorage) GetCustomersLinkedStatuses(companyID string, customers *[]domain.Customer) []domain.Customer {
@@ -317,8 +372,10 @@ func (s SQLStorage) GetCustomersLinkedStatuses(companyID string, customers *[]do
 	}
 
 	// Single query using pgx.Array
+	// Locations can have many logins, the one notifications go to is shown
 	rows, err := s.db.Query(
-		"SELECT qb_customer_id, qb_company_id, firebase_id, created_at FROM customer WHERE qb_company_id = $1 AND qb_customer_id = ANY($2)",
+		"SELECT DISTINCT ON (qb_customer_id) "+customerColumns+` FROM customer WHERE qb_company_id = $1 AND qb_customer_id = ANY($2)
+			ORDER BY qb_customer_id, role = 'location_admin' DESC, created_at`,
 		companyID,
 		customerIDs,
 	)
@@ -328,13 +385,7 @@ func (s SQLStorage) GetCustomersLinkedStatuses(companyID string, customers *[]do
 	defer rows.Close()
 
 	for rows.Next() {
-		var dbCustomer domain.DBCustomer
-		err := rows.Scan(
-			&dbCustomer.QBCustomerID,
-			&dbCustomer.QBCompanyID,
-			&dbCustomer.FirebaseID,
-			&dbCustomer.CreatedAt,
-		)
+		dbCustomer, err := scanCustomer(rows)
 		if err != nil {
 			continue
 		}
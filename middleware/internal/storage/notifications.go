@@ -0,0 +1,248 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Vertisphere/backend-service/internal/domain"
+)
+
+const notificationColumns = `id, idempotency_key, qb_company_id, event_type, payload, status, attempts, delivered,
+	last_error, trace_id, next_attempt_at, created_at, updated_at, sent_at`
+
+// insertNotifications queues the notifications of an order event. Notifications without an idempotency key
+// get one from the event, queuing the same one twice is a no-op.
+func insertNotifications(tx *sql.Tx, eventID int64, notifications []domain.Notification) error {
+	query := `INSERT INTO notification_outbox(idempotency_key, qb_company_id, event_type, payload, trace_id)
+		VALUES($1, $2, $3, $4, $5)
+		ON CONFLICT (idempotency_key) DO NOTHING`
+	for _, n := range notifications {
+		key := n.IdempotencyKey
+		if key == "" {
+			key = fmt.Sprintf("order_event:%d:%s", eventID, n.EventType)
+		}
+		if _, err := tx.Exec(query, key, n.QBCompanyID, n.EventType, []byte(n.Payload), n.TraceID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ClaimNotifications marks up to limit due notifications as sending and returns them. A claimed
+// notification is held for lease, if it's still sending after that the worker is assumed dead and
+// it's claimed again. Every claim counts as an attempt.
+func (s SQLStorage) ClaimNotifications(limit int, lease time.Duration) ([]domain.Notification, error) {
+	query := `
+		UPDATE notification_outbox
+		SET status = 'sending', attempts = attempts + 1, updated_at = NOW(),
+			locked_until = NOW() + $2 * INTERVAL '1 second'
+		WHERE id IN (
+			SELECT id FROM notification_outbox
+			WHERE (status = 'pending' AND next_attempt_at <= NOW())
+			   OR (status = 'sending' AND locked_until < NOW())
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + notificationColumns
+	rows, err := s.db.Query(query, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	return scanNotifications(rows)
+}
+
+// RenewNotificationLease extends the lease on a notification claimed for the given attempt. It
+// returns false if the notification was claimed again since, or isn't being sent anymore.
+func (s SQLStorage) RenewNotificationLease(id int64, attempt int, lease time.Duration) (bool, error) {
+	query := `UPDATE notification_outbox
+		SET locked_until = NOW() + $3 * INTERVAL '1 second', updated_at = NOW()
+		WHERE id = $1 AND attempts = $2 AND status = 'sending'`
+	res, err := s.db.Exec(query, id, attempt, lease.Seconds())
+	if err != nil {
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	return rows == 1, err
+}
+
+// CompleteNotification marks a notification claimed for the given attempt as sent on every channel.
+// Like RenewNotificationLease it returns false if the notification was claimed again since.
+func (s SQLStorage) CompleteNotification(id int64, attempt int, delivered []string) (bool, error) {
+	b, err := json.Marshal(delivered)
+	if err != nil {
+		return false, err
+	}
+	query := `UPDATE notification_outbox
+		SET status = 'sent', delivered = $3, last_error = '', locked_until = NULL, sent_at = NOW(), updated_at = NOW()
+		WHERE id = $1 AND attempts = $2 AND status = 'sending'`
+	return s.finishNotification(query, id, attempt, b)
+}
+
+// FailNotification records a failed attempt. The notification is tried again at retryAt, or never if dead.
+// delivered is kept so what did go out isn't sent twice. It returns false if the notification was
+// claimed again since.
+func (s SQLStorage) FailNotification(id int64, attempt int, delivered []string, lastError string, retryAt time.Time, dead bool) (bool, error) {
+	b, err := json.Marshal(delivered)
+	if err != nil {
+		return false, err
+	}
+	status := domain.NotificationPending
+	if dead {
+		status = domain.NotificationDead
+	}
+	query := `UPDATE notification_outbox
+		SET status = $4, delivered = $3, last_error = $5, next_attempt_at = $6, locked_until = NULL, updated_at = NOW()
+		WHERE id = $1 AND attempts = $2 AND status = 'sending'`
+	return s.finishNotification(query, id, attempt, b, status, lastError, retryAt)
+}
+
+// finishNotification runs an update on a notification that's only applied if the attempt still holds
+// its lease, the attempt number is bumped when the notification is claimed again
+func (s SQLStorage) finishNotification(query string, id int64, attempt int, args ...any) (bool, error) {
+	res, err := s.db.Exec(query, append([]any{id, attempt}, args...)...)
+	if err != nil {
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	return rows == 1, err
+}
+
+// ListNotifications returns a company's notifications in the given statuses, newest first
+func (s SQLStorage) ListNotifications(companyID string, statuses []domain.NotificationStatus, limit int) ([]domain.Notification, error) {
+	query := `SELECT ` + notificationColumns + `
+		FROM notification_outbox
+		WHERE qb_company_id = $1 AND status = ANY($2)
+		ORDER BY created_at DESC, id DESC
+		LIMIT $3`
+	statusValues := make([]string, len(statuses))
+	for i, status := range statuses {
+		statusValues[i] = string(status)
+	}
+	rows, err := s.db.Query(query, companyID, statusValues, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanNotifications(rows)
+}
+
+// RetryNotification queues a dead notification again with a fresh set of attempts. It returns
+// sql.ErrNoRows if the company has no such dead notification.
+func (s SQLStorage) RetryNotification(companyID string, id int64) (domain.Notification, error) {
+	query := `UPDATE notification_outbox
+		SET status = 'pending', attempts = 0, next_attempt_at = NOW(), updated_at = NOW()
+		WHERE id = $1 AND qb_company_id = $2 AND status = 'dead'
+		RETURNING ` + notificationColumns
+	rows, err := s.db.Query(query, id, companyID)
+	if err != nil {
+		return domain.Notification{}, err
+	}
+	notifications, err := scanNotifications(rows)
+	if err != nil {
+		return domain.Notification{}, err
+	}
+	if len(notifications) == 0 {
+		return domain.Notification{}, sql.ErrNoRows
+	}
+	return notifications[0], nil
+}
+
+func scanNotifications(rows *sql.Rows) ([]domain.Notification, error) {
+	defer rows.Close()
+	notifications := []domain.Notification{}
+	for rows.Next() {
+		var n domain.Notification
+		var payload, delivered []byte
+		var sentAt sql.NullTime
+		err := rows.Scan(
+			&n.ID, &n.IdempotencyKey, &n.QBCompanyID, &n.EventType, &payload, &n.Status, &n.Attempts, &delivered,
+			&n.LastError, &n.TraceID, &n.NextAttemptAt, &n.CreatedAt, &n.UpdatedAt, &sentAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		n.Payload = payload
+		if err := json.Unmarshal(delivered, &n.Delivered); err != nil {
+			return nil, err
+		}
+		if sentAt.Valid {
+			n.SentAt = &sentAt.Time
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, rows.Err()
+}
+
+// GetNotificationPreferences returns the user's notification preferences, or sql.ErrNoRows if they never set any
+func (s SQLStorage) GetNotificationPreferences(firebaseID string) (domain.NotificationPreferences, error) {
+	query := `SELECT firebase_id, channels, events, quiet_hours, phone, email, updated_at
+		FROM notification_preferences WHERE firebase_id = $1`
+	var p domain.NotificationPreferences
+	var channels, events, quietHours []byte
+	err := s.db.QueryRow(query, firebaseID).Scan(&p.FirebaseID, &channels, &events, &quietHours, &p.Phone, &p.Email, &p.UpdatedAt)
+	if err != nil {
+		return domain.NotificationPreferences{}, err
+	}
+	if err := json.Unmarshal(channels, &p.Channels); err != nil {
+		return domain.NotificationPreferences{}, err
+	}
+	if err := json.Unmarshal(events, &p.Events); err != nil {
+		return domain.NotificationPreferences{}, err
+	}
+	if quietHours != nil {
+		p.QuietHours = &domain.QuietHours{}
+		if err := json.Unmarshal(quietHours, p.QuietHours); err != nil {
+			return domain.NotificationPreferences{}, err
+		}
+	}
+	return p, nil
+}
+
+// SaveNotificationPreferences replaces the user's notification preferences
+func (s SQLStorage) SaveNotificationPreferences(p domain.NotificationPreferences) (domain.NotificationPreferences, error) {
+	if p.Channels == nil {
+		p.Channels = map[string]bool{}
+	}
+	if p.Events == nil {
+		p.Events = map[string]map[string]bool{}
+	}
+	channels, err := json.Marshal(p.Channels)
+	if err != nil {
+		return domain.NotificationPreferences{}, err
+	}
+	events, err := json.Marshal(p.Events)
+	if err != nil {
+		return domain.NotificationPreferences{}, err
+	}
+	var quietHours []byte
+	if p.QuietHours != nil {
+		if quietHours, err = json.Marshal(p.QuietHours); err != nil {
+			return domain.NotificationPreferences{}, err
+		}
+	}
+	query := `INSERT INTO notification_preferences(firebase_id, channels, events, quiet_hours, phone, email)
+		VALUES($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (firebase_id) DO UPDATE SET
+			channels = EXCLUDED.channels, events = EXCLUDED.events, quiet_hours = EXCLUDED.quiet_hours,
+			phone = EXCLUDED.phone, email = EXCLUDED.email, updated_at = NOW()
+		RETURNING updated_at`
+	err = s.db.QueryRow(query, p.FirebaseID, channels, events, quietHours, p.Phone, p.Email).Scan(&p.UpdatedAt)
+	return p, err
+}
+
+// DeferNotification puts a notification claimed for the given attempt back until the given time without
+// counting the attempt, e.g. because the recipient is in their quiet hours. It returns false if the
+// notification was claimed again since.
+func (s SQLStorage) DeferNotification(id int64, attempt int, delivered []string, until time.Time) (bool, error) {
+	b, err := json.Marshal(delivered)
+	if err != nil {
+		return false, err
+	}
+	query := `UPDATE notification_outbox
+		SET status = 'pending', delivered = $3, next_attempt_at = $4, attempts = GREATEST(attempts - 1, 0),
+			locked_until = NULL, updated_at = NOW()
+		WHERE id = $1 AND attempts = $2 AND status = 'sending'`
+	return s.finishNotification(query, id, attempt, b, until)
+}
@@ -0,0 +1,298 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/Vertisphere/backend-service/internal/domain"
+)
+
+// ErrOrderStatusChanged is returned when an order is no longer in the status the caller expected,
+// usually because another request moved it first.
+var ErrOrderStatusChanged = errors.New("order status changed")
+
+// CreateOrder tracks a new invoice as an order and records the event that created it. txnDate is the
+// invoice's TxnDate, so listings can be sorted by it.
+func (s SQLStorage) CreateOrder(customerID string, txnDate time.Time, event domain.OrderEvent) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := "INSERT INTO orders(qb_company_id, qb_invoice_id, qb_customer_id, status, txn_date) VALUES($1, $2, $3, $4, $5)"
+	_, err = tx.Exec(query, event.QBCompanyID, event.QBInvoiceID, customerID, event.ToStatus, nullTime(txnDate))
+	if err != nil {
+		return err
+	}
+	eventID, err := insertOrderEvent(tx, event)
+	if err != nil {
+		return err
+	}
+	if err = insertNotifications(tx, eventID, event.Notifications); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// BackfillOrder inserts an order row if one doesn't exist yet. Used for invoices created
+// before statuses were stored in postgres. createdAt is when the invoice was created in QuickBooks
+// and txnDate its TxnDate, so backfilled orders sort like the others.
+func (s SQLStorage) BackfillOrder(companyID string, invoiceID string, customerID string, status domain.OrderStatus, createdAt time.Time, txnDate time.Time) error {
+	query := `INSERT INTO orders(qb_company_id, qb_invoice_id, qb_customer_id, status, created_at, txn_date)
+		VALUES($1, $2, $3, $4, COALESCE($5::timestamp, CURRENT_TIMESTAMP), $6)
+		ON CONFLICT (qb_company_id, qb_invoice_id) DO NOTHING`
+	// created_at is in UTC like the rows postgres fills in
+	_, err := s.db.Exec(query, companyID, invoiceID, customerID, status, nullTime(createdAt.UTC()), nullTime(txnDate))
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// nullTime is NULL for the zero time
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+func (s SQLStorage) GetOrder(companyID string, invoiceID string) (domain.Order, error) {
+	var order domain.Order
+	query := `
+		SELECT qb_company_id, qb_invoice_id, qb_customer_id, status, created_at, updated_at
+		FROM orders
+		WHERE qb_company_id = $1 AND qb_invoice_id = $2
+	`
+	err := s.db.QueryRow(query, companyID, invoiceID).Scan(
+		&order.QBCompanyID, &order.QBInvoiceID, &order.QBCustomerID,
+		&order.Status, &order.CreatedAt, &order.UpdatedAt,
+	)
+	if err != nil {
+		return domain.Order{}, err
+	}
+	return order, nil
+}
+
+// TransitionOrder moves an order out of status from. The order's row stays locked while apply runs
+// the side effects of the move and returns the event to record, so no other request can move the
+// order in between. ErrOrderStatusChanged is returned without calling apply if the order isn't in
+// status from anymore, and nothing is written if apply fails.
+func (s SQLStorage) TransitionOrder(companyID string, invoiceID string, from domain.OrderStatus, apply func() (domain.OrderEvent, error)) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var status domain.OrderStatus
+	query := "SELECT status FROM orders WHERE qb_company_id = $1 AND qb_invoice_id = $2 FOR UPDATE"
+	err = tx.QueryRow(query, companyID, invoiceID).Scan(&status)
+	if errors.Is(err, sql.ErrNoRows) || err == nil && status != from {
+		return ErrOrderStatusChanged
+	}
+	if err != nil {
+		return err
+	}
+
+	event, err := apply()
+	if err != nil {
+		return err
+	}
+	query = "UPDATE orders SET status = $1, updated_at = NOW() WHERE qb_company_id = $2 AND qb_invoice_id = $3"
+	if _, err = tx.Exec(query, event.ToStatus, companyID, invoiceID); err != nil {
+		return err
+	}
+	eventID, err := insertOrderEvent(tx, event)
+	if err != nil {
+		return err
+	}
+	if err = insertNotifications(tx, eventID, event.Notifications); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertOrderEvent records the event and returns its id
+func insertOrderEvent(tx *sql.Tx, event domain.OrderEvent) (int64, error) {
+	var fromStatus sql.NullString
+	if event.FromStatus != "" {
+		fromStatus = sql.NullString{String: string(event.FromStatus), Valid: true}
+	}
+	// review and changes are left NULL unless set
+	var review, changes []byte
+	var err error
+	if event.Review != nil {
+		if review, err = json.Marshal(event.Review); err != nil {
+			return 0, err
+		}
+	}
+	if event.Changes != nil {
+		if changes, err = json.Marshal(event.Changes); err != nil {
+			return 0, err
+		}
+	}
+	query := `INSERT INTO order_events(
+			qb_company_id, qb_invoice_id, actor_firebase_id, actor_role, from_status, to_status, trace_id, reason,
+			review, changes
+		) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id`
+	var id int64
+	err = tx.QueryRow(query,
+		event.QBCompanyID, event.QBInvoiceID, event.ActorFirebaseID, event.ActorRole,
+		fromStatus, event.ToStatus, event.TraceID, event.Reason, review, changes,
+	).Scan(&id)
+	return id, err
+}
+
+// LatestOrderReview returns the review from the last time the order was sent back for revision.
+// Returns sql.ErrNoRows if it never was.
+func (s SQLStorage) LatestOrderReview(companyID string, invoiceID string) (domain.OrderReview, error) {
+	var review domain.OrderReview
+	var raw []byte
+	query := `
+		SELECT review FROM order_events
+		WHERE qb_company_id = $1 AND qb_invoice_id = $2 AND to_status = $3 AND review IS NOT NULL
+		ORDER BY created_at DESC, id DESC
+		LIMIT 1
+	`
+	err := s.db.QueryRow(query, companyID, invoiceID, domain.OrderRevision).Scan(&raw)
+	if err != nil {
+		return domain.OrderReview{}, err
+	}
+	if err := json.Unmarshal(raw, &review); err != nil {
+		return domain.OrderReview{}, err
+	}
+	return review, nil
+}
+
+// ListOrderEvents returns the history of an order, oldest first
+func (s SQLStorage) ListOrderEvents(companyID string, invoiceID string) ([]domain.OrderEvent, error) {
+	query := `
+		SELECT id, qb_company_id, qb_invoice_id, actor_firebase_id, actor_role,
+			   from_status, to_status, trace_id, reason, review, changes, created_at
+		FROM order_events
+		WHERE qb_company_id = $1 AND qb_invoice_id = $2
+		ORDER BY created_at, id
+	`
+	rows, err := s.db.Query(query, companyID, invoiceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []domain.OrderEvent{}
+	for rows.Next() {
+		var event domain.OrderEvent
+		var fromStatus sql.NullString
+		var review, changes []byte
+		err := rows.Scan(
+			&event.ID, &event.QBCompanyID, &event.QBInvoiceID, &event.ActorFirebaseID, &event.ActorRole,
+			&fromStatus, &event.ToStatus, &event.TraceID, &event.Reason, &review, &changes, &event.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		event.FromStatus = domain.OrderStatus(fromStatus.String)
+		if review != nil {
+			event.Review = &domain.OrderReview{}
+			if err := json.Unmarshal(review, event.Review); err != nil {
+				return nil, err
+			}
+		}
+		if changes != nil {
+			if err := json.Unmarshal(changes, &event.Changes); err != nil {
+				return nil, err
+			}
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// OrderSort is what order listings can be sorted by
+type OrderSort string
+
+const (
+	// SortCreated sorts orders by when their invoice was created
+	SortCreated OrderSort = "created_at"
+	// SortTxnDate sorts orders by their invoice's TxnDate. Orders from before it was stored go by
+	// the day they were created.
+	SortTxnDate OrderSort = "COALESCE(txn_date, created_at::date)"
+)
+
+// ListOrderInvoiceIDs returns a page of the invoice ids of orders in any of the given statuses,
+// sorted by sort, and how many there are in all. Orders sorting the same go by when they were
+// created. An empty customerID returns orders for every customer of the company, a limit of 0
+// returns every order.
+func (s SQLStorage) ListOrderInvoiceIDs(companyID string, customerID string, statuses []domain.OrderStatus, sort OrderSort, descending bool, limit int, offset int) ([]string, int, error) {
+	statusValues := make([]string, len(statuses))
+	for i, status := range statuses {
+		statusValues[i] = string(status)
+	}
+
+	where := `WHERE qb_company_id = $1 AND status = ANY($2) AND ($3 = '' OR qb_customer_id = $3)`
+	var total int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM orders `+where, companyID, statusValues, customerID).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	order := "ASC"
+	if descending {
+		order = "DESC"
+	}
+	query := `SELECT qb_invoice_id FROM orders ` + where + `
+		ORDER BY ` + string(sort) + ` ` + order + `, created_at ` + order + `, qb_invoice_id ` + order + `
+		LIMIT NULLIF($4, 0) OFFSET $5`
+	rows, err := s.db.Query(query, companyID, statusValues, customerID, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	invoiceIDs := []string{}
+	for rows.Next() {
+		var invoiceID string
+		if err := rows.Scan(&invoiceID); err != nil {
+			return nil, 0, err
+		}
+		invoiceIDs = append(invoiceIDs, invoiceID)
+	}
+	return invoiceIDs, total, rows.Err()
+}
+
+// OrdersBackfilled reports whether the company's legacy invoices already got order rows
+func (s SQLStorage) OrdersBackfilled(companyID string) (bool, error) {
+	var backfilled bool
+	query := "SELECT orders_backfilled_at IS NOT NULL FROM company WHERE qb_company_id = $1"
+	err := s.db.QueryRow(query, companyID).Scan(&backfilled)
+	return backfilled, err
+}
+
+// SetOrdersBackfilled records that the company's legacy invoices got order rows
+func (s SQLStorage) SetOrdersBackfilled(companyID string) error {
+	query := "UPDATE company SET orders_backfilled_at = NOW() WHERE qb_company_id = $1"
+	_, err := s.db.Exec(query, companyID)
+	return err
+}
+
+// GetOrderStatuses returns a map of invoice id to status for the given invoices
+func (s SQLStorage) GetOrderStatuses(companyID string, invoiceIDs []string) (map[string]domain.OrderStatus, error) {
+	query := "SELECT qb_invoice_id, status FROM orders WHERE qb_company_id = $1 AND qb_invoice_id = ANY($2)"
+	rows, err := s.db.Query(query, companyID, invoiceIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	statuses := make(map[string]domain.OrderStatus, len(invoiceIDs))
+	for rows.Next() {
+		var invoiceID string
+		var status domain.OrderStatus
+		if err := rows.Scan(&invoiceID, &status); err != nil {
+			return nil, err
+		}
+		statuses[invoiceID] = status
+	}
+	return statuses, rows.Err()
+}
@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	"github.com/Vertisphere/backend-service/internal/domain"
+)
+
+// ListPriceLists returns the company's price lists with their items
+func (s SQLStorage) ListPriceLists(companyID string) ([]domain.PriceList, error) {
+	query := `SELECT id, qb_company_id, name, COALESCE(qb_customer_id, ''), COALESCE(qb_customer_type_id, ''),
+			restricted, effective_from, effective_to, created_at, updated_at
+		FROM price_lists WHERE qb_company_id = $1
+		ORDER BY id`
+	rows, err := s.db.Query(query, companyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lists := []domain.PriceList{}
+	index := map[int64]int{}
+	for rows.Next() {
+		var l domain.PriceList
+		var from, to sql.NullTime
+		err := rows.Scan(&l.ID, &l.QBCompanyID, &l.Name, &l.QBCustomerID, &l.QBCustomerTypeID,
+			&l.Restricted, &from, &to, &l.CreatedAt, &l.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if from.Valid {
+			l.EffectiveFrom = &from.Time
+		}
+		if to.Valid {
+			l.EffectiveTo = &to.Time
+		}
+		l.Items = []domain.PriceListItem{}
+		index[l.ID] = len(lists)
+		lists = append(lists, l)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	itemRows, err := s.db.Query(`SELECT i.price_list_id, i.qb_item_id, COALESCE(i.unit_price::TEXT, ''), i.hidden
+		FROM price_list_items i JOIN price_lists l ON l.id = i.price_list_id
+		WHERE l.qb_company_id = $1
+		ORDER BY i.price_list_id, i.qb_item_id`, companyID)
+	if err != nil {
+		return nil, err
+	}
+	defer itemRows.Close()
+	for itemRows.Next() {
+		var listID int64
+		var item domain.PriceListItem
+		var unitPrice string
+		if err := itemRows.Scan(&listID, &item.QBItemID, &unitPrice, &item.Hidden); err != nil {
+			return nil, err
+		}
+		item.UnitPrice = json.Number(unitPrice)
+		if i, ok := index[listID]; ok {
+			lists[i].Items = append(lists[i].Items, item)
+		}
+	}
+	return lists, itemRows.Err()
+}
+
+// SavePriceList creates the price list, or replaces it and its items if it has an ID. It returns
+// sql.ErrNoRows if the company has no price list with that ID.
+func (s SQLStorage) SavePriceList(l domain.PriceList) (domain.PriceList, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return domain.PriceList{}, err
+	}
+	defer tx.Rollback()
+
+	customerID := sql.NullString{String: l.QBCustomerID, Valid: l.QBCustomerID != ""}
+	customerTypeID := sql.NullString{String: l.QBCustomerTypeID, Valid: l.QBCustomerTypeID != ""}
+	if l.ID == 0 {
+		query := `INSERT INTO price_lists(qb_company_id, name, qb_customer_id, qb_customer_type_id, restricted, effective_from, effective_to)
+			VALUES($1, $2, $3, $4, $5, $6, $7)
+			RETURNING id, created_at, updated_at`
+		err = tx.QueryRow(query, l.QBCompanyID, l.Name, customerID, customerTypeID, l.Restricted, l.EffectiveFrom, l.EffectiveTo).
+			Scan(&l.ID, &l.CreatedAt, &l.UpdatedAt)
+	} else {
+		query := `UPDATE price_lists
+			SET name = $3, qb_customer_id = $4, qb_customer_type_id = $5, restricted = $6,
+				effective_from = $7, effective_to = $8, updated_at = NOW()
+			WHERE id = $1 AND qb_company_id = $2
+			RETURNING created_at, updated_at`
+		err = tx.QueryRow(query, l.ID, l.QBCompanyID, l.Name, customerID, customerTypeID, l.Restricted, l.EffectiveFrom, l.EffectiveTo).
+			Scan(&l.CreatedAt, &l.UpdatedAt)
+	}
+	if err != nil {
+		return domain.PriceList{}, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM price_list_items WHERE price_list_id = $1", l.ID); err != nil {
+		return domain.PriceList{}, err
+	}
+	query := "INSERT INTO price_list_items(price_list_id, qb_item_id, unit_price, hidden) VALUES($1, $2, $3, $4)"
+	for _, item := range l.Items {
+		unitPrice := sql.NullString{String: item.UnitPrice.String(), Valid: item.UnitPrice != ""}
+		if _, err := tx.Exec(query, l.ID, item.QBItemID, unitPrice, item.Hidden); err != nil {
+			return domain.PriceList{}, err
+		}
+	}
+	if l.Items == nil {
+		l.Items = []domain.PriceListItem{}
+	}
+	return l, tx.Commit()
+}
+
+// DeletePriceList deletes the price list and its items. It returns sql.ErrNoRows if the company has no
+// price list with that ID.
+func (s SQLStorage) DeletePriceList(companyID string, id int64) error {
+	res, err := s.db.Exec("DELETE FROM price_lists WHERE id = $1 AND qb_company_id = $2", id, companyID)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ListQuantityRules returns the company's quantity rules
+func (s SQLStorage) ListQuantityRules(companyID string) ([]domain.QuantityRule, error) {
+	query := `SELECT id, qb_company_id, qb_item_id, qb_customer_id, COALESCE(min_qty::TEXT, ''),
+			COALESCE(pack_multiple::TEXT, ''), COALESCE(max_qty::TEXT, ''), allow_decimal, updated_at
+		FROM quantity_rules WHERE qb_company_id = $1
+		ORDER BY qb_item_id, qb_customer_id`
+	rows, err := s.db.Query(query, companyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []domain.QuantityRule{}
+	for rows.Next() {
+		var rule domain.QuantityRule
+		var minQty, packMultiple, maxQty string
+		err := rows.Scan(&rule.ID, &rule.QBCompanyID, &rule.QBItemID, &rule.QBCustomerID, &minQty,
+			&packMultiple, &maxQty, &rule.AllowDecimal, &rule.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		rule.MinQty, rule.PackMultiple, rule.MaxQty = json.Number(minQty), json.Number(packMultiple), json.Number(maxQty)
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// SaveQuantityRule creates or replaces the rule for the item and customer
+func (s SQLStorage) SaveQuantityRule(rule domain.QuantityRule) (domain.QuantityRule, error) {
+	number := func(n json.Number) sql.NullString {
+		return sql.NullString{String: n.String(), Valid: n != ""}
+	}
+	query := `INSERT INTO quantity_rules(qb_company_id, qb_item_id, qb_customer_id, min_qty, pack_multiple, max_qty, allow_decimal)
+		VALUES($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (qb_company_id, qb_item_id, qb_customer_id) DO UPDATE SET
+			min_qty = EXCLUDED.min_qty, pack_multiple = EXCLUDED.pack_multiple, max_qty = EXCLUDED.max_qty,
+			allow_decimal = EXCLUDED.allow_decimal, updated_at = NOW()
+		RETURNING id, updated_at`
+	err := s.db.QueryRow(query, rule.QBCompanyID, rule.QBItemID, rule.QBCustomerID, number(rule.MinQty),
+		number(rule.PackMultiple), number(rule.MaxQty), rule.AllowDecimal).Scan(&rule.ID, &rule.UpdatedAt)
+	return rule, err
+}
+
+// DeleteQuantityRule deletes a rule. It returns sql.ErrNoRows if the company has no rule with that ID.
+func (s SQLStorage) DeleteQuantityRule(companyID string, id int64) error {
+	res, err := s.db.Exec("DELETE FROM quantity_rules WHERE id = $1 AND qb_company_id = $2", id, companyID)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
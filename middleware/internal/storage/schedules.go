@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"encoding/json"
+
+	"github.com/Vertisphere/backend-service/internal/domain"
+)
+
+// GetOrderSchedule returns the company's order schedule, or sql.ErrNoRows if it never set one
+func (s SQLStorage) GetOrderSchedule(companyID string) (domain.OrderSchedule, error) {
+	query := `SELECT qb_company_id, time_zone, after_cutoff, windows, blackout_dates, updated_at
+		FROM order_schedules WHERE qb_company_id = $1`
+	var schedule domain.OrderSchedule
+	var windows, blackoutDates []byte
+	err := s.db.QueryRow(query, companyID).Scan(&schedule.QBCompanyID, &schedule.TimeZone, &schedule.AfterCutoff,
+		&windows, &blackoutDates, &schedule.UpdatedAt)
+	if err != nil {
+		return domain.OrderSchedule{}, err
+	}
+	if err := json.Unmarshal(windows, &schedule.Windows); err != nil {
+		return domain.OrderSchedule{}, err
+	}
+	if err := json.Unmarshal(blackoutDates, &schedule.BlackoutDates); err != nil {
+		return domain.OrderSchedule{}, err
+	}
+	return schedule, nil
+}
+
+// SaveOrderSchedule replaces the company's order schedule
+func (s SQLStorage) SaveOrderSchedule(schedule domain.OrderSchedule) (domain.OrderSchedule, error) {
+	if schedule.Windows == nil {
+		schedule.Windows = []domain.OrderWindow{}
+	}
+	if schedule.BlackoutDates == nil {
+		schedule.BlackoutDates = []string{}
+	}
+	windows, err := json.Marshal(schedule.Windows)
+	if err != nil {
+		return domain.OrderSchedule{}, err
+	}
+	blackoutDates, err := json.Marshal(schedule.BlackoutDates)
+	if err != nil {
+		return domain.OrderSchedule{}, err
+	}
+	query := `INSERT INTO order_schedules(qb_company_id, time_zone, after_cutoff, windows, blackout_dates)
+		VALUES($1, $2, $3, $4, $5)
+		ON CONFLICT (qb_company_id) DO UPDATE SET
+			time_zone = EXCLUDED.time_zone, after_cutoff = EXCLUDED.after_cutoff, windows = EXCLUDED.windows,
+			blackout_dates = EXCLUDED.blackout_dates, updated_at = NOW()
+		RETURNING updated_at`
+	err = s.db.QueryRow(query, schedule.QBCompanyID, schedule.TimeZone, schedule.AfterCutoff, windows, blackoutDates).
+		Scan(&schedule.UpdatedAt)
+	return schedule, err
+}
@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/Vertisphere/backend-service/internal/domain"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// ErrLastOwner is returned when a change would leave the company without an owner
+var ErrLastOwner = errors.New("company needs at least one owner")
+
+// ErrDuplicateUser is returned when the firebase user is already a staff user
+var ErrDuplicateUser = errors.New("user already exists")
+
+const companyUserColumns = `firebase_id, qb_company_id, email, name, role, COALESCE(invited_by, ''), created_at, updated_at`
+
+// GetCompanyUser returns the staff user with the firebase ID, or sql.ErrNoRows
+func (s SQLStorage) GetCompanyUser(firebaseID string) (domain.CompanyUser, error) {
+	query := `SELECT ` + companyUserColumns + ` FROM company_users WHERE firebase_id = $1`
+	var u domain.CompanyUser
+	err := s.db.QueryRow(query, firebaseID).
+		Scan(&u.FirebaseID, &u.QBCompanyID, &u.Email, &u.Name, &u.Role, &u.InvitedBy, &u.CreatedAt, &u.UpdatedAt)
+	return u, err
+}
+
+// ListCompanyUsers returns the company's staff users, oldest first
+func (s SQLStorage) ListCompanyUsers(companyID string) ([]domain.CompanyUser, error) {
+	query := `SELECT ` + companyUserColumns + ` FROM company_users WHERE qb_company_id = $1 ORDER BY created_at`
+	rows, err := s.db.Query(query, companyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []domain.CompanyUser{}
+	for rows.Next() {
+		var u domain.CompanyUser
+		err := rows.Scan(&u.FirebaseID, &u.QBCompanyID, &u.Email, &u.Name, &u.Role, &u.InvitedBy, &u.CreatedAt, &u.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// ListCompanyFirebaseIDs returns the firebase users of everyone that can sign in to the company:
+// its staff users and the logins of its franchisee locations
+func (s SQLStorage) ListCompanyFirebaseIDs(companyID string) ([]string, error) {
+	query := `SELECT firebase_id FROM company_users WHERE qb_company_id = $1
+		UNION SELECT firebase_id FROM customer WHERE qb_company_id = $1`
+	rows, err := s.db.Query(query, companyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	firebaseIDs := []string{}
+	for rows.Next() {
+		var firebaseID string
+		if err := rows.Scan(&firebaseID); err != nil {
+			return nil, err
+		}
+		firebaseIDs = append(firebaseIDs, firebaseID)
+	}
+	return firebaseIDs, rows.Err()
+}
+
+// CreateCompanyUser adds a staff user to the company. It returns ErrDuplicateUser if the firebase user
+// already is one.
+func (s SQLStorage) CreateCompanyUser(u domain.CompanyUser) (domain.CompanyUser, error) {
+	query := `INSERT INTO company_users(firebase_id, qb_company_id, email, name, role, invited_by)
+		VALUES($1, $2, $3, $4, $5, NULLIF($6, ''))
+		RETURNING created_at, updated_at`
+	err := s.db.QueryRow(query, u.FirebaseID, u.QBCompanyID, u.Email, u.Name, u.Role, u.InvitedBy).
+		Scan(&u.CreatedAt, &u.UpdatedAt)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+		return domain.CompanyUser{}, ErrDuplicateUser
+	}
+	if err != nil {
+		return domain.CompanyUser{}, err
+	}
+	return u, nil
+}
+
+// EnsureCompanyOwner makes the firebase user an owner of the company, adding them if they aren't a
+// staff user yet. It's how the QuickBooks user gets in.
+func (s SQLStorage) EnsureCompanyOwner(companyID string, firebaseID string) error {
+	query := `INSERT INTO company_users(firebase_id, qb_company_id, role) VALUES($1, $2, 'owner')
+		ON CONFLICT (firebase_id) DO UPDATE SET role = 'owner', updated_at = NOW()
+			WHERE company_users.qb_company_id = $2 AND company_users.role <> 'owner'`
+	_, err := s.db.Exec(query, firebaseID, companyID)
+	return err
+}
+
+// UpdateCompanyUserRole changes a staff user's role. It returns sql.ErrNoRows if there's no such user
+// and ErrLastOwner if they're the company's only owner.
+func (s SQLStorage) UpdateCompanyUserRole(companyID string, firebaseID string, role domain.Role) (domain.CompanyUser, error) {
+	var u domain.CompanyUser
+	err := s.withOwnerCheck(companyID, firebaseID, role == domain.RoleOwner, func(tx *sql.Tx) error {
+		query := `UPDATE company_users SET role = $3, updated_at = NOW()
+			WHERE firebase_id = $1 AND qb_company_id = $2
+			RETURNING ` + companyUserColumns
+		return tx.QueryRow(query, firebaseID, companyID, role).
+			Scan(&u.FirebaseID, &u.QBCompanyID, &u.Email, &u.Name, &u.Role, &u.InvitedBy, &u.CreatedAt, &u.UpdatedAt)
+	})
+	return u, err
+}
+
+// DeleteCompanyUser removes a staff user from the company. It returns sql.ErrNoRows if there's no such
+// user and ErrLastOwner if they're the company's only owner.
+func (s SQLStorage) DeleteCompanyUser(companyID string, firebaseID string) error {
+	return s.withOwnerCheck(companyID, firebaseID, false, func(tx *sql.Tx) error {
+		_, err := tx.Exec("DELETE FROM company_users WHERE firebase_id = $1 AND qb_company_id = $2", firebaseID, companyID)
+		return err
+	})
+}
+
+// withOwnerCheck runs change on one of the company's staff users, unless the user is an owner that
+// won't be one afterwards and there is no other owner. The company is locked so two owners can't
+// demote each other at the same time.
+func (s SQLStorage) withOwnerCheck(companyID string, firebaseID string, staysOwner bool, change func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SELECT 1 FROM company WHERE qb_company_id = $1 FOR UPDATE", companyID); err != nil {
+		return err
+	}
+	var role domain.Role
+	err = tx.QueryRow("SELECT role FROM company_users WHERE firebase_id = $1 AND qb_company_id = $2", firebaseID, companyID).
+		Scan(&role)
+	if err != nil {
+		return err
+	}
+	if role == domain.RoleOwner && !staysOwner {
+		var others int
+		err := tx.QueryRow("SELECT COUNT(*) FROM company_users WHERE qb_company_id = $1 AND role = 'owner' AND firebase_id <> $2",
+			companyID, firebaseID).Scan(&others)
+		if err != nil {
+			return err
+		}
+		if others == 0 {
+			return ErrLastOwner
+		}
+	}
+	if err := change(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/Vertisphere/backend-service/internal/domain"
+)
+
+// ErrOccurrenceTaken is returned when a standing order occurrence was already placed, or by another
+// instance of the scheduler
+var ErrOccurrenceTaken = errors.New("occurrence already taken")
+
+const standingOrderColumns = `id, qb_company_id, qb_customer_id, name, lines, rrule, time_zone, starts_at,
+	auto_publish, paused, next_run_at, created_by, created_at, updated_at`
+
+// ListStandingOrders returns the company's standing orders, only the customer's if customerID isn't empty
+func (s SQLStorage) ListStandingOrders(companyID string, customerID string) ([]domain.StandingOrder, error) {
+	query := `SELECT ` + standingOrderColumns + ` FROM standing_orders
+		WHERE qb_company_id = $1 AND ($2 = '' OR qb_customer_id = $2)
+		ORDER BY id`
+	rows, err := s.db.Query(query, companyID, customerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanStandingOrders(rows)
+}
+
+// GetStandingOrder returns a standing order of the company, or sql.ErrNoRows
+func (s SQLStorage) GetStandingOrder(companyID string, id int64) (domain.StandingOrder, error) {
+	query := `SELECT ` + standingOrderColumns + ` FROM standing_orders WHERE id = $1 AND qb_company_id = $2`
+	rows, err := s.db.Query(query, id, companyID)
+	if err != nil {
+		return domain.StandingOrder{}, err
+	}
+	defer rows.Close()
+	orders, err := scanStandingOrders(rows)
+	if err != nil {
+		return domain.StandingOrder{}, err
+	}
+	if len(orders) == 0 {
+		return domain.StandingOrder{}, sql.ErrNoRows
+	}
+	return orders[0], nil
+}
+
+// SaveStandingOrder creates a standing order, or replaces the customer's one with o.ID. It returns
+// sql.ErrNoRows if there's no such standing order.
+func (s SQLStorage) SaveStandingOrder(o domain.StandingOrder) (domain.StandingOrder, error) {
+	lines, err := json.Marshal(o.Lines)
+	if err != nil {
+		return domain.StandingOrder{}, err
+	}
+	if o.ID == 0 {
+		query := `INSERT INTO standing_orders(qb_company_id, qb_customer_id, name, lines, rrule, time_zone, starts_at,
+				auto_publish, paused, next_run_at, created_by)
+			VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+			RETURNING id, created_at, updated_at`
+		err = s.db.QueryRow(query, o.QBCompanyID, o.QBCustomerID, o.Name, lines, o.RRule, o.TimeZone, o.StartsAt,
+			o.AutoPublish, o.Paused, o.NextRunAt, o.CreatedBy).Scan(&o.ID, &o.CreatedAt, &o.UpdatedAt)
+	} else {
+		query := `UPDATE standing_orders
+			SET name = $4, lines = $5, rrule = $6, time_zone = $7, starts_at = $8, auto_publish = $9,
+				paused = $10, next_run_at = $11, updated_at = NOW()
+			WHERE id = $1 AND qb_company_id = $2 AND qb_customer_id = $3
+			RETURNING created_by, created_at, updated_at`
+		err = s.db.QueryRow(query, o.ID, o.QBCompanyID, o.QBCustomerID, o.Name, lines, o.RRule, o.TimeZone, o.StartsAt,
+			o.AutoPublish, o.Paused, o.NextRunAt).Scan(&o.CreatedBy, &o.CreatedAt, &o.UpdatedAt)
+	}
+	if err != nil {
+		return domain.StandingOrder{}, err
+	}
+	return o, nil
+}
+
+// DeleteStandingOrder deletes the customer's standing order and its runs. It returns sql.ErrNoRows if
+// there's no such standing order.
+func (s SQLStorage) DeleteStandingOrder(companyID string, customerID string, id int64) error {
+	res, err := s.db.Exec("DELETE FROM standing_orders WHERE id = $1 AND qb_company_id = $2 AND qb_customer_id = $3",
+		id, companyID, customerID)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DueStandingOrders returns the standing orders that aren't paused and whose next occurrence is at or before now, oldest first
+func (s SQLStorage) DueStandingOrders(now time.Time, limit int) ([]domain.StandingOrder, error) {
+	query := `SELECT ` + standingOrderColumns + ` FROM standing_orders
+		WHERE NOT paused AND next_run_at <= $1
+		ORDER BY next_run_at
+		LIMIT $2`
+	rows, err := s.db.Query(query, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanStandingOrders(rows)
+}
+
+// StartStandingOrderRun takes the standing order's next occurrence and moves it on to next, nil when
+// there are no more. The run is recorded as pending. It returns ErrOccurrenceTaken if another
+// scheduler got there first, and a run that isn't pending if the occurrence was skipped.
+func (s SQLStorage) StartStandingOrderRun(o domain.StandingOrder, next *time.Time) (domain.StandingOrderRun, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return domain.StandingOrderRun{}, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE standing_orders SET next_run_at = $3 WHERE id = $1 AND next_run_at = $2`,
+		o.ID, o.NextRunAt, next)
+	if err != nil {
+		return domain.StandingOrderRun{}, err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return domain.StandingOrderRun{}, err
+	}
+	if rows == 0 {
+		return domain.StandingOrderRun{}, ErrOccurrenceTaken
+	}
+
+	run := domain.StandingOrderRun{StandingOrderID: o.ID, Occurrence: *o.NextRunAt, Status: domain.RunPending}
+	query := `INSERT INTO standing_order_runs(standing_order_id, occurrence, status) VALUES($1, $2, $3)
+		ON CONFLICT (standing_order_id, occurrence) DO UPDATE SET updated_at = standing_order_runs.updated_at
+		RETURNING id, status, created_at, updated_at`
+	err = tx.QueryRow(query, run.StandingOrderID, run.Occurrence, run.Status).
+		Scan(&run.ID, &run.Status, &run.CreatedAt, &run.UpdatedAt)
+	if err != nil {
+		return domain.StandingOrderRun{}, err
+	}
+	return run, tx.Commit()
+}
+
+// FinishStandingOrderRun records what happened to a pending run
+func (s SQLStorage) FinishStandingOrderRun(run domain.StandingOrderRun) error {
+	query := `UPDATE standing_order_runs SET status = $2, qb_invoice_id = NULLIF($3, ''), error = NULLIF($4, ''),
+			updated_at = NOW()
+		WHERE id = $1`
+	_, err := s.db.Exec(query, run.ID, run.Status, run.QBInvoiceID, run.Error)
+	return err
+}
+
+// SkipStandingOrderOccurrence stops an occurrence from being placed. It returns ErrOccurrenceTaken if
+// it already was.
+func (s SQLStorage) SkipStandingOrderOccurrence(id int64, occurrence time.Time) (domain.StandingOrderRun, error) {
+	run := domain.StandingOrderRun{StandingOrderID: id, Occurrence: occurrence, Status: domain.RunSkipped}
+	query := `INSERT INTO standing_order_runs(standing_order_id, occurrence, status) VALUES($1, $2, $3)
+		ON CONFLICT (standing_order_id, occurrence) DO UPDATE SET updated_at = NOW()
+			WHERE standing_order_runs.status = 'skipped'
+		RETURNING id, created_at, updated_at`
+	err := s.db.QueryRow(query, id, occurrence, run.Status).Scan(&run.ID, &run.CreatedAt, &run.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return domain.StandingOrderRun{}, ErrOccurrenceTaken
+	}
+	return run, err
+}
+
+// UnskipStandingOrderOccurrence lets a skipped occurrence be placed again. It returns sql.ErrNoRows if
+// the occurrence isn't skipped.
+func (s SQLStorage) UnskipStandingOrderOccurrence(id int64, occurrence time.Time) error {
+	res, err := s.db.Exec("DELETE FROM standing_order_runs WHERE standing_order_id = $1 AND occurrence = $2 AND status = 'skipped'",
+		id, occurrence)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ListStandingOrderRuns returns the standing order's runs and skips from since on, oldest first
+func (s SQLStorage) ListStandingOrderRuns(id int64, since time.Time) ([]domain.StandingOrderRun, error) {
+	query := `SELECT id, standing_order_id, occurrence, status, COALESCE(qb_invoice_id, ''), COALESCE(error, ''),
+			created_at, updated_at
+		FROM standing_order_runs WHERE standing_order_id = $1 AND occurrence >= $2
+		ORDER BY occurrence`
+	rows, err := s.db.Query(query, id, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := []domain.StandingOrderRun{}
+	for rows.Next() {
+		var run domain.StandingOrderRun
+		err := rows.Scan(&run.ID, &run.StandingOrderID, &run.Occurrence, &run.Status, &run.QBInvoiceID, &run.Error,
+			&run.CreatedAt, &run.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+func scanStandingOrders(rows *sql.Rows) ([]domain.StandingOrder, error) {
+	orders := []domain.StandingOrder{}
+	for rows.Next() {
+		var o domain.StandingOrder
+		var lines []byte
+		var nextRunAt sql.NullTime
+		err := rows.Scan(&o.ID, &o.QBCompanyID, &o.QBCustomerID, &o.Name, &lines, &o.RRule, &o.TimeZone, &o.StartsAt,
+			&o.AutoPublish, &o.Paused, &nextRunAt, &o.CreatedBy, &o.CreatedAt, &o.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(lines, &o.Lines); err != nil {
+			return nil, err
+		}
+		if nextRunAt.Valid {
+			o.NextRunAt = &nextRunAt.Time
+		}
+		orders = append(orders, o)
+	}
+	return orders, rows.Err()
+}
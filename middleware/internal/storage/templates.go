@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	"github.com/Vertisphere/backend-service/internal/domain"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// ErrDuplicateName is returned when the customer already has a template with the name
+var ErrDuplicateName = errors.New("name already in use")
+
+// uniqueViolation is the Postgres error code for a unique constraint violation
+const uniqueViolation = "23505"
+
+// ListOrderTemplates returns the customer's order templates by name
+func (s SQLStorage) ListOrderTemplates(companyID string, customerID string) ([]domain.OrderTemplate, error) {
+	query := `SELECT id, qb_company_id, qb_customer_id, name, lines, created_at, updated_at
+		FROM order_templates WHERE qb_company_id = $1 AND qb_customer_id = $2
+		ORDER BY name`
+	rows, err := s.db.Query(query, companyID, customerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	templates := []domain.OrderTemplate{}
+	for rows.Next() {
+		var t domain.OrderTemplate
+		var lines []byte
+		if err := rows.Scan(&t.ID, &t.QBCompanyID, &t.QBCustomerID, &t.Name, &lines, &t.CreatedAt, &t.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(lines, &t.Lines); err != nil {
+			return nil, err
+		}
+		templates = append(templates, t)
+	}
+	return templates, rows.Err()
+}
+
+// GetOrderTemplate returns one of the customer's order templates, or sql.ErrNoRows
+func (s SQLStorage) GetOrderTemplate(companyID string, customerID string, id int64) (domain.OrderTemplate, error) {
+	query := `SELECT id, qb_company_id, qb_customer_id, name, lines, created_at, updated_at
+		FROM order_templates WHERE id = $1 AND qb_company_id = $2 AND qb_customer_id = $3`
+	var t domain.OrderTemplate
+	var lines []byte
+	err := s.db.QueryRow(query, id, companyID, customerID).
+		Scan(&t.ID, &t.QBCompanyID, &t.QBCustomerID, &t.Name, &lines, &t.CreatedAt, &t.UpdatedAt)
+	if err != nil {
+		return domain.OrderTemplate{}, err
+	}
+	if err := json.Unmarshal(lines, &t.Lines); err != nil {
+		return domain.OrderTemplate{}, err
+	}
+	return t, nil
+}
+
+// SaveOrderTemplate creates an order template, or replaces the customer's one with t.ID. It returns
+// sql.ErrNoRows if there's no such template and ErrDuplicateName if the name is taken.
+func (s SQLStorage) SaveOrderTemplate(t domain.OrderTemplate) (domain.OrderTemplate, error) {
+	lines, err := json.Marshal(t.Lines)
+	if err != nil {
+		return domain.OrderTemplate{}, err
+	}
+	if t.ID == 0 {
+		query := `INSERT INTO order_templates(qb_company_id, qb_customer_id, name, lines) VALUES($1, $2, $3, $4)
+			RETURNING id, created_at, updated_at`
+		err = s.db.QueryRow(query, t.QBCompanyID, t.QBCustomerID, t.Name, lines).Scan(&t.ID, &t.CreatedAt, &t.UpdatedAt)
+	} else {
+		query := `UPDATE order_templates SET name = $4, lines = $5, updated_at = NOW()
+			WHERE id = $1 AND qb_company_id = $2 AND qb_customer_id = $3
+			RETURNING created_at, updated_at`
+		err = s.db.QueryRow(query, t.ID, t.QBCompanyID, t.QBCustomerID, t.Name, lines).Scan(&t.CreatedAt, &t.UpdatedAt)
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+		return domain.OrderTemplate{}, ErrDuplicateName
+	}
+	if err != nil {
+		return domain.OrderTemplate{}, err
+	}
+	return t, nil
+}
+
+// DeleteOrderTemplate deletes one of the customer's order templates. It returns sql.ErrNoRows if
+// there's no such template.
+func (s SQLStorage) DeleteOrderTemplate(companyID string, customerID string, id int64) error {
+	res, err := s.db.Exec("DELETE FROM order_templates WHERE id = $1 AND qb_company_id = $2 AND qb_customer_id = $3",
+		id, companyID, customerID)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ListFavoriteItems returns the customer's favorite items, most recent first
+func (s SQLStorage) ListFavoriteItems(companyID string, customerID string) ([]domain.FavoriteItem, error) {
+	query := `SELECT qb_company_id, qb_customer_id, qb_item_id, created_at
+		FROM favorite_items WHERE qb_company_id = $1 AND qb_customer_id = $2
+		ORDER BY created_at DESC`
+	rows, err := s.db.Query(query, companyID, customerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	favorites := []domain.FavoriteItem{}
+	for rows.Next() {
+		var f domain.FavoriteItem
+		if err := rows.Scan(&f.QBCompanyID, &f.QBCustomerID, &f.QBItemID, &f.CreatedAt); err != nil {
+			return nil, err
+		}
+		favorites = append(favorites, f)
+	}
+	return favorites, rows.Err()
+}
+
+// AddFavoriteItem adds an item to the customer's favorites, it's fine if it's there already
+func (s SQLStorage) AddFavoriteItem(f domain.FavoriteItem) (domain.FavoriteItem, error) {
+	query := `INSERT INTO favorite_items(qb_company_id, qb_customer_id, qb_item_id) VALUES($1, $2, $3)
+		ON CONFLICT (qb_company_id, qb_customer_id, qb_item_id) DO UPDATE SET created_at = favorite_items.created_at
+		RETURNING created_at`
+	err := s.db.QueryRow(query, f.QBCompanyID, f.QBCustomerID, f.QBItemID).Scan(&f.CreatedAt)
+	return f, err
+}
+
+// RemoveFavoriteItem removes an item from the customer's favorites. It returns sql.ErrNoRows if it
+// wasn't one.
+func (s SQLStorage) RemoveFavoriteItem(companyID string, customerID string, itemID string) error {
+	res, err := s.db.Exec("DELETE FROM favorite_items WHERE qb_company_id = $1 AND qb_customer_id = $2 AND qb_item_id = $3",
+		companyID, customerID, itemID)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}